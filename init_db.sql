@@ -126,20 +126,94 @@ CREATE TABLE IF NOT EXISTS admins (
 GRANT ALL PRIVILEGES ON TABLE admins TO birthdaybot;
 GRANT ALL PRIVILEGES ON SEQUENCE admins_id_seq TO birthdaybot;
 
+-- Суперадминистраторы управляют списком администраторов (v1.13 compatible minimum)
+-- Список суперадминистраторов задается переменной окружения SUPER_ADMIN_IDS и применяется при запуске
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS is_super BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS granted_by_chat_id BIGINT;
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
+
 -- Создание таблицы журнала сообщений (v1.2 compatible minimum)
+-- Помесячные секции по created_at, chat_id и message_id вычисляются из JSON (v1.22 compatible minimum)
 CREATE TABLE IF NOT EXISTS api_messages_journal (
-    id SERIAL PRIMARY KEY,
+    id SERIAL,
     message JSONB NOT NULL,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    action_id INTEGER REFERENCES actions(id)
-);
+    action_id INTEGER REFERENCES actions(id),
+    chat_id BIGINT GENERATED ALWAYS AS ((message->>'chat_id')::bigint) STORED,
+    message_id INTEGER GENERATED ALWAYS AS ((message->>'message_id')::integer) STORED,
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
 
 -- Предоставление прав на новую таблицу
 GRANT ALL PRIVILEGES ON TABLE api_messages_journal TO birthdaybot;
 GRANT ALL PRIVILEGES ON SEQUENCE api_messages_journal_id_seq TO birthdaybot;
 
--- Функция для получения альтернативного тимлида (v1.4 compatible minimum)
+-- Индекс для поиска записей журнала по действию (v1.18 compatible minimum)
+CREATE INDEX IF NOT EXISTS api_messages_journal_action_idx ON api_messages_journal (action_id);
+
+-- Индексы для поиска по журналу по типу сообщения и дате (v1.21 compatible minimum)
+CREATE INDEX IF NOT EXISTS api_messages_journal_type_idx ON api_messages_journal ((message->>'type'));
+CREATE INDEX IF NOT EXISTS api_messages_journal_created_idx ON api_messages_journal (created_at);
+
+-- Индексы для поиска сообщения по получателю и message_id (v1.22 compatible minimum)
+CREATE INDEX IF NOT EXISTS api_messages_journal_chat_idx ON api_messages_journal (chat_id);
+CREATE INDEX IF NOT EXISTS api_messages_journal_message_idx ON api_messages_journal (message_id, chat_id);
+
+-- Создает секцию журнала за месяц, если ее еще нет (v1.22 compatible minimum).
+-- Выполняется с правами владельца таблицы, чтобы бот мог создавать секции заранее
+CREATE OR REPLACE FUNCTION ensure_journal_partition(month DATE)
+RETURNS VOID AS $$
+DECLARE
+    month_start DATE := date_trunc('month', month)::date;
+BEGIN
+    EXECUTE format(
+        'CREATE TABLE IF NOT EXISTS %I PARTITION OF api_messages_journal FOR VALUES FROM (%L) TO (%L)',
+        'api_messages_journal_p' || to_char(month_start, 'YYYY_MM'),
+        month_start,
+        (month_start + interval '1 month')::date
+    );
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+-- Удаляет секцию журнала за месяц после архивации (v1.29 compatible minimum).
+-- Секция удаляется, только если в ней ровно expected_rows записей, то есть все они попали в архив
+DROP FUNCTION IF EXISTS drop_journal_partition(DATE);
+CREATE OR REPLACE FUNCTION drop_journal_partition(month DATE, expected_rows BIGINT)
+RETURNS VOID AS $$
+DECLARE
+    partition_name TEXT := 'api_messages_journal_p' || to_char(date_trunc('month', month), 'YYYY_MM');
+    actual_rows BIGINT;
+BEGIN
+    IF to_regclass(partition_name) IS NULL THEN
+        RETURN;
+    END IF;
+    EXECUTE format('SELECT count(*) FROM %I', partition_name) INTO actual_rows;
+    IF actual_rows != expected_rows THEN
+        RAISE EXCEPTION 'partition % has % rows, % archived', partition_name, actual_rows, expected_rows;
+    END IF;
+    EXECUTE format('DROP TABLE %I', partition_name);
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+SELECT ensure_journal_partition(CURRENT_DATE);
+SELECT ensure_journal_partition((CURRENT_DATE + interval '1 month')::date);
+
+-- Архивы секций журнала, выгруженных в сжатые JSONL-файлы по сроку хранения (v1.22 compatible minimum)
+CREATE TABLE IF NOT EXISTS journal_archives (
+    id SERIAL PRIMARY KEY,
+    partition_name VARCHAR(63) NOT NULL,
+    month DATE NOT NULL UNIQUE,
+    file_path TEXT NOT NULL,
+    row_count INTEGER NOT NULL,
+    file_size BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+GRANT ALL PRIVILEGES ON TABLE journal_archives TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE journal_archives_id_seq TO birthdaybot;
+
+-- Функция для получения альтернативного тимлида (v1.10 compatible minimum)
 CREATE OR REPLACE FUNCTION get_alternative_teamlead(team_id INTEGER, birthday_member_id INTEGER)
 RETURNS TABLE (
     teamlead_id INTEGER,
@@ -149,128 +223,650 @@ RETURNS TABLE (
 BEGIN
     -- Сначала пытаемся найти другого тимлида из той же команды
     RETURN QUERY
-    SELECT 
+    SELECT
         tl.id,
-        tl.phone_number,
+        get_collector_phone(tm.id),
         tm.name
     FROM teamleads tl
     JOIN team_members tm ON tl.team_member_id = tm.id
-    WHERE tl.team_id = $1  -- используем первый параметр функции (team_id)
-    AND tl.team_member_id != $2  -- используем второй параметр (birthday_member_id)
+    WHERE tl.team_id = $1
+    AND tl.team_member_id != $2
+    ORDER BY tl.id
     LIMIT 1;
 
     -- Если не нашли, возвращаем любого другого тимлида
     IF NOT FOUND THEN
         RETURN QUERY
-        SELECT 
+        SELECT
             tl.id,
-            tl.phone_number,
+            get_collector_phone(tm.id),
             tm.name
         FROM teamleads tl
         JOIN team_members tm ON tl.team_member_id = tm.id
-        WHERE tl.team_member_id != $2  -- используем второй параметр (birthday_member_id)
+        WHERE tl.team_member_id != $2
+        ORDER BY tl.id
         LIMIT 1;
     END IF;
 END;
 $$ LANGUAGE plpgsql;
 
--- Обновляем запрос для уведомлений тимлида (v1.4 compatible minimum)
+-- Создание таблицы казначеев команд (v1.5 compatible minimum)
+-- Казначей получает переводы и действия payout вместо тимлида
+CREATE TABLE IF NOT EXISTS treasurers (
+    id SERIAL PRIMARY KEY,
+    team_id INTEGER NOT NULL UNIQUE,
+    team_member_id INTEGER NOT NULL,
+    FOREIGN KEY (team_id) REFERENCES teams(id),
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE treasurers TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE treasurers_id_seq TO birthdaybot;
+
+-- Уникальность тимлида в команде (v1.6 compatible minimum)
+CREATE UNIQUE INDEX IF NOT EXISTS teamleads_team_member_idx ON teamleads (team_id, team_member_id);
+
+-- Получатель переводов закрепляется за задачей (v1.6 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_member_id INTEGER REFERENCES team_members(id);
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_assigned_at TIMESTAMP WITH TIME ZONE;
+
+-- Телефон тимлида берется из подтвержденного контакта (v1.10 compatible minimum)
+-- Колонка teamleads.phone_number больше не используется
+ALTER TABLE teamleads ALTER COLUMN phone_number DROP NOT NULL;
+
+-- Создание таблицы замен телефона для получения переводов (v1.10 compatible minimum)
+-- Замена действует только после подтверждения администратором (status = 'approved')
+CREATE TABLE IF NOT EXISTS collection_phone_overrides (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL,
+    phone_number VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    requested_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    decided_at TIMESTAMP WITH TIME ZONE,
+    decided_by_chat_id BIGINT,
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id),
+    CHECK (status IN ('pending', 'approved', 'rejected', 'revoked'))
+);
+
+-- Не более одной действующей и одной ожидающей замены на участника
+CREATE UNIQUE INDEX IF NOT EXISTS collection_phone_overrides_approved_idx
+    ON collection_phone_overrides (team_member_id)
+    WHERE status = 'approved';
+CREATE UNIQUE INDEX IF NOT EXISTS collection_phone_overrides_pending_idx
+    ON collection_phone_overrides (team_member_id)
+    WHERE status = 'pending';
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE collection_phone_overrides TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE collection_phone_overrides_id_seq TO birthdaybot;
+
+-- Время отправки запроса на замену администраторам (v1.29 compatible minimum)
+ALTER TABLE collection_phone_overrides ADD COLUMN IF NOT EXISTS notified_at TIMESTAMP WITH TIME ZONE;
+
+-- Функция для получения телефона получателя переводов (v1.10 compatible minimum)
+-- Подтвержденная замена, иначе подтвержденный контакт участника
+CREATE OR REPLACE FUNCTION get_collector_phone(member_id INTEGER)
+RETURNS VARCHAR(50) AS $$
+    SELECT COALESCE(
+        (SELECT o.phone_number FROM collection_phone_overrides o
+         WHERE o.team_member_id = $1 AND o.status = 'approved'
+         ORDER BY o.decided_at DESC LIMIT 1),
+        (SELECT tm.phone_number FROM team_members tm WHERE tm.id = $1)
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Создание таблицы резервных тимлидов команды (v1.7 compatible minimum)
+-- Резервные тимлиды используются по порядку priority, если в команде нет другого тимлида
+CREATE TABLE IF NOT EXISTS teamlead_backups (
+    id SERIAL PRIMARY KEY,
+    team_id INTEGER NOT NULL,
+    team_member_id INTEGER NOT NULL,
+    priority INTEGER NOT NULL,
+    FOREIGN KEY (team_id) REFERENCES teams(id),
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id),
+    UNIQUE (team_id, team_member_id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE teamlead_backups TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE teamlead_backups_id_seq TO birthdaybot;
+
+-- Источник выбора получателя переводов: treasurer, teamlead, backup, rotation (v1.7 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_source VARCHAR(20);
+
+-- Создание таблицы периодов отсутствия тимлидов (v1.8 compatible minimum)
+-- На период отсутствия сборы передаются заместителю (delegate_member_id)
+CREATE TABLE IF NOT EXISTS teamlead_absences (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL,
+    date_from DATE NOT NULL,
+    date_to DATE NOT NULL,
+    delegate_member_id INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id),
+    FOREIGN KEY (delegate_member_id) REFERENCES team_members(id),
+    CHECK (date_from <= date_to),
+    CHECK (team_member_id != delegate_member_id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE teamlead_absences TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE teamlead_absences_id_seq TO birthdaybot;
+
+-- Кого замещает получатель переводов (NULL, если замещения нет) (v1.8 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_delegated_from INTEGER REFERENCES team_members(id);
+
+-- Произвольные сборы и годовщины наряду с днями рождения: kind birthday, anniversary или custom (v1.19 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS kind VARCHAR(20) NOT NULL DEFAULT 'birthday';
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS title VARCHAR(200);
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS deadline DATE;
+-- Участники сбора: NULL — вся компания, иначе только указанная команда (v1.19 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS scope_team_id INTEGER REFERENCES teams(id);
+-- Рекомендуемая сумма перевода (NULL — на усмотрение участника) (v1.19 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS amount NUMERIC(10, 2);
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS created_by_chat_id BIGINT;
+
+-- Дата приема на работу для годовщин (NULL — не указана) (v1.20 compatible minimum)
+ALTER TABLE team_members ADD COLUMN IF NOT EXISTS hire_date DATE;
+
+-- Функция для получения даты события задачи: годовщина работы, срок произвольного сбора
+-- или день рождения в году задачи (v1.20 compatible minimum)
+CREATE OR REPLACE FUNCTION get_task_event_date(task_id INTEGER)
+RETURNS DATE AS $$
+    SELECT CASE
+        WHEN yt.kind = 'anniversary' THEN
+            (bm.hire_date + make_interval(years => yt.year - EXTRACT(YEAR FROM bm.hire_date)::integer))::date
+        ELSE COALESCE(
+            yt.deadline,
+            (bm.birthday + make_interval(years => yt.year - EXTRACT(YEAR FROM bm.birthday)::integer))::date
+        )
+    END
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1;
+$$ LANGUAGE sql STABLE;
+
+-- Функция для получения заместителя, если период отсутствия пересекается с периодом сбора (v1.8 compatible minimum)
+CREATE OR REPLACE FUNCTION get_absence_delegate(member_id INTEGER, window_from DATE, window_to DATE)
+RETURNS INTEGER AS $$
+    SELECT ab.delegate_member_id
+    FROM teamlead_absences ab
+    WHERE ab.team_member_id = $1
+    AND ab.date_from <= $3
+    AND ab.date_to >= $2
+    ORDER BY ab.created_at DESC, ab.id DESC
+    LIMIT 1;
+$$ LANGUAGE sql STABLE;
+
+-- Отмена сборов: задача закрывается без перевода подарка (v1.11 compatible minimum)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP WITH TIME ZONE;
+
+-- Деактивированные участники не участвуют в сборах и не получают поздравлений (v1.12 compatible minimum)
+ALTER TABLE team_members ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT true;
+
+-- Создание таблицы истории изменений участников администраторами (v1.12 compatible minimum)
+-- Ссылки на team_members нет, чтобы история сохранялась после удаления участника
+CREATE TABLE IF NOT EXISTS member_audit (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL,
+    admin_chat_id BIGINT NOT NULL,
+    action VARCHAR(30) NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS member_audit_member_idx ON member_audit (team_member_id, created_at);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE member_audit TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE member_audit_id_seq TO birthdaybot;
+
+-- Создание таблицы сотрудников HR (v1.14 compatible minimum)
+-- Роль HR дает доступ к дням рождения и статистике без прав администратора
+CREATE TABLE IF NOT EXISTS hr_staff (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE hr_staff TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE hr_staff_id_seq TO birthdaybot;
+
+-- Создание таблицы пользователей, писавших боту (v1.15 compatible minimum)
+-- Нужна для рассылок пользователям, которые не завершили регистрацию
+CREATE TABLE IF NOT EXISTS bot_users (
+    telegram_chat_id BIGINT PRIMARY KEY,
+    username VARCHAR(100),
+    first_name VARCHAR(100),
+    first_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Создание таблицы рассылок администраторов (v1.15 compatible minimum)
+CREATE TABLE IF NOT EXISTS broadcasts (
+    id SERIAL PRIMARY KEY,
+    admin_chat_id BIGINT NOT NULL,
+    text TEXT NOT NULL,
+    audience VARCHAR(50) NOT NULL,
+    recipients_count INTEGER NOT NULL DEFAULT 0,
+    sent_count INTEGER NOT NULL DEFAULT 0,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Предоставление прав на новые таблицы
+GRANT ALL PRIVILEGES ON TABLE bot_users TO birthdaybot;
+GRANT ALL PRIVILEGES ON TABLE broadcasts TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE broadcasts_id_seq TO birthdaybot;
+
+-- Создание таблицы запусков рассылок из панели администратора (v1.16 compatible minimum)
+CREATE TABLE IF NOT EXISTS job_runs (
+    id SERIAL PRIMARY KEY,
+    job VARCHAR(50) NOT NULL,
+    admin_chat_id BIGINT,
+    sent_count INTEGER NOT NULL DEFAULT 0,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    skipped_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    retried_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Получатели запуска: статус sent, failed, skipped или retrying,
+-- ошибка Telegram или причина пропуска и данные сообщения для повтора
+CREATE TABLE IF NOT EXISTS job_run_items (
+    id SERIAL PRIMARY KEY,
+    run_id INTEGER NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    chat_id BIGINT,
+    recipient_name VARCHAR(100),
+    status VARCHAR(20) NOT NULL,
+    reason TEXT,
+    action_id INTEGER,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (run_id) REFERENCES job_runs(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS job_run_items_run_status_idx ON job_run_items (run_id, status);
+
+-- Предоставление прав на новые таблицы
+GRANT ALL PRIVILEGES ON TABLE job_runs TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE job_runs_id_seq TO birthdaybot;
+GRANT ALL PRIVILEGES ON TABLE job_run_items TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE job_run_items_id_seq TO birthdaybot;
+
+-- Создание журнала аудита привилегированных действий (v1.17 compatible minimum)
+-- actor_chat_id = NULL: изменение из конфигурации (SUPER_ADMIN_IDS)
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_chat_id BIGINT,
+    action VARCHAR(100) NOT NULL,
+    target_type VARCHAR(50),
+    target_id BIGINT,
+    old_value TEXT,
+    new_value TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_chat_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id);
+
+-- Общая функция для таблиц истории, которые только пополняются:
+-- изменение и удаление записей запрещены
+CREATE OR REPLACE FUNCTION append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_no_update ON audit_log;
+CREATE TRIGGER audit_log_no_update
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION append_only();
+
+-- Боту нужны только чтение и добавление записей
+GRANT SELECT, INSERT ON TABLE audit_log TO birthdaybot;
+GRANT USAGE, SELECT ON SEQUENCE audit_log_id_seq TO birthdaybot;
+
+-- История нажатий кнопок с итогом обработки (v1.25 compatible minimum).
+-- journal_id без внешнего ключа: секции журнала архивируются и удаляются по сроку хранения
+CREATE TABLE IF NOT EXISTS callback_interactions (
+    id BIGSERIAL PRIMARY KEY,
+    journal_id INTEGER,
+    chat_id BIGINT,
+    message_id INTEGER,
+    from_chat_id BIGINT, -- NULL для нажатий до v1.25: нажавший неизвестен (v1.29)
+    username VARCHAR(100),
+    data TEXT NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    error TEXT,
+    pressed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS callback_interactions_journal_idx ON callback_interactions (journal_id);
+CREATE INDEX IF NOT EXISTS callback_interactions_message_idx ON callback_interactions (chat_id, message_id);
+CREATE INDEX IF NOT EXISTS callback_interactions_data_idx ON callback_interactions (data);
+
+DROP TRIGGER IF EXISTS callback_interactions_no_update ON callback_interactions;
+CREATE TRIGGER callback_interactions_no_update
+    BEFORE UPDATE OR DELETE ON callback_interactions
+    FOR EACH ROW EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS callback_interactions_no_truncate ON callback_interactions;
+CREATE TRIGGER callback_interactions_no_truncate
+    BEFORE TRUNCATE ON callback_interactions
+    FOR EACH STATEMENT EXECUTE FUNCTION append_only();
+
+GRANT SELECT, INSERT ON TABLE callback_interactions TO birthdaybot;
+GRANT USAGE, SELECT ON SEQUENCE callback_interactions_id_seq TO birthdaybot;
+
+-- Правки отправленных сообщений при изменении данных (v1.28 compatible minimum)
+CREATE TABLE IF NOT EXISTS message_edits (
+    id BIGSERIAL PRIMARY KEY,
+    journal_id INTEGER NOT NULL,
+    chat_id BIGINT NOT NULL,
+    message_id INTEGER NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    old_text TEXT NOT NULL,
+    new_text TEXT NOT NULL,
+    closed BOOLEAN NOT NULL DEFAULT false,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    edited_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS message_edits_journal_idx ON message_edits (journal_id);
+
+DROP TRIGGER IF EXISTS message_edits_no_update ON message_edits;
+CREATE TRIGGER message_edits_no_update
+    BEFORE UPDATE OR DELETE ON message_edits
+    FOR EACH ROW EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS message_edits_no_truncate ON message_edits;
+CREATE TRIGGER message_edits_no_truncate
+    BEFORE TRUNCATE ON message_edits
+    FOR EACH STATEMENT EXECUTE FUNCTION append_only();
+
+GRANT SELECT, INSERT ON TABLE message_edits TO birthdaybot;
+GRANT USAGE, SELECT ON SEQUENCE message_edits_id_seq TO birthdaybot;
+
+-- Функция для назначения получателя переводов по задаче (v1.29 compatible minimum)
+-- Порядок: казначей команды, тимлид команды с наименьшей нагрузкой,
+-- резервные тимлиды команды по порядку, справедливая ротация тимлидов по компании.
+-- Если выбранный получатель отсутствует в период сбора, назначается его заместитель
+CREATE OR REPLACE FUNCTION assign_task_collector(task_id INTEGER)
+RETURNS INTEGER AS $$
+DECLARE
+    v_collector_id INTEGER;
+    v_source VARCHAR(20);
+    v_team_id INTEGER;
+    v_birthday_member_id INTEGER;
+    v_year INTEGER;
+    v_event_date DATE;
+    v_delegate_id INTEGER;
+    v_delegated_from INTEGER;
+BEGIN
+    SELECT yt.collector_member_id, COALESCE(yt.scope_team_id, bm.team_id), bm.id, yt.year
+    INTO v_collector_id, v_team_id, v_birthday_member_id, v_year
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1
+    FOR UPDATE OF yt;
+
+    -- Получатель уже назначен: все шаги используют его
+    IF NOT FOUND OR v_collector_id IS NOT NULL THEN
+        RETURN v_collector_id;
+    END IF;
+
+    -- Кандидат, отсутствующий в период сбора, которого замещает сам именинник, пропускается
+    v_event_date := get_task_event_date($1);
+
+    -- Казначей команды, если он не является именинником
+    SELECT tr.team_member_id INTO v_collector_id
+    FROM treasurers tr
+    JOIN team_members tm ON tm.id = tr.team_member_id
+    WHERE tr.team_id = v_team_id
+    AND tr.team_member_id != v_birthday_member_id
+    AND tm.is_active
+    AND get_absence_delegate(tr.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id;
+    IF v_collector_id IS NOT NULL THEN
+        v_source := 'treasurer';
+    END IF;
+
+    -- Тимлид команды: меньше открытых сборов, затем дольше всех без назначения
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM teamleads tl
+        JOIN team_members tm ON tm.id = tl.team_member_id
+        WHERE tl.team_id = v_team_id
+        AND tl.team_member_id != v_birthday_member_id
+        AND tm.is_active
+        AND get_absence_delegate(tl.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.is_money_transfered = false
+             AND x.cancelled_at IS NULL),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'teamlead';
+        END IF;
+    END IF;
+
+    -- Резервные тимлиды команды в заданном порядке
+    IF v_collector_id IS NULL THEN
+        SELECT b.team_member_id INTO v_collector_id
+        FROM teamlead_backups b
+        JOIN team_members tm ON tm.id = b.team_member_id
+        WHERE b.team_id = v_team_id
+        AND b.team_member_id != v_birthday_member_id
+        AND tm.is_active
+        AND get_absence_delegate(b.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id
+        ORDER BY b.priority, b.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'backup';
+        END IF;
+    END IF;
+
+    -- Справедливая ротация: тимлид с наименьшим числом сборов за год
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM (
+            SELECT DISTINCT t.team_member_id
+            FROM teamleads t
+            JOIN team_members tm ON tm.id = t.team_member_id
+            WHERE t.team_member_id != v_birthday_member_id
+            AND tm.is_active
+            AND get_absence_delegate(t.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id
+        ) tl
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.year = v_year),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.team_member_id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'rotation';
+        END IF;
+    END IF;
+
+    -- Замещение на время отсутствия (ограничиваем глубину цепочки заместителей)
+    IF v_collector_id IS NOT NULL THEN
+        FOR i IN 1..5 LOOP
+            v_delegate_id := get_absence_delegate(v_collector_id, v_event_date - 3, v_event_date);
+            EXIT WHEN v_delegate_id IS NULL OR v_delegate_id = v_birthday_member_id
+                OR NOT EXISTS (SELECT 1 FROM team_members WHERE id = v_delegate_id AND is_active);
+            v_delegated_from := COALESCE(v_delegated_from, v_collector_id);
+            v_collector_id := v_delegate_id;
+            v_source := 'delegate';
+        END LOOP;
+    END IF;
+
+    IF v_collector_id IS NOT NULL THEN
+        UPDATE year_tasks
+        SET collector_member_id = v_collector_id,
+            collector_assigned_at = CURRENT_TIMESTAMP,
+            collector_source = v_source,
+            collector_delegated_from = v_delegated_from
+        WHERE id = $1;
+    END IF;
+
+    RETURN v_collector_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Не более одного действия payout на задачу (v1.9 compatible minimum)
+CREATE UNIQUE INDEX IF NOT EXISTS actions_task_payout_idx ON actions (task_id) WHERE type = 'payout';
+
+-- Доставленные уведомления тимлидов по задачам (v1.29 compatible minimum).
+-- Получатель, которому уведомление уже доставлено, не получает его повторно
+CREATE TABLE IF NOT EXISTS teamlead_notification_deliveries (
+    task_id INTEGER NOT NULL REFERENCES year_tasks(id),
+    team_member_id INTEGER NOT NULL REFERENCES team_members(id),
+    sent_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (task_id, team_member_id)
+);
+
+GRANT SELECT, INSERT ON TABLE teamlead_notification_deliveries TO birthdaybot;
+
+-- Запрос для уведомлений тимлида (v1.29 compatible minimum)
 CREATE OR REPLACE VIEW teamlead_notifications AS
 WITH birthday_info AS (
-    SELECT 
+    SELECT
         yt.id as task_id,
         bm.name as birthday_person_name,
-        t.id as team_id,
+        COALESCE(yt.scope_team_id, bm.team_id) as team_id,
         bm.id as birthday_member_id,
-        -- Проверяем, является ли именинник тимлидом
+        get_task_event_date(yt.id) as event_date,
+        cm.id as collector_member_id,
+        cm.name as collector_name,
         EXISTS (
-            SELECT 1 
-            FROM teamleads tl 
-            WHERE tl.team_member_id = bm.id
-        ) as is_birthday_person_teamlead
+            SELECT 1
+            FROM teamleads tl
+            WHERE tl.team_member_id = cm.id
+        ) as is_collector_teamlead,
+        df.name as delegated_from_name,
+        yt.kind,
+        yt.title,
+        yt.amount
     FROM year_tasks yt
     JOIN team_members bm ON yt.team_member_id = bm.id
-    JOIN teams t ON bm.team_id = t.id
+    JOIN team_members cm ON yt.collector_member_id = cm.id
+    LEFT JOIN team_members df ON yt.collector_delegated_from = df.id
     WHERE yt.is_teamlead_notified = false
 ),
-teamlead_info AS (
-    SELECT 
-        bi.*,
-        CASE 
-            WHEN bi.is_birthday_person_teamlead THEN
-                (SELECT member_name FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
-            ELSE
-                tlm.name
-        END as notified_teamlead_name,
-        CASE 
-            WHEN bi.is_birthday_person_teamlead THEN
-                (SELECT tm.telegram_chat_id 
-                 FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id) alt
-                 JOIN teamleads tl ON alt.teamlead_id = tl.id
-                 JOIN team_members tm ON tl.team_member_id = tm.id)
-            ELSE
-                tlm.telegram_chat_id
-        END as telegram_chat_id
+team_leads AS (
+    -- Активные тимлиды команды именинника, кроме него самого, и их заместители на время сбора
+    SELECT
+        bi.task_id,
+        tl.team_member_id as lead_member_id,
+        get_absence_delegate(tl.team_member_id, bi.event_date - 3, bi.event_date) as delegate_member_id
     FROM birthday_info bi
-    LEFT JOIN teamleads tl ON bi.team_id = tl.team_id
-    LEFT JOIN team_members tlm ON tl.team_member_id = tlm.id
-    WHERE NOT bi.is_birthday_person_teamlead 
-    OR EXISTS (SELECT 1 FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
+    JOIN teamleads tl ON tl.team_id = bi.team_id
+    JOIN team_members tm ON tm.id = tl.team_member_id
+    WHERE tl.team_member_id != bi.birthday_member_id
+    AND tm.is_active
+),
+recipients AS (
+    -- Присутствующие тимлиды
+    SELECT task_id, lead_member_id as notified_member_id, NULL::integer as covering_for_member_id
+    FROM team_leads
+    WHERE delegate_member_id IS NULL
+    UNION
+    -- Получатель переводов (казначей, альтернативный тимлид или заместитель)
+    SELECT bi.task_id, bi.collector_member_id, NULL::integer
+    FROM birthday_info bi
+    UNION
+    -- Заместители отсутствующих тимлидов, если они не получают уведомление сами
+    SELECT tl.task_id, tl.delegate_member_id, MIN(tl.lead_member_id)
+    FROM team_leads tl
+    JOIN birthday_info bi ON bi.task_id = tl.task_id
+    WHERE tl.delegate_member_id IS NOT NULL
+    AND tl.delegate_member_id != bi.collector_member_id
+    AND tl.delegate_member_id != bi.birthday_member_id
+    AND NOT EXISTS (
+        SELECT 1 FROM team_leads o
+        WHERE o.task_id = tl.task_id
+        AND o.lead_member_id = tl.delegate_member_id
+        AND o.delegate_member_id IS NULL
+    )
+    GROUP BY tl.task_id, tl.delegate_member_id
 )
-SELECT 
-    task_id,
-    birthday_person_name,
-    telegram_chat_id,
-    notified_teamlead_name
-FROM teamlead_info;
-
--- Обновляем запрос для уведомлений участников (v1.4 compatible minimum)
+SELECT
+    bi.task_id,
+    bi.birthday_person_name,
+    rm.telegram_chat_id,
+    rm.name as notified_teamlead_name,
+    rm.id as notified_member_id,
+    bi.collector_member_id,
+    bi.collector_name,
+    rm.id = bi.collector_member_id as is_collector,
+    bi.is_collector_teamlead,
+    bi.delegated_from_name,
+    bi.kind,
+    bi.title,
+    bi.event_date,
+    bi.amount,
+    cf.name as covering_for_name
+FROM recipients r
+JOIN birthday_info bi ON bi.task_id = r.task_id
+JOIN team_members rm ON r.notified_member_id = rm.id
+LEFT JOIN team_members cf ON r.covering_for_member_id = cf.id
+WHERE rm.telegram_chat_id IS NOT NULL
+AND rm.is_active
+AND NOT EXISTS (
+    SELECT 1 FROM teamlead_notification_deliveries d
+    WHERE d.task_id = r.task_id AND d.team_member_id = r.notified_member_id
+);
+
+-- Запрос для уведомлений участников (v1.19 compatible minimum)
 CREATE OR REPLACE VIEW member_notifications AS
 WITH birthday_info AS (
-    SELECT 
+    SELECT
         yt.id as task_id,
         bm.name as birthday_person_name,
         t.id as team_id,
         t.name as team_name,
         bm.id as birthday_member_id,
-        -- Проверяем, является ли именинник тимлидом
-        EXISTS (
-            SELECT 1 
-            FROM teamleads tl 
-            WHERE tl.team_member_id = bm.id
-        ) as is_birthday_person_teamlead
+        cm.id as collector_member_id,
+        get_collector_phone(cm.id) as collector_phone,
+        cm.name as collector_name,
+        yt.kind,
+        yt.title,
+        get_task_event_date(yt.id) as event_date,
+        yt.amount
     FROM year_tasks yt
     JOIN team_members bm ON yt.team_member_id = bm.id
     JOIN teams t ON bm.team_id = t.id
+    JOIN team_members cm ON yt.collector_member_id = cm.id
     WHERE yt.is_members_notified = false
-),
-teamlead_info AS (
-    SELECT 
-        bi.*,
-        CASE 
-            WHEN bi.is_birthday_person_teamlead THEN
-                (SELECT phone_number FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
-            ELSE
-                tl.phone_number
-        END as teamlead_phone,
-        CASE 
-            WHEN bi.is_birthday_person_teamlead THEN
-                (SELECT member_name FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
-            ELSE
-                tlm.name
-        END as teamlead_name
-    FROM birthday_info bi
-    LEFT JOIN teamleads tl ON bi.team_id = tl.team_id
-    LEFT JOIN team_members tlm ON tl.team_member_id = tlm.id
-    WHERE NOT bi.is_birthday_person_teamlead 
-    OR EXISTS (SELECT 1 FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
 )
-SELECT 
+SELECT
     a.id as action_id,
-    ti.*,
+    bi.*,
     m.telegram_chat_id
-FROM teamlead_info ti
-JOIN actions a ON a.task_id = ti.task_id
+FROM birthday_info bi
+JOIN actions a ON a.task_id = bi.task_id
 JOIN team_members m ON a.team_member_id = m.id
 WHERE a.type = 'request' AND a.is_done = false;
 
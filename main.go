@@ -1,11 +1,18 @@
 package main
 
 import (
+        "bytes"
+        "compress/gzip"
         "database/sql"
+        "encoding/csv"
         "encoding/json"
+        "errors"
         "fmt"
+        "io"
         "log"
         "os"
+        "path/filepath"
+        "runtime/debug"
         "strconv"
         "strings"
         "time"
@@ -20,6 +27,12 @@ type Team struct {
         IsActive bool
 }
 
+type TeamInfo struct {
+        Team
+        MemberCount int
+        OpenTasks   int
+}
+
 type TeamMember struct {
         ID             int
         Name           string
@@ -56,21 +69,318 @@ type TeamLead struct {
         TeamName     string
 }
 
+type Treasurer struct {
+        ID           int
+        TeamMemberID int
+        TeamID       int
+        PhoneNumber  string
+        MemberName   string
+        TeamName     string
+}
+
+type TeamLeadBackup struct {
+        ID           int
+        TeamID       int
+        TeamMemberID int
+        Priority     int
+        MemberName   string
+        TeamName     string
+}
+
+type TeamLeadAbsence struct {
+        ID               int
+        TeamMemberID     int
+        DateFrom         time.Time
+        DateTo           time.Time
+        DelegateMemberID int
+        DelegateName     string
+}
+
+type TeamTaskSummary struct {
+        TaskID       int
+        BirthdayName string
+        EventDate    time.Time
+        RequestsDone int
+        RequestsAll  int
+        PayoutMember string
+}
+
+type PhoneOverride struct {
+        ID           int
+        TeamMemberID int
+        PhoneNumber  string
+        Status       string // "pending", "approved", "rejected", "revoked"
+        MemberName   string
+        TeamName     string
+        CurrentPhone string // подтвержденный контакт участника
+}
+
+type MemberRecord struct {
+        TeamMember
+        IsActive bool
+        HireDate sql.NullTime
+}
+
+// Годовщина работы участника в компании
+type Anniversary struct {
+        Member TeamMember
+        Date   time.Time // ближайшая дата годовщины
+        Years  int
+}
+
+type MemberAuditEntry struct {
+        AdminChatID int64
+        Action      string
+        OldValue    string
+        NewValue    string
+        CreatedAt   time.Time
+}
+
+// Запись журнала аудита. ActorChatID не задан для изменений из конфигурации.
+type AuditEntry struct {
+        ID          int
+        ActorChatID sql.NullInt64
+        ActorName   string
+        Action      string
+        TargetType  string
+        TargetID    sql.NullInt64
+        OldValue    string
+        NewValue    string
+        CreatedAt   time.Time
+}
+
+// Запись журнала исходящих сообщений api_messages_journal
+type JournalEntry struct {
+        ID            int
+        RecipientName string
+        ActionID      sql.NullInt64
+        Interactions  int // число нажатий кнопок в сообщении
+        Record        JournalRecord
+        Message       []byte // JSONB записи целиком
+        CreatedAt     time.Time
+        UpdatedAt     time.Time
+}
+
+// Параметры /export. To — первый день после периода
+type ExportRequest struct {
+        Kind   string // "journal", "collections", "members"
+        Format string // "csv", "json"
+        From   time.Time
+        To     time.Time
+}
+
+// Нажатие кнопки в сообщении бота и итог его обработки (callback_interactions)
+type CallbackInteraction struct {
+        ID         int64
+        JournalID  sql.NullInt64 // NULL — сообщение не записано в журнал
+        ChatID     int64
+        MessageID  int
+        FromChatID int64 // 0 для нажатий до v1.25: нажавший неизвестен
+        FromName   string
+        Username   string
+        Data       string
+        Outcome    string // "ok", "error", "denied", "handled", "ignored", "unknown" (до v1.25)
+        Error      string
+        PressedAt  time.Time
+}
+
+// Отправленное сообщение по открытому действию, найденное через журнал
+type OutstandingMessage struct {
+        JournalID    int
+        ActionID     int
+        ChatID       int64
+        MessageID    int
+        Record       JournalRecord
+        BirthdayName string
+        Cancelled    bool
+}
+
+// Правка отправленного сообщения (message_edits)
+type MessageEdit struct {
+        ID        int64
+        JournalID int
+        ChatID    int64
+        MessageID int
+        Reason    string // "phone_change", "member_change", "collector_change", "cancelled"
+        OldText   string
+        NewText   string
+        Closed    bool // кнопки убраны, сообщение больше не обновляется
+        Status    string // "edited", "failed"
+        Error     string
+        EditedAt  time.Time
+}
+
+// Условия выборки /journal; нулевые значения не ограничивают выборку
+type JournalFilter struct {
+        ChatID   int64
+        Type     string
+        From     time.Time
+        To       time.Time
+        ActionID int64
+        Callback string // "yes" — только с нажатием кнопки, "no" — без нажатия
+        Status   string // "sent" — доставленные, "failed" — неудачные отправки
+}
+
+// Секция журнала за месяц, выгруженная в архив и удаленная из базы
+type JournalArchive struct {
+        Month    time.Time
+        FilePath string
+        Rows     int
+        Size     int64
+}
+
+// Итог ночного обслуживания журнала сообщений
+type JournalMaintenanceReport struct {
+        CreatedPartitions []string
+        Archived          []JournalArchive
+        Errors            []string
+}
+
+// Показатели сборов команды за период. TeamID = 0 — итог по всем командам.
+type CollectionStats struct {
+        TeamID           int
+        TeamName         string
+        Celebrations     int
+        Requests         int
+        DoneRequests     int
+        AvgHoursToDone   sql.NullFloat64
+        MedianPayoutDays sql.NullFloat64
+}
+
+// Условия выборки /audit; нулевые значения не ограничивают выборку
+type AuditFilter struct {
+        ActorChatID int64
+        Action      string
+        TargetType  string
+        TargetID    int64
+        From        time.Time
+        To          time.Time
+        Limit       int
+}
+
+type Admin struct {
+        ChatID  int64
+        IsSuper bool
+        Name    string // имя участника с тем же chat ID, если он зарегистрирован
+}
+
+type Role string
+
+const (
+        RoleMember    Role = "member"
+        RoleTeamLead  Role = "teamlead"
+        RoleTreasurer Role = "treasurer"
+        RoleHR        Role = "hr"
+        RoleAdmin     Role = "admin"
+)
+
+// Роли пользователя Telegram
+type RoleSet map[Role]bool
+
+// Правило доступа к команде, callback или этапу диалога.
+// Public — доступно всем, иначе нужна хотя бы одна из ролей Roles.
+type accessRule struct {
+        Key    string
+        Prefix bool
+        Public bool
+        Roles  []Role
+}
+
+type accessRules []accessRule
+
+type BroadcastRecipient struct {
+        ChatID int64
+        Name   string
+}
+
+// Сообщение одного получателя в запуске рассылки. Текст, кнопки и запись журнала
+// сохраняются, чтобы неудачную отправку можно было повторить без пересчета.
+type JobItem struct {
+        ID       int
+        Kind     string // тип записи журнала: "member_notification", "teamlead_notification", ...
+        ChatID   int64
+        Name     string
+        Text     string
+        Keyboard *tgbotapi.InlineKeyboardMarkup
+        Journal  JournalRecord
+        ActionID sql.NullInt64
+        Status   string // "sent", "failed", "skipped"
+        Reason   string // ошибка Telegram или причина пропуска
+}
+
+// Итог запуска рассылки по каждому получателю
+type JobReport struct {
+        RunID int
+        Job   string // "member_notifications", "teamlead_notifications", "birthday_wishes", "anniversary_wishes", "payout_reminders"
+        Items []JobItem
+}
+
+// Повод сбора: день рождения или произвольный сбор со своим названием, сроком и суммой
+type CollectionOccasion struct {
+        Kind      string // "birthday", "anniversary", "custom"
+        Title     string
+        EventDate time.Time
+        Amount    sql.NullFloat64
+}
+
+// Произвольный сбор (свадьба, рождение ребенка, проводы) с прогрессом переводов
+type CustomCollection struct {
+        TaskID            int
+        Title             string
+        BeneficiaryID     int
+        BeneficiaryName   string
+        BeneficiaryTeamID int
+        Deadline          time.Time
+        ScopeTeamID       sql.NullInt64 // NULL — вся компания
+        ScopeTeamName     sql.NullString
+        Amount            sql.NullFloat64
+        CollectorName     sql.NullString
+        CreatedByChatID   sql.NullInt64
+        RequestsDone      int
+        RequestsAll       int
+}
+
 type UserState struct {
-        Stage       string // "awaiting_name", "awaiting_birthday", "awaiting_phone", "awaiting_team"
-        Name        string
-        Birthday    time.Time
-        PhoneNumber string
+        Stage             string // "awaiting_name", "awaiting_birthday", "awaiting_phone", "awaiting_team", "awaiting_away_delegate", "awaiting_phone_contact", "awaiting_phone_override", "awaiting_team_create", "awaiting_team_rename", "awaiting_team_move_members", "awaiting_member_search", "awaiting_member_edit", "awaiting_admin_grant", "awaiting_broadcast_text", "awaiting_broadcast_audience", "awaiting_broadcast_confirm", "awaiting_collection_title", "awaiting_collection_beneficiary", "awaiting_collection_deadline", "awaiting_collection_scope", "awaiting_collection_amount", "awaiting_collection_confirm"
+        Name              string
+        Birthday          time.Time
+        PhoneNumber       string
+        AwayFrom          time.Time
+        AwayTo            time.Time
+        TeamID            int
+        TargetTeamID      int
+        MemberID          int
+        EditField         string // "name", "birthday", "hire", "phone", "chat"
+        BroadcastText     string
+        BroadcastAudience string // "all", "teamleads", "unregistered", "team_<id>"
+        CollectionTitle    string
+        CollectionDeadline time.Time
+        CollectionAmount   float64 // 0 — сумма не указана
 }
 
 var userStates = make(map[int64]*UserState)
 
+// Последний поиск /journal каждого администратора для постраничного просмотра
+var journalSearches = make(map[int64]JournalFilter)
+
+// Создавать ли сборы на годовщины работы (ANNIVERSARY_COLLECTIONS=true).
+// Поздравления с годовщиной отправляются в любом случае
+var anniversaryCollections bool
+
+// Срок хранения журнала сообщений в месяцах (JOURNAL_RETENTION_MONTHS, 0 — хранить всегда)
+// и каталог для архивов старых секций (JOURNAL_ARCHIVE_DIR)
+var (
+        journalRetentionMonths = 12
+        journalArchiveDir      = "journal_archive"
+)
+
 func main() {
         // Отладочная информация
         log.Printf("Starting bot...")
         log.Printf("Environment variables:")
         log.Printf("DATABASE_URL: %s", os.Getenv("DATABASE_URL"))
         log.Printf("TELEGRAM_BOT_TOKEN: %s", os.Getenv("TELEGRAM_BOT_TOKEN"))
+        log.Printf("SUPER_ADMIN_IDS: %s", os.Getenv("SUPER_ADMIN_IDS"))
 
         // Подключение к базе данных
         connStr := os.Getenv("DATABASE_URL")
@@ -105,6 +415,43 @@ func main() {
 
         log.Printf("Authorized on account %s", bot.Self.UserName)
 
+        // Суперадминистраторы из конфигурации
+        superAdminIDs, err := parseSuperAdminIDs(os.Getenv("SUPER_ADMIN_IDS"))
+        if err != nil {
+                log.Fatalf("Invalid SUPER_ADMIN_IDS: %v", err)
+        }
+        if err := syncSuperAdmins(db, superAdminIDs); err != nil {
+                log.Fatalf("Error applying super admins: %v", err)
+        }
+        log.Printf("Super admins from configuration: %v", superAdminIDs)
+
+        anniversaryCollections = os.Getenv("ANNIVERSARY_COLLECTIONS") == "true"
+        log.Printf("Anniversary collections enabled: %v", anniversaryCollections)
+
+        // Хранение журнала сообщений
+        if value := os.Getenv("JOURNAL_RETENTION_MONTHS"); value != "" {
+                months, err := strconv.Atoi(value)
+                if err != nil || months < 0 {
+                        log.Fatalf("Invalid JOURNAL_RETENTION_MONTHS: %s", value)
+                }
+                journalRetentionMonths = months
+        }
+        if value := os.Getenv("JOURNAL_ARCHIVE_DIR"); value != "" {
+                journalArchiveDir = value
+        }
+        log.Printf("Journal retention: %d months, archive dir: %s", journalRetentionMonths, journalArchiveDir)
+        if _, err := ensureJournalPartitions(db, time.Now()); err != nil {
+                log.Printf("Error creating journal partitions: %v", err)
+        }
+
+        notifyPendingPhoneOverrides(bot, db)
+
+        if count, err := resetRetryingJobItems(db); err != nil {
+                log.Printf("Error resetting interrupted job retries: %v", err)
+        } else if count > 0 {
+                log.Printf("Reset %d interrupted job retries to failed", count)
+        }
+
         u := tgbotapi.NewUpdate(0)
         u.Timeout = 60
 
@@ -116,6 +463,7 @@ func main() {
         go sendNotifications(db, bot)
         go sendBirthdayWishes(db, bot)
         go sendPayoutReminders(db, bot)
+        go runJournalMaintenance(db, bot)
 
         // Обработка сообщений
         for update := range updates {
@@ -127,9 +475,223 @@ func main() {
         }
 }
 
+// Версия схемы записей журнала. Записи без schema_version (версия 0) писались
+// до появления типов и читаются декодером с приведением к текущей версии.
+// Поля callback_data и callback_time старых записей не читаются: нажатия хранятся в callback_interactions
+const journalSchemaVersion = 1
+
+// Запись журнала сообщений: общие поля всех типов и данные конкретного типа в Payload.
+// В JSON поля Payload хранятся на одном уровне с общими полями
+type JournalRecord struct {
+    SchemaVersion int    `json:"schema_version"`
+    Type          string `json:"type"`
+    ChatID        int64  `json:"chat_id,omitempty"`
+    MessageID     int    `json:"message_id,omitempty"`
+    Text          string `json:"text"`
+    Status        string `json:"status,omitempty"` // исходящие: "sent", "failed"
+    ErrorCode     int    `json:"error_code,omitempty"` // код ошибки Telegram для неудачной отправки
+    Error         string `json:"error,omitempty"`
+    ResendOf      int    `json:"resend_of,omitempty"` // ID записи, повторно отправленной из /journal
+    Payload       JournalPayload `json:"-"`
+}
+
+// Данные записи журнала, зависящие от ее типа
+type JournalPayload interface {
+    journalPayload()
+}
+
+// Участник, упомянутый в записи журнала
+type JournalPerson struct {
+    ID     int    `json:"id,omitempty"`
+    Name   string `json:"name"`
+    Team   string `json:"team,omitempty"`
+    TeamID int    `json:"team_id,omitempty"`
+    Phone  string `json:"phone,omitempty"`
+}
+
+// Произвольный сбор, к которому относится уведомление
+type JournalCollection struct {
+    TaskID   int      `json:"task_id"`
+    Title    string   `json:"title"`
+    Deadline string   `json:"deadline"`
+    Amount   *float64 `json:"amount,omitempty"`
+}
+
+// member_notification
+type MemberNotificationRecord struct {
+    Keyboard       *tgbotapi.InlineKeyboardMarkup `json:"keyboard,omitempty"`
+    BirthdayPerson JournalPerson                  `json:"birthday_person"`
+    Collector      JournalPerson                  `json:"collector"`
+    Collection     *JournalCollection             `json:"collection,omitempty"`
+}
+
+// teamlead_notification, collector_notification
+type TeamLeadNotificationRecord struct {
+    BirthdayPerson   JournalPerson      `json:"birthday_person"`
+    TaskID           int                `json:"task_id"`
+    NotifiedMemberID int                `json:"notified_member_id,omitempty"` // получатель уведомления
+    Collection       *JournalCollection `json:"collection,omitempty"`
+}
+
+// birthday_wish
+type BirthdayWishRecord struct {
+    BirthdayPerson JournalPerson `json:"birthday_person"`
+}
+
+// anniversary_wish
+type AnniversaryWishRecord struct {
+    Member JournalPerson `json:"member"`
+    Years  int           `json:"years"`
+}
+
+// payout_reminder
+type PayoutReminderRecord struct {
+    Keyboard       *tgbotapi.InlineKeyboardMarkup `json:"keyboard,omitempty"`
+    BirthdayPerson JournalPerson                  `json:"birthday_person"`
+}
+
+// handover_notification
+type HandoverNotificationRecord struct {
+    AbsenceID int   `json:"absence_id"`
+    TaskIDs   []int `json:"task_ids"`
+}
+
+// phone_override_request, phone_change_notification
+type PhoneNoticeRecord struct {
+    MemberID int `json:"member_id"`
+}
+
+// broadcast
+type BroadcastRecord struct {
+    BroadcastID int `json:"broadcast_id"`
+}
+
+// inbound_message: сообщение или команда пользователя (message_id — ID его сообщения)
+type InboundMessageRecord struct {
+    FromID   int64  `json:"from_id"`
+    Username string `json:"username,omitempty"`
+    Command  string `json:"command,omitempty"`
+}
+
+// inbound_callback: нажатие кнопки. ID сообщения с кнопкой хранится отдельно от message_id,
+// чтобы запись не путалась с исходящим сообщением
+type InboundCallbackRecord struct {
+    FromID          int64  `json:"from_id"`
+    Username        string `json:"username,omitempty"`
+    Data            string `json:"data"`
+    SourceMessageID int    `json:"source_message_id,omitempty"`
+}
+
+func (*MemberNotificationRecord) journalPayload()   {}
+func (*TeamLeadNotificationRecord) journalPayload() {}
+func (*BirthdayWishRecord) journalPayload()         {}
+func (*AnniversaryWishRecord) journalPayload()      {}
+func (*PayoutReminderRecord) journalPayload()       {}
+func (*HandoverNotificationRecord) journalPayload() {}
+func (*PhoneNoticeRecord) journalPayload()          {}
+func (*BroadcastRecord) journalPayload()            {}
+func (*InboundMessageRecord) journalPayload()       {}
+func (*InboundCallbackRecord) journalPayload()      {}
+
+// Тип данных записи по полю type. Записи неизвестных типов читаются без Payload
+var journalPayloadTypes = map[string]func() JournalPayload{
+    "member_notification":       func() JournalPayload { return &MemberNotificationRecord{} },
+    "teamlead_notification":     func() JournalPayload { return &TeamLeadNotificationRecord{} },
+    "collector_notification":    func() JournalPayload { return &TeamLeadNotificationRecord{} },
+    "birthday_wish":             func() JournalPayload { return &BirthdayWishRecord{} },
+    "anniversary_wish":          func() JournalPayload { return &AnniversaryWishRecord{} },
+    "payout_reminder":           func() JournalPayload { return &PayoutReminderRecord{} },
+    "handover_notification":     func() JournalPayload { return &HandoverNotificationRecord{} },
+    "phone_override_request":    func() JournalPayload { return &PhoneNoticeRecord{} },
+    "phone_change_notification": func() JournalPayload { return &PhoneNoticeRecord{} },
+    "broadcast":                 func() JournalPayload { return &BroadcastRecord{} },
+    "inbound_message":           func() JournalPayload { return &InboundMessageRecord{} },
+    "inbound_callback":          func() JournalPayload { return &InboundCallbackRecord{} },
+}
+
+// Входящие записи журнала: сообщения и нажатия кнопок пользователей
+func isInboundJournalType(journalType string) bool {
+    return strings.HasPrefix(journalType, "inbound_")
+}
+
+// Общие поля записи без методов JournalRecord, чтобы не зациклить (un)marshal
+type journalRecordHeader JournalRecord
+
+func (r JournalRecord) MarshalJSON() ([]byte, error) {
+    fields := make(map[string]json.RawMessage)
+    if r.Payload != nil {
+        data, err := json.Marshal(r.Payload)
+        if err != nil {
+            return nil, err
+        }
+        if err := json.Unmarshal(data, &fields); err != nil {
+            return nil, err
+        }
+    }
+    data, err := json.Marshal(journalRecordHeader(r))
+    if err != nil {
+        return nil, err
+    }
+    if err := json.Unmarshal(data, &fields); err != nil {
+        return nil, err
+    }
+    return json.Marshal(fields)
+}
+
+func (r *JournalRecord) UnmarshalJSON(data []byte) error {
+    record, err := decodeJournalRecord(data)
+    if record != nil {
+        *r = *record
+    }
+    return err
+}
+
+// Читает запись журнала любой версии и приводит ее к текущей.
+// Если не удалось разобрать данные типа, возвращает общие поля вместе с ошибкой
+func decodeJournalRecord(data []byte) (*JournalRecord, error) {
+    var header journalRecordHeader
+    if err := json.Unmarshal(data, &header); err != nil {
+        return nil, fmt.Errorf("error decoding journal record: %v", err)
+    }
+    record := JournalRecord(header)
+    if record.SchemaVersion > journalSchemaVersion {
+        return &record, fmt.Errorf("unsupported journal schema_version %d", record.SchemaVersion)
+    }
+
+    // До статуса доставки в журнал записывались только успешные отправки
+    if record.Status == "" && !isInboundJournalType(record.Type) {
+        record.Status = "sent"
+    }
+
+    newPayload, known := journalPayloadTypes[record.Type]
+    if !known {
+        record.SchemaVersion = journalSchemaVersion
+        return &record, nil
+    }
+    payload := newPayload()
+    if err := json.Unmarshal(data, payload); err != nil {
+        return &record, fmt.Errorf("error decoding %s journal record: %v", record.Type, err)
+    }
+
+    // В версии 0 получатель переводов в уведомлении участника хранился под ключом teamlead
+    if notification, ok := payload.(*MemberNotificationRecord); ok && record.SchemaVersion == 0 && notification.Collector.Name == "" {
+        var legacy struct {
+            Teamlead *JournalPerson `json:"teamlead"`
+        }
+        if err := json.Unmarshal(data, &legacy); err == nil && legacy.Teamlead != nil {
+            notification.Collector = *legacy.Teamlead
+        }
+    }
+
+    record.Payload = payload
+    record.SchemaVersion = journalSchemaVersion
+    return &record, nil
+}
+
 // Вспомогательная функция для записи в журнал
-func logMessageToJournal(db *sql.DB, messageData map[string]interface{}, actionID sql.NullInt64) error {
-    jsonBytes, err := json.Marshal(messageData)
+func logMessageToJournal(db *sql.DB, record JournalRecord, actionID sql.NullInt64) error {
+    record.SchemaVersion = journalSchemaVersion
+    jsonBytes, err := json.Marshal(record)
     if err != nil {
         return fmt.Errorf("error marshaling message to JSON: %v", err)
     }
@@ -146,147 +708,435 @@ func logMessageToJournal(db *sql.DB, messageData map[string]interface{}, actionI
     return nil
 }
 
-// Функция создания записи в журнале для уведомления участника
-func createMemberNotificationJournal(db *sql.DB, sentMessage tgbotapi.Message, messageText string, keyboard interface{},
-    birthdayName, teamName, teamleadName, teamleadPhone string, actionID int) error {
-    messageJSON := map[string]interface{}{
-        "message_id": sentMessage.MessageID,
-        "chat_id": sentMessage.Chat.ID,
-        "text": messageText,
-        "keyboard": keyboard,
-        "type": "member_notification",
-        "birthday_person": map[string]interface{}{
-            "name": birthdayName,
-            "team": teamName,
-        },
-        "teamlead": map[string]interface{}{
-            "name": teamleadName,
-            "phone": teamleadPhone,
+// Отмечает в записи журнала результат отправки: message_id или код и текст ошибки Telegram
+func (r *JournalRecord) setDelivery(sentMessage tgbotapi.Message, err error) {
+    if err != nil {
+        r.Status = "failed"
+        r.Error = err.Error()
+        var apiErr *tgbotapi.Error
+        if errors.As(err, &apiErr) {
+            r.ErrorCode = apiErr.Code
+            r.Error = apiErr.Message
+        }
+        return
+    }
+    r.Status = "sent"
+    r.ChatID = sentMessage.Chat.ID
+    r.MessageID = sentMessage.MessageID
+}
+
+// Отправляет ответ пользователю и записывает его в журнал вместе с результатом доставки.
+// Изменение кнопок и другие запросы без текста отправляются без записи в журнал
+func sendReply(bot *tgbotapi.BotAPI, db *sql.DB, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+    sentMessage, err := bot.Send(c)
+
+    record := JournalRecord{Type: "reply"}
+    switch m := c.(type) {
+    case tgbotapi.MessageConfig:
+        record.ChatID = m.ChatID
+        record.Text = m.Text
+    case tgbotapi.EditMessageTextConfig:
+        record.ChatID = m.ChatID
+        record.MessageID = m.MessageID
+        record.Text = m.Text
+    case tgbotapi.DocumentConfig:
+        record.ChatID = m.ChatID
+        record.Text = "[файл] " + m.Caption
+    default:
+        return sentMessage, err
+    }
+    if err != nil {
+        log.Printf("Error sending reply to %d: %v", record.ChatID, err)
+    }
+    record.setDelivery(sentMessage, err)
+    if err := logMessageToJournal(db, record, sql.NullInt64{Valid: false}); err != nil {
+        log.Printf("Error logging reply to journal: %v", err)
+    }
+    return sentMessage, err
+}
+
+// Записывает в журнал входящее сообщение или команду
+func journalInboundMessage(db *sql.DB, message *tgbotapi.Message) {
+    record := JournalRecord{
+        Type:      "inbound_message",
+        ChatID:    message.Chat.ID,
+        MessageID: message.MessageID,
+        Text:      message.Text,
+        Payload:   &InboundMessageRecord{FromID: message.From.ID, Username: message.From.UserName, Command: message.Command()},
+    }
+    if message.Contact != nil {
+        record.Text = "[контакт] " + message.Contact.PhoneNumber
+    }
+    if err := logMessageToJournal(db, record, sql.NullInt64{Valid: false}); err != nil {
+        log.Printf("Error logging inbound message to journal: %v", err)
+    }
+}
+
+// Записывает в журнал нажатие кнопки
+func journalInboundCallback(db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    payload := &InboundCallbackRecord{FromID: callback.From.ID, Username: callback.From.UserName, Data: callback.Data}
+    record := JournalRecord{
+        Type:    "inbound_callback",
+        ChatID:  callback.From.ID,
+        Payload: payload,
+    }
+    if callback.Message != nil {
+        record.ChatID = callback.Message.Chat.ID
+        payload.SourceMessageID = callback.Message.MessageID
+    }
+    if err := logMessageToJournal(db, record, sql.NullInt64{Valid: false}); err != nil {
+        log.Printf("Error logging inbound callback to journal: %v", err)
+    }
+}
+
+// Перезаписывает запись журнала после изменения отправленного сообщения
+func updateJournalRecord(db *sql.DB, journalID int, record JournalRecord) error {
+    record.SchemaVersion = journalSchemaVersion
+    jsonBytes, err := json.Marshal(record)
+    if err != nil {
+        return fmt.Errorf("error marshaling message to JSON: %v", err)
+    }
+
+    _, err = db.Exec(`
+        UPDATE api_messages_journal
+        SET updated_at = CURRENT_TIMESTAMP,
+            message = $1::jsonb
+        WHERE id = $2`,
+        string(jsonBytes), journalID)
+    return err
+}
+
+// Совпадают ли данные типа в двух записях журнала
+func sameJournalPayload(a, b JournalPayload) bool {
+    dataA, errA := json.Marshal(a)
+    dataB, errB := json.Marshal(b)
+    return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// Запись журнала для уведомления участника (message_id и chat_id добавляются при отправке).
+// collection заполняется только для произвольных сборов
+func memberNotificationJournal(messageText string, keyboard tgbotapi.InlineKeyboardMarkup,
+    birthdayName, teamName, collectorName, collectorPhone string, collection *JournalCollection) JournalRecord {
+    return JournalRecord{
+        Type: "member_notification",
+        Text: messageText,
+        Payload: &MemberNotificationRecord{
+            Keyboard:       &keyboard,
+            BirthdayPerson: JournalPerson{Name: birthdayName, Team: teamName},
+            Collector:      JournalPerson{Name: collectorName, Phone: collectorPhone},
+            Collection:     collection,
         },
     }
-    return logMessageToJournal(db, messageJSON, sql.NullInt64{Int64: int64(actionID), Valid: true})
 }
 
-// Функция создания записи в журнале для уведомления тимлида
-func createTeamLeadNotificationJournal(db *sql.DB, sentMessage tgbotapi.Message, messageText string,
-    birthdayName string, taskID int) error {
-    messageJSON := map[string]interface{}{
-        "message_id": sentMessage.MessageID,
-        "chat_id": sentMessage.Chat.ID,
-        "text": messageText,
-        "type": "teamlead_notification",
-        "birthday_person": map[string]interface{}{
-            "name": birthdayName,
+// Запись журнала для уведомления тимлида или казначея (journalType: teamlead_notification, collector_notification)
+func teamLeadNotificationJournal(messageText, journalType, birthdayName string, taskID, notifiedMemberID int,
+    collection *JournalCollection) JournalRecord {
+    return JournalRecord{
+        Type: journalType,
+        Text: messageText,
+        Payload: &TeamLeadNotificationRecord{
+            BirthdayPerson:   JournalPerson{Name: birthdayName},
+            TaskID:           taskID,
+            NotifiedMemberID: notifiedMemberID,
+            Collection:       collection,
         },
-        "task_id": taskID,
-    }
-    return logMessageToJournal(db, messageJSON, sql.NullInt64{Valid: false})
-}
-
-// Функция создания записи в журнале для поздравления с днем рождения
-func createBirthdayWishJournal(db *sql.DB, sentMessage tgbotapi.Message, messageText string,
-    memberID int, name string, teamID int) error {
-    messageJSON := map[string]interface{}{
-        "message_id": sentMessage.MessageID,
-        "chat_id": sentMessage.Chat.ID,
-        "text": messageText,
-        "type": "birthday_wish",
-        "birthday_person": map[string]interface{}{
-            "id": memberID,
-            "name": name,
-            "team_id": teamID,
+    }
+}
+
+// Сведения о произвольном сборе для записи журнала уведомления; nil для дней рождения и годовщин
+func collectionJournal(taskID int, occasion CollectionOccasion) *JournalCollection {
+    if occasion.Kind != "custom" {
+        return nil
+    }
+    collection := &JournalCollection{
+        TaskID:   taskID,
+        Title:    occasion.Title,
+        Deadline: occasion.EventDate.Format("2006-01-02"),
+    }
+    if occasion.Amount.Valid {
+        collection.Amount = &occasion.Amount.Float64
+    }
+    return collection
+}
+
+// Запись журнала для уведомления о передаче сборов заместителю
+func handoverNotificationJournal(messageText string, absenceID int, taskIDs []int) JournalRecord {
+    return JournalRecord{
+        Type:    "handover_notification",
+        Text:    messageText,
+        Payload: &HandoverNotificationRecord{AbsenceID: absenceID, TaskIDs: taskIDs},
+    }
+}
+
+// Запись журнала для уведомлений о телефоне для переводов
+// (noticeType: phone_override_request, phone_change_notification)
+func phoneNoticeJournal(messageText, noticeType string, memberID int) JournalRecord {
+    return JournalRecord{
+        Type:    noticeType,
+        Text:    messageText,
+        Payload: &PhoneNoticeRecord{MemberID: memberID},
+    }
+}
+
+// Функция создания записи в журнале для сообщения рассылки.
+// Неудачная отправка тоже записывается, с кодом ошибки Telegram.
+func createBroadcastJournal(db *sql.DB, chatID int64, sentMessage tgbotapi.Message, messageText string,
+    broadcastID int, sendErr error) error {
+    record := JournalRecord{
+        Type:    "broadcast",
+        ChatID:  chatID,
+        Text:    messageText,
+        Payload: &BroadcastRecord{BroadcastID: broadcastID},
+    }
+    record.setDelivery(sentMessage, sendErr)
+    return logMessageToJournal(db, record, sql.NullInt64{Valid: false})
+}
+
+// Запись журнала для поздравления с днем рождения
+func birthdayWishJournal(messageText string, memberID int, name string, teamID int) JournalRecord {
+    return JournalRecord{
+        Type:    "birthday_wish",
+        Text:    messageText,
+        Payload: &BirthdayWishRecord{BirthdayPerson: JournalPerson{ID: memberID, Name: name, TeamID: teamID}},
+    }
+}
+
+// Запись журнала для поздравления с годовщиной работы
+func anniversaryWishJournal(messageText string, memberID int, name string, teamID, years int) JournalRecord {
+    return JournalRecord{
+        Type: "anniversary_wish",
+        Text: messageText,
+        Payload: &AnniversaryWishRecord{
+            Member: JournalPerson{ID: memberID, Name: name, TeamID: teamID},
+            Years:  years,
         },
     }
-    return logMessageToJournal(db, messageJSON, sql.NullInt64{Valid: false})
-}
-
-// Функция создания записи в журнале для напоминания о переводе денег
-func createPayoutReminderJournal(db *sql.DB, sentMessage tgbotapi.Message, messageText string, keyboard interface{},
-    birthdayPersonName, birthdayPersonPhone string, actionID int) error {
-    messageJSON := map[string]interface{}{
-        "message_id": sentMessage.MessageID,
-        "chat_id": sentMessage.Chat.ID,
-        "text": messageText,
-        "keyboard": keyboard,
-        "type": "payout_reminder",
-        "birthday_person": map[string]interface{}{
-            "name": birthdayPersonName,
-            "phone": birthdayPersonPhone,
+}
+
+// Запись журнала для напоминания о переводе денег
+func payoutReminderJournal(messageText string, keyboard tgbotapi.InlineKeyboardMarkup,
+    birthdayPersonName, birthdayPersonPhone string) JournalRecord {
+    return JournalRecord{
+        Type: "payout_reminder",
+        Text: messageText,
+        Payload: &PayoutReminderRecord{
+            Keyboard:       &keyboard,
+            BirthdayPerson: JournalPerson{Name: birthdayPersonName, Phone: birthdayPersonPhone},
         },
     }
-    return logMessageToJournal(db, messageJSON, sql.NullInt64{Int64: int64(actionID), Valid: true})
+}
+
+// Права доступа к командам. Команды без правила запрещены.
+var commandRoles = accessRules{
+        {Key: "start", Public: true},
+        {Key: "help", Public: true},
+        {Key: "birthdays", Roles: []Role{RoleTeamLead, RoleHR, RoleAdmin}},
+        // В списке телефоны тимлидов и казначеев, поэтому обычным участникам он не показывается
+        {Key: "teamleads", Roles: []Role{RoleTeamLead, RoleTreasurer, RoleHR, RoleAdmin}},
+        {Key: "myteam", Roles: []Role{RoleTeamLead}},
+        {Key: "away", Roles: []Role{RoleTeamLead}},
+        {Key: "phone", Roles: []Role{RoleTeamLead, RoleTreasurer}},
+        {Key: "admin", Roles: []Role{RoleAdmin}},
+        {Key: "backups", Roles: []Role{RoleAdmin}},
+        {Key: "audit", Roles: []Role{RoleAdmin}},
+        {Key: "journal", Roles: []Role{RoleAdmin}},
+        {Key: "timeline", Roles: []Role{RoleAdmin}},
+        {Key: "export", Roles: []Role{RoleAdmin}},
+        {Key: "stats", Roles: []Role{RoleHR, RoleAdmin}},
+        {Key: "collect", Roles: []Role{RoleTeamLead, RoleAdmin}},
+}
+
+// Права доступа к callback по префиксу. Проверяются по порядку, неизвестные callback запрещены.
+var callbackRoles = accessRules{
+        {Key: "team_", Prefix: true, Public: true},
+        {Key: "transfer_done_", Prefix: true, Roles: []Role{RoleMember}},
+        {Key: "payout_done_", Prefix: true, Roles: []Role{RoleMember}},
+        {Key: "myteam_", Prefix: true, Roles: []Role{RoleTeamLead}},
+        {Key: "phone_approve_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "phone_reject_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "phone_", Prefix: true, Roles: []Role{RoleTeamLead, RoleTreasurer}},
+        {Key: "away_delegate_", Prefix: true, Roles: []Role{RoleTeamLead}},
+        {Key: "admin_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "collect_", Prefix: true, Roles: []Role{RoleTeamLead, RoleAdmin}},
+        {Key: "", Prefix: true},
+}
+
+// Права доступа к этапам диалога. Этапы без правила запрещены.
+var stageRoles = accessRules{
+        {Key: "awaiting_name", Public: true},
+        {Key: "awaiting_birthday", Public: true},
+        {Key: "awaiting_phone", Public: true},
+        {Key: "awaiting_team", Public: true},
+        {Key: "awaiting_away_delegate", Roles: []Role{RoleTeamLead}},
+        {Key: "awaiting_phone_contact", Roles: []Role{RoleTeamLead, RoleTreasurer}},
+        {Key: "awaiting_phone_override", Roles: []Role{RoleTeamLead, RoleTreasurer}},
+        {Key: "awaiting_team_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "awaiting_member_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "awaiting_admin_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "awaiting_broadcast_", Prefix: true, Roles: []Role{RoleAdmin}},
+        {Key: "awaiting_collection_", Prefix: true, Roles: []Role{RoleTeamLead, RoleAdmin}},
+}
+
+// Команды в порядке вывода в /help
+var helpCommands = []struct {
+        Command     string
+        Description string
+}{
+        {"start", "начать процесс регистрации"},
+        {"birthdays", "показать ближайшие дни рождения"},
+        {"teamleads", "список тимлидов и казначеев команд"},
+        {"myteam", "сводка по вашей команде"},
+        {"away", "ДД.ММ-ДД.ММ - указать период отсутствия и заместителя"},
+        {"phone", "телефон для получения переводов"},
+        {"admin", "панель управления администратора"},
+        {"backups", "порядок резервных тимлидов команд"},
+        {"audit", "журнал действий администраторов и изменений ролей"},
+        {"journal", "поиск по журналу сообщений"},
+        {"timeline", "история переписки бота с пользователем"},
+        {"export", "выгрузка журнала, сборов и участников в CSV или JSON"},
+        {"stats", "статистика участия в сборах по командам"},
+        {"collect", "сборы на свадьбу, рождение ребенка и другие поводы"},
+        {"help", "показать это сообщение"},
+}
+
+var roleNames = map[Role]string{
+        RoleMember:    "зарегистрированных участников",
+        RoleTeamLead:  "тимлидов",
+        RoleTreasurer: "казначеев",
+        RoleHR:        "HR",
+        RoleAdmin:     "администраторов",
+}
+
+func (rules accessRules) find(key string) (accessRule, bool) {
+        for _, rule := range rules {
+                if rule.Key == key || (rule.Prefix && strings.HasPrefix(key, rule.Key)) {
+                        return rule, true
+                }
+        }
+        return accessRule{}, false
+}
+
+func (rule accessRule) allows(roles RoleSet) bool {
+        if rule.Public {
+                return true
+        }
+        for _, role := range rule.Roles {
+                if roles[role] {
+                        return true
+                }
+        }
+        return false
+}
+
+// Проверяет права пользователя userID по правилам rules и сообщает об отказе в chatID.
+// Возвращает роли пользователя для дальнейшей обработки.
+func authorize(bot *tgbotapi.BotAPI, db *sql.DB, userID, chatID int64, rules accessRules, key string) (RoleSet, bool) {
+        roles, err := getUserRoles(db, userID)
+        if err != nil {
+                log.Printf("Error getting roles of user %d: %v", userID, err)
+                return nil, false
+        }
+
+        rule, found := rules.find(key)
+        if !found {
+                log.Printf("Access denied for user %d to %q: no access rule", userID, key)
+                return roles, false
+        }
+        if rule.allows(roles) {
+                return roles, true
+        }
+
+        log.Printf("Access denied for user %d to %q", userID, key)
+        if len(rule.Roles) > 0 {
+                names := make([]string, 0, len(rule.Roles))
+                for _, role := range rule.Roles {
+                        names = append(names, roleNames[role])
+                }
+                text := "Эта команда доступна только для: " + strings.Join(names, ", ") + "."
+                if len(roles) == 0 {
+                        text += " Используйте /start для регистрации."
+                }
+                sendReply(bot, db, tgbotapi.NewMessage(chatID, text))
+        }
+        return roles, false
+}
+
+func formatHelpMessage(roles RoleSet) string {
+        var sb strings.Builder
+        sb.WriteString("Доступные команды:\n")
+        for _, command := range helpCommands {
+                if rule, found := commandRoles.find(command.Command); found && !rule.allows(roles) {
+                        continue
+                }
+                sb.WriteString(fmt.Sprintf("/%s - %s\n", command.Command, command.Description))
+        }
+        return sb.String()
 }
 
 func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
     userID := message.From.ID
     chatID := message.Chat.ID
 
+    if err := recordBotUser(db, message.From); err != nil {
+        log.Printf("Error recording bot user: %v", err)
+    }
+    journalInboundMessage(db, message)
+
     if message.IsCommand() {
+        if _, known := commandRoles.find(message.Command()); !known {
+            sendReply(bot, db, tgbotapi.NewMessage(chatID, "Неизвестная команда. Используйте /help для списка доступных команд."))
+            return
+        }
+        roles, allowed := authorize(bot, db, userID, chatID, commandRoles, message.Command())
+        if !allowed {
+            return
+        }
+
         switch message.Command() {
         case "start":
             // Начинаем процесс регистрации
             userStates[userID] = &UserState{Stage: "awaiting_name"}
             msg := tgbotapi.NewMessage(chatID, "Привет! Давайте добавим ваш день рождения в базу данных. Как вас зовут?")
-            bot.Send(msg)
+            sendReply(bot, db, msg)
             return
         case "help":
-            msg := tgbotapi.NewMessage(chatID, `Доступные команды:
-/start - начать процесс регистрации
-/birthdays - показать ближайшие дни рождения (только для тимлидов)
-/help - показать это сообщение`)
-            bot.Send(msg)
+            msg := tgbotapi.NewMessage(chatID, formatHelpMessage(roles))
+            sendReply(bot, db, msg)
             return
         case "teamleads":
             teamLeads, err := getTeamLeads(db)
             if err != nil {
                 log.Printf("Error getting team leads: %v", err)
                 msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка тимлидов")
-                bot.Send(msg)
+                sendReply(bot, db, msg)
                 return
             }
-            msg := tgbotapi.NewMessage(chatID, formatTeamLeadsMessage(teamLeads))
-            bot.Send(msg)
-            return
-        case "birthdays":
-            // Проверяем, является ли пользователь тимлидом
-            var isTeamLead bool
-            err := db.QueryRow(`
-                SELECT EXISTS(
-                    SELECT 1 FROM teamleads tl
-                    JOIN team_members tm ON tl.team_member_id = tm.id
-                    WHERE tm.telegram_chat_id = $1::bigint
-                )`, message.Chat.ID).Scan(&isTeamLead)
+            treasurers, err := getTreasurers(db)
             if err != nil {
-                log.Printf("Error checking team lead status: %v", err)
-                return
-            }
-            if !isTeamLead {
-                msg := tgbotapi.NewMessage(chatID, "Эта команда доступна только для тимлидов.")
-                bot.Send(msg)
+                log.Printf("Error getting treasurers: %v", err)
+                msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка тимлидов")
+                sendReply(bot, db, msg)
                 return
             }
-
+            msg := tgbotapi.NewMessage(chatID, formatTeamLeadsMessage(teamLeads, treasurers))
+            sendReply(bot, db, msg)
+            return
+        case "birthdays":
             birthdays, err := getUpcomingBirthdays(db)
             if err != nil {
                 log.Printf("Error getting birthdays: %v", err)
                 return
             }
-            msg := tgbotapi.NewMessage(chatID, formatBirthdayMessage(birthdays))
-            bot.Send(msg)
-            return
-        case "admin":
-            // Проверяем, является ли пользователь администратором
-            isAdmin, err := isAdmin(db, chatID)
+            anniversaries, err := getUpcomingAnniversaries(db)
             if err != nil {
-                log.Printf("Error checking admin status: %v", err)
+                log.Printf("Error getting anniversaries: %v", err)
                 return
             }
-            if !isAdmin {
-                msg := tgbotapi.NewMessage(chatID, "Эта команда доступна только для администраторов.")
-                bot.Send(msg)
-                return
-            }
-
+            msg := tgbotapi.NewMessage(chatID, formatBirthdayMessage(birthdays, anniversaries))
+            sendReply(bot, db, msg)
+            return
+        case "admin":
             // Создаем inline-кнопки для панели управления
             keyboard := tgbotapi.NewInlineKeyboardMarkup(
                 tgbotapi.NewInlineKeyboardRow(
@@ -301,11 +1151,49 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
                     tgbotapi.NewInlineKeyboardButtonData("Send today birthday messages", "admin_send_today_birthday_messages"),
                     tgbotapi.NewInlineKeyboardButtonData("Send teamlead money message", "admin_send_teamlead_money_message"),
                 ),
+                tgbotapi.NewInlineKeyboardRow(
+                    tgbotapi.NewInlineKeyboardButtonData("Teams", "admin_teams"),
+                    tgbotapi.NewInlineKeyboardButtonData("Members", "admin_members"),
+                    tgbotapi.NewInlineKeyboardButtonData("Admins", "admin_admins"),
+                ),
+                tgbotapi.NewInlineKeyboardRow(
+                    tgbotapi.NewInlineKeyboardButtonData("Broadcast", "admin_broadcast"),
+                ),
             )
 
             msg := tgbotapi.NewMessage(chatID, "Панель управления администратора:")
             msg.ReplyMarkup = keyboard
-            bot.Send(msg)
+            sendReply(bot, db, msg)
+            return
+        case "myteam":
+            handleMyTeamCommand(bot, db, message)
+            return
+        case "away":
+            handleAwayCommand(bot, db, message)
+            return
+        case "phone":
+            handlePhoneCommand(bot, db, message)
+            return
+        case "backups":
+            handleBackupsCommand(bot, db, message)
+            return
+        case "audit":
+            handleAuditCommand(bot, db, message)
+            return
+        case "journal":
+            handleJournalCommand(bot, db, message)
+            return
+        case "timeline":
+            handleTimelineCommand(bot, db, message)
+            return
+        case "export":
+            handleExportCommand(bot, db, message)
+            return
+        case "stats":
+            handleStatsCommand(bot, db, message)
+            return
+        case "collect":
+            handleCollectCommand(bot, db, message, roles)
             return
         }
     }
@@ -314,7 +1202,11 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
     state, exists := userStates[userID]
     if !exists {
         msg := tgbotapi.NewMessage(chatID, "Используйте /start для начала процесса регистрации.")
-        bot.Send(msg)
+        sendReply(bot, db, msg)
+        return
+    }
+    if _, allowed := authorize(bot, db, userID, chatID, stageRoles, state.Stage); !allowed {
+        delete(userStates, userID)
         return
     }
 
@@ -323,13 +1215,13 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
         state.Name = message.Text
         state.Stage = "awaiting_birthday"
         msg := tgbotapi.NewMessage(chatID, "Отлично! Теперь введите вашу дату рождения в формате DD.MM.YYYY")
-        bot.Send(msg)
+        sendReply(bot, db, msg)
 
     case "awaiting_birthday":
         birthday, err := time.Parse("02.01.2006", message.Text)
         if err != nil {
             msg := tgbotapi.NewMessage(chatID, "Неверный формат даты. Пожалуйста, используйте формат DD.MM.YYYY")
-            bot.Send(msg)
+            sendReply(bot, db, msg)
             return
         }
 
@@ -346,7 +1238,7 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
 
         msg := tgbotapi.NewMessage(chatID, "Отлично! Пожалуйста, нажмите на кнопку ниже, чтобы поделиться своим номером телефона")
         msg.ReplyMarkup = keyboard
-        bot.Send(msg)
+        sendReply(bot, db, msg)
         return
 
     case "awaiting_phone":
@@ -357,14 +1249,14 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
         // Проверяем, что пользователь отправил контакт, а не текстовое сообщение
         if message.Contact == nil {
             msg = tgbotapi.NewMessage(chatID, "Пожалуйста, используйте кнопку 'Поделиться номером телефона' для отправки вашего номера")
-            bot.Send(msg)
+            sendReply(bot, db, msg)
             return
         }
 
         // Проверяем, что контакт принадлежит пользователю
         if message.Contact.UserID != message.From.ID {
             msg = tgbotapi.NewMessage(chatID, "Пожалуйста, поделитесь своим собственным номером телефона")
-            bot.Send(msg)
+            sendReply(bot, db, msg)
             return
         }
 
@@ -374,14 +1266,14 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
         // Убираем клавиатуру после получения номера
         msg = tgbotapi.NewMessage(chatID, "Спасибо! Теперь выберите вашу команду")
         msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
-        bot.Send(msg)
+        sendReply(bot, db, msg)
 
         // Получаем список команд и создаем inline-кнопки
         teams, err = getActiveTeams(db)
         if err != nil {
             log.Printf("Error getting teams: %v", err)
             msg = tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка команд")
-            bot.Send(msg)
+            sendReply(bot, db, msg)
             return
         }
 
@@ -392,889 +1284,8548 @@ func handleMessage(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message)
             buttons = append(buttons, []tgbotapi.InlineKeyboardButton{button})
         }
         msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
-        bot.Send(msg)
+        sendReply(bot, db, msg)
+
+    case "awaiting_phone_contact":
+        handlePhoneContact(bot, db, message)
+
+    case "awaiting_phone_override":
+        handlePhoneOverrideInput(bot, db, message)
+
+    case "awaiting_team_create", "awaiting_team_rename", "awaiting_team_move_members":
+        handleAdminTeamInput(bot, db, message, state)
+
+    case "awaiting_member_search", "awaiting_member_edit":
+        handleAdminMemberInput(bot, db, message, state)
+
+    case "awaiting_admin_grant":
+        handleAdminGrantInput(bot, db, message)
+
+    case "awaiting_broadcast_text", "awaiting_broadcast_audience", "awaiting_broadcast_confirm":
+        handleBroadcastInput(bot, db, message, state)
+
+    case "awaiting_collection_title", "awaiting_collection_beneficiary", "awaiting_collection_deadline",
+        "awaiting_collection_scope", "awaiting_collection_amount", "awaiting_collection_confirm":
+        handleCollectionInput(bot, db, message, state)
     }
 }
 
-func handleCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
-    // Обновляем запись в журнале для любого callback
-    if callback.Message != nil {
-        updateQuery := `
-            UPDATE api_messages_journal
-            SET updated_at = CURRENT_TIMESTAMP,
-                message = jsonb_set(
-                    jsonb_set(message, '{callback_data}', $1::jsonb),
-                    '{callback_time}', $2::jsonb
-                )
-            WHERE message->>'message_id' = $3
-            AND message->>'chat_id' = $4`
-
-        callbackJSON, _ := json.Marshal(callback.Data)
-        timeJSON, _ := json.Marshal(time.Now().Format(time.RFC3339))
-        
-        _, err := db.Exec(updateQuery, 
-            string(callbackJSON), 
-            string(timeJSON),
-            strconv.Itoa(callback.Message.MessageID),
-            strconv.FormatInt(callback.Message.Chat.ID, 10))
-        
+// Обрабатывает /backups: без аргументов показывает порядок резервных тимлидов,
+// "/backups <team_id> <member_id> ..." задает его, "/backups <team_id> clear" очищает
+func handleBackupsCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+    args := strings.Fields(message.CommandArguments())
+
+    if len(args) == 0 {
+        backups, err := getTeamLeadBackups(db)
         if err != nil {
-            log.Printf("Error updating message journal: %v", err)
+            log.Printf("Error getting teamlead backups: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении резервных тимлидов")
+            sendReply(bot, db, msg)
+            return
         }
+        msg := tgbotapi.NewMessage(chatID, formatTeamLeadBackupsMessage(backups)+
+            "\nИспользование: /backups <ID команды> <ID участника> [<ID участника> ...]\n"+
+            "Очистить: /backups <ID команды> clear")
+        sendReply(bot, db, msg)
+        return
     }
 
-    // Проверяем тип callback
-    if strings.HasPrefix(callback.Data, "team_") {
-        handleTeamSelection(bot, db, callback)
-    } else if strings.HasPrefix(callback.Data, "transfer_done_") {
-        handleTransferConfirmation(bot, db, callback)
-    } else if strings.HasPrefix(callback.Data, "payout_done_") {
-        handlePayoutConfirmation(bot, db, callback)
-    } else if strings.HasPrefix(callback.Data, "admin_") {
-        handleAdminCallback(bot, db, callback)
+    teamID, err := strconv.Atoi(args[0])
+    if err != nil || len(args) < 2 {
+        msg := tgbotapi.NewMessage(chatID, "Использование: /backups <ID команды> <ID участника> [<ID участника> ...]")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var memberIDs []int
+    if !(len(args) == 2 && args[1] == "clear") {
+        for _, arg := range args[1:] {
+            memberID, err := strconv.Atoi(arg)
+            if err != nil {
+                msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Неверный ID участника: %s", arg))
+                sendReply(bot, db, msg)
+                return
+            }
+            memberIDs = append(memberIDs, memberID)
+        }
+    }
+
+    if err := setTeamLeadBackups(db, teamID, memberIDs, chatID); err != nil {
+        log.Printf("Error setting teamlead backups: %v", err)
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось сохранить резервных тимлидов: %v", err))
+        sendReply(bot, db, msg)
+        return
     }
+
+    msg := tgbotapi.NewMessage(chatID, "Порядок резервных тимлидов сохранен.")
+    sendReply(bot, db, msg)
 }
 
-func handleAdminCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
-    // Проверяем, является ли пользователь администратором
-    isAdmin, err := isAdmin(db, callback.Message.Chat.ID)
+const (
+    auditDefaultLimit = 20
+    auditMaxLimit     = 100
+)
+
+const auditUsage = "Использование: /audit [actor=<chat ID>] [action=<текст>] [target=<тип>[:<ID>]] " +
+    "[from=ДД.ММ.ГГГГ] [to=ДД.ММ.ГГГГ] [limit=<N>]\n" +
+    "Типы объектов: callback, admin, member, team, task"
+
+// Обрабатывает /audit: последние записи журнала аудита с фильтрами key=value
+func handleAuditCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    filter, err := parseAuditFilter(strings.Fields(message.CommandArguments()))
+    if err != nil {
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%v\n\n%s", err, auditUsage))
+        sendReply(bot, db, msg)
+        return
+    }
+
+    entries, err := getAuditLog(db, filter)
     if err != nil {
-        log.Printf("Error checking admin status: %v", err)
+        log.Printf("Error getting audit log: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении журнала аудита")
+        sendReply(bot, db, msg)
         return
     }
-    if !isAdmin {
-        msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Эта команда доступна только для администраторов.")
-        bot.Send(msg)
+    if len(entries) == 0 {
+        msg := tgbotapi.NewMessage(chatID, "Записей не найдено.\n\n"+auditUsage)
+        sendReply(bot, db, msg)
         return
     }
 
-    // Отправляем начальное сообщение о начале обработки
-    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Начинаем обработку запроса...")
-    bot.Send(msg)
+    var sb strings.Builder
+    sb.WriteString(fmt.Sprintf("Журнал аудита, последние %d записей:\n", len(entries)))
+    for _, entry := range entries {
+        sb.WriteString("\n" + formatAuditEntry(entry) + "\n")
+    }
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    sendReply(bot, db, msg)
+}
 
-    // Обрабатываем callback в зависимости от типа действия
-    switch callback.Data {
-    case "admin_gen_tasks":
-        go func() {
-            log.Printf("Starting to check upcoming birthdays")
-            count, err := checkUpcomingBirthdaysCount(db)
+func parseAuditFilter(args []string) (AuditFilter, error) {
+    filter := AuditFilter{Limit: auditDefaultLimit}
+    for _, arg := range args {
+        key, value, found := strings.Cut(arg, "=")
+        if !found || value == "" {
+            return filter, fmt.Errorf("Неверный фильтр: %s", arg)
+        }
+
+        switch key {
+        case "actor":
+            id, err := strconv.ParseInt(value, 10, 64)
             if err != nil {
-                log.Printf("Error checking upcoming birthdays count: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке предстоящих дней рождения.")
-                bot.Send(msg)
-                return
-            }
-            log.Printf("Found %d upcoming birthdays without tasks", count)
-            if count == 0 {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых дней рождения для создания задач.")
-                bot.Send(msg)
-                return
+                return filter, fmt.Errorf("Неверный chat ID: %s", value)
             }
-            log.Printf("Starting to create birthday tasks")
-            tasksCreated, err := checkUpcomingBirthdaysOnce(db)
-            if err != nil {
-                if err.Error() == "no new tasks created" {
-                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых дней рождения для создания задач.")
-                    bot.Send(msg)
-                } else {
-                    log.Printf("Error creating birthday tasks: %v", err)
-                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при создании задач.")
-                    bot.Send(msg)
+            filter.ActorChatID = id
+        case "action":
+            filter.Action = value
+        case "target":
+            targetType, targetID, hasID := strings.Cut(value, ":")
+            filter.TargetType = targetType
+            if hasID {
+                id, err := strconv.ParseInt(targetID, 10, 64)
+                if err != nil {
+                    return filter, fmt.Errorf("Неверный ID объекта: %s", targetID)
                 }
-                return
-            }
-            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Задачи успешно созданы для %d предстоящих дней рождения.", tasksCreated))
-            bot.Send(msg)
-            log.Printf("Finished creating birthday tasks")
-        }()
-    case "admin_gen_actions":
-        go func() {
-            log.Printf("Starting to check pending actions")
-            count, err := checkPendingActionsCount(db)
-            if err != nil {
-                log.Printf("Error checking pending actions: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих действий.")
-                bot.Send(msg)
-                return
-            }
-            log.Printf("Found %d tasks without actions", count)
-            if count == 0 {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых задач для создания действий.")
-                bot.Send(msg)
-                return
+                filter.TargetID = id
             }
-            log.Printf("Starting to create request actions")
-            err = createRequestActionsOnce(db)
+        case "from", "to":
+            date, err := time.ParseInLocation("02.01.2006", value, time.Local)
             if err != nil {
-                if err.Error() == "no new actions created" {
-                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых задач для создания действий.")
-                    bot.Send(msg)
-                } else {
-                    log.Printf("Error creating request actions: %v", err)
-                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при создании действий.")
-                    bot.Send(msg)
-                }
-                return
+                return filter, fmt.Errorf("Неверная дата: %s", value)
             }
-            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Действия успешно созданы для %d задач.", count))
-            bot.Send(msg)
-            log.Printf("Finished creating request actions")
-        }()
-    case "admin_send_members_messages":
-        go func() {
-            count, err := checkPendingMemberNotificationsCount(db)
-            if err != nil {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих уведомлений участников.")
-                bot.Send(msg)
-                return
+            if key == "from" {
+                filter.From = date
+            } else {
+                // Дата окончания включается в выборку целиком
+                filter.To = date.AddDate(0, 0, 1)
             }
-            if count == 0 {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых уведомлений для отправки участникам.")
-                bot.Send(msg)
-                return
+        case "limit":
+            limit, err := strconv.Atoi(value)
+            if err != nil || limit < 1 || limit > auditMaxLimit {
+                return filter, fmt.Errorf("Лимит должен быть от 1 до %d", auditMaxLimit)
             }
-            sendMemberNotifications(db, bot)
-            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Уведомления успешно отправлены %d участникам.", count))
-            bot.Send(msg)
-        }()
-    case "admin_send_teamlead_notify":
-        go func() {
-            count, err := checkPendingTeamLeadNotificationsCount(db)
+            filter.Limit = limit
+        default:
+            return filter, fmt.Errorf("Неизвестный фильтр: %s", key)
+        }
+    }
+    return filter, nil
+}
+
+func formatAuditEntry(entry AuditEntry) string {
+    actor := "конфигурация"
+    if entry.ActorChatID.Valid {
+        actor = strconv.FormatInt(entry.ActorChatID.Int64, 10)
+        if entry.ActorName != "" {
+            actor = fmt.Sprintf("%s (%s)", entry.ActorName, actor)
+        }
+    }
+
+    text := fmt.Sprintf("#%d %s — %s\n%s", entry.ID, entry.CreatedAt.In(time.Local).Format("02.01.2006 15:04"), actor, entry.Action)
+    if entry.TargetType != "" {
+        text += " " + entry.TargetType
+        if entry.TargetID.Valid {
+            text += fmt.Sprintf(" %d", entry.TargetID.Int64)
+        }
+    }
+    switch {
+    case entry.OldValue != "" && entry.NewValue != "":
+        text += fmt.Sprintf(": %s → %s", entry.OldValue, entry.NewValue)
+    case entry.NewValue != "":
+        text += ": " + entry.NewValue
+    case entry.OldValue != "":
+        text += fmt.Sprintf(": %s → (пусто)", entry.OldValue)
+    }
+    return text
+}
+
+const journalPageSize = 10
+
+const journalUsage = "Использование: /journal [chat=<chat ID>] [type=<тип>] [action=<ID действия>] " +
+    "[callback=yes|no] [status=sent|failed] [from=ДД.ММ.ГГГГ] [to=ДД.ММ.ГГГГ]\n" +
+    "Типы: member_notification, teamlead_notification, collector_notification, birthday_wish, " +
+    "anniversary_wish, payout_reminder, broadcast, handover_notification, inbound_message, inbound_callback и другие"
+
+// Обрабатывает /journal: поиск по журналу отправленных сообщений с фильтрами key=value.
+// Фильтр сохраняется, чтобы листать страницы кнопками
+func handleJournalCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    filter, err := parseJournalFilter(strings.Fields(message.CommandArguments()))
+    if err != nil {
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%v\n\n%s", err, journalUsage))
+        sendReply(bot, db, msg)
+        return
+    }
+    journalSearches[message.From.ID] = filter
+    sendJournalPage(bot, db, chatID, filter, 0)
+}
+
+func parseJournalFilter(args []string) (JournalFilter, error) {
+    var filter JournalFilter
+    for _, arg := range args {
+        key, value, found := strings.Cut(arg, "=")
+        if !found || value == "" {
+            return filter, fmt.Errorf("Неверный фильтр: %s", arg)
+        }
+
+        switch key {
+        case "chat":
+            id, err := strconv.ParseInt(value, 10, 64)
             if err != nil {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих уведомлений тимлидов.")
-                bot.Send(msg)
-                return
-            }
-            if count == 0 {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых уведомлений для отправки тимлидам.")
-                bot.Send(msg)
-                return
+                return filter, fmt.Errorf("Неверный chat ID: %s", value)
             }
-            sendTeamLeadNotifications(db, bot)
-            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Уведомления успешно отправлены %d тимлидам.", count))
-            bot.Send(msg)
-        }()
-    case "admin_send_today_birthday_messages":
-        go func() {
-            log.Printf("Starting to check today's birthdays")
-            count, err := checkTodayBirthdaysCount(db)
+            filter.ChatID = id
+        case "type":
+            filter.Type = value
+        case "action":
+            id, err := strconv.ParseInt(value, 10, 64)
             if err != nil {
-                log.Printf("Error checking today's birthdays: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке сегодняшних дней рождения.")
-                bot.Send(msg)
-                return
+                return filter, fmt.Errorf("Неверный ID действия: %s", value)
             }
-            log.Printf("Found %d birthdays today", count)
-            if count == 0 {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Сегодня нет дней рождения для отправки поздравлений.")
-                bot.Send(msg)
-                return
+            filter.ActionID = id
+        case "callback":
+            if value != "yes" && value != "no" {
+                return filter, fmt.Errorf("callback может быть только yes или no")
             }
-            log.Printf("Starting to send birthday wishes")
-            err = sendBirthdayWishesOnce(db, bot)
-            if err != nil {
-                log.Printf("Error sending birthday wishes: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при отправке поздравлений.")
-                bot.Send(msg)
-                return
+            filter.Callback = value
+        case "status":
+            if value != "sent" && value != "failed" {
+                return filter, fmt.Errorf("status может быть только sent или failed")
             }
-            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Поздравления успешно отправлены %d именинникам.", count))
-            bot.Send(msg)
-            log.Printf("Finished sending birthday wishes")
-        }()
-    case "admin_send_teamlead_money_message":
-        go func() {
-            log.Printf("Starting to check pending payout reminders")
-            count, err := checkPendingPayoutRemindersCount(db)
+            filter.Status = value
+        case "from", "to":
+            date, err := time.ParseInLocation("02.01.2006", value, time.Local)
             if err != nil {
-                log.Printf("Error checking pending payout reminders: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих напоминаний о переводе денег.")
-                bot.Send(msg)
-                return
-            }
-            log.Printf("Found %d pending payout reminders", count)
-            if count == 0 {
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых напоминаний о переводе денег для отправки.")
-                bot.Send(msg)
-                return
+                return filter, fmt.Errorf("Неверная дата: %s", value)
             }
-            log.Printf("Starting to send payout reminders")
-            err = sendPayoutRemindersOnce(db, bot)
-            if err != nil {
-                log.Printf("Error sending payout reminders: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при отправке напоминаний о переводе денег.")
-                bot.Send(msg)
-                return
+            if key == "from" {
+                filter.From = date
+            } else {
+                // Дата окончания включается в выборку целиком
+                filter.To = date.AddDate(0, 0, 1)
             }
-            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Напоминания о переводе денег успешно отправлены %d тимлидам.", count))
-            bot.Send(msg)
-            log.Printf("Finished sending payout reminders")
-        }()
+        default:
+            return filter, fmt.Errorf("Неизвестный фильтр: %s", key)
+        }
     }
+    return filter, nil
 }
 
-// Функции проверки количества событий
-func checkUpcomingBirthdaysCount(db *sql.DB) (int, error) {
-    // Сначала выведем отладочную информацию
-    debugQuery := `
-        SELECT
-            m.id,
-            m.name,
-            m.birthday,
-            CURRENT_DATE as today,
-            CURRENT_DATE + INTERVAL '3 days' as max_date,
-            EXTRACT(MONTH FROM m.birthday) as birth_month,
-            EXTRACT(DAY FROM m.birthday) as birth_day
-        FROM team_members m
-        WHERE m.id IN (13, 14)`
-
-    debugRows, err := db.Query(debugQuery)
+func sendJournalPage(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, filter JournalFilter, page int) {
+    entries, total, err := getJournalEntries(db, filter, journalPageSize, page*journalPageSize)
     if err != nil {
-        log.Printf("Debug query error: %v", err)
-    } else {
-        defer debugRows.Close()
-        log.Printf("Debug information for users:")
-        for debugRows.Next() {
-            var (
-                id int
-                name string
-                birthday time.Time
-                today, maxDate time.Time
-                birthMonth, birthDay int
-            )
-            if err := debugRows.Scan(&id, &name, &birthday, &today, &maxDate, &birthMonth, &birthDay); err != nil {
-                log.Printf("Error scanning debug row: %v", err)
-                continue
-            }
-            log.Printf("ID: %d, Name: %s, Birthday: %v, Today: %v, MaxDate: %v, Birth Month/Day: %d/%d",
-                id, name, birthday, today, maxDate, birthMonth, birthDay)
+        log.Printf("Error getting journal entries: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при поиске по журналу сообщений")
+        sendReply(bot, db, msg)
+        return
+    }
+    if total == 0 {
+        msg := tgbotapi.NewMessage(chatID, "Записей не найдено.\n\n"+journalUsage)
+        sendReply(bot, db, msg)
+        return
+    }
+
+    pages := (total + journalPageSize - 1) / journalPageSize
+    var sb strings.Builder
+    sb.WriteString(fmt.Sprintf("Журнал сообщений: найдено %d, страница %d из %d\n", total, page+1, pages))
+
+    var viewButtons []tgbotapi.InlineKeyboardButton
+    for _, entry := range entries {
+        sb.WriteString("\n" + formatJournalEntryLine(entry) + "\n")
+        viewButtons = append(viewButtons, tgbotapi.NewInlineKeyboardButtonData(
+            fmt.Sprintf("#%d", entry.ID), fmt.Sprintf("admin_journal_view_%d_%d", entry.ID, page)))
+    }
+
+    var rows [][]tgbotapi.InlineKeyboardButton
+    for i := 0; i < len(viewButtons); i += 5 {
+        end := i + 5
+        if end > len(viewButtons) {
+            end = len(viewButtons)
         }
+        rows = append(rows, viewButtons[i:end])
+    }
+    var nav []tgbotapi.InlineKeyboardButton
+    if page > 0 {
+        nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("« Prev", fmt.Sprintf("admin_journal_page_%d", page-1)))
+    }
+    if page+1 < pages {
+        nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Next »", fmt.Sprintf("admin_journal_page_%d", page+1)))
+    }
+    if len(nav) > 0 {
+        rows = append(rows, nav)
     }
 
-    // Теперь выполним основной запрос для подсчета
-    var count int
-    query := `
-        WITH date_range AS (
-            SELECT generate_series(
-                CURRENT_DATE,
-                CURRENT_DATE + INTERVAL '3 days',
-                INTERVAL '1 day'
-            )::date as check_date
-        )
-        SELECT COUNT(DISTINCT m.id)
-        FROM team_members m
-        CROSS JOIN date_range d
-        LEFT JOIN year_tasks yt ON
-            yt.team_member_id = m.id AND
-            yt.year = EXTRACT(YEAR FROM d.check_date)::integer
-        WHERE 
-            EXTRACT(MONTH FROM m.birthday) = EXTRACT(MONTH FROM d.check_date)
-            AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM d.check_date)
-            AND yt.id IS NULL`
-
-    err = db.QueryRow(query).Scan(&count)
-    log.Printf("Found %d birthdays in range without tasks", count)
-    return count, err
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
 }
 
-func checkPendingActionsCount(db *sql.DB) (int, error) {
-    var count int
-    query := `
-        SELECT COUNT(*)
-        FROM year_tasks yt
-        LEFT JOIN actions a ON yt.id = a.task_id
-        WHERE a.id IS NULL
-        AND yt.is_members_notified = false`
-
-    err := db.QueryRow(query).Scan(&count)
-    return count, err
+func formatJournalRecipient(entry JournalEntry) string {
+    if entry.Record.ChatID == 0 {
+        return "получатель не указан"
+    }
+    if entry.RecipientName != "" {
+        return fmt.Sprintf("%s (%d)", entry.RecipientName, entry.Record.ChatID)
+    }
+    return strconv.FormatInt(entry.Record.ChatID, 10)
 }
 
-func checkPendingMemberNotificationsCount(db *sql.DB) (int, error) {
-    var count int
-    query := `
-        SELECT COUNT(*)
-        FROM year_tasks yt
-        WHERE yt.is_members_notified = false
-        AND EXISTS (
-            SELECT 1 FROM actions a
-            WHERE a.task_id = yt.id
-            AND a.type = 'request'
-            AND a.is_done = false
-        )`
+func formatJournalEntryLine(entry JournalEntry) string {
+    line := fmt.Sprintf("#%d %s %s → %s", entry.ID, entry.CreatedAt.In(time.Local).Format("02.01.2006 15:04"),
+        entry.Record.Type, formatJournalRecipient(entry))
+    if entry.ActionID.Valid {
+        line += fmt.Sprintf(", действие %d", entry.ActionID.Int64)
+    }
+    if entry.Interactions > 0 {
+        line += fmt.Sprintf(", нажатий: %d", entry.Interactions)
+    }
+    if entry.Record.Status == "failed" {
+        line += ", не доставлено: " + formatJournalError(entry.Record)
+    }
+    if entry.Record.Text != "" {
+        line += "\n" + truncateMessage(strings.ReplaceAll(entry.Record.Text, "\n", " "), 80)
+    }
+    return line
+}
 
-    err := db.QueryRow(query).Scan(&count)
-    return count, err
+var callbackOutcomeTitles = map[string]string{
+    "ok":      "выполнено",
+    "error":   "ошибка",
+    "denied":  "нет прав",
+    "handled": "обработано",
+    "ignored": "не обработано",
+    "unknown": "итог неизвестен",
 }
 
-func checkPendingTeamLeadNotificationsCount(db *sql.DB) (int, error) {
-    var count int
-    query := `
-        SELECT COUNT(*)
-        FROM year_tasks yt
-        WHERE yt.is_teamlead_notified = false
-        AND EXISTS (
-            SELECT 1 FROM actions a
-            WHERE a.task_id = yt.id
-            AND a.type = 'request'
-            AND a.is_done = true
-        )`
+var messageEditReasonTitles = map[string]string{
+    "phone_change":     "изменен телефон для переводов",
+    "member_change":    "изменены данные участника",
+    "collector_change": "сменился получатель переводов",
+    "cancelled":        "сбор отменен",
+}
 
-    err := db.QueryRow(query).Scan(&count)
-    return count, err
+func formatMessageEdit(edit MessageEdit) string {
+    reason := messageEditReasonTitles[edit.Reason]
+    if reason == "" {
+        reason = edit.Reason
+    }
+    line := fmt.Sprintf("%s %s", edit.EditedAt.In(time.Local).Format("02.01.2006 15:04"), reason)
+    if edit.Closed {
+        line += ", кнопки убраны"
+    }
+    if edit.Status == "failed" {
+        line += " — не удалось: " + edit.Error
+    }
+    return line
 }
 
-func checkTodayBirthdaysCount(db *sql.DB) (int, error) {
-    var count int
-    query := `
-        SELECT COUNT(*)
-        FROM team_members
-        WHERE EXTRACT(MONTH FROM birthday) = EXTRACT(MONTH FROM CURRENT_DATE)
-        AND EXTRACT(DAY FROM birthday) = EXTRACT(DAY FROM CURRENT_DATE)`
+func formatCallbackInteraction(interaction CallbackInteraction) string {
+    who := strconv.FormatInt(interaction.FromChatID, 10)
+    if interaction.FromChatID == 0 {
+        who = "нажавший неизвестен"
+    } else if interaction.FromName != "" {
+        who = fmt.Sprintf("%s (%d)", interaction.FromName, interaction.FromChatID)
+    }
+    if interaction.Username != "" {
+        who += " @" + interaction.Username
+    }
 
-    err := db.QueryRow(query).Scan(&count)
-    return count, err
+    outcome := callbackOutcomeTitles[interaction.Outcome]
+    if outcome == "" {
+        outcome = interaction.Outcome
+    }
+    if interaction.Error != "" {
+        outcome += ": " + interaction.Error
+    }
+    return fmt.Sprintf("%s %s: %s → %s", interaction.PressedAt.In(time.Local).Format("02.01.2006 15:04:05"),
+        who, interaction.Data, outcome)
 }
 
-func checkPendingPayoutRemindersCount(db *sql.DB) (int, error) {
-    var count int
-    query := `
-        SELECT COUNT(DISTINCT yt.id)
-        FROM year_tasks yt
-        JOIN actions a ON a.task_id = yt.id
-        WHERE yt.is_money_transfered = false
-        AND a.type = 'payout'
-        AND a.is_done = false
-        AND yt.is_teamlead_notified = true`
-
-    err := db.QueryRow(query).Scan(&count)
-    if err != nil {
-        log.Printf("Error in checkPendingPayoutRemindersCount: %v", err)
-        return 0, err
+func formatJournalError(record JournalRecord) string {
+    if record.ErrorCode != 0 {
+        return fmt.Sprintf("%d %s", record.ErrorCode, record.Error)
     }
-    log.Printf("Found %d pending payout reminders", count)
-    return count, nil
+    return record.Error
 }
 
-func sendPayoutRemindersOnce(db *sql.DB, bot *tgbotapi.BotAPI) error {
-    query := `
-        SELECT
-            a.id as action_id,
-            tl.telegram_chat_id as teamlead_chat_id,
-            bm.name as birthday_person_name,
-            bm.phone_number as birthday_person_phone,
-            yt.id as task_id
-        FROM actions a
-        JOIN year_tasks yt ON a.task_id = yt.id
-        JOIN team_members bm ON yt.team_member_id = bm.id
-        JOIN team_members tl ON a.team_member_id = tl.id
-        WHERE a.type = 'payout'
-        AND a.is_done = false
-        AND yt.is_money_transfered = false`
+const timelineLimit = 30
 
-    rows, err := db.Query(query)
+// Обрабатывает /timeline <chat ID>: последние сообщения бота пользователю и его ответы по порядку
+func handleTimelineCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    targetChatID, err := strconv.ParseInt(strings.TrimSpace(message.CommandArguments()), 10, 64)
     if err != nil {
-        return fmt.Errorf("error querying payout reminders: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Использование: /timeline <chat ID>")
+        sendReply(bot, db, msg)
+        return
     }
-    defer rows.Close()
 
-    for rows.Next() {
-        var (
-            actionID           int
-            teamleadChatID     int64
-            birthdayPersonName string
-            birthdayPersonPhone string
-            taskID             int
-        )
+    entries, total, err := getJournalEntries(db, JournalFilter{ChatID: targetChatID}, timelineLimit, 0)
+    if err != nil {
+        log.Printf("Error getting timeline of %d: %v", targetChatID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении истории переписки")
+        sendReply(bot, db, msg)
+        return
+    }
+    if total == 0 {
+        msg := tgbotapi.NewMessage(chatID, "В журнале нет сообщений с этим пользователем.")
+        sendReply(bot, db, msg)
+        return
+    }
 
-        err := rows.Scan(&actionID, &teamleadChatID, &birthdayPersonName, &birthdayPersonPhone, &taskID)
-        if err != nil {
-            log.Printf("Error scanning payout reminder data: %v", err)
-            continue
-        }
+    var sb strings.Builder
+    sb.WriteString(fmt.Sprintf("Переписка с %s: последние %d из %d\n→ сообщение бота, ← сообщение пользователя\n",
+        formatJournalRecipient(entries[0]), len(entries), total))
 
-        // Создаем сообщение с кнопкой
-        keyboard := tgbotapi.NewInlineKeyboardMarkup(
-            tgbotapi.NewInlineKeyboardRow(
-                tgbotapi.NewInlineKeyboardButtonData("Готово, перевел", fmt.Sprintf("payout_done_%d_%d", actionID, taskID)),
-            ),
-        )
+    // Записи приходят новыми первыми, выводим по порядку
+    for i := len(entries) - 1; i >= 0; i-- {
+        sb.WriteString("\n" + formatTimelineLine(entries[i]))
+    }
 
-        messageText := fmt.Sprintf("Напоминание: необходимо перевести деньги %s (тел: %s)", 
-            birthdayPersonName, birthdayPersonPhone)
-        msg := tgbotapi.NewMessage(teamleadChatID, messageText)
-        msg.ReplyMarkup = keyboard
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    sendReply(bot, db, msg)
+}
 
-        // Отправляем сообщение
-        sentMessage, err := bot.Send(msg)
-        if err != nil {
-            log.Printf("Error sending payout reminder to teamlead %d: %v", teamleadChatID, err)
-            continue
+func formatTimelineLine(entry JournalEntry) string {
+    record := entry.Record
+    when := entry.CreatedAt.In(time.Local).Format("02.01 15:04")
+
+    var line string
+    switch payload := record.Payload.(type) {
+    case *InboundCallbackRecord:
+        line = fmt.Sprintf("%s ← кнопка %s", when, payload.Data)
+    case *InboundMessageRecord:
+        line = fmt.Sprintf("%s ← %s", when, truncateMessage(strings.ReplaceAll(record.Text, "\n", " "), 80))
+    default:
+        line = fmt.Sprintf("%s → #%d %s", when, entry.ID, record.Type)
+        if record.Status == "failed" {
+            line += " ❌ " + formatJournalError(record)
         }
-        
-        if err := createPayoutReminderJournal(db, sentMessage, messageText, keyboard, birthdayPersonName, birthdayPersonPhone, actionID); err != nil {
-            log.Printf("Error logging message to journal: %v", err)
+        if record.Text != "" {
+            line += ": " + truncateMessage(strings.ReplaceAll(record.Text, "\n", " "), 60)
         }
     }
+    return line
+}
 
-    if err = rows.Err(); err != nil {
-        return fmt.Errorf("error iterating over payout reminders: %v", err)
+// Сведения из данных записи журнала для карточки записи
+func formatJournalPayload(payload JournalPayload) []string {
+    person := func(p JournalPerson) string {
+        text := p.Name
+        if p.Team != "" {
+            text += " (" + p.Team + ")"
+        }
+        if p.Phone != "" {
+            text += ", " + p.Phone
+        }
+        return text
+    }
+    collection := func(c *JournalCollection) string {
+        return fmt.Sprintf("Сбор: %s до %s", c.Title, c.Deadline)
     }
 
-    return nil
+    var lines []string
+    switch p := payload.(type) {
+    case *MemberNotificationRecord:
+        lines = append(lines, "Именинник: "+person(p.BirthdayPerson), "Получатель переводов: "+person(p.Collector))
+        if p.Collection != nil {
+            lines = append(lines, collection(p.Collection))
+        }
+    case *TeamLeadNotificationRecord:
+        lines = append(lines, "Именинник: "+person(p.BirthdayPerson), fmt.Sprintf("Задача: %d", p.TaskID))
+        if p.Collection != nil {
+            lines = append(lines, collection(p.Collection))
+        }
+    case *BirthdayWishRecord:
+        lines = append(lines, "Именинник: "+person(p.BirthdayPerson))
+    case *AnniversaryWishRecord:
+        lines = append(lines, fmt.Sprintf("Годовщина: %s, %s", person(p.Member), formatYears(p.Years)))
+    case *PayoutReminderRecord:
+        lines = append(lines, "Получатель подарка: "+person(p.BirthdayPerson))
+    case *HandoverNotificationRecord:
+        lines = append(lines, fmt.Sprintf("Отсутствие: %d, задачи: %v", p.AbsenceID, p.TaskIDs))
+    case *PhoneNoticeRecord:
+        lines = append(lines, fmt.Sprintf("Участник: %d", p.MemberID))
+    case *BroadcastRecord:
+        lines = append(lines, fmt.Sprintf("Рассылка: %d", p.BroadcastID))
+    case *InboundMessageRecord:
+        lines = append(lines, fmt.Sprintf("От: %d @%s", p.FromID, p.Username))
+        if p.Command != "" {
+            lines = append(lines, "Команда: /"+p.Command)
+        }
+    case *InboundCallbackRecord:
+        lines = append(lines, fmt.Sprintf("От: %d @%s", p.FromID, p.Username), "Кнопка: "+p.Data)
+        if p.SourceMessageID != 0 {
+            lines = append(lines, fmt.Sprintf("Сообщение с кнопкой: %d", p.SourceMessageID))
+        }
+    }
+    return lines
 }
 
-func handleTeamSelection(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
-        userID := callback.From.ID
-        state, exists := userStates[userID]
-        if !exists || state.Stage != "awaiting_team" {
-                return
-        }
+// Полная запись журнала: admin_journal_view_<id>_<страница>, admin_journal_page_<страница>,
+// повторная отправка: admin_journal_resend_<id>_<страница>
+func handleJournalCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+    data := callback.Data
 
-        // Извлекаем ID команды из callback data
-        parts := strings.Split(callback.Data, "_")
-        if len(parts) != 2 {
-                return
+    if strings.HasPrefix(data, "admin_journal_resend_") {
+        handleJournalResend(bot, db, callback)
+        return
+    }
+
+    if strings.HasPrefix(data, "admin_journal_page_") {
+        page, err := strconv.Atoi(strings.TrimPrefix(data, "admin_journal_page_"))
+        if err != nil || page < 0 {
+            return
+        }
+        filter, exists := journalSearches[callback.From.ID]
+        if !exists {
+            msg := tgbotapi.NewMessage(chatID, "Поиск не найден. Повторите /journal.")
+            sendReply(bot, db, msg)
+            return
         }
+        sendJournalPage(bot, db, chatID, filter, page)
+        return
+    }
 
-        teamID, err := strconv.Atoi(parts[1])
-        if err != nil {
-                return
+    parts := strings.Split(strings.TrimPrefix(data, "admin_journal_view_"), "_")
+    if len(parts) != 2 {
+        return
+    }
+    entryID, err := strconv.Atoi(parts[0])
+    if err != nil {
+        return
+    }
+    page, err := strconv.Atoi(parts[1])
+    if err != nil {
+        return
+    }
+
+    entry, err := getJournalEntry(db, entryID)
+    if err != nil {
+        log.Printf("Error getting journal entry %d: %v", entryID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении записи журнала")
+        sendReply(bot, db, msg)
+        return
+    }
+    if entry == nil {
+        msg := tgbotapi.NewMessage(chatID, "Запись журнала не найдена.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var sb strings.Builder
+    sb.WriteString(fmt.Sprintf("Запись журнала #%d\nТип: %s\nПолучатель: %s\n", entry.ID, entry.Record.Type, formatJournalRecipient(*entry)))
+    sb.WriteString(fmt.Sprintf("Создана: %s\nИзменена: %s\n",
+        entry.CreatedAt.In(time.Local).Format("02.01.2006 15:04:05"), entry.UpdatedAt.In(time.Local).Format("02.01.2006 15:04:05")))
+    if entry.ActionID.Valid {
+        sb.WriteString(fmt.Sprintf("Действие: %d\n", entry.ActionID.Int64))
+    }
+    if entry.Record.ResendOf != 0 {
+        sb.WriteString(fmt.Sprintf("Повторная отправка записи #%d\n", entry.Record.ResendOf))
+    }
+    if entry.Record.Status == "failed" {
+        sb.WriteString("Не доставлено: " + formatJournalError(entry.Record) + "\n")
+    }
+    for _, line := range formatJournalPayload(entry.Record.Payload) {
+        sb.WriteString(line + "\n")
+    }
+
+    interactions, err := getCallbackInteractions(db, entry.ID)
+    if err != nil {
+        log.Printf("Error getting callback interactions of journal entry %d: %v", entry.ID, err)
+    }
+    if len(interactions) == 0 {
+        sb.WriteString("\nКнопки не нажимались\n")
+    } else {
+        sb.WriteString("\nНажатия кнопок:\n")
+        for _, interaction := range interactions {
+            sb.WriteString(formatCallbackInteraction(interaction) + "\n")
         }
+    }
 
-        // Добавляем пользователя в базу данных
-        err = addBirthday(db, state.Name, state.Birthday, state.PhoneNumber, teamID, callback.Message.Chat.ID)
-        if err != nil {
-                log.Printf("Error adding birthday: %v", err)
-                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при сохранении данных")
-                bot.Send(msg)
-                return
+    edits, err := getMessageEdits(db, entry.ID)
+    if err != nil {
+        log.Printf("Error getting edits of journal entry %d: %v", entry.ID, err)
+    }
+    if len(edits) > 0 {
+        sb.WriteString("\nПравки сообщения:\n")
+        for _, edit := range edits {
+            sb.WriteString(formatMessageEdit(edit) + "\n")
         }
+    }
 
-        // Отправляем подтверждение
-        msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Спасибо, данные приняты!")
-        bot.Send(msg)
+    var pretty bytes.Buffer
+    if err := json.Indent(&pretty, entry.Message, "", "  "); err != nil {
+        pretty.Write(entry.Message)
+    }
+    sb.WriteString("\n" + pretty.String())
 
-        // Удаляем клавиатуру
-        edit := tgbotapi.NewEditMessageReplyMarkup(
-                callback.Message.Chat.ID,
-                callback.Message.MessageID,
-                tgbotapi.InlineKeyboardMarkup{})
-        bot.Send(edit)
+    row := tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("Back", fmt.Sprintf("admin_journal_page_%d", page)),
+    )
+    if entry.ActionID.Valid && isActionMessageType(entry.Record.Type) {
+        row = append(row, tgbotapi.NewInlineKeyboardButtonData("Resend", fmt.Sprintf("admin_journal_resend_%d_%d", entry.ID, page)))
+    }
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(row)
+    sendReply(bot, db, msg)
+}
 
-        // Очищаем состояние пользователя
-        delete(userStates, userID)
+// Сообщения по действиям, которые можно собрать заново по текущим данным: их можно
+// отправить повторно и обновить после изменения данных
+func isActionMessageType(journalType string) bool {
+    return journalType == "member_notification" || journalType == "payout_reminder"
 }
 
-func checkUpcomingBirthdaysOnce(db *sql.DB) (int, error) {
-    // Проверяем дни рождения через 3 дня
-    query := `
-        WITH date_range AS (
-            SELECT generate_series(
-                CURRENT_DATE,
-                CURRENT_DATE + INTERVAL '3 days',
-                INTERVAL '1 day'
-            )::date as check_date
-        )
-        SELECT DISTINCT
-            m.id,
-            m.name,
-            m.birthday,
-            d.check_date,
-            EXTRACT(MONTH FROM m.birthday) as birth_month,
-            EXTRACT(DAY FROM m.birthday) as birth_day,
-            EXTRACT(MONTH FROM d.check_date) as check_month,
-            EXTRACT(DAY FROM d.check_date) as check_day,
-            yt.id as task_id
-        FROM team_members m
-        CROSS JOIN date_range d
-        LEFT JOIN year_tasks yt ON
-            yt.team_member_id = m.id AND
-            yt.year = EXTRACT(YEAR FROM d.check_date)::integer
-        WHERE m.id IN (13, 14)  -- Временно добавим фильтр для отладки
-        ORDER BY m.id, d.check_date`
+// Отправляет сообщение записи журнала заново: текст и кнопки собираются по текущим данным
+// (телефон и получатель переводов, chat ID участника), новая запись журнала привязывается к тому же действию
+func handleJournalResend(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
 
-    // Сначала выведем отладочную информацию
-    debugRows, err := db.Query(query)
+    parts := strings.Split(strings.TrimPrefix(callback.Data, "admin_journal_resend_"), "_")
+    if len(parts) != 2 {
+        return
+    }
+    entryID, err := strconv.Atoi(parts[0])
     if err != nil {
-        return 0, fmt.Errorf("error in debug query: %v", err)
+        return
     }
-    defer debugRows.Close()
 
-    log.Printf("Debug information for birthday checks:")
-    for debugRows.Next() {
-        var (
-            id int
-            name string
-            birthday time.Time
-            checkDate time.Time
-            birthMonth, birthDay, checkMonth, checkDay int
-            taskID sql.NullInt64
-        )
-        if err := debugRows.Scan(&id, &name, &birthday, &checkDate, &birthMonth, &birthDay, &checkMonth, &checkDay, &taskID); err != nil {
-            log.Printf("Error scanning debug row: %v", err)
-            continue
+    entry, err := getJournalEntry(db, entryID)
+    if err != nil {
+        log.Printf("Error getting journal entry %d: %v", entryID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении записи журнала")
+        sendReply(bot, db, msg)
+        return
+    }
+    if entry == nil || !entry.ActionID.Valid || !isActionMessageType(entry.Record.Type) {
+        msg := tgbotapi.NewMessage(chatID, "Эту запись журнала нельзя отправить повторно.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    item, err := renderActionMessage(db, int(entry.ActionID.Int64))
+    if err != nil {
+        log.Printf("Error rendering message of action %d: %v", entry.ActionID.Int64, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при подготовке сообщения")
+        sendReply(bot, db, msg)
+        return
+    }
+    if item == nil {
+        msg := tgbotapi.NewMessage(chatID, "Сообщение больше не актуально: действие выполнено или сбор отменен.")
+        sendReply(bot, db, msg)
+        return
+    }
+    if item.ChatID == 0 {
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%s не зарегистрирован в боте, отправить некому.", item.Name))
+        sendReply(bot, db, msg)
+        return
+    }
+
+    item.Journal.ResendOf = entry.ID
+    deliverJobItem(bot, db, item)
+
+    text := fmt.Sprintf("Сообщение записи #%d отправлено повторно: %s.", entry.ID, item.Name)
+    if item.Status == "failed" {
+        text = fmt.Sprintf("Не удалось отправить сообщение записи #%d (%s): %s", entry.ID, item.Name, item.Reason)
+    }
+    msg := tgbotapi.NewMessage(chatID, text)
+    sendReply(bot, db, msg)
+}
+
+// Обрабатывает /stats: показатели сборов по командам за квартал в сравнении с предыдущим.
+// "/stats" — текущий квартал, "/stats 2026-Q3" — указанный
+func handleStatsCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    from := quarterStart(time.Now())
+    if arg := strings.TrimSpace(message.CommandArguments()); arg != "" {
+        var ok bool
+        from, ok = parseQuarter(arg)
+        if !ok {
+            msg := tgbotapi.NewMessage(chatID, "Использование: /stats [ГГГГ-QN], например /stats 2026-Q3")
+            sendReply(bot, db, msg)
+            return
         }
-        log.Printf("ID: %d, Name: %s, Birthday: %v, Check Date: %v, Birth Month/Day: %d/%d, Check Month/Day: %d/%d, Task ID: %v",
-            id, name, birthday, checkDate, birthMonth, birthDay, checkMonth, checkDay, taskID.Int64)
     }
+    to := from.AddDate(0, 3, 0)
+    prevFrom := from.AddDate(0, -3, 0)
 
-    // Теперь выполним основной запрос для создания задач
-    query = `
-        WITH date_range AS (
-            SELECT generate_series(
-                CURRENT_DATE,
-                CURRENT_DATE + INTERVAL '3 days',
-                INTERVAL '1 day'
-            )::date as check_date
-        )
-        SELECT DISTINCT
-            m.id
-        FROM team_members m
-        CROSS JOIN date_range d
-        LEFT JOIN year_tasks yt ON
-            yt.team_member_id = m.id AND
-            yt.year = EXTRACT(YEAR FROM d.check_date)::integer
-        WHERE 
-            EXTRACT(MONTH FROM m.birthday) = EXTRACT(MONTH FROM d.check_date)
-            AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM d.check_date)
-            AND yt.id IS NULL`
+    current, err := getCollectionStats(db, from, to)
+    if err != nil {
+        log.Printf("Error getting collection stats: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при расчете статистики")
+        sendReply(bot, db, msg)
+        return
+    }
+    previous, err := getCollectionStats(db, prevFrom, from)
+    if err != nil {
+        log.Printf("Error getting collection stats: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при расчете статистики")
+        sendReply(bot, db, msg)
+        return
+    }
 
-    rows, err := db.Query(query)
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(formatCollectionStats(current, previous, from, to, prevFrom), 4000))
+    sendReply(bot, db, msg)
+}
+
+func quarterStart(t time.Time) time.Time {
+    month := time.Month((int(t.Month())-1)/3*3 + 1)
+    return time.Date(t.Year(), month, 1, 0, 0, 0, 0, time.Local)
+}
+
+// Разбирает квартал в виде 2026-Q3 или 2026Q3
+func parseQuarter(text string) (time.Time, bool) {
+    text = strings.ToUpper(strings.ReplaceAll(text, "-", ""))
+    var year, quarter int
+    if n, err := fmt.Sscanf(text, "%dQ%d", &year, &quarter); err != nil || n != 2 {
+        return time.Time{}, false
+    }
+    if quarter < 1 || quarter > 4 || year < 2000 || year > 2100 {
+        return time.Time{}, false
+    }
+    return time.Date(year, time.Month((quarter-1)*3+1), 1, 0, 0, 0, 0, time.Local), true
+}
+
+func formatQuarter(from time.Time) string {
+    return fmt.Sprintf("%d кв. %d", (int(from.Month())-1)/3+1, from.Year())
+}
+
+func formatCollectionStats(current, previous []CollectionStats, from, to, prevFrom time.Time) string {
+    var sb strings.Builder
+    sb.WriteString(fmt.Sprintf("Статистика сборов за %s (%s–%s), сравнение с %s\n",
+        formatQuarter(from), from.Format("02.01.2006"), to.AddDate(0, 0, -1).Format("02.01.2006"), formatQuarter(prevFrom)))
+
+    // Без данных запрос возвращает только итоговую строку
+    if len(current) <= 1 {
+        sb.WriteString("\nЗа период нет сборов.")
+        return sb.String()
+    }
+
+    previousByTeam := make(map[int]CollectionStats)
+    for _, stats := range previous {
+        previousByTeam[stats.TeamID] = stats
+    }
+
+    for _, stats := range current {
+        prev, hasPrev := previousByTeam[stats.TeamID]
+        name := stats.TeamName
+        if stats.TeamID == 0 {
+            name = "Все команды"
+        }
+        sb.WriteString("\n" + name + "\n")
+
+        line := fmt.Sprintf("Праздников: %d", stats.Celebrations)
+        if hasPrev {
+            line += fmt.Sprintf(" (было %d, %+d)", prev.Celebrations, stats.Celebrations-prev.Celebrations)
+        }
+        sb.WriteString(line + "\n")
+
+        if stats.Requests > 0 {
+            rate := participationRate(stats)
+            line = fmt.Sprintf("Участие: %.0f%% (%d из %d)", rate, stats.DoneRequests, stats.Requests)
+            if hasPrev && prev.Requests > 0 {
+                line += fmt.Sprintf(", было %.0f%%, %+.0f п.п.", participationRate(prev), rate-participationRate(prev))
+            }
+            sb.WriteString(line + "\n")
+        } else {
+            sb.WriteString("Участие: нет запросов\n")
+        }
+
+        if stats.AvgHoursToDone.Valid {
+            line = fmt.Sprintf("Среднее время от запроса до перевода: %.1f ч", stats.AvgHoursToDone.Float64)
+            if hasPrev && prev.AvgHoursToDone.Valid {
+                line += fmt.Sprintf(" (было %.1f ч)", prev.AvgHoursToDone.Float64)
+            }
+            sb.WriteString(line + "\n")
+        }
+
+        if stats.MedianPayoutDays.Valid {
+            line = fmt.Sprintf("Медиана дней до выплаты: %.1f", stats.MedianPayoutDays.Float64)
+            if hasPrev && prev.MedianPayoutDays.Valid {
+                line += fmt.Sprintf(" (было %.1f)", prev.MedianPayoutDays.Float64)
+            }
+            sb.WriteString(line + "\n")
+        }
+    }
+    return sb.String()
+}
+
+func participationRate(stats CollectionStats) float64 {
+    if stats.Requests == 0 {
+        return 0
+    }
+    return float64(stats.DoneRequests) * 100 / float64(stats.Requests)
+}
+
+const collectionMaxTitle = 100
+
+// Обрабатывает /collect: открытые произвольные сборы и создание нового.
+// Тимлид видит сборы своих команд и созданные им, администратор — все
+func handleCollectCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message, roles RoleSet) {
+    sendCustomCollections(bot, db, message.Chat.ID, message.From.ID, roles)
+}
+
+func sendCustomCollections(bot *tgbotapi.BotAPI, db *sql.DB, chatID, userID int64, roles RoleSet) {
+    collections, err := getCustomCollections(db, userID, roles[RoleAdmin])
     if err != nil {
-        return 0, fmt.Errorf("error checking upcoming birthdays: %v", err)
+        log.Printf("Error getting custom collections: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка сборов")
+        sendReply(bot, db, msg)
+        return
     }
-    defer rows.Close()
 
-    tasksCreated := 0
-    currentYear := time.Now().Year()
-    for rows.Next() {
-        var memberID int
-        if err := rows.Scan(&memberID); err != nil {
-            log.Printf("Error scanning member ID: %v", err)
-            continue
+    var sb strings.Builder
+    var rows [][]tgbotapi.InlineKeyboardButton
+    if len(collections) == 0 {
+        sb.WriteString("Открытых сборов нет.")
+    } else {
+        sb.WriteString("Открытые сборы:\n")
+        for _, c := range collections {
+            sb.WriteString(fmt.Sprintf("\n#%d «%s» для %s до %s — переводов %d из %d",
+                c.TaskID, c.Title, c.BeneficiaryName, c.Deadline.Format("02.01.2006"), c.RequestsDone, c.RequestsAll))
+            rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("#%d %s", c.TaskID, c.Title), fmt.Sprintf("collect_view_%d", c.TaskID)),
+            ))
         }
+    }
+    rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("Новый сбор", "collect_new"),
+    ))
 
-        // Создаем новую задачу для дня рождения
-        result, err := db.Exec(`
-            INSERT INTO year_tasks (year, team_member_id)
-            VALUES ($1, $2)`,
-            currentYear, memberID)
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+func formatCustomCollection(c *CustomCollection) string {
+    scope := "вся компания"
+    if c.ScopeTeamID.Valid {
+        scope = "команда " + c.ScopeTeamName.String
+    }
+    amount := "не указана"
+    if c.Amount.Valid {
+        amount = formatAmount(c.Amount.Float64) + " ₽"
+    }
+    collector := "не назначен"
+    if c.CollectorName.Valid {
+        collector = c.CollectorName.String
+    }
+    return fmt.Sprintf("Сбор #%d «%s»\nДля: %s\nСрок: %s\nУчастники: %s\nРекомендуемая сумма: %s\n"+
+        "Получатель переводов: %s\nПереводов: %d из %d",
+        c.TaskID, c.Title, c.BeneficiaryName, c.Deadline.Format("02.01.2006"), scope, amount,
+        collector, c.RequestsDone, c.RequestsAll)
+}
+
+// Тимлид управляет сборами своих команд и созданными им, администратор — всеми
+func canManageCollection(db *sql.DB, c *CustomCollection, userID int64, roles RoleSet) (bool, error) {
+    if roles[RoleAdmin] || (c.CreatedByChatID.Valid && c.CreatedByChatID.Int64 == userID) {
+        return true, nil
+    }
+    teamIDs, err := getTeamIDsByTeamLeadChatID(db, userID)
+    if err != nil {
+        return false, err
+    }
+    teamID := c.BeneficiaryTeamID
+    if c.ScopeTeamID.Valid {
+        teamID = int(c.ScopeTeamID.Int64)
+    }
+    for _, id := range teamIDs {
+        if id == teamID {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// Callback произвольных сборов: collect_new, collect_benef_<member_id>, collect_scope_<team_id|0>,
+// collect_create, collect_abort, collect_view_<task_id>, collect_cancel_<task_id>, collect_cancel_confirm_<task_id>
+func handleCollectCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery, roles RoleSet) {
+    chatID := callback.Message.Chat.ID
+    userID := callback.From.ID
+    data := callback.Data
+
+    lastID := func() int {
+        id, _ := strconv.Atoi(data[strings.LastIndex(data, "_")+1:])
+        return id
+    }
+
+    switch {
+    case data == "collect_new":
+        userStates[userID] = &UserState{Stage: "awaiting_collection_title"}
+        msg := tgbotapi.NewMessage(chatID, "Введите название сбора, например «Свадьба»:")
+        sendReply(bot, db, msg)
+
+    case data == "collect_abort":
+        delete(userStates, userID)
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+        msg := tgbotapi.NewMessage(chatID, "Создание сбора отменено.")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "collect_benef_"):
+        state, exists := userStates[userID]
+        if !exists || state.Stage != "awaiting_collection_beneficiary" {
+            return
+        }
+        member, err := getMemberRecord(db, lastID())
+        if err != nil || member == nil || !member.IsActive {
+            msg := tgbotapi.NewMessage(chatID, "Участник не найден. Введите имя еще раз:")
+            sendReply(bot, db, msg)
+            return
+        }
+        selectCollectionBeneficiary(bot, db, chatID, state, member)
+
+    case strings.HasPrefix(data, "collect_scope_"):
+        state, exists := userStates[userID]
+        if !exists || state.Stage != "awaiting_collection_scope" {
+            return
+        }
+        teamID := lastID()
+        allowed, err := collectionScopeAllowed(db, userID, roles, teamID)
         if err != nil {
-            log.Printf("Error creating year task: %v", err)
+            log.Printf("Error checking collection scope: %v", err)
+            return
+        }
+        if !allowed {
+            msg := tgbotapi.NewMessage(chatID, "Сбор можно создать только для своей команды.")
+            sendReply(bot, db, msg)
+            return
+        }
+        state.TeamID = teamID
+        state.Stage = "awaiting_collection_amount"
+        msg := tgbotapi.NewMessage(chatID, "Введите рекомендуемую сумму перевода в рублях или «-», чтобы не указывать ее:")
+        sendReply(bot, db, msg)
+
+    case data == "collect_create":
+        state, exists := userStates[userID]
+        if !exists || state.Stage != "awaiting_collection_confirm" {
+            return
+        }
+        delete(userStates, userID)
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+
+        taskID, err := createCustomCollection(db, collectionFromState(state), userID)
+        if err != nil {
+            log.Printf("Error creating custom collection: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при создании сбора")
+            sendReply(bot, db, msg)
+            return
+        }
+        collection, err := getCustomCollection(db, taskID)
+        if err != nil || collection == nil {
+            log.Printf("Error getting custom collection %d: %v", taskID, err)
+            return
+        }
+
+        text := "Сбор создан.\n\n" + formatCustomCollection(collection)
+        if !collection.CollectorName.Valid {
+            text += "\n\nПолучатель переводов не назначен: уведомления будут отправлены после его назначения."
+        }
+        sendReply(bot, db, tgbotapi.NewMessage(chatID, text))
+        go notifyCustomCollection(bot, db, chatID, taskID, roles[RoleAdmin])
+
+    case strings.HasPrefix(data, "collect_view_"), strings.HasPrefix(data, "collect_cancel_"):
+        collection, err := getCustomCollection(db, lastID())
+        if err != nil {
+            log.Printf("Error getting custom collection: %v", err)
+            return
+        }
+        if collection == nil {
+            msg := tgbotapi.NewMessage(chatID, "Сбор не найден или уже закрыт.")
+            sendReply(bot, db, msg)
+            return
+        }
+        allowed, err := canManageCollection(db, collection, userID, roles)
+        if err != nil {
+            log.Printf("Error checking collection access: %v", err)
+            return
+        }
+        if !allowed {
+            msg := tgbotapi.NewMessage(chatID, "Этот сбор относится к другой команде.")
+            sendReply(bot, db, msg)
+            return
+        }
+
+        switch {
+        case strings.HasPrefix(data, "collect_cancel_confirm_"):
+            cancelled, err := cancelCustomCollection(db, collection.TaskID, userID)
+            if err != nil {
+                log.Printf("Error cancelling custom collection %d: %v", collection.TaskID, err)
+                msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при отмене сбора")
+                sendReply(bot, db, msg)
+                return
+            }
+            edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+            sendReply(bot, db, edit)
+
+            closeCancelledTaskMessages(bot, db, cancelled)
+
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Сбор #%d «%s» отменен.", collection.TaskID, collection.Title))
+            sendReply(bot, db, msg)
+
+        case strings.HasPrefix(data, "collect_cancel_"):
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Отменить сбор #%d «%s»? Участники больше не получат напоминаний, "+
+                "кнопки в отправленных запросах будут убраны.", collection.TaskID, collection.Title))
+            msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+                tgbotapi.NewInlineKeyboardRow(
+                    tgbotapi.NewInlineKeyboardButtonData("Да, отменить", fmt.Sprintf("collect_cancel_confirm_%d", collection.TaskID)),
+                    tgbotapi.NewInlineKeyboardButtonData("Назад", fmt.Sprintf("collect_view_%d", collection.TaskID)),
+                ),
+            )
+            sendReply(bot, db, msg)
+
+        default:
+            msg := tgbotapi.NewMessage(chatID, formatCustomCollection(collection))
+            msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+                tgbotapi.NewInlineKeyboardRow(
+                    tgbotapi.NewInlineKeyboardButtonData("Отменить сбор", fmt.Sprintf("collect_cancel_%d", collection.TaskID)),
+                ),
+            )
+            sendReply(bot, db, msg)
+        }
+    }
+}
+
+// Этапы мастера создания сбора: название, получатель подарка, срок, участники, сумма, подтверждение
+func handleCollectionInput(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message, state *UserState) {
+    chatID := message.Chat.ID
+    text := strings.TrimSpace(message.Text)
+
+    switch state.Stage {
+    case "awaiting_collection_title":
+        if text == "" || len([]rune(text)) > collectionMaxTitle {
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Название должно содержать от 1 до %d символов. Попробуйте еще раз:", collectionMaxTitle))
+            sendReply(bot, db, msg)
+            return
+        }
+        state.CollectionTitle = text
+        state.Stage = "awaiting_collection_beneficiary"
+        msg := tgbotapi.NewMessage(chatID, "Для кого собираем? Введите имя или часть имени участника:")
+        sendReply(bot, db, msg)
+
+    case "awaiting_collection_beneficiary":
+        found, err := searchMembers(db, text, 10, 0)
+        if err != nil {
+            log.Printf("Error searching members: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при поиске участников")
+            sendReply(bot, db, msg)
+            return
+        }
+        var members []MemberRecord
+        for _, member := range found {
+            if member.IsActive {
+                members = append(members, member)
+            }
+        }
+
+        switch len(members) {
+        case 0:
+            msg := tgbotapi.NewMessage(chatID, "Активные участники не найдены. Попробуйте еще раз:")
+            sendReply(bot, db, msg)
+        case 1:
+            selectCollectionBeneficiary(bot, db, chatID, state, &members[0])
+        default:
+            var rows [][]tgbotapi.InlineKeyboardButton
+            for _, member := range members {
+                rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+                    tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s (%s)", member.Name, member.TeamName),
+                        fmt.Sprintf("collect_benef_%d", member.ID)),
+                ))
+            }
+            msg := tgbotapi.NewMessage(chatID, "Выберите участника:")
+            msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+            sendReply(bot, db, msg)
+        }
+
+    case "awaiting_collection_deadline":
+        now := time.Now()
+        today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+        deadline, err := time.ParseInLocation("02.01.2006", text, time.Local)
+        if err != nil || deadline.Before(today) || deadline.After(today.AddDate(1, 0, 0)) {
+            msg := tgbotapi.NewMessage(chatID, "Введите дату в формате ДД.ММ.ГГГГ, не раньше сегодняшней и не позже чем через год:")
+            sendReply(bot, db, msg)
+            return
+        }
+        state.CollectionDeadline = deadline
+        state.Stage = "awaiting_collection_scope"
+        sendCollectionScopeChoice(bot, db, chatID, message.From.ID)
+
+    case "awaiting_collection_amount":
+        var amount float64
+        if text != "-" {
+            value, err := strconv.ParseFloat(strings.ReplaceAll(text, ",", "."), 64)
+            if err != nil || value <= 0 || value > 1000000 {
+                msg := tgbotapi.NewMessage(chatID, "Введите сумму числом от 1 до 1000000 или «-», чтобы не указывать ее:")
+                sendReply(bot, db, msg)
+                return
+            }
+            amount = value
+        }
+        state.CollectionAmount = amount
+        state.Stage = "awaiting_collection_confirm"
+        sendCollectionPreview(bot, db, chatID, state)
+
+    default:
+        msg := tgbotapi.NewMessage(chatID, "Используйте кнопки выше, чтобы продолжить или отменить создание сбора.")
+        sendReply(bot, db, msg)
+    }
+}
+
+func selectCollectionBeneficiary(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, state *UserState, member *MemberRecord) {
+    state.MemberID = member.ID
+    state.Name = member.Name
+    state.Stage = "awaiting_collection_deadline"
+    msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Получатель подарка: %s (%s).\n"+
+        "До какого числа собираем? Введите дату в формате ДД.ММ.ГГГГ:", member.Name, member.TeamName))
+    sendReply(bot, db, msg)
+}
+
+// Администратор выбирает всю компанию или команду, тимлид — одну из своих команд
+func sendCollectionScopeChoice(bot *tgbotapi.BotAPI, db *sql.DB, chatID, userID int64) {
+    roles, err := getUserRoles(db, userID)
+    if err != nil {
+        log.Printf("Error getting roles of user %d: %v", userID, err)
+        return
+    }
+
+    var rows [][]tgbotapi.InlineKeyboardButton
+    if roles[RoleAdmin] {
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Вся компания", "collect_scope_0"),
+        ))
+    }
+    teams, err := getActiveTeams(db)
+    if err != nil {
+        log.Printf("Error getting teams: %v", err)
+        return
+    }
+    for _, team := range teams {
+        if allowed, err := collectionScopeAllowed(db, userID, roles, team.ID); err != nil || !allowed {
             continue
         }
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData(team.Name, fmt.Sprintf("collect_scope_%d", team.ID)),
+        ))
+    }
+    rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("Отмена", "collect_abort"),
+    ))
 
-        rowsAffected, _ := result.RowsAffected()
-        tasksCreated += int(rowsAffected)
+    msg := tgbotapi.NewMessage(chatID, "Кто участвует в сборе?")
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+// teamID 0 — вся компания, доступна только администраторам
+func collectionScopeAllowed(db *sql.DB, userID int64, roles RoleSet, teamID int) (bool, error) {
+    if roles[RoleAdmin] {
+        return true, nil
+    }
+    if teamID == 0 {
+        return false, nil
     }
+    teamIDs, err := getTeamIDsByTeamLeadChatID(db, userID)
+    if err != nil {
+        return false, err
+    }
+    for _, id := range teamIDs {
+        if id == teamID {
+            return true, nil
+        }
+    }
+    return false, nil
+}
 
-    if err = rows.Err(); err != nil {
-        return tasksCreated, fmt.Errorf("error iterating over members: %v", err)
+func collectionFromState(state *UserState) CustomCollection {
+    c := CustomCollection{
+        Title:           state.CollectionTitle,
+        BeneficiaryID:   state.MemberID,
+        BeneficiaryName: state.Name,
+        Deadline:        state.CollectionDeadline,
     }
+    if state.TeamID != 0 {
+        c.ScopeTeamID = sql.NullInt64{Int64: int64(state.TeamID), Valid: true}
+    }
+    if state.CollectionAmount > 0 {
+        c.Amount = sql.NullFloat64{Float64: state.CollectionAmount, Valid: true}
+    }
+    return c
+}
 
-    if tasksCreated == 0 {
-        return 0, fmt.Errorf("no new tasks created")
+func sendCollectionPreview(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, state *UserState) {
+    c := collectionFromState(state)
+    if c.ScopeTeamID.Valid {
+        team, err := getTeamInfo(db, state.TeamID)
+        if err != nil || team == nil {
+            log.Printf("Error getting team %d: %v", state.TeamID, err)
+            return
+        }
+        c.ScopeTeamName = sql.NullString{String: team.Name, Valid: true}
+    }
+    participants, err := countCollectionParticipants(db, c.BeneficiaryID, c.ScopeTeamID)
+    if err != nil {
+        log.Printf("Error counting collection participants: %v", err)
+        return
     }
 
-    return tasksCreated, nil
+    scope := "вся компания"
+    if c.ScopeTeamID.Valid {
+        scope = "команда " + c.ScopeTeamName.String
+    }
+    amount := "не указана"
+    if c.Amount.Valid {
+        amount = formatAmount(c.Amount.Float64) + " ₽"
+    }
+    msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Новый сбор «%s»\nДля: %s\nСрок: %s\nУчастники: %s (%d чел.)\n"+
+        "Рекомендуемая сумма: %s\n\nУчастники получат запрос на перевод сразу после создания. Создать сбор?",
+        c.Title, c.BeneficiaryName, c.Deadline.Format("02.01.2006"), scope, participants, amount))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Создать", "collect_create"),
+            tgbotapi.NewInlineKeyboardButtonData("Отмена", "collect_abort"),
+        ),
+    )
+    sendReply(bot, db, msg)
+}
+
+// Сразу рассылает запросы участникам и уведомления тимлидам по новому сбору и отчитывается создателю.
+// Администратор получает отчет с кнопкой повтора, тимлид — только итог
+func notifyCustomCollection(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, taskID int, isAdmin bool) {
+    memberReport, err := sendMemberNotifications(db, bot, taskID)
+    sendCollectionJobReport(bot, db, chatID, isAdmin, memberReport, err, "Произошла ошибка при отправке запросов участникам.")
+
+    teamLeadReport, err := sendTeamLeadNotifications(db, bot, taskID)
+    sendCollectionJobReport(bot, db, chatID, isAdmin, teamLeadReport, err, "Произошла ошибка при отправке уведомлений тимлидам.")
+}
+
+func sendCollectionJobReport(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, isAdmin bool, report *JobReport, err error, errorText string) {
+    if isAdmin {
+        sendJobReport(bot, db, chatID, report, err, errorText)
+        return
+    }
+    if err != nil {
+        log.Printf("Error running job: %v", err)
+    }
+    if report == nil {
+        sendReply(bot, db, tgbotapi.NewMessage(chatID, errorText))
+        return
+    }
+    logJobReport(report)
+
+    text := formatJobReport(jobTitles[report.Job], report)
+    if len(report.Items) == 0 {
+        text += "\n\nНет получателей для отправки."
+    }
+    sendReply(bot, db, tgbotapi.NewMessage(chatID, truncateMessage(text, 4000)))
+}
+
+// Обрабатывает /away: "/away ДД.ММ-ДД.ММ" начинает выбор заместителя,
+// без аргументов показывает текущие периоды отсутствия, "/away cancel" их отменяет
+func handleAwayCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    member, err := getTeamLeadMemberByChatID(db, chatID)
+    if err != nil {
+        log.Printf("Error checking team lead status: %v", err)
+        return
+    }
+    if member == nil {
+        msg := tgbotapi.NewMessage(chatID, "Эта команда доступна только для тимлидов.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    args := strings.TrimSpace(message.CommandArguments())
+    switch args {
+    case "":
+        absences, err := getTeamLeadAbsences(db, member.ID)
+        if err != nil {
+            log.Printf("Error getting absences: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении периодов отсутствия")
+            sendReply(bot, db, msg)
+            return
+        }
+        msg := tgbotapi.NewMessage(chatID, formatAbsencesMessage(absences)+
+            "\nИспользование: /away ДД.ММ-ДД.ММ\nОтменить: /away cancel")
+        sendReply(bot, db, msg)
+        return
+    case "cancel":
+        count, err := cancelTeamLeadAbsences(db, member.ID)
+        if err != nil {
+            log.Printf("Error cancelling absences: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при отмене периодов отсутствия")
+            sendReply(bot, db, msg)
+            return
+        }
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Отменено периодов отсутствия: %d. "+
+            "Уже переданные заместителю сборы остаются у него.", count))
+        sendReply(bot, db, msg)
+        return
+    }
+
+    dateFrom, dateTo, err := parseAwayPeriod(args, time.Now())
+    if err != nil {
+        msg := tgbotapi.NewMessage(chatID, "Неверный формат периода. Пожалуйста, используйте формат ДД.ММ-ДД.ММ, например /away 01.08-15.08")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    candidates, err := getDelegateCandidates(db, member.ID)
+    if err != nil {
+        log.Printf("Error getting delegate candidates: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка заместителей")
+        sendReply(bot, db, msg)
+        return
+    }
+    if len(candidates) == 0 {
+        msg := tgbotapi.NewMessage(chatID, "Нет участников, которые могут вас заменить.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    userStates[message.From.ID] = &UserState{
+        Stage:    "awaiting_away_delegate",
+        AwayFrom: dateFrom,
+        AwayTo:   dateTo,
+    }
+
+    var buttons [][]tgbotapi.InlineKeyboardButton
+    for _, candidate := range candidates {
+        button := tgbotapi.NewInlineKeyboardButtonData(candidate.Name, fmt.Sprintf("away_delegate_%d", candidate.ID))
+        buttons = append(buttons, []tgbotapi.InlineKeyboardButton{button})
+    }
+
+    msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Период отсутствия: %s - %s. Выберите заместителя:",
+        dateFrom.Format("02.01.2006"), dateTo.Format("02.01.2006")))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
+    sendReply(bot, db, msg)
+}
+
+func handleAwayDelegateSelection(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    userID := callback.From.ID
+    state, exists := userStates[userID]
+    if !exists || state.Stage != "awaiting_away_delegate" {
+        return
+    }
+
+    parts := strings.Split(callback.Data, "_")
+    if len(parts) != 3 {
+        return
+    }
+
+    delegateID, err := strconv.Atoi(parts[2])
+    if err != nil {
+        return
+    }
+
+    member, err := getTeamLeadMemberByChatID(db, callback.Message.Chat.ID)
+    if err != nil || member == nil {
+        log.Printf("Error checking team lead status: %v", err)
+        return
+    }
+
+    // Заместителем можно назначить только одного из предложенных кандидатов
+    candidates, err := getDelegateCandidates(db, member.ID)
+    if err != nil {
+        log.Printf("Error getting delegate candidates: %v", err)
+        return
+    }
+    isCandidate := false
+    for _, candidate := range candidates {
+        if candidate.ID == delegateID {
+            isCandidate = true
+            break
+        }
+    }
+    if !isCandidate {
+        log.Printf("User %d selected delegate %d outside of candidates", userID, delegateID)
+        msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Этого участника нельзя назначить заместителем. Выберите заместителя из списка.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    absenceID, taskIDs, reassignedIDs, err := addTeamLeadAbsence(db, member.ID, delegateID, state.AwayFrom, state.AwayTo, callback.Message.Chat.ID)
+    if err != nil {
+        log.Printf("Error adding absence: %v", err)
+        msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при сохранении периода отсутствия")
+        sendReply(bot, db, msg)
+        return
+    }
+    delete(userStates, userID)
+
+    // Удаляем клавиатуру
+    edit := tgbotapi.NewEditMessageReplyMarkup(
+        callback.Message.Chat.ID,
+        callback.Message.MessageID,
+        tgbotapi.InlineKeyboardMarkup{})
+    sendReply(bot, db, edit)
+
+    notifyHandover(bot, db, absenceID, member, delegateID, state.AwayFrom, state.AwayTo, taskIDs)
+
+    // В запросах на перевод теперь другой получатель, напоминания о выплате переходят заместителю
+    // или следующему кандидату, если заместитель сам именинник
+    for _, taskID := range append(taskIDs, reassignedIDs...) {
+        if _, err := refreshActionMessages(bot, db, taskID, 0, "collector_change"); err != nil {
+            log.Printf("Error refreshing messages of task %d: %v", taskID, err)
+        }
+    }
+}
+
+// Сообщает тимлиду и заместителю о передаче сборов
+func notifyHandover(bot *tgbotapi.BotAPI, db *sql.DB, absenceID int, member *TeamMember, delegateID int,
+    dateFrom, dateTo time.Time, taskIDs []int) {
+    var delegateName string
+    var delegateChatID sql.NullInt64
+    err := db.QueryRow("SELECT name, telegram_chat_id FROM team_members WHERE id = $1", delegateID).
+        Scan(&delegateName, &delegateChatID)
+    if err != nil {
+        log.Printf("Error getting delegate: %v", err)
+        return
+    }
+
+    var birthdayNames []string
+    for _, taskID := range taskIDs {
+        var name string
+        err := db.QueryRow(`
+            SELECT bm.name
+            FROM year_tasks yt
+            JOIN team_members bm ON yt.team_member_id = bm.id
+            WHERE yt.id = $1`, taskID).Scan(&name)
+        if err != nil {
+            log.Printf("Error getting task %d: %v", taskID, err)
+            continue
+        }
+        birthdayNames = append(birthdayNames, name)
+    }
+
+    period := fmt.Sprintf("%s - %s", dateFrom.Format("02.01.2006"), dateTo.Format("02.01.2006"))
+    handedOver := "Открытых сборов на этот период пока нет."
+    if len(birthdayNames) > 0 {
+        handedOver = "Переданы сборы: " + strings.Join(birthdayNames, ", ") + "."
+    }
+
+    leadText := fmt.Sprintf("Период отсутствия %s сохранен. Твой заместитель: %s. %s", period, delegateName, handedOver)
+    deliverJobItem(bot, db, &JobItem{
+        Kind:    "handover_notification",
+        ChatID:  member.TelegramChatID,
+        Name:    member.Name,
+        Text:    leadText,
+        Journal: handoverNotificationJournal(leadText, absenceID, taskIDs),
+    })
+
+    if !delegateChatID.Valid {
+        return
+    }
+    delegateText := fmt.Sprintf("Привет, %s! %s отсутствует в период %s и назначил тебя заместителем. "+
+        "На это время переводы на подарки и перевод подарков именинникам будут на тебе. %s",
+        delegateName, member.Name, period, handedOver)
+    deliverJobItem(bot, db, &JobItem{
+        Kind:    "handover_notification",
+        ChatID:  delegateChatID.Int64,
+        Name:    delegateName,
+        Text:    delegateText,
+        Journal: handoverNotificationJournal(delegateText, absenceID, taskIDs),
+    })
+}
+
+// Обрабатывает /myteam: сводка по команде тимлида, при нескольких командах — выбор команды
+func handleMyTeamCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    teamIDs, err := getTeamIDsByTeamLeadChatID(db, chatID)
+    if err != nil {
+        log.Printf("Error getting teamlead teams: %v", err)
+        return
+    }
+    if len(teamIDs) == 0 {
+        msg := tgbotapi.NewMessage(chatID, "Эта команда доступна только для тимлидов.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    if len(teamIDs) == 1 {
+        sendTeamDashboard(bot, db, chatID, teamIDs[0])
+        return
+    }
+
+    var buttons [][]tgbotapi.InlineKeyboardButton
+    for _, teamID := range teamIDs {
+        lead, err := getTeamLeadByTeamID(db, teamID)
+        if err != nil || lead == nil {
+            continue
+        }
+        button := tgbotapi.NewInlineKeyboardButtonData(lead.TeamName, fmt.Sprintf("myteam_team_%d", teamID))
+        buttons = append(buttons, []tgbotapi.InlineKeyboardButton{button})
+    }
+
+    msg := tgbotapi.NewMessage(chatID, "Выберите команду:")
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
+    sendReply(bot, db, msg)
+}
+
+func handleMyTeamCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+
+    // Формат: myteam_<team|roster|task|member>_<id>, для состава команды — myteam_roster_<id>_<страница>
+    parts := strings.Split(callback.Data, "_")
+    if len(parts) != 3 && !(len(parts) == 4 && parts[1] == "roster") {
+        return
+    }
+    id, err := strconv.Atoi(parts[2])
+    if err != nil {
+        return
+    }
+    page := 0
+    if len(parts) == 4 {
+        if page, err = strconv.Atoi(parts[3]); err != nil {
+            return
+        }
+    }
+
+    // Определяем команду, к которой относится запрошенный объект
+    var teamID int
+    switch parts[1] {
+    case "team", "roster":
+        teamID = id
+    case "task":
+        err = db.QueryRow(`
+            SELECT bm.team_id
+            FROM year_tasks yt
+            JOIN team_members bm ON yt.team_member_id = bm.id
+            WHERE yt.id = $1`, id).Scan(&teamID)
+    case "member":
+        err = db.QueryRow("SELECT team_id FROM team_members WHERE id = $1", id).Scan(&teamID)
+    default:
+        return
+    }
+    if err != nil {
+        log.Printf("Error resolving team for %s: %v", callback.Data, err)
+        return
+    }
+
+    teamIDs, err := getTeamIDsByTeamLeadChatID(db, chatID)
+    if err != nil {
+        log.Printf("Error getting teamlead teams: %v", err)
+        return
+    }
+    allowed := false
+    for _, leadTeamID := range teamIDs {
+        if leadTeamID == teamID {
+            allowed = true
+            break
+        }
+    }
+    if !allowed {
+        msg := tgbotapi.NewMessage(chatID, "Эта информация доступна только тимлиду команды.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    switch parts[1] {
+    case "team":
+        sendTeamDashboard(bot, db, chatID, id)
+    case "roster":
+        sendTeamRoster(bot, db, chatID, id, page)
+    case "task":
+        sendTaskProgress(bot, db, chatID, id)
+    case "member":
+        sendMemberActions(bot, db, chatID, id)
+    }
+}
+
+func sendTeamDashboard(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, teamID int) {
+    lead, err := getTeamLeadByTeamID(db, teamID)
+    if err != nil || lead == nil {
+        log.Printf("Error getting team lead for team %d: %v", teamID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении данных команды")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    members, err := getTeamMembers(db, teamID)
+    if err != nil {
+        log.Printf("Error getting team members: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении данных команды")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    birthdays, err := getUpcomingBirthdays(db)
+    if err != nil {
+        log.Printf("Error getting birthdays: %v", err)
+    }
+
+    anniversaries, err := getUpcomingAnniversaries(db)
+    if err != nil {
+        log.Printf("Error getting anniversaries: %v", err)
+    }
+
+    openTasks, err := getTeamOpenTasks(db, teamID)
+    if err != nil {
+        log.Printf("Error getting open tasks: %v", err)
+    }
+
+    overdue, err := getTeamOverduePayouts(db, teamID)
+    if err != nil {
+        log.Printf("Error getting overdue payouts: %v", err)
+    }
+
+    text := fmt.Sprintf("Команда: %s\nТимлид: %s\nУчастников: %d\n", lead.TeamName, lead.MemberName, len(members))
+
+    var withoutChat []string
+    for _, member := range members {
+        if member.TelegramChatID == 0 {
+            withoutChat = append(withoutChat, member.Name)
+        }
+    }
+    if len(withoutChat) > 0 {
+        text += fmt.Sprintf("\nНе зарегистрированы в боте (%d): %s\n", len(withoutChat), strings.Join(withoutChat, ", "))
+    }
+
+    text += "\nДни рождения в ближайшие 30 дней:\n"
+    upcoming := 0
+    for _, member := range birthdays {
+        if member.TeamID != teamID {
+            continue
+        }
+        text += fmt.Sprintf("%s - %s\n", member.Name, member.Birthday.Format("02.01"))
+        upcoming++
+    }
+    if upcoming == 0 {
+        text += "нет\n"
+    }
+
+    var teamAnniversaries []string
+    for _, anniversary := range anniversaries {
+        if anniversary.Member.TeamID == teamID {
+            teamAnniversaries = append(teamAnniversaries, fmt.Sprintf("🏢 %s - %s, %s в компании",
+                anniversary.Member.Name, anniversary.Date.Format("02.01"), formatYears(anniversary.Years)))
+        }
+    }
+    if len(teamAnniversaries) > 0 {
+        text += "\nГодовщины работы в ближайшие 30 дней:\n" + strings.Join(teamAnniversaries, "\n") + "\n"
+    }
+
+    var buttons [][]tgbotapi.InlineKeyboardButton
+    text += "\nОткрытые сборы:\n"
+    if len(openTasks) == 0 {
+        text += "нет\n"
+    }
+    for _, task := range openTasks {
+        text += fmt.Sprintf("%s (%s) - перевели %d из %d\n",
+            task.BirthdayName, task.EventDate.Format("02.01"), task.RequestsDone, task.RequestsAll)
+        button := tgbotapi.NewInlineKeyboardButtonData(
+            fmt.Sprintf("Сбор: %s (%d/%d)", task.BirthdayName, task.RequestsDone, task.RequestsAll),
+            fmt.Sprintf("myteam_task_%d", task.TaskID))
+        buttons = append(buttons, []tgbotapi.InlineKeyboardButton{button})
+    }
+
+    if len(overdue) > 0 {
+        text += "\nПросроченные переводы подарков:\n"
+        for _, task := range overdue {
+            text += fmt.Sprintf("%s (%s) - ответственный %s\n",
+                task.BirthdayName, task.EventDate.Format("02.01"), task.PayoutMember)
+            button := tgbotapi.NewInlineKeyboardButtonData(
+                fmt.Sprintf("Просрочен: %s", task.BirthdayName),
+                fmt.Sprintf("myteam_task_%d", task.TaskID))
+            buttons = append(buttons, []tgbotapi.InlineKeyboardButton{button})
+        }
+    }
+
+    buttons = append(buttons, tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("Состав команды", fmt.Sprintf("myteam_roster_%d", teamID)),
+    ))
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(text, 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
+    sendReply(bot, db, msg)
+}
+
+// Участников на странице состава команды: у каждого своя кнопка, а Telegram принимает не больше 100 кнопок
+const rosterPageSize = 20
+
+func sendTeamRoster(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, teamID int, page int) {
+    members, err := getTeamMembers(db, teamID)
+    if err != nil {
+        log.Printf("Error getting team members: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении состава команды")
+        sendReply(bot, db, msg)
+        return
+    }
+    if len(members) == 0 {
+        msg := tgbotapi.NewMessage(chatID, "В команде нет участников.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    pages := (len(members) + rosterPageSize - 1) / rosterPageSize
+    if page >= pages {
+        page = pages - 1
+    }
+    if page < 0 {
+        page = 0
+    }
+
+    text := "Состав команды:\n\n"
+    if pages > 1 {
+        text = fmt.Sprintf("Состав команды (страница %d из %d, всего %d):\n\n", page+1, pages, len(members))
+    }
+    var buttons [][]tgbotapi.InlineKeyboardButton
+    end := (page + 1) * rosterPageSize
+    if end > len(members) {
+        end = len(members)
+    }
+    for _, member := range members[page*rosterPageSize : end] {
+        status := "✅"
+        if member.TelegramChatID == 0 {
+            status = "❌ нет Telegram"
+        }
+        text += fmt.Sprintf("%s - %s %s\n", member.Name, member.Birthday.Format("02.01"), status)
+        button := tgbotapi.NewInlineKeyboardButtonData(member.Name, fmt.Sprintf("myteam_member_%d", member.ID))
+        buttons = append(buttons, []tgbotapi.InlineKeyboardButton{button})
+    }
+
+    var nav []tgbotapi.InlineKeyboardButton
+    if page > 0 {
+        nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("« Назад", fmt.Sprintf("myteam_roster_%d_%d", teamID, page-1)))
+    }
+    if page < pages-1 {
+        nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Вперед »", fmt.Sprintf("myteam_roster_%d_%d", teamID, page+1)))
+    }
+    if len(nav) > 0 {
+        buttons = append(buttons, nav)
+    }
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(text, 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(buttons...)
+    sendReply(bot, db, msg)
+}
+
+func sendTaskProgress(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, taskID int) {
+    actions, err := getActions(db, taskID)
+    if err != nil {
+        log.Printf("Error getting actions for task %d: %v", taskID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении данных сбора")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var birthdayName string
+    err = db.QueryRow(`
+        SELECT bm.name
+        FROM year_tasks yt
+        JOIN team_members bm ON yt.team_member_id = bm.id
+        WHERE yt.id = $1`, taskID).Scan(&birthdayName)
+    if err != nil {
+        log.Printf("Error getting task %d: %v", taskID, err)
+        return
+    }
+
+    var done, pending []string
+    payoutStatus := "еще не создан"
+    for _, action := range actions {
+        switch action.Type {
+        case "request":
+            if action.IsDone {
+                done = append(done, action.MemberName)
+            } else {
+                pending = append(pending, action.MemberName)
+            }
+        case "payout":
+            if action.IsDone {
+                payoutStatus = fmt.Sprintf("выполнен (%s)", action.MemberName)
+            } else {
+                payoutStatus = fmt.Sprintf("ожидает (%s)", action.MemberName)
+            }
+        }
+    }
+
+    text := fmt.Sprintf("Сбор: %s\nПеревели: %d из %d\nПеревод подарка: %s\n",
+        birthdayName, len(done), len(done)+len(pending), payoutStatus)
+    if len(pending) > 0 {
+        text += "\nЕще не перевели:\n" + strings.Join(pending, "\n")
+    }
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(text, 4000))
+    sendReply(bot, db, msg)
+}
+
+func sendMemberActions(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, memberID int) {
+    var member TeamMember
+    var telegramChatID sql.NullInt64
+    err := db.QueryRow(`
+        SELECT id, name, birthday, phone_number, telegram_chat_id
+        FROM team_members
+        WHERE id = $1`, memberID).Scan(&member.ID, &member.Name, &member.Birthday, &member.PhoneNumber, &telegramChatID)
+    if err != nil {
+        log.Printf("Error getting member %d: %v", memberID, err)
+        return
+    }
+
+    actions, err := getActionsByMember(db, memberID)
+    if err != nil {
+        log.Printf("Error getting actions for member %d: %v", memberID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении данных участника")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    telegramStatus := "привязан"
+    if !telegramChatID.Valid {
+        telegramStatus = "не привязан"
+    }
+    text := fmt.Sprintf("%s\nДень рождения: %s\nТелефон: %s\nTelegram: %s\n",
+        member.Name, member.Birthday.Format("02.01.2006"), member.PhoneNumber, telegramStatus)
+
+    var open []string
+    doneCount := 0
+    for _, action := range actions {
+        if action.IsDone {
+            doneCount++
+            continue
+        }
+        var birthdayName string
+        err := db.QueryRow(`
+            SELECT bm.name
+            FROM year_tasks yt
+            JOIN team_members bm ON yt.team_member_id = bm.id
+            WHERE yt.id = $1`, action.TaskID).Scan(&birthdayName)
+        if err != nil {
+            log.Printf("Error getting task %d: %v", action.TaskID, err)
+            continue
+        }
+        if action.Type == "payout" {
+            open = append(open, fmt.Sprintf("перевести подарок: %s", birthdayName))
+        } else {
+            open = append(open, fmt.Sprintf("перевести вклад: %s", birthdayName))
+        }
+    }
+
+    text += fmt.Sprintf("\nВыполнено действий: %d\n", doneCount)
+    if len(open) > 0 {
+        text += "Ожидают выполнения:\n" + strings.Join(open, "\n")
+    } else {
+        text += "Нет ожидающих действий."
+    }
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(text, 4000))
+    sendReply(bot, db, msg)
+}
+
+// Обрабатывает /phone: показывает телефон для получения переводов и способы его изменить
+func handlePhoneCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    member, err := getCollectorMemberByChatID(db, chatID)
+    if err != nil {
+        log.Printf("Error checking collector status: %v", err)
+        return
+    }
+    if member == nil {
+        msg := tgbotapi.NewMessage(chatID, "Эта команда доступна только для тимлидов и казначеев.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    phone, isOverride, err := getCollectionPhone(db, member.ID)
+    if err != nil {
+        log.Printf("Error getting collection phone: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении телефона")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    source := "подтвержден через Telegram"
+    if isOverride {
+        source = "замена, подтвержденная администратором"
+    }
+    text := fmt.Sprintf("Телефон для получения переводов: %s (%s)", phone, source)
+
+    pending, err := getPendingPhoneOverride(db, member.ID)
+    if err != nil {
+        log.Printf("Error getting pending phone override: %v", err)
+    }
+    if pending != nil {
+        text += fmt.Sprintf("\nОжидает подтверждения администратора: %s", pending.PhoneNumber)
+    }
+
+    rows := [][]tgbotapi.InlineKeyboardButton{
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("📱 Подтвердить номер через контакт", "phone_contact"),
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("✏️ Указать другой номер", "phone_override"),
+        ),
+    }
+    if isOverride {
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("↩️ Использовать номер из контакта", "phone_reset"),
+        ))
+    }
+
+    msg := tgbotapi.NewMessage(chatID, text)
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+func handlePhoneCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+
+    // Решение администратора по замене телефона: phone_approve_<id> / phone_reject_<id>
+    if strings.HasPrefix(callback.Data, "phone_approve_") || strings.HasPrefix(callback.Data, "phone_reject_") {
+        handlePhoneOverrideDecision(bot, db, callback)
+        return
+    }
+
+    member, err := getCollectorMemberByChatID(db, chatID)
+    if err != nil {
+        log.Printf("Error checking collector status: %v", err)
+        return
+    }
+    if member == nil {
+        msg := tgbotapi.NewMessage(chatID, "Эта команда доступна только для тимлидов и казначеев.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    switch callback.Data {
+    case "phone_contact":
+        userStates[callback.From.ID] = &UserState{Stage: "awaiting_phone_contact"}
+
+        keyboard := tgbotapi.NewReplyKeyboard(
+            tgbotapi.NewKeyboardButtonRow(
+                tgbotapi.NewKeyboardButtonContact("📱 Поделиться номером телефона"),
+            ),
+        )
+        keyboard.OneTimeKeyboard = true
+
+        msg := tgbotapi.NewMessage(chatID, "Пожалуйста, нажмите на кнопку ниже, чтобы поделиться своим номером телефона")
+        msg.ReplyMarkup = keyboard
+        sendReply(bot, db, msg)
+    case "phone_override":
+        userStates[callback.From.ID] = &UserState{Stage: "awaiting_phone_override"}
+        msg := tgbotapi.NewMessage(chatID, "Введите номер телефона для получения переводов в формате +79991234567. "+
+            "Номер начнет использоваться после подтверждения администратором.")
+        sendReply(bot, db, msg)
+    case "phone_reset":
+        oldPhone, _, err := getCollectionPhone(db, member.ID)
+        if err != nil {
+            log.Printf("Error getting collection phone: %v", err)
+            return
+        }
+        changed, err := resetPhoneOverride(db, member.ID, chatID)
+        if err != nil {
+            log.Printf("Error resetting phone override: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сбросе телефона")
+            sendReply(bot, db, msg)
+            return
+        }
+        if !changed {
+            msg := tgbotapi.NewMessage(chatID, "Замена телефона не задана.")
+            sendReply(bot, db, msg)
+            return
+        }
+        onCollectionPhoneChanged(bot, db, member, oldPhone, "сброс замены на номер из контакта")
+    }
+}
+
+func handlePhoneContact(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    if message.Contact == nil {
+        msg := tgbotapi.NewMessage(chatID, "Пожалуйста, используйте кнопку 'Поделиться номером телефона' для отправки вашего номера")
+        sendReply(bot, db, msg)
+        return
+    }
+    if message.Contact.UserID != message.From.ID {
+        msg := tgbotapi.NewMessage(chatID, "Пожалуйста, поделитесь своим собственным номером телефона")
+        sendReply(bot, db, msg)
+        return
+    }
+    delete(userStates, message.From.ID)
+
+    member, err := getCollectorMemberByChatID(db, chatID)
+    if err != nil || member == nil {
+        log.Printf("Error checking collector status: %v", err)
+        return
+    }
+
+    oldPhone, _, err := getCollectionPhone(db, member.ID)
+    if err != nil {
+        log.Printf("Error getting collection phone: %v", err)
+        return
+    }
+
+    if err := confirmPhoneByContact(db, member.ID, message.Contact.PhoneNumber, chatID); err != nil {
+        log.Printf("Error confirming phone by contact: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении телефона")
+        msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+        sendReply(bot, db, msg)
+        return
+    }
+
+    msg := tgbotapi.NewMessage(chatID, "Спасибо! Номер подтвержден.")
+    msg.ReplyMarkup = tgbotapi.NewRemoveKeyboard(true)
+    sendReply(bot, db, msg)
+
+    onCollectionPhoneChanged(bot, db, member, oldPhone, "подтверждение через контакт Telegram")
+}
+
+func handlePhoneOverrideInput(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+
+    phone, ok := normalizePhone(message.Text)
+    if !ok {
+        msg := tgbotapi.NewMessage(chatID, "Неверный формат номера. Пожалуйста, используйте формат +79991234567")
+        sendReply(bot, db, msg)
+        return
+    }
+    delete(userStates, message.From.ID)
+
+    member, err := getCollectorMemberByChatID(db, chatID)
+    if err != nil || member == nil {
+        log.Printf("Error checking collector status: %v", err)
+        return
+    }
+
+    overrideID, err := requestPhoneOverride(db, member.ID, phone)
+    if err != nil {
+        log.Printf("Error requesting phone override: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении телефона")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    msg := tgbotapi.NewMessage(chatID, "Запрос на замену телефона отправлен администраторам. "+
+        "До подтверждения переводы поступают на текущий номер.")
+    sendReply(bot, db, msg)
+
+    text := fmt.Sprintf("%s (команда %s) просит получать переводы на номер %s вместо %s.",
+        member.Name, member.TeamName, phone, member.PhoneNumber)
+    sendPhoneOverrideRequest(bot, db, overrideID, member.ID, text)
+}
+
+// Отправляет администраторам запрос на замену телефона с кнопками решения
+// и отмечает запрос отправленным
+func sendPhoneOverrideRequest(bot *tgbotapi.BotAPI, db *sql.DB, overrideID, memberID int, text string) {
+    adminChatIDs, err := getAdminChatIDs(db)
+    if err != nil {
+        log.Printf("Error getting admins: %v", err)
+        return
+    }
+    keyboard := tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Подтвердить", fmt.Sprintf("phone_approve_%d", overrideID)),
+            tgbotapi.NewInlineKeyboardButtonData("Отклонить", fmt.Sprintf("phone_reject_%d", overrideID)),
+        ),
+    )
+    for _, adminChatID := range adminChatIDs {
+        deliverJobItem(bot, db, &JobItem{
+            Kind:     "phone_override_request",
+            ChatID:   adminChatID,
+            Text:     text,
+            Keyboard: &keyboard,
+            Journal:  phoneNoticeJournal(text, "phone_override_request", memberID),
+        })
+    }
+    if err := markPhoneOverrideNotified(db, overrideID); err != nil {
+        log.Printf("Error marking phone override %d notified: %v", overrideID, err)
+    }
+}
+
+// Отправляет администраторам запросы на замену телефона, которые еще не отправлялись,
+// например созданные миграцией из телефонов тимлидов
+func notifyPendingPhoneOverrides(bot *tgbotapi.BotAPI, db *sql.DB) {
+    overrides, err := getUnnotifiedPhoneOverrides(db)
+    if err != nil {
+        log.Printf("Error getting pending phone overrides: %v", err)
+        return
+    }
+    for _, override := range overrides {
+        text := fmt.Sprintf("Ожидает подтверждения замена телефона для переводов: %s (команда %s), номер %s вместо %s.",
+            override.MemberName, override.TeamName, override.PhoneNumber, override.CurrentPhone)
+        sendPhoneOverrideRequest(bot, db, override.ID, override.TeamMemberID, text)
+    }
+}
+
+func handlePhoneOverrideDecision(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+
+    parts := strings.Split(callback.Data, "_")
+    if len(parts) != 3 {
+        return
+    }
+    overrideID, err := strconv.Atoi(parts[2])
+    if err != nil {
+        return
+    }
+    approve := parts[1] == "approve"
+
+    var memberID int
+    err = db.QueryRow("SELECT team_member_id FROM collection_phone_overrides WHERE id = $1", overrideID).Scan(&memberID)
+    if err != nil {
+        log.Printf("Error getting phone override %d: %v", overrideID, err)
+        return
+    }
+    oldPhone, _, err := getCollectionPhone(db, memberID)
+    if err != nil {
+        log.Printf("Error getting collection phone: %v", err)
+        return
+    }
+
+    override, err := decidePhoneOverride(db, overrideID, approve, callback.From.ID)
+    if err != nil {
+        log.Printf("Error deciding phone override: %v", err)
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось обработать запрос: %v", err))
+        sendReply(bot, db, msg)
+        return
+    }
+
+    // Удаляем кнопки
+    edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+    sendReply(bot, db, edit)
+
+    member, err := getMemberByID(db, override.TeamMemberID)
+    if err != nil || member == nil {
+        log.Printf("Error getting member %d: %v", override.TeamMemberID, err)
+        return
+    }
+
+    if !approve {
+        msg := tgbotapi.NewMessage(chatID, "Запрос на замену телефона отклонен.")
+        sendReply(bot, db, msg)
+        if member.TelegramChatID != 0 {
+            sendReply(bot, db, tgbotapi.NewMessage(member.TelegramChatID,
+                fmt.Sprintf("Администратор отклонил замену телефона для переводов на %s.", override.PhoneNumber)))
+        }
+        return
+    }
+
+    msg := tgbotapi.NewMessage(chatID, "Замена телефона подтверждена.")
+    sendReply(bot, db, msg)
+    onCollectionPhoneChanged(bot, db, member, oldPhone, "замена, подтвержденная администратором")
+}
+
+// Сообщает получателю и администраторам о смене телефона для переводов
+// и обновляет уже отправленные запросы на перевод
+func onCollectionPhoneChanged(bot *tgbotapi.BotAPI, db *sql.DB, member *TeamMember, oldPhone, reason string) {
+    newPhone, _, err := getCollectionPhone(db, member.ID)
+    if err != nil {
+        log.Printf("Error getting collection phone: %v", err)
+        return
+    }
+    if newPhone == oldPhone {
+        return
+    }
+
+    text := fmt.Sprintf("Телефон для получения переводов %s изменен: %s → %s (%s).",
+        member.Name, oldPhone, newPhone, reason)
+
+    recipients := []int64{}
+    if member.TelegramChatID != 0 {
+        recipients = append(recipients, member.TelegramChatID)
+    }
+    adminChatIDs, err := getAdminChatIDs(db)
+    if err != nil {
+        log.Printf("Error getting admins: %v", err)
+    }
+    for _, adminChatID := range adminChatIDs {
+        if adminChatID != member.TelegramChatID {
+            recipients = append(recipients, adminChatID)
+        }
+    }
+
+    for _, recipient := range recipients {
+        deliverJobItem(bot, db, &JobItem{
+            Kind:    "phone_change_notification",
+            ChatID:  recipient,
+            Text:    text,
+            Journal: phoneNoticeJournal(text, "phone_change_notification", member.ID),
+        })
+    }
+
+    updated, err := refreshActionMessages(bot, db, 0, member.ID, "phone_change")
+    if err != nil {
+        log.Printf("Error refreshing request messages: %v", err)
+        return
+    }
+    log.Printf("Updated %d request messages after phone change of member %d", updated, member.ID)
+}
+
+// Приводит отправленные сообщения по открытым действиям в соответствие с текущими данными.
+// Сообщения находятся через журнал (taskID и memberID, равные 0, не ограничивают выборку;
+// memberID — именинник или получатель переводов сбора), текст и кнопки собираются заново
+// и правятся через editMessageText. Сообщения отмененного сбора и действия, переданного другому
+// участнику, закрываются: к тексту добавляется пометка, кнопки убираются. Каждая правка
+// записывается в message_edits. Возвращает число исправленных сообщений
+func refreshActionMessages(bot *tgbotapi.BotAPI, db *sql.DB, taskID, memberID int, reason string) (int, error) {
+    messages, err := findOutstandingMessages(db, taskID, memberID)
+    if err != nil {
+        return 0, err
+    }
+
+    updated := 0
+    for _, message := range messages {
+        edit := MessageEdit{
+            JournalID: message.JournalID,
+            ChatID:    message.ChatID,
+            MessageID: message.MessageID,
+            Reason:    reason,
+            OldText:   message.Record.Text,
+        }
+        record := message.Record
+        keyboard := tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}}
+
+        if message.Cancelled {
+            edit.NewText = fmt.Sprintf("%s\n\n❌ Сбор на подарок для %s отменен.", message.Record.Text, message.BirthdayName)
+            edit.Closed = true
+        } else if isActionMessageType(record.Type) {
+            item, err := renderActionMessage(db, message.ActionID)
+            if err != nil {
+                log.Printf("Error rendering message of action %d: %v", message.ActionID, err)
+                continue
+            }
+            switch {
+            case item == nil:
+                continue
+            case item.ChatID != 0 && item.ChatID != message.ChatID:
+                edit.NewText = fmt.Sprintf("%s\n\n↪️ Больше не актуально: передано участнику %s.", message.Record.Text, item.Name)
+                edit.Closed = true
+            case sameJournalPayload(message.Record.Payload, item.Journal.Payload):
+                // Данные, из которых собирается сообщение, не изменились
+                continue
+            default:
+                edit.NewText = item.Text
+                keyboard = *item.Keyboard
+                record.Payload = item.Journal.Payload
+            }
+        } else {
+            continue
+        }
+
+        _, err := sendWithRetry(bot, tgbotapi.NewEditMessageTextAndMarkup(message.ChatID, message.MessageID, edit.NewText, keyboard))
+        edit.Status = "edited"
+        if err != nil {
+            log.Printf("Error editing message %d in chat %d: %v", message.MessageID, message.ChatID, err)
+            edit.Status = "failed"
+            edit.Error = describeSendError(err)
+        }
+        if err := recordMessageEdit(db, edit); err != nil {
+            log.Printf("Error recording edit of journal entry %d: %v", message.JournalID, err)
+        }
+        if edit.Status != "edited" {
+            continue
+        }
+
+        updated++
+        record.Text = edit.NewText
+        if err := updateJournalRecord(db, message.JournalID, record); err != nil {
+            log.Printf("Error updating message journal: %v", err)
+        }
+    }
+
+    return updated, nil
+}
+
+func handleCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    if err := recordBotUser(db, callback.From); err != nil {
+        log.Printf("Error recording bot user: %v", err)
+    }
+    journalInboundCallback(db, callback)
+
+    // Каждое нажатие добавляется в историю сообщения вместе с итогом обработки,
+    // в том числе нажатия, отклоненные проверкой прав, и необработанные
+    interaction := CallbackInteraction{
+        FromChatID: callback.From.ID,
+        Username:   callback.From.UserName,
+        Data:       callback.Data,
+        Outcome:    "ignored",
+        PressedAt:  time.Now(),
+    }
+    if callback.Message != nil {
+        interaction.ChatID = callback.Message.Chat.ID
+        interaction.MessageID = callback.Message.MessageID
+    }
+    // Ошибка в обработчике одной кнопки не должна останавливать обработку обновлений
+    defer func() {
+        if recovered := recover(); recovered != nil {
+            log.Printf("Panic while handling callback %q from user %d: %v\n%s",
+                callback.Data, callback.From.ID, recovered, debug.Stack())
+            interaction.Outcome = "error"
+            interaction.Error = fmt.Sprint(recovered)
+        }
+        if err := recordCallbackInteraction(db, interaction); err != nil {
+            log.Printf("Error recording callback interaction: %v", err)
+        }
+    }()
+
+    // Кнопки бота есть только в его сообщениях, callback без сообщения (inline-режим) не обрабатываем
+    if callback.Message == nil {
+        log.Printf("Ignoring callback %q from user %d without message", callback.Data, callback.From.ID)
+        return
+    }
+
+    // Проверяем права пользователя, нажавшего кнопку
+    roles, allowed := authorize(bot, db, callback.From.ID, callback.Message.Chat.ID, callbackRoles, callback.Data)
+    if !allowed {
+        interaction.Outcome = "denied"
+        return
+    }
+
+    // Все нажатия в панели администратора попадают в журнал аудита
+    if strings.HasPrefix(callback.Data, "admin_") {
+        if err := logAudit(db, callback.From.ID, "admin_callback", "callback", 0, "", callback.Data); err != nil {
+            log.Printf("Error logging admin callback: %v", err)
+        }
+    }
+
+    // Проверяем тип callback. Подтверждения переводов сообщают итог для истории нажатий
+    interaction.Outcome = "handled"
+    if strings.HasPrefix(callback.Data, "team_") {
+        handleTeamSelection(bot, db, callback)
+    } else if strings.HasPrefix(callback.Data, "transfer_done_") {
+        interaction.setResult(handleTransferConfirmation(bot, db, callback))
+    } else if strings.HasPrefix(callback.Data, "payout_done_") {
+        interaction.setResult(handlePayoutConfirmation(bot, db, callback))
+    } else if strings.HasPrefix(callback.Data, "myteam_") {
+        handleMyTeamCallback(bot, db, callback)
+    } else if strings.HasPrefix(callback.Data, "phone_") {
+        handlePhoneCallback(bot, db, callback)
+    } else if strings.HasPrefix(callback.Data, "away_delegate_") {
+        handleAwayDelegateSelection(bot, db, callback)
+    } else if strings.HasPrefix(callback.Data, "admin_") {
+        handleAdminCallback(bot, db, callback)
+    } else if strings.HasPrefix(callback.Data, "collect_") {
+        handleCollectCallback(bot, db, callback, roles)
+    } else {
+        interaction.Outcome = "ignored"
+    }
+}
+
+func (i *CallbackInteraction) setResult(err error) {
+    if err != nil {
+        i.Outcome = "error"
+        i.Error = err.Error()
+        return
+    }
+    i.Outcome = "ok"
+}
+
+func handleAdminCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    // Управление командами и участниками обрабатывается отдельно
+    if strings.HasPrefix(callback.Data, "admin_team") {
+        handleAdminTeamsCallback(bot, db, callback)
+        return
+    }
+    if strings.HasPrefix(callback.Data, "admin_member") {
+        handleAdminMembersCallback(bot, db, callback)
+        return
+    }
+    if strings.HasPrefix(callback.Data, "admin_admin") {
+        handleAdminRightsCallback(bot, db, callback)
+        return
+    }
+    if strings.HasPrefix(callback.Data, "admin_broadcast") {
+        handleBroadcastCallback(bot, db, callback)
+        return
+    }
+    if strings.HasPrefix(callback.Data, "admin_job_retry_") {
+        handleJobRetryCallback(bot, db, callback)
+        return
+    }
+    if strings.HasPrefix(callback.Data, "admin_journal_") {
+        handleJournalCallback(bot, db, callback)
+        return
+    }
+
+    // Отправляем начальное сообщение о начале обработки
+    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Начинаем обработку запроса...")
+    sendReply(bot, db, msg)
+
+    // Обрабатываем callback в зависимости от типа действия
+    switch callback.Data {
+    case "admin_gen_tasks":
+        go func() {
+            log.Printf("Starting to check upcoming birthdays")
+            count, err := checkUpcomingBirthdaysCount(db)
+            if err != nil {
+                log.Printf("Error checking upcoming birthdays count: %v", err)
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке предстоящих дней рождения.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Found %d upcoming birthdays without tasks", count)
+            if count == 0 {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых дней рождения и годовщин для создания задач.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Starting to create birthday tasks")
+            tasksCreated, err := checkUpcomingBirthdaysOnce(db)
+            if err != nil {
+                if err.Error() == "no new tasks created" {
+                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых дней рождения и годовщин для создания задач.")
+                    sendReply(bot, db, msg)
+                } else {
+                    log.Printf("Error creating birthday tasks: %v", err)
+                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при создании задач.")
+                    sendReply(bot, db, msg)
+                }
+                return
+            }
+            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Задачи успешно созданы для %d предстоящих дней рождения и годовщин.", tasksCreated))
+            sendReply(bot, db, msg)
+            log.Printf("Finished creating birthday tasks")
+        }()
+    case "admin_gen_actions":
+        go func() {
+            log.Printf("Starting to check pending actions")
+            count, err := checkPendingActionsCount(db)
+            if err != nil {
+                log.Printf("Error checking pending actions: %v", err)
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих действий.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Found %d tasks without actions", count)
+            if count == 0 {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых задач для создания действий.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Starting to create request actions")
+            err = createRequestActionsOnce(db)
+            if err != nil {
+                if err.Error() == "no new actions created" {
+                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых задач для создания действий.")
+                    sendReply(bot, db, msg)
+                } else {
+                    log.Printf("Error creating request actions: %v", err)
+                    msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при создании действий.")
+                    sendReply(bot, db, msg)
+                }
+                return
+            }
+            msg := tgbotapi.NewMessage(callback.Message.Chat.ID, fmt.Sprintf("Действия успешно созданы для %d задач.", count))
+            sendReply(bot, db, msg)
+            log.Printf("Finished creating request actions")
+        }()
+    case "admin_send_members_messages":
+        go func() {
+            count, err := checkPendingMemberNotificationsCount(db)
+            if err != nil {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих уведомлений участников.")
+                sendReply(bot, db, msg)
+                return
+            }
+            if count == 0 {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых уведомлений для отправки участникам.")
+                sendReply(bot, db, msg)
+                return
+            }
+            report, err := sendMemberNotifications(db, bot, 0)
+            sendJobReport(bot, db, callback.Message.Chat.ID, report, err, "Произошла ошибка при отправке уведомлений участникам.")
+        }()
+    case "admin_send_teamlead_notify":
+        go func() {
+            count, err := checkPendingTeamLeadNotificationsCount(db)
+            if err != nil {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих уведомлений тимлидов.")
+                sendReply(bot, db, msg)
+                return
+            }
+            if count == 0 {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых уведомлений для отправки тимлидам.")
+                sendReply(bot, db, msg)
+                return
+            }
+            report, err := sendTeamLeadNotifications(db, bot, 0)
+            sendJobReport(bot, db, callback.Message.Chat.ID, report, err, "Произошла ошибка при отправке уведомлений тимлидам.")
+        }()
+    case "admin_send_today_birthday_messages":
+        go func() {
+            log.Printf("Starting to check today's birthdays")
+            count, err := checkTodayBirthdaysCount(db)
+            if err != nil {
+                log.Printf("Error checking today's birthdays: %v", err)
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке сегодняшних дней рождения.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Found %d birthdays today", count)
+            anniversaryCount, err := checkTodayAnniversariesCount(db)
+            if err != nil {
+                log.Printf("Error checking today's anniversaries: %v", err)
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке сегодняшних годовщин.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Found %d anniversaries today", anniversaryCount)
+            if count == 0 && anniversaryCount == 0 {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Сегодня нет дней рождения и годовщин для отправки поздравлений.")
+                sendReply(bot, db, msg)
+                return
+            }
+            if count > 0 {
+                log.Printf("Starting to send birthday wishes")
+                report, err := sendBirthdayWishesOnce(db, bot)
+                sendJobReport(bot, db, callback.Message.Chat.ID, report, err, "Произошла ошибка при отправке поздравлений.")
+                log.Printf("Finished sending birthday wishes")
+            }
+            if anniversaryCount > 0 {
+                report, err := sendAnniversaryWishesOnce(db, bot)
+                sendJobReport(bot, db, callback.Message.Chat.ID, report, err, "Произошла ошибка при отправке поздравлений с годовщиной.")
+            }
+        }()
+    case "admin_send_teamlead_money_message":
+        go func() {
+            log.Printf("Starting to check pending payout reminders")
+            count, err := checkPendingPayoutRemindersCount(db)
+            if err != nil {
+                log.Printf("Error checking pending payout reminders: %v", err)
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при проверке ожидающих напоминаний о переводе денег.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Found %d pending payout reminders", count)
+            if count == 0 {
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Нет новых напоминаний о переводе денег для отправки.")
+                sendReply(bot, db, msg)
+                return
+            }
+            log.Printf("Starting to send payout reminders")
+            report, err := sendPayoutRemindersOnce(db, bot)
+            sendJobReport(bot, db, callback.Message.Chat.ID, report, err, "Произошла ошибка при отправке напоминаний о переводе денег.")
+            log.Printf("Finished sending payout reminders")
+        }()
+    }
+}
+
+// Управление командами из панели администратора:
+// admin_teams, admin_team_view_<id>, admin_team_create, admin_team_rename_<id>,
+// admin_team_deactivate_<id>, admin_team_deactivate_confirm_<id>, admin_team_activate_<id>,
+// admin_team_move_<id>, admin_team_moveto_<id>_<id>, admin_team_treasurer_<id>,
+// admin_team_settreasurer_<id>_<id>, admin_team_untreasurer_<id>
+func handleAdminTeamsCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+    data := callback.Data
+
+    lastID := func() int {
+        id, err := strconv.Atoi(data[strings.LastIndex(data, "_")+1:])
+        if err != nil {
+            return 0
+        }
+        return id
+    }
+
+    switch {
+    case data == "admin_teams":
+        sendTeamsList(bot, db, chatID)
+
+    case data == "admin_team_create":
+        userStates[callback.From.ID] = &UserState{Stage: "awaiting_team_create"}
+        msg := tgbotapi.NewMessage(chatID, "Введите название новой команды:")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_team_view_"):
+        sendTeamCard(bot, db, chatID, lastID())
+
+    case strings.HasPrefix(data, "admin_team_rename_"):
+        userStates[callback.From.ID] = &UserState{Stage: "awaiting_team_rename", TeamID: lastID()}
+        msg := tgbotapi.NewMessage(chatID, "Введите новое название команды:")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_team_deactivate_confirm_"):
+        teamID := lastID()
+        cancelled, err := deactivateTeam(db, teamID)
+        if err != nil {
+            log.Printf("Error deactivating team %d: %v", teamID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при деактивации команды")
+            sendReply(bot, db, msg)
+            return
+        }
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+
+        closeCancelledTaskMessages(bot, db, cancelled)
+
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Команда деактивирована. Отменено сборов: %d.", len(cancelled)))
+        sendReply(bot, db, msg)
+        sendTeamCard(bot, db, chatID, teamID)
+
+    case strings.HasPrefix(data, "admin_team_deactivate_"):
+        team, err := getTeamInfo(db, lastID())
+        if err != nil || team == nil {
+            log.Printf("Error getting team: %v", err)
+            return
+        }
+        text := fmt.Sprintf("Деактивировать команду «%s»?\n"+
+            "Команда пропадет из списка при регистрации, открытые сборы (%d) будут отменены.",
+            team.Name, team.OpenTasks)
+        msg := tgbotapi.NewMessage(chatID, text)
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Деактивировать", fmt.Sprintf("admin_team_deactivate_confirm_%d", team.ID)),
+                tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("admin_team_view_%d", team.ID)),
+            ),
+        )
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_team_activate_"):
+        teamID := lastID()
+        if err := setTeamActive(db, teamID, true); err != nil {
+            log.Printf("Error activating team %d: %v", teamID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при активации команды")
+            sendReply(bot, db, msg)
+            return
+        }
+        msg := tgbotapi.NewMessage(chatID, "Команда снова активна.")
+        sendReply(bot, db, msg)
+        sendTeamCard(bot, db, chatID, teamID)
+
+    case strings.HasPrefix(data, "admin_team_moveto_"):
+        parts := strings.Split(strings.TrimPrefix(data, "admin_team_moveto_"), "_")
+        if len(parts) != 2 {
+            return
+        }
+        sourceID, err1 := strconv.Atoi(parts[0])
+        targetID, err2 := strconv.Atoi(parts[1])
+        if err1 != nil || err2 != nil {
+            return
+        }
+
+        members, err := getTeamMembers(db, sourceID)
+        if err != nil {
+            log.Printf("Error getting team members: %v", err)
+            return
+        }
+        if len(members) == 0 {
+            msg := tgbotapi.NewMessage(chatID, "В команде нет участников.")
+            sendReply(bot, db, msg)
+            return
+        }
+
+        userStates[callback.From.ID] = &UserState{
+            Stage:        "awaiting_team_move_members",
+            TeamID:       sourceID,
+            TargetTeamID: targetID,
+        }
+
+        var sb strings.Builder
+        sb.WriteString("Участники команды:\n")
+        for _, member := range members {
+            sb.WriteString(fmt.Sprintf("%d. %s\n", member.ID, member.Name))
+        }
+        sb.WriteString("\nВведите ID участников для переноса через пробел или «все»:")
+        msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_team_treasurer_"):
+        teamID := lastID()
+        candidates, err := getTreasurerCandidates(db, teamID)
+        if err != nil {
+            log.Printf("Error getting treasurer candidates: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении участников команды")
+            sendReply(bot, db, msg)
+            return
+        }
+        if len(candidates) == 0 {
+            msg := tgbotapi.NewMessage(chatID, "В команде нет активных участников.")
+            sendReply(bot, db, msg)
+            return
+        }
+        var rows [][]tgbotapi.InlineKeyboardButton
+        for _, member := range candidates {
+            rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData(member.Name, fmt.Sprintf("admin_team_settreasurer_%d_%d", teamID, member.ID)),
+            ))
+        }
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("admin_team_view_%d", teamID)),
+        ))
+        msg := tgbotapi.NewMessage(chatID, "Выберите казначея команды. Переводы по новым сборам будут направляться ему:")
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_team_settreasurer_"):
+        parts := strings.Split(strings.TrimPrefix(data, "admin_team_settreasurer_"), "_")
+        if len(parts) != 2 {
+            return
+        }
+        teamID, err1 := strconv.Atoi(parts[0])
+        memberID, err2 := strconv.Atoi(parts[1])
+        if err1 != nil || err2 != nil {
+            return
+        }
+        if err := setTreasurer(db, memberID, teamID, callback.From.ID); err != nil {
+            log.Printf("Error setting treasurer of team %d: %v", teamID, err)
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось назначить казначея: %v", err))
+            sendReply(bot, db, msg)
+            return
+        }
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+        msg := tgbotapi.NewMessage(chatID, "Казначей назначен.")
+        sendReply(bot, db, msg)
+        sendTeamCard(bot, db, chatID, teamID)
+
+    case strings.HasPrefix(data, "admin_team_untreasurer_"):
+        teamID := lastID()
+        if err := removeTreasurer(db, teamID, callback.From.ID); err != nil {
+            log.Printf("Error removing treasurer of team %d: %v", teamID, err)
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось снять казначея: %v", err))
+            sendReply(bot, db, msg)
+            return
+        }
+        msg := tgbotapi.NewMessage(chatID, "Казначей снят, переводы по новым сборам снова получает тимлид.")
+        sendReply(bot, db, msg)
+        sendTeamCard(bot, db, chatID, teamID)
+
+    case strings.HasPrefix(data, "admin_team_move_"):
+        sourceID := lastID()
+        teams, err := getActiveTeams(db)
+        if err != nil {
+            log.Printf("Error getting teams: %v", err)
+            return
+        }
+        var rows [][]tgbotapi.InlineKeyboardButton
+        for _, team := range teams {
+            if team.ID == sourceID {
+                continue
+            }
+            rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData(team.Name, fmt.Sprintf("admin_team_moveto_%d_%d", sourceID, team.ID)),
+            ))
+        }
+        if len(rows) == 0 {
+            msg := tgbotapi.NewMessage(chatID, "Нет других активных команд.")
+            sendReply(bot, db, msg)
+            return
+        }
+        msg := tgbotapi.NewMessage(chatID, "Выберите команду, в которую перенести участников:")
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+        sendReply(bot, db, msg)
+    }
+}
+
+func sendTeamsList(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64) {
+    teams, err := getTeamsInfo(db)
+    if err != nil {
+        log.Printf("Error getting teams: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка команд")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var sb strings.Builder
+    sb.WriteString("Команды:\n")
+    var rows [][]tgbotapi.InlineKeyboardButton
+    for _, team := range teams {
+        status := ""
+        if !team.IsActive {
+            status = " (неактивна)"
+        }
+        sb.WriteString(fmt.Sprintf("%d. %s%s — участников: %d\n", team.ID, team.Name, status, team.MemberCount))
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData(team.Name+status, fmt.Sprintf("admin_team_view_%d", team.ID)),
+        ))
+    }
+    rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("➕ Новая команда", "admin_team_create"),
+    ))
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+func sendTeamCard(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, teamID int) {
+    team, err := getTeamInfo(db, teamID)
+    if err != nil {
+        log.Printf("Error getting team %d: %v", teamID, err)
+        return
+    }
+    if team == nil {
+        msg := tgbotapi.NewMessage(chatID, "Команда не найдена.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    status := "активна"
+    if !team.IsActive {
+        status = "неактивна"
+    }
+    text := fmt.Sprintf("Команда «%s» (ID %d)\nСтатус: %s\nУчастников: %d\nОткрытых сборов: %d",
+        team.Name, team.ID, status, team.MemberCount, team.OpenTasks)
+
+    treasurer, err := getTreasurerByTeamID(db, team.ID)
+    if err != nil {
+        log.Printf("Error getting treasurer of team %d: %v", team.ID, err)
+    }
+    treasurerRow := tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("Назначить казначея", fmt.Sprintf("admin_team_treasurer_%d", team.ID)),
+    )
+    if treasurer != nil {
+        text += fmt.Sprintf("\nКазначей: %s (%s)", treasurer.MemberName, treasurer.PhoneNumber)
+        treasurerRow = append(treasurerRow,
+            tgbotapi.NewInlineKeyboardButtonData("Снять казначея", fmt.Sprintf("admin_team_untreasurer_%d", team.ID)))
+    } else {
+        text += "\nКазначей: не назначен"
+    }
+
+    toggle := tgbotapi.NewInlineKeyboardButtonData("Деактивировать", fmt.Sprintf("admin_team_deactivate_%d", team.ID))
+    if !team.IsActive {
+        toggle = tgbotapi.NewInlineKeyboardButtonData("Активировать", fmt.Sprintf("admin_team_activate_%d", team.ID))
+    }
+
+    msg := tgbotapi.NewMessage(chatID, text)
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Переименовать", fmt.Sprintf("admin_team_rename_%d", team.ID)),
+            toggle,
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Перенести участников", fmt.Sprintf("admin_team_move_%d", team.ID)),
+        ),
+        treasurerRow,
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("« К списку команд", "admin_teams"),
+        ),
+    )
+    sendReply(bot, db, msg)
+}
+
+// Обрабатывает текстовый ввод в сценариях управления командами
+func handleAdminTeamInput(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message, state *UserState) {
+    chatID := message.Chat.ID
+
+    switch state.Stage {
+    case "awaiting_team_create", "awaiting_team_rename":
+        name := strings.TrimSpace(message.Text)
+        if name == "" || len([]rune(name)) > 50 {
+            msg := tgbotapi.NewMessage(chatID, "Название должно содержать от 1 до 50 символов. Попробуйте еще раз:")
+            sendReply(bot, db, msg)
+            return
+        }
+        taken, err := isTeamNameTaken(db, name, state.TeamID)
+        if err != nil {
+            log.Printf("Error checking team name: %v", err)
+            return
+        }
+        if taken {
+            msg := tgbotapi.NewMessage(chatID, "Команда с таким названием уже существует. Введите другое название:")
+            sendReply(bot, db, msg)
+            return
+        }
+        delete(userStates, message.From.ID)
+
+        teamID := state.TeamID
+        if state.Stage == "awaiting_team_create" {
+            teamID, err = createTeam(db, name, chatID)
+        } else {
+            err = renameTeam(db, teamID, name, chatID)
+        }
+        if err != nil {
+            log.Printf("Error saving team: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении команды")
+            sendReply(bot, db, msg)
+            return
+        }
+        sendTeamCard(bot, db, chatID, teamID)
+
+    case "awaiting_team_move_members":
+        members, err := getTeamMembers(db, state.TeamID)
+        if err != nil {
+            log.Printf("Error getting team members: %v", err)
+            return
+        }
+
+        var memberIDs []int
+        if strings.EqualFold(strings.TrimSpace(message.Text), "все") {
+            for _, member := range members {
+                memberIDs = append(memberIDs, member.ID)
+            }
+        } else {
+            inTeam := make(map[int]bool)
+            for _, member := range members {
+                inTeam[member.ID] = true
+            }
+            for _, field := range strings.Fields(strings.ReplaceAll(message.Text, ",", " ")) {
+                id, err := strconv.Atoi(field)
+                if err != nil || !inTeam[id] {
+                    msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Участник с ID %s не найден в команде. Попробуйте еще раз:", field))
+                    sendReply(bot, db, msg)
+                    return
+                }
+                memberIDs = append(memberIDs, id)
+            }
+        }
+        if len(memberIDs) == 0 {
+            msg := tgbotapi.NewMessage(chatID, "Не указано ни одного участника. Попробуйте еще раз:")
+            sendReply(bot, db, msg)
+            return
+        }
+        delete(userStates, message.From.ID)
+
+        moved, err := moveTeamMembers(db, state.TeamID, state.TargetTeamID, memberIDs, chatID)
+        if err != nil {
+            log.Printf("Error moving team members: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при переносе участников")
+            sendReply(bot, db, msg)
+            return
+        }
+
+        text := fmt.Sprintf("Перенесено участников: %d.", moved)
+        roles, err := getTeamRoleHolders(db, state.TeamID, memberIDs)
+        if err != nil {
+            log.Printf("Error checking team roles: %v", err)
+        }
+        if len(roles) > 0 {
+            text += "\nРоли в прежней команде сохранены: " + strings.Join(roles, ", ")
+        }
+        msg := tgbotapi.NewMessage(chatID, text)
+        sendReply(bot, db, msg)
+        sendTeamCard(bot, db, chatID, state.TargetTeamID)
+    }
+}
+
+const membersPageSize = 10
+
+// Справочник участников в панели администратора:
+// admin_members, admin_members_page_<n>, admin_members_search, admin_member_view_<id>,
+// admin_member_edit_<field>_<id>, admin_member_team_<id>, admin_member_setteam_<id>_<team>,
+// admin_member_deactivate_<id>, admin_member_deactivate_confirm_<id>, admin_member_activate_<id>,
+// admin_member_delete_<id>, admin_member_delete_confirm_<id>, admin_member_hr_<id>
+func handleAdminMembersCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+    adminChatID := callback.From.ID
+    data := callback.Data
+
+    lastID := func() int {
+        id, err := strconv.Atoi(data[strings.LastIndex(data, "_")+1:])
+        if err != nil {
+            return 0
+        }
+        return id
+    }
+
+    switch {
+    case data == "admin_members":
+        sendMembersPage(bot, db, chatID, 0)
+
+    case strings.HasPrefix(data, "admin_members_page_"):
+        sendMembersPage(bot, db, chatID, lastID())
+
+    case data == "admin_members_search":
+        userStates[adminChatID] = &UserState{Stage: "awaiting_member_search"}
+        msg := tgbotapi.NewMessage(chatID, "Введите часть имени или номера телефона:")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_member_view_"):
+        sendMemberCard(bot, db, chatID, lastID())
+
+    case strings.HasPrefix(data, "admin_member_edit_"):
+        parts := strings.Split(strings.TrimPrefix(data, "admin_member_edit_"), "_")
+        if len(parts) != 2 {
+            return
+        }
+        memberID, err := strconv.Atoi(parts[1])
+        if err != nil {
+            return
+        }
+        prompts := map[string]string{
+            "name":     "Введите новое имя:",
+            "birthday": "Введите дату рождения в формате DD.MM.YYYY:",
+            "hire":     "Введите дату приема на работу в формате DD.MM.YYYY или «-», чтобы очистить ее:",
+            "phone":    "Введите номер телефона в формате +79991234567:",
+            "chat":     "Введите Telegram chat ID или «-», чтобы отвязать Telegram:",
+        }
+        prompt, ok := prompts[parts[0]]
+        if !ok {
+            return
+        }
+        userStates[adminChatID] = &UserState{Stage: "awaiting_member_edit", MemberID: memberID, EditField: parts[0]}
+        msg := tgbotapi.NewMessage(chatID, prompt)
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_member_team_"):
+        memberID := lastID()
+        teams, err := getActiveTeams(db)
+        if err != nil {
+            log.Printf("Error getting teams: %v", err)
+            return
+        }
+        var rows [][]tgbotapi.InlineKeyboardButton
+        for _, team := range teams {
+            rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData(team.Name, fmt.Sprintf("admin_member_setteam_%d_%d", memberID, team.ID)),
+            ))
+        }
+        msg := tgbotapi.NewMessage(chatID, "Выберите новую команду:")
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_member_setteam_"):
+        parts := strings.Split(strings.TrimPrefix(data, "admin_member_setteam_"), "_")
+        if len(parts) != 2 {
+            return
+        }
+        memberID, err1 := strconv.Atoi(parts[0])
+        teamID, err2 := strconv.Atoi(parts[1])
+        if err1 != nil || err2 != nil {
+            return
+        }
+        if err := updateMemberField(db, memberID, "team_id", teamID, adminChatID); err != nil {
+            log.Printf("Error updating member team: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении изменений")
+            sendReply(bot, db, msg)
+            return
+        }
+        sendMemberCard(bot, db, chatID, memberID)
+
+    case strings.HasPrefix(data, "admin_member_deactivate_confirm_"):
+        memberID := lastID()
+        cancelled, err := deactivateMember(db, memberID, adminChatID)
+        if err != nil {
+            log.Printf("Error deactivating member %d: %v", memberID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при деактивации участника")
+            sendReply(bot, db, msg)
+            return
+        }
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+        closeCancelledTaskMessages(bot, db, cancelled)
+        sendMemberCard(bot, db, chatID, memberID)
+
+    case strings.HasPrefix(data, "admin_member_deactivate_"):
+        memberID := lastID()
+        msg := tgbotapi.NewMessage(chatID, "Деактивировать участника? Он перестанет получать запросы на сбор и поздравления, "+
+            "открытый сбор на его день рождения будет отменен.")
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Деактивировать", fmt.Sprintf("admin_member_deactivate_confirm_%d", memberID)),
+                tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("admin_member_view_%d", memberID)),
+            ),
+        )
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_member_activate_"):
+        memberID := lastID()
+        if err := updateMemberField(db, memberID, "is_active", true, adminChatID); err != nil {
+            log.Printf("Error activating member %d: %v", memberID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении изменений")
+            sendReply(bot, db, msg)
+            return
+        }
+        sendMemberCard(bot, db, chatID, memberID)
+
+    case strings.HasPrefix(data, "admin_member_hr_"):
+        memberID := lastID()
+        isHR, err := isMemberHR(db, memberID)
+        if err != nil {
+            log.Printf("Error checking HR role: %v", err)
+            return
+        }
+        if err := setMemberHR(db, memberID, !isHR, adminChatID); err != nil {
+            log.Printf("Error changing HR role of member %d: %v", memberID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении изменений")
+            sendReply(bot, db, msg)
+            return
+        }
+        sendMemberCard(bot, db, chatID, memberID)
+
+    case strings.HasPrefix(data, "admin_member_delete_confirm_"):
+        memberID := lastID()
+        deleted, err := deleteMember(db, memberID, adminChatID)
+        if err != nil {
+            log.Printf("Error deleting member %d: %v", memberID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при удалении участника")
+            sendReply(bot, db, msg)
+            return
+        }
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+        if !deleted {
+            msg := tgbotapi.NewMessage(chatID, "У участника есть история сборов или роли в командах, удалить его нельзя. "+
+                "Используйте деактивацию.")
+            sendReply(bot, db, msg)
+            return
+        }
+        msg := tgbotapi.NewMessage(chatID, "Участник удален.")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_member_delete_"):
+        memberID := lastID()
+        msg := tgbotapi.NewMessage(chatID, "Удалить участника без возможности восстановления?")
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Удалить", fmt.Sprintf("admin_member_delete_confirm_%d", memberID)),
+                tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("admin_member_view_%d", memberID)),
+            ),
+        )
+        sendReply(bot, db, msg)
+    }
+}
+
+func sendMembersPage(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, page int) {
+    total, err := countMembers(db)
+    if err != nil {
+        log.Printf("Error counting members: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка участников")
+        sendReply(bot, db, msg)
+        return
+    }
+    pages := (total + membersPageSize - 1) / membersPageSize
+    if pages == 0 {
+        pages = 1
+    }
+    if page >= pages {
+        page = pages - 1
+    }
+    if page < 0 {
+        page = 0
+    }
+
+    members, err := searchMembers(db, "", membersPageSize, page*membersPageSize)
+    if err != nil {
+        log.Printf("Error getting members: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка участников")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    rows := memberButtons(members)
+    var nav []tgbotapi.InlineKeyboardButton
+    if page > 0 {
+        nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("« Назад", fmt.Sprintf("admin_members_page_%d", page-1)))
+    }
+    if page < pages-1 {
+        nav = append(nav, tgbotapi.NewInlineKeyboardButtonData("Вперед »", fmt.Sprintf("admin_members_page_%d", page+1)))
+    }
+    if len(nav) > 0 {
+        rows = append(rows, nav)
+    }
+    rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("🔍 Поиск", "admin_members_search"),
+    ))
+
+    msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Участники (страница %d из %d, всего %d):", page+1, pages, total))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+func memberButtons(members []MemberRecord) [][]tgbotapi.InlineKeyboardButton {
+    var rows [][]tgbotapi.InlineKeyboardButton
+    for _, member := range members {
+        label := fmt.Sprintf("%s (%s)", member.Name, member.TeamName)
+        if !member.IsActive {
+            label += " — неактивен"
+        }
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("admin_member_view_%d", member.ID)),
+        ))
+    }
+    return rows
+}
+
+func sendMemberCard(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, memberID int) {
+    member, err := getMemberRecord(db, memberID)
+    if err != nil {
+        log.Printf("Error getting member %d: %v", memberID, err)
+        return
+    }
+    if member == nil {
+        msg := tgbotapi.NewMessage(chatID, "Участник не найден.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    telegram := "не привязан"
+    if member.TelegramChatID != 0 {
+        telegram = strconv.FormatInt(member.TelegramChatID, 10)
+    }
+    status := "активен"
+    if !member.IsActive {
+        status = "неактивен"
+    }
+
+    var sb strings.Builder
+    sb.WriteString(fmt.Sprintf("%s (ID %d)\n", member.Name, member.ID))
+    sb.WriteString(fmt.Sprintf("Дата рождения: %s\n", member.Birthday.Format("02.01.2006")))
+    hireDate := "не указана"
+    if member.HireDate.Valid {
+        hireDate = member.HireDate.Time.Format("02.01.2006")
+    }
+    sb.WriteString(fmt.Sprintf("Дата приема на работу: %s\n", hireDate))
+    sb.WriteString(fmt.Sprintf("Команда: %s\n", member.TeamName))
+    sb.WriteString(fmt.Sprintf("Телефон: %s\n", member.PhoneNumber))
+    sb.WriteString(fmt.Sprintf("Telegram chat ID: %s\n", telegram))
+    sb.WriteString(fmt.Sprintf("Статус: %s\n", status))
+
+    audit, err := getMemberAudit(db, memberID, 5)
+    if err != nil {
+        log.Printf("Error getting member audit: %v", err)
+    }
+    if len(audit) > 0 {
+        sb.WriteString("\nПоследние изменения:\n")
+        for _, entry := range audit {
+            sb.WriteString(fmt.Sprintf("%s %s: %s → %s (админ %d)\n",
+                entry.CreatedAt.Format("02.01.2006 15:04"), entry.Action, entry.OldValue, entry.NewValue, entry.AdminChatID))
+        }
+    }
+
+    toggle := tgbotapi.NewInlineKeyboardButtonData("Деактивировать", fmt.Sprintf("admin_member_deactivate_%d", member.ID))
+    if !member.IsActive {
+        toggle = tgbotapi.NewInlineKeyboardButtonData("Активировать", fmt.Sprintf("admin_member_activate_%d", member.ID))
+    }
+
+    isHR, err := isMemberHR(db, member.ID)
+    if err != nil {
+        log.Printf("Error checking HR role: %v", err)
+    }
+    hrToggle := tgbotapi.NewInlineKeyboardButtonData("Выдать роль HR", fmt.Sprintf("admin_member_hr_%d", member.ID))
+    if isHR {
+        hrToggle = tgbotapi.NewInlineKeyboardButtonData("Снять роль HR", fmt.Sprintf("admin_member_hr_%d", member.ID))
+    }
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Имя", fmt.Sprintf("admin_member_edit_name_%d", member.ID)),
+            tgbotapi.NewInlineKeyboardButtonData("Дата рождения", fmt.Sprintf("admin_member_edit_birthday_%d", member.ID)),
+            tgbotapi.NewInlineKeyboardButtonData("Дата приема", fmt.Sprintf("admin_member_edit_hire_%d", member.ID)),
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Команда", fmt.Sprintf("admin_member_team_%d", member.ID)),
+            tgbotapi.NewInlineKeyboardButtonData("Телефон", fmt.Sprintf("admin_member_edit_phone_%d", member.ID)),
+            tgbotapi.NewInlineKeyboardButtonData("Chat ID", fmt.Sprintf("admin_member_edit_chat_%d", member.ID)),
+        ),
+        tgbotapi.NewInlineKeyboardRow(hrToggle),
+        tgbotapi.NewInlineKeyboardRow(
+            toggle,
+            tgbotapi.NewInlineKeyboardButtonData("Удалить", fmt.Sprintf("admin_member_delete_%d", member.ID)),
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("« К списку участников", "admin_members"),
+        ),
+    )
+    sendReply(bot, db, msg)
+}
+
+// Обрабатывает текстовый ввод в сценариях справочника участников
+func handleAdminMemberInput(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message, state *UserState) {
+    chatID := message.Chat.ID
+    adminChatID := message.From.ID
+
+    text := strings.TrimSpace(message.Text)
+
+    if state.Stage == "awaiting_member_search" {
+        delete(userStates, adminChatID)
+        members, err := searchMembers(db, text, 21, 0)
+        if err != nil {
+            log.Printf("Error searching members: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при поиске участников")
+            sendReply(bot, db, msg)
+            return
+        }
+        if len(members) == 0 {
+            msg := tgbotapi.NewMessage(chatID, "Никого не найдено.")
+            sendReply(bot, db, msg)
+            return
+        }
+        header := fmt.Sprintf("Найдено участников: %d", len(members))
+        if len(members) > 20 {
+            members = members[:20]
+            header = "Найдено больше 20 участников, уточните запрос. Первые 20:"
+        }
+        msg := tgbotapi.NewMessage(chatID, header)
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(memberButtons(members)...)
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var column string
+    var value interface{}
+    switch state.EditField {
+    case "name":
+        if text == "" || len([]rune(text)) > 100 {
+            msg := tgbotapi.NewMessage(chatID, "Имя должно содержать от 1 до 100 символов. Попробуйте еще раз:")
+            sendReply(bot, db, msg)
+            return
+        }
+        column, value = "name", text
+    case "birthday":
+        birthday, err := time.Parse("02.01.2006", text)
+        if err != nil {
+            msg := tgbotapi.NewMessage(chatID, "Неверный формат даты. Пожалуйста, используйте формат DD.MM.YYYY")
+            sendReply(bot, db, msg)
+            return
+        }
+        column, value = "birthday", birthday
+    case "hire":
+        column = "hire_date"
+        if text == "-" {
+            value = nil
+        } else {
+            hireDate, err := time.Parse("02.01.2006", text)
+            if err != nil || hireDate.After(time.Now()) {
+                msg := tgbotapi.NewMessage(chatID, "Неверная дата. Пожалуйста, используйте формат DD.MM.YYYY, дата не может быть в будущем")
+                sendReply(bot, db, msg)
+                return
+            }
+            value = hireDate
+        }
+    case "phone":
+        phone, ok := normalizePhone(text)
+        if !ok {
+            msg := tgbotapi.NewMessage(chatID, "Неверный формат номера. Пожалуйста, используйте формат +79991234567")
+            sendReply(bot, db, msg)
+            return
+        }
+        column, value = "phone_number", phone
+    case "chat":
+        column = "telegram_chat_id"
+        if text == "-" {
+            value = nil
+        } else {
+            telegramChatID, err := strconv.ParseInt(text, 10, 64)
+            if err != nil {
+                msg := tgbotapi.NewMessage(chatID, "Chat ID должен быть числом. Попробуйте еще раз:")
+                sendReply(bot, db, msg)
+                return
+            }
+            value = telegramChatID
+        }
+    default:
+        delete(userStates, adminChatID)
+        return
+    }
+    delete(userStates, adminChatID)
+
+    var oldPhone string
+    if column == "phone_number" {
+        var err error
+        oldPhone, _, err = getCollectionPhone(db, state.MemberID)
+        if err != nil {
+            log.Printf("Error getting collection phone: %v", err)
+        }
+    }
+
+    if err := updateMemberField(db, state.MemberID, column, value, adminChatID); err != nil {
+        log.Printf("Error updating member %d: %v", state.MemberID, err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при сохранении изменений")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    // Имя именинника и получателя переводов есть в отправленных запросах
+    if column == "name" {
+        if _, err := refreshActionMessages(bot, db, 0, state.MemberID, "member_change"); err != nil {
+            log.Printf("Error refreshing messages of member %d: %v", state.MemberID, err)
+        }
+    }
+
+    // Телефон тимлида или казначея используется в запросах на перевод
+    if column == "phone_number" && oldPhone != "" {
+        hasRole, err := hasCollectorRole(db, state.MemberID)
+        if err != nil {
+            log.Printf("Error checking collector role: %v", err)
+        }
+        member, err := getMemberByID(db, state.MemberID)
+        if hasRole && err == nil && member != nil {
+            onCollectionPhoneChanged(bot, db, member, oldPhone, "изменение администратором")
+        }
+    }
+
+    sendMemberCard(bot, db, chatID, state.MemberID)
+}
+
+// Управление администраторами: admin_admins, admin_admin_view_<chat>, admin_admin_grant,
+// admin_admin_add_<chat>, admin_admin_revoke_<chat>, admin_admin_revoke_confirm_<chat>,
+// admin_admin_super_<chat>, admin_admin_unsuper_<chat>.
+// Просматривать список может любой администратор, изменять — только суперадминистратор.
+func handleAdminRightsCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+    actorChatID := callback.From.ID
+    data := callback.Data
+
+    if data == "admin_admins" {
+        sendAdminsList(bot, db, chatID)
+        return
+    }
+
+    isSuper, err := isSuperAdmin(db, actorChatID)
+    if err != nil {
+        log.Printf("Error checking super admin status: %v", err)
+        return
+    }
+    if !isSuper {
+        msg := tgbotapi.NewMessage(chatID, "Управлять администраторами могут только суперадминистраторы.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    targetChatID, _ := strconv.ParseInt(data[strings.LastIndex(data, "_")+1:], 10, 64)
+
+    switch {
+    case data == "admin_admin_grant":
+        userStates[actorChatID] = &UserState{Stage: "awaiting_admin_grant"}
+        msg := tgbotapi.NewMessage(chatID, "Перешлите любое сообщение пользователя, которому нужно выдать права, "+
+            "или введите часть имени участника:")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_admin_view_"):
+        sendAdminCard(bot, db, chatID, targetChatID)
+
+    case strings.HasPrefix(data, "admin_admin_add_"):
+        created, err := grantAdmin(db, targetChatID, actorChatID)
+        if err != nil {
+            log.Printf("Error granting admin rights to %d: %v", targetChatID, err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при выдаче прав")
+            sendReply(bot, db, msg)
+            return
+        }
+        if !created {
+            msg := tgbotapi.NewMessage(chatID, "Пользователь уже является администратором.")
+            sendReply(bot, db, msg)
+            return
+        }
+        sendReply(bot, db, tgbotapi.NewMessage(targetChatID, "Вам выданы права администратора. Используйте /admin."))
+        sendAdminCard(bot, db, chatID, targetChatID)
+
+    case strings.HasPrefix(data, "admin_admin_revoke_confirm_"):
+        if err := revokeAdmin(db, targetChatID, actorChatID); err != nil {
+            log.Printf("Error revoking admin rights of %d: %v", targetChatID, err)
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось отозвать права: %v", err))
+            sendReply(bot, db, msg)
+            return
+        }
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+        sendReply(bot, db, tgbotapi.NewMessage(targetChatID, "Ваши права администратора отозваны."))
+        msg := tgbotapi.NewMessage(chatID, "Права администратора отозваны.")
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_admin_revoke_"):
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Отозвать права администратора у %d?", targetChatID))
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Отозвать", fmt.Sprintf("admin_admin_revoke_confirm_%d", targetChatID)),
+                tgbotapi.NewInlineKeyboardButtonData("Отмена", fmt.Sprintf("admin_admin_view_%d", targetChatID)),
+            ),
+        )
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_admin_super_"), strings.HasPrefix(data, "admin_admin_unsuper_"):
+        makeSuper := strings.HasPrefix(data, "admin_admin_super_")
+        if err := setSuperAdmin(db, targetChatID, makeSuper, actorChatID); err != nil {
+            log.Printf("Error changing super admin status of %d: %v", targetChatID, err)
+            msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось изменить права: %v", err))
+            sendReply(bot, db, msg)
+            return
+        }
+        sendAdminCard(bot, db, chatID, targetChatID)
+    }
+}
+
+func sendAdminsList(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64) {
+    admins, err := getAdmins(db)
+    if err != nil {
+        log.Printf("Error getting admins: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при получении списка администраторов")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var sb strings.Builder
+    sb.WriteString("Администраторы (⭐ — суперадминистратор):\n")
+    var rows [][]tgbotapi.InlineKeyboardButton
+    for _, admin := range admins {
+        label := formatAdminLabel(admin)
+        sb.WriteString(label + "\n")
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData(label, fmt.Sprintf("admin_admin_view_%d", admin.ChatID)),
+        ))
+    }
+    rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+        tgbotapi.NewInlineKeyboardButtonData("➕ Выдать права", "admin_admin_grant"),
+    ))
+
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(sb.String(), 4000))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+func sendAdminCard(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, adminChatID int64) {
+    admin, err := getAdmin(db, adminChatID)
+    if err != nil {
+        log.Printf("Error getting admin %d: %v", adminChatID, err)
+        return
+    }
+    if admin == nil {
+        msg := tgbotapi.NewMessage(chatID, "Пользователь не является администратором.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    role := "администратор"
+    toggle := tgbotapi.NewInlineKeyboardButtonData("Сделать суперадминистратором", fmt.Sprintf("admin_admin_super_%d", admin.ChatID))
+    if admin.IsSuper {
+        role = "суперадминистратор"
+        toggle = tgbotapi.NewInlineKeyboardButtonData("Снять статус суперадминистратора", fmt.Sprintf("admin_admin_unsuper_%d", admin.ChatID))
+    }
+
+    msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%s\nРоль: %s", formatAdminLabel(*admin), role))
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(toggle),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Отозвать права", fmt.Sprintf("admin_admin_revoke_%d", admin.ChatID)),
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("« К списку администраторов", "admin_admins"),
+        ),
+    )
+    sendReply(bot, db, msg)
+}
+
+func formatAdminLabel(admin Admin) string {
+    label := strconv.FormatInt(admin.ChatID, 10)
+    if admin.Name != "" {
+        label = fmt.Sprintf("%s (%d)", admin.Name, admin.ChatID)
+    }
+    if admin.IsSuper {
+        label = "⭐ " + label
+    }
+    return label
+}
+
+// Выдача прав: пересланное сообщение пользователя или поиск участника по имени
+func handleAdminGrantInput(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+    chatID := message.Chat.ID
+    actorChatID := message.From.ID
+
+    isSuper, err := isSuperAdmin(db, actorChatID)
+    if err != nil {
+        log.Printf("Error checking super admin status: %v", err)
+        return
+    }
+    if !isSuper {
+        delete(userStates, actorChatID)
+        msg := tgbotapi.NewMessage(chatID, "Управлять администраторами могут только суперадминистраторы.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    if message.ForwardFrom != nil {
+        delete(userStates, actorChatID)
+        user := message.ForwardFrom
+        if user.IsBot {
+            msg := tgbotapi.NewMessage(chatID, "Нельзя выдать права боту.")
+            sendReply(bot, db, msg)
+            return
+        }
+        name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Выдать права администратора пользователю %s (%d)?", name, user.ID))
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Выдать права", fmt.Sprintf("admin_admin_add_%d", user.ID)),
+            ),
+        )
+        sendReply(bot, db, msg)
+        return
+    }
+    if message.ForwardSenderName != "" {
+        msg := tgbotapi.NewMessage(chatID, "Пользователь скрыл свой аккаунт в пересланных сообщениях. "+
+            "Введите часть имени участника:")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    search := strings.TrimSpace(message.Text)
+    if search == "" {
+        msg := tgbotapi.NewMessage(chatID, "Перешлите сообщение пользователя или введите часть имени участника:")
+        sendReply(bot, db, msg)
+        return
+    }
+    delete(userStates, actorChatID)
+
+    members, err := searchMembers(db, search, 20, 0)
+    if err != nil {
+        log.Printf("Error searching members: %v", err)
+        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при поиске участников")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    var rows [][]tgbotapi.InlineKeyboardButton
+    for _, member := range members {
+        if member.TelegramChatID == 0 {
+            continue
+        }
+        rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData(
+                fmt.Sprintf("%s (%s)", member.Name, member.TeamName),
+                fmt.Sprintf("admin_admin_add_%d", member.TelegramChatID),
+            ),
+        ))
+    }
+    if len(rows) == 0 {
+        msg := tgbotapi.NewMessage(chatID, "Не найдено участников с привязанным Telegram.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    msg := tgbotapi.NewMessage(chatID, "Выберите участника, которому нужно выдать права:")
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+    sendReply(bot, db, msg)
+}
+
+// Интервал между сообщениями рассылки (лимит Telegram — около 30 сообщений в секунду)
+const broadcastInterval = 50 * time.Millisecond
+
+// Мастер рассылки: admin_broadcast, admin_broadcast_aud_teams, admin_broadcast_aud_<аудитория>,
+// admin_broadcast_send, admin_broadcast_cancel. Текст и аудитория хранятся в userStates.
+func handleBroadcastCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+    adminChatID := callback.From.ID
+    data := callback.Data
+
+    if data == "admin_broadcast" {
+        userStates[adminChatID] = &UserState{Stage: "awaiting_broadcast_text"}
+        msg := tgbotapi.NewMessage(chatID, "Введите текст объявления:")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    state, exists := userStates[adminChatID]
+    if !exists || state.BroadcastText == "" {
+        msg := tgbotapi.NewMessage(chatID, "Рассылка не найдена. Начните заново из /admin.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    switch {
+    case data == "admin_broadcast_cancel":
+        delete(userStates, adminChatID)
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+        msg := tgbotapi.NewMessage(chatID, "Рассылка отменена.")
+        sendReply(bot, db, msg)
+
+    case data == "admin_broadcast_aud_teams":
+        teams, err := getActiveTeams(db)
+        if err != nil {
+            log.Printf("Error getting teams: %v", err)
+            return
+        }
+        var rows [][]tgbotapi.InlineKeyboardButton
+        for _, team := range teams {
+            rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData(team.Name, fmt.Sprintf("admin_broadcast_aud_team_%d", team.ID)),
+            ))
+        }
+        msg := tgbotapi.NewMessage(chatID, "Выберите команду:")
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+        sendReply(bot, db, msg)
+
+    case strings.HasPrefix(data, "admin_broadcast_aud_"):
+        audience := strings.TrimPrefix(data, "admin_broadcast_aud_")
+        recipients, err := getBroadcastRecipients(db, audience)
+        if err != nil {
+            log.Printf("Error getting broadcast recipients: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при подборе получателей")
+            sendReply(bot, db, msg)
+            return
+        }
+        state.BroadcastAudience = audience
+        state.Stage = "awaiting_broadcast_confirm"
+
+        // Предпросмотр: сообщение в том виде, в котором его получат участники
+        sendReply(bot, db, tgbotapi.NewMessage(chatID, state.BroadcastText))
+
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Аудитория: %s\nПолучателей: %d\nОтправить объявление?",
+            describeBroadcastAudience(db, audience), len(recipients)))
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Отправить", "admin_broadcast_send"),
+                tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_broadcast_cancel"),
+            ),
+        )
+        sendReply(bot, db, msg)
+
+    case data == "admin_broadcast_send":
+        if state.Stage != "awaiting_broadcast_confirm" {
+            return
+        }
+        delete(userStates, adminChatID)
+        edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID, tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+
+        recipients, err := getBroadcastRecipients(db, state.BroadcastAudience)
+        if err != nil {
+            log.Printf("Error getting broadcast recipients: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при подборе получателей")
+            sendReply(bot, db, msg)
+            return
+        }
+        broadcastID, err := createBroadcast(db, adminChatID, state.BroadcastText, state.BroadcastAudience, len(recipients))
+        if err != nil {
+            log.Printf("Error creating broadcast: %v", err)
+            msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при создании рассылки")
+            sendReply(bot, db, msg)
+            return
+        }
+
+        msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("Рассылка #%d запущена, получателей: %d.", broadcastID, len(recipients)))
+        sendReply(bot, db, msg)
+        go runBroadcast(bot, db, broadcastID, state.BroadcastText, recipients, chatID)
+    }
+}
+
+func handleBroadcastInput(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message, state *UserState) {
+    chatID := message.Chat.ID
+
+    if state.Stage != "awaiting_broadcast_text" {
+        msg := tgbotapi.NewMessage(chatID, "Используйте кнопки выше, чтобы продолжить или отменить рассылку.")
+        sendReply(bot, db, msg)
+        return
+    }
+
+    text := strings.TrimSpace(message.Text)
+    if text == "" || len([]rune(text)) > 4000 {
+        msg := tgbotapi.NewMessage(chatID, "Текст должен содержать от 1 до 4000 символов. Попробуйте еще раз:")
+        sendReply(bot, db, msg)
+        return
+    }
+    state.BroadcastText = text
+    state.Stage = "awaiting_broadcast_audience"
+
+    msg := tgbotapi.NewMessage(chatID, "Выберите получателей:")
+    msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Все участники", "admin_broadcast_aud_all"),
+            tgbotapi.NewInlineKeyboardButtonData("Одна команда", "admin_broadcast_aud_teams"),
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Тимлиды", "admin_broadcast_aud_teamleads"),
+            tgbotapi.NewInlineKeyboardButtonData("Не завершившие регистрацию", "admin_broadcast_aud_unregistered"),
+        ),
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Отмена", "admin_broadcast_cancel"),
+        ),
+    )
+    sendReply(bot, db, msg)
+}
+
+// Отправляет рассылку с ограничением скорости и присылает администратору отчет о доставке
+func runBroadcast(bot *tgbotapi.BotAPI, db *sql.DB, broadcastID int, text string,
+    recipients []BroadcastRecipient, reportChatID int64) {
+    log.Printf("Starting broadcast %d to %d recipients", broadcastID, len(recipients))
+
+    sent := 0
+    var failures []string
+    for i, recipient := range recipients {
+        if i > 0 {
+            time.Sleep(broadcastInterval)
+        }
+
+        sentMessage, err := sendWithRetry(bot, tgbotapi.NewMessage(recipient.ChatID, text))
+        if err == nil {
+            sent++
+        } else {
+            log.Printf("Error sending broadcast %d to %d: %v", broadcastID, recipient.ChatID, err)
+            failures = append(failures, fmt.Sprintf("%s (%d): %v", recipient.Name, recipient.ChatID, err))
+        }
+
+        if err := createBroadcastJournal(db, recipient.ChatID, sentMessage, text, broadcastID, err); err != nil {
+            log.Printf("Error logging message to journal: %v", err)
+        }
+    }
+
+    if err := finishBroadcast(db, broadcastID, sent, len(failures)); err != nil {
+        log.Printf("Error finishing broadcast %d: %v", broadcastID, err)
+    }
+    log.Printf("Finished broadcast %d: sent %d, failed %d", broadcastID, sent, len(failures))
+
+    report := fmt.Sprintf("Рассылка #%d завершена.\nДоставлено: %d\nНе доставлено: %d", broadcastID, sent, len(failures))
+    if len(failures) > 0 {
+        report += "\n\nОшибки:\n" + strings.Join(failures, "\n")
+    }
+    sendReply(bot, db, tgbotapi.NewMessage(reportChatID, truncateMessage(report, 4000)))
+}
+
+// Отправляет сообщение и один раз повторяет попытку, если Telegram просит подождать (429)
+func sendWithRetry(bot *tgbotapi.BotAPI, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+    sentMessage, err := bot.Send(c)
+    var apiErr *tgbotapi.Error
+    if err != nil && errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+        time.Sleep(time.Duration(apiErr.RetryAfter) * time.Second)
+        sentMessage, err = bot.Send(c)
+    }
+    return sentMessage, err
+}
+
+// Описание ошибки отправки для отчета: код и текст ответа Telegram
+func describeSendError(err error) string {
+    var apiErr *tgbotapi.Error
+    if errors.As(err, &apiErr) {
+        return fmt.Sprintf("%d %s", apiErr.Code, apiErr.Message)
+    }
+    return err.Error()
+}
+
+// Отправляет сообщение запуска и записывает попытку в журнал. Результат сохраняется в item.
+func deliverJobItem(bot *tgbotapi.BotAPI, db *sql.DB, item *JobItem) {
+    msg := tgbotapi.NewMessage(item.ChatID, item.Text)
+    if item.Keyboard != nil {
+        msg.ReplyMarkup = *item.Keyboard
+    }
+
+    sentMessage, err := sendWithRetry(bot, msg)
+    if err != nil {
+        log.Printf("Error sending %s to %d: %v", item.Kind, item.ChatID, err)
+        item.Status = "failed"
+        item.Reason = describeSendError(err)
+    } else {
+        item.Status = "sent"
+        item.Reason = ""
+    }
+
+    // Неудачная попытка тоже попадает в журнал, с кодом ошибки Telegram
+    record := item.Journal
+    record.ChatID = item.ChatID
+    record.setDelivery(sentMessage, err)
+    if err := logMessageToJournal(db, record, item.ActionID); err != nil {
+        log.Printf("Error logging message to journal: %v", err)
+    }
+}
+
+func (r *JobReport) count(status string) int {
+    count := 0
+    for _, item := range r.Items {
+        if item.Status == status {
+            count++
+        }
+    }
+    return count
+}
+
+var jobTitles = map[string]string{
+    "member_notifications":   "Уведомления участникам",
+    "teamlead_notifications": "Уведомления тимлидам",
+    "birthday_wishes":        "Поздравления именинникам",
+    "anniversary_wishes":     "Поздравления с годовщиной работы",
+    "payout_reminders":       "Напоминания о переводе денег",
+}
+
+func logJobReport(report *JobReport) {
+    log.Printf("Job %s finished: sent %d, failed %d, skipped %d", report.Job,
+        report.count("sent"), report.count("failed"), report.count("skipped"))
+}
+
+// Отчет о запуске: итоги и список ошибок и пропусков по получателям
+func formatJobReport(title string, report *JobReport) string {
+    var sb strings.Builder
+    sb.WriteString(title)
+    sb.WriteString(fmt.Sprintf("\nОтправлено: %d\nНе отправлено: %d\nПропущено: %d",
+        report.count("sent"), report.count("failed"), report.count("skipped")))
+
+    for _, section := range []struct{ status, header string }{
+        {"failed", "Ошибки"},
+        {"skipped", "Пропущено"},
+    } {
+        var lines []string
+        for _, item := range report.Items {
+            if item.Status != section.status {
+                continue
+            }
+            if item.ChatID != 0 {
+                lines = append(lines, fmt.Sprintf("%s (%d): %s", item.Name, item.ChatID, item.Reason))
+            } else {
+                lines = append(lines, fmt.Sprintf("%s: %s", item.Name, item.Reason))
+            }
+        }
+        if len(lines) > 0 {
+            sb.WriteString("\n\n" + section.header + ":\n" + strings.Join(lines, "\n"))
+        }
+    }
+    return sb.String()
+}
+
+// Отправляет отчет о запуске; при неудачных отправках добавляет кнопку повтора
+func sendJobReportMessage(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, text string, runID, failed int) {
+    msg := tgbotapi.NewMessage(chatID, truncateMessage(text, 4000))
+    if failed > 0 && runID > 0 {
+        msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+            tgbotapi.NewInlineKeyboardRow(
+                tgbotapi.NewInlineKeyboardButtonData("Retry failed", fmt.Sprintf("admin_job_retry_%d", runID)),
+            ),
+        )
+    }
+    sendReply(bot, db, msg)
+}
+
+// Сохраняет итог ручного запуска и отправляет администратору отчет
+func sendJobReport(bot *tgbotapi.BotAPI, db *sql.DB, chatID int64, report *JobReport, err error, errorText string) {
+    if err != nil {
+        log.Printf("Error running job: %v", err)
+    }
+    if report == nil {
+        sendReply(bot, db, tgbotapi.NewMessage(chatID, errorText))
+        return
+    }
+    logJobReport(report)
+
+    if err := saveJobReport(db, report, chatID); err != nil {
+        log.Printf("Error saving job report: %v", err)
+    }
+
+    text := formatJobReport(fmt.Sprintf("%s, запуск #%d", jobTitles[report.Job], report.RunID), report)
+    if len(report.Items) == 0 {
+        text += "\n\nНет получателей для отправки."
+    }
+    if err != nil {
+        text += "\n\nЗапуск прерван ошибкой, часть получателей могла остаться необработанной."
+    }
+    sendJobReportMessage(bot, db, chatID, text, report.RunID, report.count("failed"))
+}
+
+// Повторная отправка неудачных сообщений запуска: admin_job_retry_<run_id>
+func handleJobRetryCallback(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+    chatID := callback.Message.Chat.ID
+    runID, err := strconv.Atoi(strings.TrimPrefix(callback.Data, "admin_job_retry_"))
+    if err != nil {
+        return
+    }
+
+    // Кнопка повтора одноразовая: следующий повтор предлагается в новом отчете
+    edit := tgbotapi.NewEditMessageReplyMarkup(chatID, callback.Message.MessageID,
+        tgbotapi.InlineKeyboardMarkup{InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{}})
+    sendReply(bot, db, edit)
+
+    go func() {
+        job, items, err := claimFailedJobItems(db, runID)
+        if err != nil {
+            log.Printf("Error loading failed items of job run %d: %v", runID, err)
+            sendReply(bot, db, tgbotapi.NewMessage(chatID, "Произошла ошибка при загрузке неудачных отправок."))
+            return
+        }
+        if len(items) == 0 {
+            sendReply(bot, db, tgbotapi.NewMessage(chatID, fmt.Sprintf("В запуске #%d нет неудачных отправок для повтора.", runID)))
+            return
+        }
+
+        report := &JobReport{RunID: runID, Job: job}
+        for i := range items {
+            item := &items[i]
+            if i > 0 {
+                time.Sleep(broadcastInterval)
+            }
+
+            closed, err := isJobItemClosed(db, item)
+            if err != nil {
+                log.Printf("Error checking job item %d: %v", item.ID, err)
+            }
+            if closed {
+                item.Status = "skipped"
+                item.Reason = "задача уже закрыта, отменена или уведомление доставлено"
+            } else {
+                deliverJobItem(bot, db, item)
+            }
+
+            if err := updateJobItem(db, item); err != nil {
+                log.Printf("Error updating job item %d: %v", item.ID, err)
+            }
+            report.Items = append(report.Items, *item)
+        }
+
+        // Задача отмечается отправленной, когда уведомление получили все ее получатели
+        for i := range items {
+            if items[i].Status != "sent" {
+                continue
+            }
+            if err := markJobItemNotified(db, &items[i]); err != nil {
+                log.Printf("Error updating notification status for job item %d: %v", items[i].ID, err)
+            }
+        }
+
+        if err := refreshJobRunCounts(db, runID); err != nil {
+            log.Printf("Error updating job run %d: %v", runID, err)
+        }
+        logJobReport(report)
+
+        text := formatJobReport(fmt.Sprintf("%s, повтор запуска #%d", jobTitles[job], runID), report)
+        sendJobReportMessage(bot, db, chatID, text, runID, report.count("failed"))
+    }()
+}
+
+// Убирает кнопки из отправленных запросов и напоминаний по отмененным сборам
+func closeCancelledTaskMessages(bot *tgbotapi.BotAPI, db *sql.DB, taskIDs []int) {
+    for _, taskID := range taskIDs {
+        closed, err := refreshActionMessages(bot, db, taskID, 0, "cancelled")
+        if err != nil {
+            log.Printf("Error closing messages of cancelled task %d: %v", taskID, err)
+            continue
+        }
+        log.Printf("Closed %d messages of cancelled task %d", closed, taskID)
+    }
+}
+
+// Функции проверки количества событий
+func checkUpcomingBirthdaysCount(db *sql.DB) (int, error) {
+    // Сначала выведем отладочную информацию
+    debugQuery := `
+        SELECT
+            m.id,
+            m.name,
+            m.birthday,
+            CURRENT_DATE as today,
+            CURRENT_DATE + INTERVAL '3 days' as max_date,
+            EXTRACT(MONTH FROM m.birthday) as birth_month,
+            EXTRACT(DAY FROM m.birthday) as birth_day
+        FROM team_members m
+        WHERE m.id IN (13, 14)`
+
+    debugRows, err := db.Query(debugQuery)
+    if err != nil {
+        log.Printf("Debug query error: %v", err)
+    } else {
+        defer debugRows.Close()
+        log.Printf("Debug information for users:")
+        for debugRows.Next() {
+            var (
+                id int
+                name string
+                birthday time.Time
+                today, maxDate time.Time
+                birthMonth, birthDay int
+            )
+            if err := debugRows.Scan(&id, &name, &birthday, &today, &maxDate, &birthMonth, &birthDay); err != nil {
+                log.Printf("Error scanning debug row: %v", err)
+                continue
+            }
+            log.Printf("ID: %d, Name: %s, Birthday: %v, Today: %v, MaxDate: %v, Birth Month/Day: %d/%d",
+                id, name, birthday, today, maxDate, birthMonth, birthDay)
+        }
+    }
+
+    // Теперь выполним основной запрос для подсчета
+    var count int
+    query := `
+        WITH date_range AS (
+            SELECT generate_series(
+                CURRENT_DATE,
+                CURRENT_DATE + INTERVAL '3 days',
+                INTERVAL '1 day'
+            )::date as check_date
+        )
+        SELECT COUNT(DISTINCT m.id)
+        FROM team_members m
+        CROSS JOIN date_range d
+        LEFT JOIN year_tasks yt ON
+            yt.team_member_id = m.id AND
+            yt.year = EXTRACT(YEAR FROM d.check_date)::integer AND
+            yt.kind = 'birthday'
+        WHERE 
+            EXTRACT(MONTH FROM m.birthday) = EXTRACT(MONTH FROM d.check_date)
+            AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM d.check_date)
+            AND yt.id IS NULL
+            AND m.is_active = true
+            AND EXISTS (SELECT 1 FROM teams t WHERE t.id = m.team_id AND t.is_active = true)`
+
+    err = db.QueryRow(query).Scan(&count)
+    log.Printf("Found %d birthdays in range without tasks", count)
+    if err != nil || !anniversaryCollections {
+        return count, err
+    }
+
+    anniversaries, err := countUpcomingAnniversaryTasks(db)
+    log.Printf("Found %d anniversaries in range without tasks", anniversaries)
+    return count + anniversaries, err
+}
+
+func checkPendingActionsCount(db *sql.DB) (int, error) {
+    var count int
+    query := `
+        SELECT COUNT(*)
+        FROM year_tasks yt
+        LEFT JOIN actions a ON yt.id = a.task_id
+        WHERE a.id IS NULL
+        AND yt.is_members_notified = false`
+
+    err := db.QueryRow(query).Scan(&count)
+    return count, err
+}
+
+func checkPendingMemberNotificationsCount(db *sql.DB) (int, error) {
+    var count int
+    query := `
+        SELECT COUNT(*)
+        FROM year_tasks yt
+        WHERE yt.is_members_notified = false
+        AND EXISTS (
+            SELECT 1 FROM actions a
+            WHERE a.task_id = yt.id
+            AND a.type = 'request'
+            AND a.is_done = false
+        )`
+
+    err := db.QueryRow(query).Scan(&count)
+    return count, err
+}
+
+func checkPendingTeamLeadNotificationsCount(db *sql.DB) (int, error) {
+    var count int
+    query := `
+        SELECT COUNT(*)
+        FROM year_tasks yt
+        WHERE yt.is_teamlead_notified = false
+        AND EXISTS (
+            SELECT 1 FROM actions a
+            WHERE a.task_id = yt.id
+            AND a.type = 'request'
+            AND a.is_done = true
+        )`
+
+    err := db.QueryRow(query).Scan(&count)
+    return count, err
+}
+
+func checkTodayBirthdaysCount(db *sql.DB) (int, error) {
+    var count int
+    query := `
+        SELECT COUNT(*)
+        FROM team_members
+        WHERE EXTRACT(MONTH FROM birthday) = EXTRACT(MONTH FROM CURRENT_DATE)
+        AND EXTRACT(DAY FROM birthday) = EXTRACT(DAY FROM CURRENT_DATE)
+        AND is_active = true`
+
+    err := db.QueryRow(query).Scan(&count)
+    return count, err
+}
+
+func checkTodayAnniversariesCount(db *sql.DB) (int, error) {
+    var count int
+    query := `
+        SELECT COUNT(*)
+        FROM team_members
+        WHERE EXTRACT(MONTH FROM hire_date) = EXTRACT(MONTH FROM CURRENT_DATE)
+        AND EXTRACT(DAY FROM hire_date) = EXTRACT(DAY FROM CURRENT_DATE)
+        AND hire_date < CURRENT_DATE
+        AND is_active = true`
+
+    err := db.QueryRow(query).Scan(&count)
+    return count, err
+}
+
+func checkPendingPayoutRemindersCount(db *sql.DB) (int, error) {
+    var count int
+    query := `
+        SELECT COUNT(DISTINCT yt.id)
+        FROM year_tasks yt
+        JOIN actions a ON a.task_id = yt.id
+        WHERE yt.is_money_transfered = false
+        AND yt.cancelled_at IS NULL
+        AND a.type = 'payout'
+        AND a.is_done = false
+        AND yt.is_teamlead_notified = true`
+
+    err := db.QueryRow(query).Scan(&count)
+    if err != nil {
+        log.Printf("Error in checkPendingPayoutRemindersCount: %v", err)
+        return 0, err
+    }
+    log.Printf("Found %d pending payout reminders", count)
+    return count, nil
+}
+
+func sendPayoutRemindersOnce(db *sql.DB, bot *tgbotapi.BotAPI) (*JobReport, error) {
+    query := `
+        SELECT
+            a.id as action_id,
+            tl.telegram_chat_id as teamlead_chat_id,
+            tl.name as teamlead_name,
+            bm.name as birthday_person_name,
+            bm.phone_number as birthday_person_phone,
+            yt.id as task_id
+        FROM actions a
+        JOIN year_tasks yt ON a.task_id = yt.id
+        JOIN team_members bm ON yt.team_member_id = bm.id
+        JOIN team_members tl ON a.team_member_id = tl.id
+        WHERE a.type = 'payout'
+        AND a.is_done = false
+        AND yt.is_money_transfered = false
+        AND yt.cancelled_at IS NULL`
+
+    rows, err := db.Query(query)
+    if err != nil {
+        return nil, fmt.Errorf("error querying payout reminders: %v", err)
+    }
+    defer rows.Close()
+
+    report := &JobReport{Job: "payout_reminders"}
+    for rows.Next() {
+        var (
+            actionID           int
+            teamleadChatID     sql.NullInt64
+            teamleadName       string
+            birthdayPersonName string
+            birthdayPersonPhone string
+            taskID             int
+        )
+
+        err := rows.Scan(&actionID, &teamleadChatID, &teamleadName, &birthdayPersonName, &birthdayPersonPhone, &taskID)
+        if err != nil {
+            log.Printf("Error scanning payout reminder data: %v", err)
+            continue
+        }
+
+        // Создаем сообщение с кнопкой
+        keyboard := payoutReminderKeyboard(actionID, taskID)
+        messageText := formatPayoutReminderText(birthdayPersonName, birthdayPersonPhone)
+        item := JobItem{
+            Kind:     "payout_reminder",
+            ChatID:   teamleadChatID.Int64,
+            Name:     teamleadName,
+            Text:     messageText,
+            Keyboard: &keyboard,
+            Journal:  payoutReminderJournal(messageText, keyboard, birthdayPersonName, birthdayPersonPhone),
+            ActionID: sql.NullInt64{Int64: int64(actionID), Valid: true},
+        }
+        if !teamleadChatID.Valid {
+            item.Status = "skipped"
+            item.Reason = "не зарегистрирован в боте"
+        } else {
+            deliverJobItem(bot, db, &item)
+        }
+        report.Items = append(report.Items, item)
+    }
+
+    if err = rows.Err(); err != nil {
+        return report, fmt.Errorf("error iterating over payout reminders: %v", err)
+    }
+
+    return report, nil
+}
+
+func formatPayoutReminderText(birthdayPersonName, birthdayPersonPhone string) string {
+    return fmt.Sprintf("Напоминание: необходимо перевести деньги %s (тел: %s)",
+        birthdayPersonName, birthdayPersonPhone)
+}
+
+func payoutReminderKeyboard(actionID, taskID int) tgbotapi.InlineKeyboardMarkup {
+    return tgbotapi.NewInlineKeyboardMarkup(
+        tgbotapi.NewInlineKeyboardRow(
+            tgbotapi.NewInlineKeyboardButtonData("Готово, перевел", fmt.Sprintf("payout_done_%d_%d", actionID, taskID)),
+        ),
+    )
+}
+
+func handleTeamSelection(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+        userID := callback.From.ID
+        state, exists := userStates[userID]
+        if !exists || state.Stage != "awaiting_team" {
+                return
+        }
+
+        // Извлекаем ID команды из callback data
+        parts := strings.Split(callback.Data, "_")
+        if len(parts) != 2 {
+                return
+        }
+
+        teamID, err := strconv.Atoi(parts[1])
+        if err != nil {
+                return
+        }
+
+        // Добавляем пользователя в базу данных
+        err = addBirthday(db, state.Name, state.Birthday, state.PhoneNumber, teamID, callback.Message.Chat.ID)
+        if err != nil {
+                log.Printf("Error adding birthday: %v", err)
+                msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Произошла ошибка при сохранении данных")
+                sendReply(bot, db, msg)
+                return
+        }
+
+        // Отправляем подтверждение
+        msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Спасибо, данные приняты!")
+        sendReply(bot, db, msg)
+
+        // Удаляем клавиатуру
+        edit := tgbotapi.NewEditMessageReplyMarkup(
+                callback.Message.Chat.ID,
+                callback.Message.MessageID,
+                tgbotapi.InlineKeyboardMarkup{})
+        sendReply(bot, db, edit)
+
+        // Очищаем состояние пользователя
+        delete(userStates, userID)
+}
+
+func checkUpcomingBirthdaysOnce(db *sql.DB) (int, error) {
+    // Проверяем дни рождения через 3 дня
+    query := `
+        WITH date_range AS (
+            SELECT generate_series(
+                CURRENT_DATE,
+                CURRENT_DATE + INTERVAL '3 days',
+                INTERVAL '1 day'
+            )::date as check_date
+        )
+        SELECT DISTINCT
+            m.id,
+            m.name,
+            m.birthday,
+            d.check_date,
+            EXTRACT(MONTH FROM m.birthday) as birth_month,
+            EXTRACT(DAY FROM m.birthday) as birth_day,
+            EXTRACT(MONTH FROM d.check_date) as check_month,
+            EXTRACT(DAY FROM d.check_date) as check_day,
+            yt.id as task_id
+        FROM team_members m
+        CROSS JOIN date_range d
+        LEFT JOIN year_tasks yt ON
+            yt.team_member_id = m.id AND
+            yt.year = EXTRACT(YEAR FROM d.check_date)::integer AND
+            yt.kind = 'birthday'
+        WHERE m.id IN (13, 14)  -- Временно добавим фильтр для отладки
+        ORDER BY m.id, d.check_date`
+
+    // Сначала выведем отладочную информацию
+    debugRows, err := db.Query(query)
+    if err != nil {
+        return 0, fmt.Errorf("error in debug query: %v", err)
+    }
+    defer debugRows.Close()
+
+    log.Printf("Debug information for birthday checks:")
+    for debugRows.Next() {
+        var (
+            id int
+            name string
+            birthday time.Time
+            checkDate time.Time
+            birthMonth, birthDay, checkMonth, checkDay int
+            taskID sql.NullInt64
+        )
+        if err := debugRows.Scan(&id, &name, &birthday, &checkDate, &birthMonth, &birthDay, &checkMonth, &checkDay, &taskID); err != nil {
+            log.Printf("Error scanning debug row: %v", err)
+            continue
+        }
+        log.Printf("ID: %d, Name: %s, Birthday: %v, Check Date: %v, Birth Month/Day: %d/%d, Check Month/Day: %d/%d, Task ID: %v",
+            id, name, birthday, checkDate, birthMonth, birthDay, checkMonth, checkDay, taskID.Int64)
+    }
+
+    // Теперь выполним основной запрос для создания задач
+    query = `
+        WITH date_range AS (
+            SELECT generate_series(
+                CURRENT_DATE,
+                CURRENT_DATE + INTERVAL '3 days',
+                INTERVAL '1 day'
+            )::date as check_date
+        )
+        SELECT DISTINCT
+            m.id
+        FROM team_members m
+        CROSS JOIN date_range d
+        LEFT JOIN year_tasks yt ON
+            yt.team_member_id = m.id AND
+            yt.year = EXTRACT(YEAR FROM d.check_date)::integer AND
+            yt.kind = 'birthday'
+        WHERE 
+            EXTRACT(MONTH FROM m.birthday) = EXTRACT(MONTH FROM d.check_date)
+            AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM d.check_date)
+            AND yt.id IS NULL
+            AND m.is_active = true
+            AND EXISTS (SELECT 1 FROM teams t WHERE t.id = m.team_id AND t.is_active = true)`
+
+    rows, err := db.Query(query)
+    if err != nil {
+        return 0, fmt.Errorf("error checking upcoming birthdays: %v", err)
+    }
+    defer rows.Close()
+
+    tasksCreated := 0
+    currentYear := time.Now().Year()
+    for rows.Next() {
+        var memberID int
+        if err := rows.Scan(&memberID); err != nil {
+            log.Printf("Error scanning member ID: %v", err)
+            continue
+        }
+
+        // Создаем новую задачу для дня рождения
+        result, err := db.Exec(`
+            INSERT INTO year_tasks (year, team_member_id)
+            VALUES ($1, $2)`,
+            currentYear, memberID)
+        if err != nil {
+            log.Printf("Error creating year task: %v", err)
+            continue
+        }
+
+        rowsAffected, _ := result.RowsAffected()
+        tasksCreated += int(rowsAffected)
+    }
+
+    if err = rows.Err(); err != nil {
+        return tasksCreated, fmt.Errorf("error iterating over members: %v", err)
+    }
+
+    // Годовщины работы проходят тот же путь, если для них включены сборы
+    if anniversaryCollections {
+        count, err := createAnniversaryTasks(db)
+        if err != nil {
+            log.Printf("Error creating anniversary tasks: %v", err)
+        }
+        tasksCreated += count
+    }
+
+    // Сразу закрепляем получателя переводов за новыми задачами
+    if err := assignTaskCollectors(db); err != nil {
+        log.Printf("Error assigning task collectors: %v", err)
+    }
+
+    if tasksCreated == 0 {
+        return 0, fmt.Errorf("no new tasks created")
+    }
+
+    return tasksCreated, nil
+}
+
+func checkUpcomingBirthdays(db *sql.DB) {
+    for {
+        // Ждем до 00:01 по московскому времени
+        now := time.Now()
+        next := time.Date(now.Year(), now.Month(), now.Day(), 0, 1, 0, 0, time.Local)
+        if now.After(next) {
+            next = next.Add(24 * time.Hour)
+        }
+        time.Sleep(time.Until(next))
+
+        // Проверяем и создаем задачи
+        count, err := checkUpcomingBirthdaysOnce(db)
+        if err != nil && err.Error() != "no new tasks created" {
+            log.Printf("Error in scheduled birthday check: %v", err)
+        } else if count > 0 {
+            log.Printf("Created %d new birthday tasks", count)
+        }
+    }
+}
+
+// Ночное обслуживание журнала сообщений: секции на текущий и следующий месяц,
+// архивация секций старше срока хранения и отчет администраторам об архивации
+func runJournalMaintenance(db *sql.DB, bot *tgbotapi.BotAPI) {
+    for {
+        // Ждем до 03:30 по московскому времени
+        now := time.Now()
+        next := time.Date(now.Year(), now.Month(), now.Day(), 3, 30, 0, 0, time.Local)
+        if now.After(next) {
+            next = next.Add(24 * time.Hour)
+        }
+        time.Sleep(time.Until(next))
+
+        report := maintainJournal(db, time.Now())
+        for _, name := range report.CreatedPartitions {
+            log.Printf("Created journal partition %s", name)
+        }
+        for _, archive := range report.Archived {
+            log.Printf("Archived journal for %s: %d records to %s", archive.Month.Format("2006-01"), archive.Rows, archive.FilePath)
+        }
+        for _, text := range report.Errors {
+            log.Printf("Journal maintenance error: %s", text)
+        }
+
+        // Администраторам пишем, только если что-то заархивировано или произошла ошибка
+        if len(report.Archived) == 0 && len(report.Errors) == 0 {
+            continue
+        }
+        adminChatIDs, err := getAdminChatIDs(db)
+        if err != nil {
+            log.Printf("Error getting admins for journal maintenance report: %v", err)
+            continue
+        }
+        text := formatJournalMaintenanceReport(report)
+        for _, chatID := range adminChatIDs {
+            msg := tgbotapi.NewMessage(chatID, truncateMessage(text, 4000))
+            if _, err := sendReply(bot, db, msg); err != nil {
+                log.Printf("Error sending journal maintenance report to %d: %v", chatID, err)
+            }
+        }
+    }
+}
+
+func formatJournalMaintenanceReport(report *JournalMaintenanceReport) string {
+    var sb strings.Builder
+    sb.WriteString("Обслуживание журнала сообщений")
+    if len(report.Archived) > 0 {
+        sb.WriteString(fmt.Sprintf("\n\nЗаархивировано месяцев: %d (срок хранения %d мес.)", len(report.Archived), journalRetentionMonths))
+        for _, archive := range report.Archived {
+            sb.WriteString(fmt.Sprintf("\n%s: %d записей, %s (%d КБ)", archive.Month.Format("01.2006"), archive.Rows,
+                archive.FilePath, (archive.Size+1023)/1024))
+        }
+    }
+    if len(report.CreatedPartitions) > 0 {
+        sb.WriteString("\n\nСозданы секции: " + strings.Join(report.CreatedPartitions, ", "))
+    }
+    if len(report.Errors) > 0 {
+        sb.WriteString("\n\nОшибки:\n" + strings.Join(report.Errors, "\n"))
+    }
+    return sb.String()
+}
+
+func getTodaysBirthdays(db *sql.DB) ([]TeamMember, error) {
+        query := `
+                SELECT m.id, m.name, m.birthday, m.team_id, t.name as team_name
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                WHERE t.is_active = true
+                AND m.is_active = true
+                AND EXTRACT(MONTH FROM birthday) = EXTRACT(MONTH FROM CURRENT_DATE)
+                AND EXTRACT(DAY FROM birthday) = EXTRACT(DAY FROM CURRENT_DATE)`
+
+        return queryBirthdays(db, query)
+}
+
+func getUpcomingBirthdays(db *sql.DB) ([]TeamMember, error) {
+        query := `
+                WITH birthday_dates AS (
+                        SELECT 
+                                id,
+                                birthday,
+                                (CASE 
+                                        WHEN (birthday + ((EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM birthday))::integer * INTERVAL '1 year')) < CURRENT_DATE
+                                        THEN (birthday + ((EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM birthday) + 1)::integer * INTERVAL '1 year'))
+                                        ELSE (birthday + ((EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM birthday))::integer * INTERVAL '1 year'))
+                                END) as next_birthday
+                        FROM team_members
+                )
+                SELECT 
+                        m.id, 
+                        m.name, 
+                        m.birthday, 
+                        m.team_id,
+                        t.name as team_name,
+                        m.phone_number
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                JOIN birthday_dates bd ON m.id = bd.id
+                WHERE t.is_active = true
+                AND m.is_active = true
+                AND bd.next_birthday <= CURRENT_DATE + INTERVAL '30 days'
+                AND bd.next_birthday >= CURRENT_DATE
+                ORDER BY bd.next_birthday`
+
+        return queryBirthdays(db, query)
+}
+
+// Годовщины работы в ближайшие 3 дня, для которых еще нет задачи: участник, год задачи, число лет
+const upcomingAnniversaryTasksQuery = `
+        WITH date_range AS (
+                SELECT generate_series(
+                        CURRENT_DATE,
+                        CURRENT_DATE + INTERVAL '3 days',
+                        INTERVAL '1 day'
+                )::date as check_date
+        )
+        SELECT DISTINCT
+                m.id,
+                EXTRACT(YEAR FROM d.check_date)::integer as task_year,
+                EXTRACT(YEAR FROM d.check_date)::integer - EXTRACT(YEAR FROM m.hire_date)::integer as years
+        FROM team_members m
+        CROSS JOIN date_range d
+        LEFT JOIN year_tasks yt ON
+                yt.team_member_id = m.id AND
+                yt.year = EXTRACT(YEAR FROM d.check_date)::integer AND
+                yt.kind = 'anniversary'
+        WHERE
+                EXTRACT(MONTH FROM m.hire_date) = EXTRACT(MONTH FROM d.check_date)
+                AND EXTRACT(DAY FROM m.hire_date) = EXTRACT(DAY FROM d.check_date)
+                AND m.hire_date < d.check_date
+                AND yt.id IS NULL
+                AND m.is_active = true
+                AND EXISTS (SELECT 1 FROM teams t WHERE t.id = m.team_id AND t.is_active = true)`
+
+func countUpcomingAnniversaryTasks(db *sql.DB) (int, error) {
+        var count int
+        err := db.QueryRow("SELECT COUNT(*) FROM (" + upcomingAnniversaryTasksQuery + ") upcoming").Scan(&count)
+        return count, err
+}
+
+// Создает задачи kind = 'anniversary' на годовщины работы через 3 дня.
+// Дальше задача проходит тот же путь, что и день рождения: запросы, уведомления, выплата
+func createAnniversaryTasks(db *sql.DB) (int, error) {
+        rows, err := db.Query(upcomingAnniversaryTasksQuery)
+        if err != nil {
+                return 0, fmt.Errorf("error checking upcoming anniversaries: %v", err)
+        }
+        defer rows.Close()
+
+        type anniversaryTask struct {
+                memberID, year, years int
+        }
+        var tasks []anniversaryTask
+        for rows.Next() {
+                var task anniversaryTask
+                if err := rows.Scan(&task.memberID, &task.year, &task.years); err != nil {
+                        return 0, fmt.Errorf("error scanning anniversary: %v", err)
+                }
+                tasks = append(tasks, task)
+        }
+        if err := rows.Err(); err != nil {
+                return 0, fmt.Errorf("error iterating over anniversaries: %v", err)
+        }
+
+        created := 0
+        for _, task := range tasks {
+                _, err := db.Exec(`
+                        INSERT INTO year_tasks (year, team_member_id, kind, title)
+                        VALUES ($1, $2, 'anniversary', $3)`,
+                        task.year, task.memberID, formatYears(task.years)+" в компании")
+                if err != nil {
+                        log.Printf("Error creating anniversary task for member %d: %v", task.memberID, err)
+                        continue
+                }
+                created++
+        }
+        return created, nil
+}
+
+// Годовщины работы в ближайшие 30 дней (не меньше года с даты приема)
+func getUpcomingAnniversaries(db *sql.DB) ([]Anniversary, error) {
+        rows, err := db.Query(`
+                WITH anniversary_dates AS (
+                        SELECT
+                                id,
+                                (CASE
+                                        WHEN hire_date + make_interval(years => (EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM hire_date))::integer) < CURRENT_DATE
+                                        THEN hire_date + make_interval(years => (EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM hire_date))::integer + 1)
+                                        ELSE hire_date + make_interval(years => (EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM hire_date))::integer)
+                                END)::date as next_anniversary
+                        FROM team_members
+                        WHERE hire_date IS NOT NULL
+                )
+                SELECT
+                        m.id,
+                        m.name,
+                        m.team_id,
+                        t.name as team_name,
+                        ad.next_anniversary,
+                        EXTRACT(YEAR FROM ad.next_anniversary)::integer - EXTRACT(YEAR FROM m.hire_date)::integer
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                JOIN anniversary_dates ad ON m.id = ad.id
+                WHERE t.is_active = true
+                AND m.is_active = true
+                AND ad.next_anniversary > m.hire_date
+                AND ad.next_anniversary <= CURRENT_DATE + INTERVAL '30 days'
+                AND ad.next_anniversary >= CURRENT_DATE
+                ORDER BY ad.next_anniversary`)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var anniversaries []Anniversary
+        for rows.Next() {
+                var anniversary Anniversary
+                err := rows.Scan(
+                        &anniversary.Member.ID,
+                        &anniversary.Member.Name,
+                        &anniversary.Member.TeamID,
+                        &anniversary.Member.TeamName,
+                        &anniversary.Date,
+                        &anniversary.Years,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                anniversaries = append(anniversaries, anniversary)
+        }
+        return anniversaries, rows.Err()
+}
+
+func queryBirthdays(db *sql.DB, query string) ([]TeamMember, error) {
+        rows, err := db.Query(query)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var birthdays []TeamMember
+        for rows.Next() {
+                var member TeamMember
+                err := rows.Scan(
+                        &member.ID,
+                        &member.Name,
+                        &member.Birthday,
+                        &member.TeamID,
+                        &member.TeamName,
+                        &member.PhoneNumber,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                birthdays = append(birthdays, member)
+        }
+
+        return birthdays, nil
+}
+
+func getActiveTeams(db *sql.DB) ([]Team, error) {
+        query := `
+                SELECT id, name, is_active
+                FROM teams
+                WHERE is_active = true
+                ORDER BY name`
+
+        rows, err := db.Query(query)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var teams []Team
+        for rows.Next() {
+                var team Team
+                err := rows.Scan(&team.ID, &team.Name, &team.IsActive)
+                if err != nil {
+                        return nil, err
+                }
+                teams = append(teams, team)
+        }
+
+        return teams, nil
+}
+
+func countMembers(db *sql.DB) (int, error) {
+        var count int
+        err := db.QueryRow("SELECT COUNT(*) FROM team_members").Scan(&count)
+        return count, err
+}
+
+// Ищет участников по части имени или номера телефона; пустой запрос возвращает всех
+func searchMembers(db *sql.DB, search string, limit, offset int) ([]MemberRecord, error) {
+        digits := strings.Map(func(r rune) rune {
+                if r >= '0' && r <= '9' {
+                        return r
+                }
+                return -1
+        }, search)
+
+        rows, err := db.Query(`
+                SELECT m.id, m.name, m.birthday, m.team_id, t.name, m.phone_number, m.telegram_chat_id, m.is_active
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                WHERE $1 = ''
+                OR m.name ILIKE '%' || $1 || '%'
+                OR ($2 != '' AND regexp_replace(m.phone_number, '\D', '', 'g') LIKE '%' || $2 || '%')
+                ORDER BY m.name, m.id
+                LIMIT $3 OFFSET $4`,
+                search, digits, limit, offset)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var members []MemberRecord
+        for rows.Next() {
+                var member MemberRecord
+                var telegramChatID sql.NullInt64
+                err := rows.Scan(
+                        &member.ID,
+                        &member.Name,
+                        &member.Birthday,
+                        &member.TeamID,
+                        &member.TeamName,
+                        &member.PhoneNumber,
+                        &telegramChatID,
+                        &member.IsActive,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                member.TelegramChatID = telegramChatID.Int64
+                members = append(members, member)
+        }
+
+        return members, rows.Err()
+}
+
+func getMemberRecord(db *sql.DB, memberID int) (*MemberRecord, error) {
+        var member MemberRecord
+        var telegramChatID sql.NullInt64
+        err := db.QueryRow(`
+                SELECT m.id, m.name, m.birthday, m.team_id, t.name, m.phone_number, m.telegram_chat_id, m.is_active, m.hire_date
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                WHERE m.id = $1`,
+                memberID).Scan(
+                &member.ID,
+                &member.Name,
+                &member.Birthday,
+                &member.TeamID,
+                &member.TeamName,
+                &member.PhoneNumber,
+                &telegramChatID,
+                &member.IsActive,
+                &member.HireDate,
+        )
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        member.TelegramChatID = telegramChatID.Int64
+
+        return &member, nil
+}
+
+// Поля участника, которые может менять администратор
+var editableMemberColumns = map[string]bool{
+        "name":             true,
+        "birthday":         true,
+        "hire_date":        true,
+        "team_id":          true,
+        "phone_number":     true,
+        "telegram_chat_id": true,
+        "is_active":        true,
+}
+
+// Изменяет поле участника и записывает изменение в member_audit
+func updateMemberField(db *sql.DB, memberID int, column string, value interface{}, adminChatID int64) error {
+        if !editableMemberColumns[column] {
+                return fmt.Errorf("unknown member column %q", column)
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+
+        var oldValue string
+        err = tx.QueryRow(fmt.Sprintf(`
+                SELECT COALESCE(%s::text, '')
+                FROM team_members
+                WHERE id = $1
+                FOR UPDATE`, column),
+                memberID).Scan(&oldValue)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        var newValue string
+        err = tx.QueryRow(fmt.Sprintf(`
+                UPDATE team_members
+                SET %s = $1
+                WHERE id = $2
+                RETURNING COALESCE(%s::text, '')`, column, column),
+                value, memberID).Scan(&newValue)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        if err := logMemberAudit(tx, memberID, adminChatID, "edit_"+column, oldValue, newValue); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+// Деактивирует участника и отменяет открытый сбор на его день рождения.
+// Возвращает ID отмененных задач.
+func deactivateMember(db *sql.DB, memberID int, adminChatID int64) ([]int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return nil, err
+        }
+
+        _, err = tx.Exec("UPDATE team_members SET is_active = false WHERE id = $1", memberID)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        taskIDs, err := cancelOpenTasks(tx, "bm.id = $1", memberID)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        if err := logMemberAudit(tx, memberID, adminChatID, "deactivate", "true", "false"); err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        if err := tx.Commit(); err != nil {
+                return nil, err
+        }
+        return taskIDs, nil
+}
+
+// Удаляет участника без истории сборов и ролей; возвращает false, если удалить нельзя
+func deleteMember(db *sql.DB, memberID int, adminChatID int64) (bool, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return false, err
+        }
+
+        var hasHistory bool
+        var summary string
+        err = tx.QueryRow(`
+                SELECT
+                        EXISTS (SELECT 1 FROM year_tasks WHERE team_member_id = m.id OR collector_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM actions WHERE team_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM teamleads WHERE team_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM treasurers WHERE team_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM teamlead_backups WHERE team_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM teamlead_absences WHERE team_member_id = m.id OR delegate_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM collection_phone_overrides WHERE team_member_id = m.id)
+                        OR EXISTS (SELECT 1 FROM hr_staff WHERE team_member_id = m.id),
+                        m.name || ', ' || to_char(m.birthday, 'DD.MM.YYYY') || ', ' || m.phone_number
+                FROM team_members m
+                WHERE m.id = $1
+                FOR UPDATE`,
+                memberID).Scan(&hasHistory, &summary)
+        if err != nil {
+                tx.Rollback()
+                return false, err
+        }
+        if hasHistory {
+                tx.Rollback()
+                return false, nil
+        }
+
+        if _, err := tx.Exec("DELETE FROM team_members WHERE id = $1", memberID); err != nil {
+                tx.Rollback()
+                return false, err
+        }
+
+        if err := logMemberAudit(tx, memberID, adminChatID, "delete", summary, ""); err != nil {
+                tx.Rollback()
+                return false, err
+        }
+
+        if err := tx.Commit(); err != nil {
+                return false, err
+        }
+        return true, nil
+}
+
+func isMemberHR(db *sql.DB, memberID int) (bool, error) {
+        var exists bool
+        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM hr_staff WHERE team_member_id = $1)", memberID).Scan(&exists)
+        return exists, err
+}
+
+// Выдает или снимает роль HR и записывает изменение в member_audit
+func setMemberHR(db *sql.DB, memberID int, isHR bool, adminChatID int64) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+
+        action := "revoke_hr"
+        query := "DELETE FROM hr_staff WHERE team_member_id = $1"
+        if isHR {
+                action = "grant_hr"
+                query = "INSERT INTO hr_staff (team_member_id) VALUES ($1) ON CONFLICT (team_member_id) DO NOTHING"
+        }
+        if _, err := tx.Exec(query, memberID); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        if err := logMemberAudit(tx, memberID, adminChatID, action, strconv.FormatBool(!isHR), strconv.FormatBool(isHR)); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+// Записывает изменение участника в member_audit (история в карточке) и в общий журнал аудита
+func logMemberAudit(tx *sql.Tx, memberID int, adminChatID int64, action, oldValue, newValue string) error {
+        _, err := tx.Exec(`
+                INSERT INTO member_audit (team_member_id, admin_chat_id, action, old_value, new_value)
+                VALUES ($1, $2, $3, $4, $5)`,
+                memberID, adminChatID, action, oldValue, newValue)
+        if err != nil {
+                return err
+        }
+        return logAudit(tx, adminChatID, action, "member", int64(memberID), oldValue, newValue)
+}
+
+// Общий интерфейс *sql.DB и *sql.Tx для записи аудита внутри и вне транзакции
+type sqlExecer interface {
+        Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Добавляет запись в журнал аудита audit_log. Таблица только пополняется:
+// изменение и удаление записей запрещены триггером.
+// actorChatID = 0 означает изменение из конфигурации; пустые значения сохраняются как NULL.
+func logAudit(exec sqlExecer, actorChatID int64, action, targetType string, targetID int64, oldValue, newValue string) error {
+        _, err := exec.Exec(`
+                INSERT INTO audit_log (actor_chat_id, action, target_type, target_id, old_value, new_value)
+                VALUES ($1, $2, NULLIF($3, ''), $4, NULLIF($5, ''), NULLIF($6, ''))`,
+                sql.NullInt64{Int64: actorChatID, Valid: actorChatID != 0}, action, targetType,
+                sql.NullInt64{Int64: targetID, Valid: targetID != 0}, oldValue, newValue)
+        if err != nil {
+                return fmt.Errorf("error writing audit log: %v", err)
+        }
+        return nil
+}
+
+// Показатели сборов по командам с датой праздника в [from, to) и итоговая строка (TeamID = 0).
+// Время запроса берется из записи журнала member_notification, время перевода и выплаты —
+// из первого успешного нажатия кнопки в callback_interactions.
+func getCollectionStats(db *sql.DB, from, to time.Time) ([]CollectionStats, error) {
+        rows, err := db.Query(`
+                WITH period_tasks AS (
+                        SELECT yt.id, bm.team_id, get_task_event_date(yt.id) as event_date, yt.is_money_transfered
+                        FROM year_tasks yt
+                        JOIN team_members bm ON yt.team_member_id = bm.id
+                        WHERE yt.cancelled_at IS NULL
+                        AND get_task_event_date(yt.id) >= $1::date
+                        AND get_task_event_date(yt.id) < $2::date
+                ),
+                requests AS (
+                        SELECT
+                                pt.team_id,
+                                a.is_done,
+                                (SELECT MIN(j.created_at)
+                                 FROM api_messages_journal j
+                                 WHERE j.action_id = a.id
+                                 AND j.message->>'type' = 'member_notification'
+                                 AND j.message_id IS NOT NULL) as requested_at,
+                                (SELECT MIN(ci.pressed_at)
+                                 FROM callback_interactions ci
+                                 WHERE ci.data = 'transfer_done_' || a.id
+                                 AND ci.outcome IN ('ok', 'unknown')) as done_at
+                        FROM period_tasks pt
+                        JOIN actions a ON a.task_id = pt.id AND a.type = 'request'
+                ),
+                payouts AS (
+                        SELECT
+                                pt.team_id,
+                                (SELECT MIN(ci.pressed_at)
+                                 FROM callback_interactions ci
+                                 JOIN actions a ON ci.data = 'payout_done_' || a.id || '_' || a.task_id
+                                 WHERE a.task_id = pt.id
+                                 AND a.type = 'payout'
+                                 AND ci.outcome IN ('ok', 'unknown'))::date - pt.event_date as days
+                        FROM period_tasks pt
+                        WHERE pt.is_money_transfered
+                ),
+                facts AS (
+                        SELECT team_id, 'task' as kind, NULL::boolean as is_done, NULL::float8 as hours, NULL::float8 as days
+                        FROM period_tasks
+                        UNION ALL
+                        SELECT team_id, 'request', is_done, EXTRACT(EPOCH FROM done_at - requested_at) / 3600, NULL
+                        FROM requests
+                        UNION ALL
+                        SELECT team_id, 'payout', NULL, NULL, days
+                        FROM payouts
+                )
+                SELECT
+                        COALESCE(f.team_id, 0),
+                        COALESCE(MAX(t.name), ''),
+                        COUNT(*) FILTER (WHERE f.kind = 'task'),
+                        COUNT(*) FILTER (WHERE f.kind = 'request'),
+                        COUNT(*) FILTER (WHERE f.kind = 'request' AND f.is_done),
+                        AVG(f.hours),
+                        percentile_cont(0.5) WITHIN GROUP (ORDER BY f.days)
+                FROM facts f
+                LEFT JOIN teams t ON t.id = f.team_id
+                GROUP BY ROLLUP (f.team_id)
+                ORDER BY f.team_id IS NULL, MAX(t.name)`,
+                from, to)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var result []CollectionStats
+        for rows.Next() {
+                var stats CollectionStats
+                err := rows.Scan(&stats.TeamID, &stats.TeamName, &stats.Celebrations, &stats.Requests,
+                        &stats.DoneRequests, &stats.AvgHoursToDone, &stats.MedianPayoutDays)
+                if err != nil {
+                        return nil, err
+                }
+                result = append(result, stats)
+        }
+        return result, rows.Err()
+}
+
+// Записи журнала аудита по фильтру, новые первыми
+func getAuditLog(db *sql.DB, filter AuditFilter) ([]AuditEntry, error) {
+        var conditions []string
+        var args []interface{}
+        addCondition := func(condition string, arg interface{}) {
+                args = append(args, arg)
+                conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+        }
+        if filter.ActorChatID != 0 {
+                addCondition("l.actor_chat_id = $%d", filter.ActorChatID)
+        }
+        if filter.Action != "" {
+                addCondition("l.action ILIKE '%%' || $%d || '%%'", filter.Action)
+        }
+        if filter.TargetType != "" {
+                addCondition("l.target_type = $%d", filter.TargetType)
+        }
+        if filter.TargetID != 0 {
+                addCondition("l.target_id = $%d", filter.TargetID)
+        }
+        if !filter.From.IsZero() {
+                addCondition("l.created_at >= $%d", filter.From)
+        }
+        if !filter.To.IsZero() {
+                addCondition("l.created_at < $%d", filter.To)
+        }
+
+        query := `
+                SELECT l.id, l.actor_chat_id, COALESCE(tm.name, bu.first_name, ''), l.action,
+                        COALESCE(l.target_type, ''), l.target_id, COALESCE(l.old_value, ''), COALESCE(l.new_value, ''),
+                        l.created_at
+                FROM audit_log l
+                LEFT JOIN team_members tm ON tm.telegram_chat_id = l.actor_chat_id
+                LEFT JOIN bot_users bu ON bu.telegram_chat_id = l.actor_chat_id`
+        if len(conditions) > 0 {
+                query += "\n                WHERE " + strings.Join(conditions, " AND ")
+        }
+        args = append(args, filter.Limit)
+        query += fmt.Sprintf("\n                ORDER BY l.created_at DESC, l.id DESC\n                LIMIT $%d", len(args))
+
+        rows, err := db.Query(query, args...)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var entries []AuditEntry
+        for rows.Next() {
+                var entry AuditEntry
+                err := rows.Scan(&entry.ID, &entry.ActorChatID, &entry.ActorName, &entry.Action,
+                        &entry.TargetType, &entry.TargetID, &entry.OldValue, &entry.NewValue, &entry.CreatedAt)
+                if err != nil {
+                        return nil, err
+                }
+                entries = append(entries, entry)
+        }
+        return entries, rows.Err()
+}
+
+const journalEntryColumns = `
+                j.id,
+                COALESCE(tm.name, bu.first_name, ''),
+                j.action_id,
+                (SELECT COUNT(*) FROM callback_interactions ci WHERE ci.journal_id = j.id),
+                j.message,
+                j.created_at,
+                j.updated_at`
+
+const journalEntryJoins = `
+                LEFT JOIN LATERAL (
+                        SELECT m.name
+                        FROM team_members m
+                        WHERE m.telegram_chat_id = j.chat_id
+                        ORDER BY m.id
+                        LIMIT 1
+                ) tm ON true
+                LEFT JOIN bot_users bu ON bu.telegram_chat_id = j.chat_id`
+
+func scanJournalEntry(scanner interface{ Scan(...interface{}) error }, entry *JournalEntry, extra ...interface{}) error {
+        dest := []interface{}{&entry.ID, &entry.RecipientName, &entry.ActionID, &entry.Interactions, &entry.Message,
+                &entry.CreatedAt, &entry.UpdatedAt}
+        if err := scanner.Scan(append(dest, extra...)...); err != nil {
+                return err
+        }
+
+        // Запись, которую не удалось разобрать, все равно показываем: JSON целиком есть в Message
+        record, err := decodeJournalRecord(entry.Message)
+        if record != nil {
+                entry.Record = *record
+        }
+        if err != nil {
+                log.Printf("Error decoding journal record %d: %v", entry.ID, err)
+        }
+        return nil
+}
+
+// Добавляет нажатие кнопки в историю. Запись журнала исходящего сообщения ищется по chat_id и message_id
+func recordCallbackInteraction(db *sql.DB, interaction CallbackInteraction) error {
+        _, err := db.Exec(`
+                INSERT INTO callback_interactions
+                        (journal_id, chat_id, message_id, from_chat_id, username, data, outcome, error, pressed_at)
+                VALUES (
+                        (SELECT j.id
+                         FROM api_messages_journal j
+                         WHERE j.chat_id = $1
+                         AND j.message_id = $2
+                         AND j.message->>'type' NOT LIKE 'inbound_%'
+                         ORDER BY j.id DESC
+                         LIMIT 1),
+                        $1, $2, $3, NULLIF($4, ''), $5, $6, NULLIF($7, ''), $8)`,
+                interaction.ChatID, interaction.MessageID, interaction.FromChatID, interaction.Username,
+                interaction.Data, interaction.Outcome, interaction.Error, interaction.PressedAt)
+        return err
+}
+
+// Отправленные сообщения по невыполненным действиям открытых сборов, кроме уже закрытых правкой.
+// Сообщения отмененных сборов попадают в выборку только по taskID
+func findOutstandingMessages(db *sql.DB, taskID, memberID int) ([]OutstandingMessage, error) {
+        rows, err := db.Query(`
+                SELECT j.id, j.action_id, j.chat_id, j.message_id, j.message, bm.name, yt.cancelled_at IS NOT NULL
+                FROM api_messages_journal j
+                JOIN actions a ON j.action_id = a.id
+                JOIN year_tasks yt ON a.task_id = yt.id
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                WHERE j.message_id IS NOT NULL
+                AND a.is_done = false
+                AND yt.is_money_transfered = false
+                AND ($1 = 0 OR a.task_id = $1)
+                AND ($2 = 0 OR yt.team_member_id = $2 OR yt.collector_member_id = $2)
+                AND (yt.cancelled_at IS NULL OR $1 != 0)
+                AND NOT EXISTS (
+                        SELECT 1 FROM message_edits e
+                        WHERE e.journal_id = j.id AND e.closed AND e.status = 'edited'
+                )
+                ORDER BY j.id`,
+                taskID, memberID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var messages []OutstandingMessage
+        for rows.Next() {
+                var message OutstandingMessage
+                var data []byte
+                if err := rows.Scan(&message.JournalID, &message.ActionID, &message.ChatID, &message.MessageID, &data,
+                        &message.BirthdayName, &message.Cancelled); err != nil {
+                        return nil, err
+                }
+                record, err := decodeJournalRecord(data)
+                if err != nil {
+                        log.Printf("Error decoding journal record %d: %v", message.JournalID, err)
+                        continue
+                }
+                message.Record = *record
+                messages = append(messages, message)
+        }
+        return messages, rows.Err()
+}
+
+func recordMessageEdit(db *sql.DB, edit MessageEdit) error {
+        _, err := db.Exec(`
+                INSERT INTO message_edits (journal_id, chat_id, message_id, reason, old_text, new_text, closed, status, error)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''))`,
+                edit.JournalID, edit.ChatID, edit.MessageID, edit.Reason, edit.OldText, edit.NewText, edit.Closed,
+                edit.Status, edit.Error)
+        return err
+}
+
+// Правки сообщения из журнала по порядку
+func getMessageEdits(db *sql.DB, journalID int) ([]MessageEdit, error) {
+        rows, err := db.Query(`
+                SELECT id, journal_id, chat_id, message_id, reason, old_text, new_text, closed, status,
+                        COALESCE(error, ''), edited_at
+                FROM message_edits
+                WHERE journal_id = $1
+                ORDER BY edited_at, id`,
+                journalID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var edits []MessageEdit
+        for rows.Next() {
+                var edit MessageEdit
+                if err := rows.Scan(&edit.ID, &edit.JournalID, &edit.ChatID, &edit.MessageID, &edit.Reason, &edit.OldText,
+                        &edit.NewText, &edit.Closed, &edit.Status, &edit.Error, &edit.EditedAt); err != nil {
+                        return nil, err
+                }
+                edits = append(edits, edit)
+        }
+        return edits, rows.Err()
+}
+
+// Нажатия кнопок в сообщении из журнала по порядку
+func getCallbackInteractions(db *sql.DB, journalID int) ([]CallbackInteraction, error) {
+        rows, err := db.Query(`
+                SELECT ci.id, ci.journal_id, ci.chat_id, ci.message_id, ci.from_chat_id, COALESCE(bu.first_name, ''),
+                        COALESCE(ci.username, ''), ci.data, ci.outcome, COALESCE(ci.error, ''), ci.pressed_at
+                FROM callback_interactions ci
+                LEFT JOIN bot_users bu ON bu.telegram_chat_id = ci.from_chat_id
+                WHERE ci.journal_id = $1
+                ORDER BY ci.pressed_at, ci.id`,
+                journalID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var interactions []CallbackInteraction
+        for rows.Next() {
+                var interaction CallbackInteraction
+                var messageID sql.NullInt64
+                var chatID sql.NullInt64
+                var fromChatID sql.NullInt64
+                if err := rows.Scan(&interaction.ID, &interaction.JournalID, &chatID, &messageID, &fromChatID,
+                        &interaction.FromName, &interaction.Username, &interaction.Data, &interaction.Outcome,
+                        &interaction.Error, &interaction.PressedAt); err != nil {
+                        return nil, err
+                }
+                interaction.ChatID = chatID.Int64
+                interaction.MessageID = int(messageID.Int64)
+                interaction.FromChatID = fromChatID.Int64
+                interactions = append(interactions, interaction)
+        }
+        return interactions, rows.Err()
+}
+
+// Записи журнала сообщений по фильтру, новые первыми; возвращает страницу и общее число найденных
+func getJournalEntries(db *sql.DB, filter JournalFilter, limit, offset int) ([]JournalEntry, int, error) {
+        var conditions []string
+        var args []interface{}
+        addCondition := func(condition string, arg interface{}) {
+                args = append(args, arg)
+                conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+        }
+        if filter.ChatID != 0 {
+                addCondition("j.chat_id = $%d", filter.ChatID)
+        }
+        if filter.Type != "" {
+                addCondition("j.message->>'type' = $%d", filter.Type)
+        }
+        if filter.ActionID != 0 {
+                addCondition("j.action_id = $%d", filter.ActionID)
+        }
+        if !filter.From.IsZero() {
+                addCondition("j.created_at >= $%d", filter.From)
+        }
+        if !filter.To.IsZero() {
+                addCondition("j.created_at < $%d", filter.To)
+        }
+        switch filter.Status {
+        case "sent":
+                conditions = append(conditions, "j.message_id IS NOT NULL AND j.message->>'type' NOT LIKE 'inbound_%'")
+        case "failed":
+                conditions = append(conditions, "j.message->>'status' = 'failed'")
+        }
+        switch filter.Callback {
+        case "yes":
+                conditions = append(conditions, "EXISTS (SELECT 1 FROM callback_interactions ci WHERE ci.journal_id = j.id)")
+        case "no":
+                conditions = append(conditions, "NOT EXISTS (SELECT 1 FROM callback_interactions ci WHERE ci.journal_id = j.id)")
+        }
+
+        query := "SELECT" + journalEntryColumns + `,
+                COUNT(*) OVER()
+                FROM api_messages_journal j` + journalEntryJoins
+        if len(conditions) > 0 {
+                query += "\n                WHERE " + strings.Join(conditions, " AND ")
+        }
+        args = append(args, limit, offset)
+        query += fmt.Sprintf("\n                ORDER BY j.created_at DESC, j.id DESC\n                LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+        rows, err := db.Query(query, args...)
+        if err != nil {
+                return nil, 0, err
+        }
+        defer rows.Close()
+
+        var entries []JournalEntry
+        total := 0
+        for rows.Next() {
+                var entry JournalEntry
+                if err := scanJournalEntry(rows, &entry, &total); err != nil {
+                        return nil, 0, err
+                }
+                entries = append(entries, entry)
+        }
+        if err := rows.Err(); err != nil {
+                return nil, 0, err
+        }
+
+        // Страница за пределами выборки: общее число берем отдельным запросом
+        if len(entries) == 0 && offset > 0 {
+                countQuery := "SELECT COUNT(*) FROM api_messages_journal j"
+                if len(conditions) > 0 {
+                        countQuery += " WHERE " + strings.Join(conditions, " AND ")
+                }
+                if err := db.QueryRow(countQuery, args[:len(args)-2]...).Scan(&total); err != nil {
+                        return nil, 0, err
+                }
+        }
+        return entries, total, nil
+}
+
+func getJournalEntry(db *sql.DB, entryID int) (*JournalEntry, error) {
+        var entry JournalEntry
+        row := db.QueryRow("SELECT"+journalEntryColumns+`
+                FROM api_messages_journal j`+journalEntryJoins+`
+                WHERE j.id = $1`,
+                entryID)
+        err := scanJournalEntry(row, &entry)
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        return &entry, nil
+}
+
+// Создает секции журнала на месяц даты now и следующий месяц, возвращает имена новых секций
+func ensureJournalPartitions(db *sql.DB, now time.Time) ([]string, error) {
+        monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+
+        var created []string
+        for _, month := range []time.Time{monthStart, monthStart.AddDate(0, 1, 0)} {
+                name := journalPartitionName(month)
+                var exists bool
+                if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+                        return created, err
+                }
+                if exists {
+                        continue
+                }
+                if _, err := db.Exec("SELECT ensure_journal_partition($1)", month.Format("2006-01-02")); err != nil {
+                        return created, fmt.Errorf("error creating partition %s: %v", name, err)
+                }
+                created = append(created, name)
+        }
+        return created, nil
+}
+
+func journalPartitionName(month time.Time) string {
+        return "api_messages_journal_p" + month.Format("2006_01")
+}
+
+// Месяцы существующих секций журнала по возрастанию
+func getJournalPartitionMonths(db *sql.DB) ([]time.Time, error) {
+        rows, err := db.Query(`
+                SELECT c.relname
+                FROM pg_inherits i
+                JOIN pg_class c ON c.oid = i.inhrelid
+                WHERE i.inhparent = 'api_messages_journal'::regclass
+                ORDER BY c.relname`)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var months []time.Time
+        for rows.Next() {
+                var name string
+                if err := rows.Scan(&name); err != nil {
+                        return nil, err
+                }
+                month, err := time.ParseInLocation("2006_01", strings.TrimPrefix(name, "api_messages_journal_p"), time.Local)
+                if err != nil {
+                        // Секции, созданные не ботом, не трогаем
+                        log.Printf("Skipping unknown journal partition %s", name)
+                        continue
+                }
+                months = append(months, month)
+        }
+        return months, rows.Err()
+}
+
+// Обслуживание журнала: новые секции и архивация секций старше срока хранения
+func maintainJournal(db *sql.DB, now time.Time) *JournalMaintenanceReport {
+        report := &JournalMaintenanceReport{}
+
+        created, err := ensureJournalPartitions(db, now)
+        report.CreatedPartitions = created
+        if err != nil {
+                report.Errors = append(report.Errors, fmt.Sprintf("создание секций: %v", err))
+        }
+
+        if journalRetentionMonths == 0 {
+                return report
+        }
+
+        months, err := getJournalPartitionMonths(db)
+        if err != nil {
+                report.Errors = append(report.Errors, fmt.Sprintf("список секций: %v", err))
+                return report
+        }
+
+        cutoff := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -journalRetentionMonths, 0)
+        for _, month := range months {
+                if !month.Before(cutoff) {
+                        continue
+                }
+                archive, err := archiveJournalPartition(db, month)
+                if err != nil {
+                        report.Errors = append(report.Errors, fmt.Sprintf("архивация %s: %v", month.Format("01.2006"), err))
+                        continue
+                }
+                report.Archived = append(report.Archived, *archive)
+        }
+        return report
+}
+
+// Строка архива журнала: запись api_messages_journal как есть
+type journalArchiveLine struct {
+        ID        int             `json:"id"`
+        Message   json.RawMessage `json:"message"`
+        CreatedAt time.Time       `json:"created_at"`
+        UpdatedAt *time.Time      `json:"updated_at,omitempty"`
+        ActionID  *int64          `json:"action_id,omitempty"`
+}
+
+// Выгружает секцию журнала за месяц в сжатый JSONL-файл и удаляет ее.
+// Записи секции читаются потоком по tableoid: ее границы заданы в часовом поясе сессии БД,
+// создавшей секцию, и могут не совпадать с месяцем по времени бота, поэтому месяц из имени секции
+// расширяется на день в обе стороны только для отсечения остальных секций. Секция удаляется только
+// после записи файла на диск и только если число записей в ней совпадает с архивом
+func archiveJournalPartition(db *sql.DB, month time.Time) (*JournalArchive, error) {
+        // Месяц уже в архиве: секция появилась снова, существующий файл не перезаписываем
+        var archivedPath string
+        err := db.QueryRow("SELECT file_path FROM journal_archives WHERE month = $1", month.Format("2006-01-02")).Scan(&archivedPath)
+        if err == nil {
+                return nil, fmt.Errorf("месяц уже заархивирован в %s, записи оставлены в базе", archivedPath)
+        }
+        if err != sql.ErrNoRows {
+                return nil, err
+        }
+
+        if err := os.MkdirAll(journalArchiveDir, 0750); err != nil {
+                return nil, err
+        }
+        archive := &JournalArchive{
+                Month:    month,
+                FilePath: filepath.Join(journalArchiveDir, fmt.Sprintf("api_messages_journal_%s.jsonl.gz", month.Format("2006_01"))),
+        }
+
+        tmpPath := archive.FilePath + ".tmp"
+        file, err := os.Create(tmpPath)
+        if err != nil {
+                return nil, err
+        }
+        defer os.Remove(tmpPath)
+
+        rows, err := db.Query(`
+                SELECT id, message, created_at, updated_at, action_id
+                FROM api_messages_journal
+                WHERE created_at >= $1 AND created_at < $2
+                AND tableoid = to_regclass($3)
+                ORDER BY id`,
+                month.AddDate(0, 0, -1), month.AddDate(0, 1, 1), journalPartitionName(month))
+        if err != nil {
+                file.Close()
+                return nil, err
+        }
+
+        gz := gzip.NewWriter(file)
+        encoder := json.NewEncoder(gz)
+        for rows.Next() {
+                var (
+                        line      journalArchiveLine
+                        updatedAt sql.NullTime
+                        actionID  sql.NullInt64
+                )
+                if err = rows.Scan(&line.ID, &line.Message, &line.CreatedAt, &updatedAt, &actionID); err != nil {
+                        break
+                }
+                if updatedAt.Valid {
+                        line.UpdatedAt = &updatedAt.Time
+                }
+                if actionID.Valid {
+                        line.ActionID = &actionID.Int64
+                }
+                if err = encoder.Encode(line); err != nil {
+                        break
+                }
+                archive.Rows++
+        }
+        if err == nil {
+                err = rows.Err()
+        }
+        rows.Close()
+        if err == nil {
+                err = gz.Close()
+        }
+        if err == nil {
+                err = file.Sync()
+        }
+        if closeErr := file.Close(); err == nil {
+                err = closeErr
+        }
+        if err != nil {
+                return nil, err
+        }
+        if err := os.Rename(tmpPath, archive.FilePath); err != nil {
+                return nil, err
+        }
+
+        info, err := os.Stat(archive.FilePath)
+        if err != nil {
+                return nil, err
+        }
+        archive.Size = info.Size()
+
+        tx, err := db.Begin()
+        if err != nil {
+                return nil, err
+        }
+        _, err = tx.Exec(`
+                INSERT INTO journal_archives (partition_name, month, file_path, row_count, file_size)
+                VALUES ($1, $2, $3, $4, $5)`,
+                journalPartitionName(month), month.Format("2006-01-02"), archive.FilePath, archive.Rows, archive.Size)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+        if _, err := tx.Exec("SELECT drop_journal_partition($1, $2)", month.Format("2006-01-02"), archive.Rows); err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+        if err := tx.Commit(); err != nil {
+                return nil, err
+        }
+        return archive, nil
+}
+
+const exportUsage = "Использование: /export journal|collections|members [from=ДД.ММ.ГГГГ] [to=ДД.ММ.ГГГГ] [format=csv|json]\n" +
+        "journal — записи журнала сообщений за период, collections — сборы с датой праздника в периоде, " +
+        "members — участники с числом запросов на перевод и подтвержденных переводов по сборам периода.\n" +
+        "По умолчанию период — с начала года по сегодня, формат CSV (разделитель «;»)"
+
+// Обрабатывает /export: файл выгрузки формируется на лету и отправляется документом.
+// Строки пишутся из базы прямо в загрузку, не накапливаясь в памяти
+func handleExportCommand(bot *tgbotapi.BotAPI, db *sql.DB, message *tgbotapi.Message) {
+        chatID := message.Chat.ID
+
+        args := strings.Fields(message.CommandArguments())
+        if len(args) == 0 {
+                msg := tgbotapi.NewMessage(chatID, exportUsage)
+                sendReply(bot, db, msg)
+                return
+        }
+        request, err := parseExportRequest(args[0], args[1:])
+        if err != nil {
+                msg := tgbotapi.NewMessage(chatID, fmt.Sprintf("%v\n\n%s", err, exportUsage))
+                sendReply(bot, db, msg)
+                return
+        }
+
+        period := fmt.Sprintf("%s - %s", request.From.Format("02.01.2006"), request.To.AddDate(0, 0, -1).Format("02.01.2006"))
+        if err := logAudit(db, message.From.ID, "export", "export", 0, "", fmt.Sprintf("%s %s %s", request.Kind, period, request.Format)); err != nil {
+                log.Printf("Error logging export: %v", err)
+        }
+
+        msg := tgbotapi.NewMessage(chatID, "Готовлю выгрузку...")
+        sendReply(bot, db, msg)
+
+        go func() {
+                reader, writer := io.Pipe()
+                go func() {
+                        writer.CloseWithError(writeExport(db, writer, request))
+                }()
+
+                fileName := fmt.Sprintf("%s_%s_%s.%s", request.Kind, request.From.Format("20060102"),
+                        request.To.AddDate(0, 0, -1).Format("20060102"), request.Format)
+                document := tgbotapi.NewDocument(chatID, tgbotapi.FileReader{Name: fileName, Reader: reader})
+                document.Caption = fmt.Sprintf("Выгрузка %s за %s", request.Kind, period)
+                _, err := sendReply(bot, db, document)
+                // Если загрузка прервалась, запись в закрытый канал завершит выгрузку
+                reader.Close()
+                if err != nil {
+                        log.Printf("Error sending %s export: %v", request.Kind, err)
+                        msg := tgbotapi.NewMessage(chatID, "Произошла ошибка при выгрузке: "+describeSendError(err))
+                        sendReply(bot, db, msg)
+                }
+        }()
+}
+
+func parseExportRequest(kind string, args []string) (ExportRequest, error) {
+        now := time.Now()
+        request := ExportRequest{
+                Kind:   kind,
+                Format: "csv",
+                From:   time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.Local),
+                To:     time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local).AddDate(0, 0, 1),
+        }
+        if _, known := exportColumns[kind]; !known {
+                return request, fmt.Errorf("Неизвестная выгрузка: %s", kind)
+        }
+
+        for _, arg := range args {
+                key, value, found := strings.Cut(arg, "=")
+                if !found || value == "" {
+                        return request, fmt.Errorf("Неверный параметр: %s", arg)
+                }
+
+                switch key {
+                case "from", "to":
+                        date, err := time.ParseInLocation("02.01.2006", value, time.Local)
+                        if err != nil {
+                                return request, fmt.Errorf("Неверная дата: %s", value)
+                        }
+                        if key == "from" {
+                                request.From = date
+                        } else {
+                                // Дата окончания включается в выгрузку целиком
+                                request.To = date.AddDate(0, 0, 1)
+                        }
+                case "format":
+                        if value != "csv" && value != "json" {
+                                return request, fmt.Errorf("format может быть только csv или json")
+                        }
+                        request.Format = value
+                default:
+                        return request, fmt.Errorf("Неизвестный параметр: %s", key)
+                }
+        }
+        if !request.From.Before(request.To) {
+                return request, fmt.Errorf("Дата начала позже даты окончания")
+        }
+        return request, nil
+}
+
+// Столбцы выгрузок /export в порядке вывода
+var exportColumns = map[string][]string{
+        "journal": {"id", "created_at", "type", "status", "error_code", "error", "chat_id", "recipient_name",
+                "message_id", "action_id", "text", "interactions", "message"},
+        "collections": {"task_id", "kind", "title", "beneficiary", "team", "event_date", "amount", "collector",
+                "requests", "transfers_confirmed", "money_transferred", "payout_at", "cancelled_at"},
+        "members": {"member_id", "name", "team", "birthday", "hire_date", "phone_number", "telegram_chat_id",
+                "is_active", "requests", "transfers_confirmed"},
+}
+
+// Построчная запись выгрузки в CSV или JSON
+type exportWriter interface {
+        WriteRow(values []interface{}) error
+        Close() error
+}
+
+type csvExportWriter struct {
+        w *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer, columns []string) (*csvExportWriter, error) {
+        // BOM и «;» — чтобы файл сразу открывался в Excel с русской локалью
+        if _, err := io.WriteString(w, "\ufeff"); err != nil {
+                return nil, err
+        }
+        writer := csv.NewWriter(w)
+        writer.Comma = ';'
+        if err := writer.Write(columns); err != nil {
+                return nil, err
+        }
+        return &csvExportWriter{w: writer}, nil
+}
+
+func (c *csvExportWriter) WriteRow(values []interface{}) error {
+        record := make([]string, len(values))
+        for i, value := range values {
+                switch v := value.(type) {
+                case nil:
+                        record[i] = ""
+                case time.Time:
+                        record[i] = v.In(time.Local).Format(time.RFC3339)
+                case string:
+                        record[i] = escapeCSVFormula(v)
+                case json.RawMessage:
+                        record[i] = escapeCSVFormula(string(v))
+                default:
+                        record[i] = fmt.Sprint(v)
+                }
+        }
+        return c.w.Write(record)
+}
+
+// Экранирует текст, который Excel принял бы за формулу (в том числе после начальных
+// табуляции или перевода каретки): имена и сообщения пользователей попадают в выгрузку без изменений
+func escapeCSVFormula(value string) string {
+        if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+                return "'" + value
+        }
+        return value
+}
+
+func (c *csvExportWriter) Close() error {
+        c.w.Flush()
+        return c.w.Error()
+}
+
+// Массив JSON-объектов, ключи в порядке столбцов
+type jsonExportWriter struct {
+        w       io.Writer
+        columns []string
+        rows    int
+}
+
+func newJSONExportWriter(w io.Writer, columns []string) (*jsonExportWriter, error) {
+        if _, err := io.WriteString(w, "["); err != nil {
+                return nil, err
+        }
+        return &jsonExportWriter{w: w, columns: columns}, nil
+}
+
+func (j *jsonExportWriter) WriteRow(values []interface{}) error {
+        var buf bytes.Buffer
+        if j.rows > 0 {
+                buf.WriteString(",")
+        }
+        buf.WriteString("\n{")
+        for i, value := range values {
+                if i > 0 {
+                        buf.WriteString(",")
+                }
+                key, _ := json.Marshal(j.columns[i])
+                data, err := json.Marshal(value)
+                if err != nil {
+                        return err
+                }
+                buf.Write(key)
+                buf.WriteString(":")
+                buf.Write(data)
+        }
+        buf.WriteString("}")
+        j.rows++
+        _, err := j.w.Write(buf.Bytes())
+        return err
+}
+
+func (j *jsonExportWriter) Close() error {
+        _, err := io.WriteString(j.w, "\n]\n")
+        return err
+}
+
+// Пишет выгрузку в w, читая строки из базы по одной
+func writeExport(db *sql.DB, w io.Writer, request ExportRequest) error {
+        columns := exportColumns[request.Kind]
+        var out exportWriter
+        var err error
+        if request.Format == "json" {
+                out, err = newJSONExportWriter(w, columns)
+        } else {
+                out, err = newCSVExportWriter(w, columns)
+        }
+        if err != nil {
+                return err
+        }
+
+        switch request.Kind {
+        case "journal":
+                err = exportJournal(db, request.From, request.To, out.WriteRow)
+        case "collections":
+                err = exportCollections(db, request.From, request.To, out.WriteRow)
+        case "members":
+                err = exportMembers(db, request.From, request.To, out.WriteRow)
+        default:
+                err = fmt.Errorf("unknown export %s", request.Kind)
+        }
+        if err != nil {
+                return err
+        }
+        return out.Close()
+}
+
+func nullableExportValue(valid bool, value interface{}) interface{} {
+        if !valid {
+                return nil
+        }
+        return value
+}
+
+// Записи журнала сообщений за период, прочитанные через декодер
+func exportJournal(db *sql.DB, from, to time.Time, emit func([]interface{}) error) error {
+        rows, err := db.Query("SELECT"+journalEntryColumns+`
+                FROM api_messages_journal j`+journalEntryJoins+`
+                WHERE j.created_at >= $1 AND j.created_at < $2
+                ORDER BY j.created_at, j.id`,
+                from, to)
+        if err != nil {
+                return err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var entry JournalEntry
+                if err := scanJournalEntry(rows, &entry); err != nil {
+                        return err
+                }
+                record := entry.Record
+                message, err := json.Marshal(record)
+                if err != nil {
+                        return err
+                }
+                err = emit([]interface{}{
+                        entry.ID,
+                        entry.CreatedAt,
+                        record.Type,
+                        nullableExportValue(record.Status != "", record.Status),
+                        nullableExportValue(record.ErrorCode != 0, record.ErrorCode),
+                        nullableExportValue(record.Error != "", record.Error),
+                        nullableExportValue(record.ChatID != 0, record.ChatID),
+                        entry.RecipientName,
+                        nullableExportValue(record.MessageID != 0, record.MessageID),
+                        nullableExportValue(entry.ActionID.Valid, entry.ActionID.Int64),
+                        record.Text,
+                        entry.Interactions,
+                        json.RawMessage(message),
+                })
+                if err != nil {
+                        return err
+                }
+        }
+        return rows.Err()
+}
+
+// Сборы с датой праздника в периоде, включая отмененные
+func exportCollections(db *sql.DB, from, to time.Time, emit func([]interface{}) error) error {
+        rows, err := db.Query(`
+                SELECT
+                        yt.id,
+                        yt.kind,
+                        COALESCE(yt.title, ''),
+                        bm.name,
+                        t.name,
+                        get_task_event_date(yt.id) as event_date,
+                        yt.amount,
+                        cm.name,
+                        (SELECT COUNT(*) FROM actions a WHERE a.task_id = yt.id AND a.type = 'request'),
+                        (SELECT COUNT(*) FROM actions a WHERE a.task_id = yt.id AND a.type = 'request' AND a.is_done),
+                        yt.is_money_transfered,
+                        (SELECT MIN(ci.pressed_at)
+                         FROM callback_interactions ci
+                         JOIN actions a ON ci.data = 'payout_done_' || a.id || '_' || a.task_id
+                         WHERE a.task_id = yt.id
+                         AND a.type = 'payout'
+                         AND ci.outcome IN ('ok', 'unknown')),
+                        yt.cancelled_at
+                FROM year_tasks yt
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                JOIN teams t ON bm.team_id = t.id
+                LEFT JOIN team_members cm ON yt.collector_member_id = cm.id
+                WHERE get_task_event_date(yt.id) >= $1::date
+                AND get_task_event_date(yt.id) < $2::date
+                ORDER BY event_date, yt.id`,
+                from.Format("2006-01-02"), to.Format("2006-01-02"))
+        if err != nil {
+                return err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var (
+                        taskID      int
+                        kind        string
+                        title       string
+                        beneficiary string
+                        teamName    string
+                        eventDate   time.Time
+                        amount      sql.NullFloat64
+                        collector   sql.NullString
+                        requests    int
+                        confirmed   int
+                        transferred bool
+                        payoutAt    sql.NullTime
+                        cancelledAt sql.NullTime
+                )
+                if err := rows.Scan(&taskID, &kind, &title, &beneficiary, &teamName, &eventDate, &amount, &collector,
+                        &requests, &confirmed, &transferred, &payoutAt, &cancelledAt); err != nil {
+                        return err
+                }
+                err := emit([]interface{}{
+                        taskID,
+                        kind,
+                        title,
+                        beneficiary,
+                        teamName,
+                        eventDate.Format("2006-01-02"),
+                        nullableExportValue(amount.Valid, amount.Float64),
+                        nullableExportValue(collector.Valid, collector.String),
+                        requests,
+                        confirmed,
+                        transferred,
+                        nullableExportValue(payoutAt.Valid, payoutAt.Time),
+                        nullableExportValue(cancelledAt.Valid, cancelledAt.Time),
+                })
+                if err != nil {
+                        return err
+                }
+        }
+        return rows.Err()
+}
+
+// Участники и их запросы на перевод по неотмененным сборам с датой праздника в периоде
+func exportMembers(db *sql.DB, from, to time.Time, emit func([]interface{}) error) error {
+        rows, err := db.Query(`
+                WITH period_tasks AS (
+                        SELECT yt.id
+                        FROM year_tasks yt
+                        WHERE yt.cancelled_at IS NULL
+                        AND get_task_event_date(yt.id) >= $1::date
+                        AND get_task_event_date(yt.id) < $2::date
+                )
+                SELECT
+                        m.id,
+                        m.name,
+                        t.name,
+                        m.birthday,
+                        m.hire_date,
+                        m.phone_number,
+                        m.telegram_chat_id,
+                        m.is_active,
+                        COUNT(a.id),
+                        COUNT(a.id) FILTER (WHERE a.is_done)
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                LEFT JOIN actions a ON a.team_member_id = m.id
+                        AND a.type = 'request'
+                        AND a.task_id IN (SELECT id FROM period_tasks)
+                GROUP BY m.id, t.name
+                ORDER BY t.name, m.name`,
+                from.Format("2006-01-02"), to.Format("2006-01-02"))
+        if err != nil {
+                return err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+                var (
+                        memberID  int
+                        name      string
+                        teamName  string
+                        birthday  time.Time
+                        hireDate  sql.NullTime
+                        phone     string
+                        chatID    sql.NullInt64
+                        isActive  bool
+                        requests  int
+                        confirmed int
+                )
+                if err := rows.Scan(&memberID, &name, &teamName, &birthday, &hireDate, &phone, &chatID, &isActive,
+                        &requests, &confirmed); err != nil {
+                        return err
+                }
+                err := emit([]interface{}{
+                        memberID,
+                        name,
+                        teamName,
+                        birthday.Format("2006-01-02"),
+                        nullableExportValue(hireDate.Valid, hireDate.Time.Format("2006-01-02")),
+                        phone,
+                        nullableExportValue(chatID.Valid, chatID.Int64),
+                        isActive,
+                        requests,
+                        confirmed,
+                })
+                if err != nil {
+                        return err
+                }
+        }
+        return rows.Err()
+}
+
+func getMemberAudit(db *sql.DB, memberID int, limit int) ([]MemberAuditEntry, error) {
+        rows, err := db.Query(`
+                SELECT admin_chat_id, action, COALESCE(old_value, ''), COALESCE(new_value, ''), created_at
+                FROM member_audit
+                WHERE team_member_id = $1
+                ORDER BY created_at DESC, id DESC
+                LIMIT $2`,
+                memberID, limit)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var entries []MemberAuditEntry
+        for rows.Next() {
+                var entry MemberAuditEntry
+                if err := rows.Scan(&entry.AdminChatID, &entry.Action, &entry.OldValue, &entry.NewValue, &entry.CreatedAt); err != nil {
+                        return nil, err
+                }
+                entries = append(entries, entry)
+        }
+        return entries, rows.Err()
+}
+
+// Является ли участник тимлидом или казначеем какой-либо команды
+func hasCollectorRole(db *sql.DB, memberID int) (bool, error) {
+        var exists bool
+        err := db.QueryRow(`
+                SELECT EXISTS (SELECT 1 FROM teamleads WHERE team_member_id = $1)
+                OR EXISTS (SELECT 1 FROM treasurers WHERE team_member_id = $1)`,
+                memberID).Scan(&exists)
+        return exists, err
+}
+
+// Все команды, включая неактивные, с числом участников и открытых сборов
+func getTeamsInfo(db *sql.DB) ([]TeamInfo, error) {
+        rows, err := db.Query(teamInfoQuery + `
+                ORDER BY t.is_active DESC, t.name`)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var teams []TeamInfo
+        for rows.Next() {
+                var team TeamInfo
+                err := rows.Scan(&team.ID, &team.Name, &team.IsActive, &team.MemberCount, &team.OpenTasks)
+                if err != nil {
+                        return nil, err
+                }
+                teams = append(teams, team)
+        }
+
+        return teams, nil
+}
+
+func getTeamInfo(db *sql.DB, teamID int) (*TeamInfo, error) {
+        var team TeamInfo
+        err := db.QueryRow(teamInfoQuery+`
+                WHERE t.id = $1`, teamID).Scan(&team.ID, &team.Name, &team.IsActive, &team.MemberCount, &team.OpenTasks)
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        return &team, nil
+}
+
+const teamInfoQuery = `
+        SELECT
+                t.id,
+                t.name,
+                COALESCE(t.is_active, false),
+                (SELECT COUNT(*) FROM team_members tm WHERE tm.team_id = t.id),
+                (SELECT COUNT(*)
+                 FROM year_tasks yt
+                 JOIN team_members bm ON yt.team_member_id = bm.id
+                 WHERE bm.team_id = t.id
+                 AND yt.is_money_transfered = false
+                 AND yt.cancelled_at IS NULL)
+        FROM teams t`
+
+// Проверяет, занято ли название другой командой (без учета регистра)
+func isTeamNameTaken(db *sql.DB, name string, exceptTeamID int) (bool, error) {
+        var exists bool
+        err := db.QueryRow(`
+                SELECT EXISTS(
+                        SELECT 1 FROM teams
+                        WHERE LOWER(name) = LOWER($1)
+                        AND id != $2
+                )`,
+                name, exceptTeamID).Scan(&exists)
+        return exists, err
+}
+
+func createTeam(db *sql.DB, name string, adminChatID int64) (int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return 0, err
+        }
+        defer tx.Rollback()
+
+        var teamID int
+        err = tx.QueryRow("INSERT INTO teams (name, is_active) VALUES ($1, true) RETURNING id", name).Scan(&teamID)
+        if err != nil {
+                return 0, err
+        }
+        if err := logAudit(tx, adminChatID, "create_team", "team", int64(teamID), "", name); err != nil {
+                return 0, err
+        }
+        return teamID, tx.Commit()
+}
+
+func renameTeam(db *sql.DB, teamID int, name string, adminChatID int64) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+
+        var oldName string
+        if err := tx.QueryRow("SELECT name FROM teams WHERE id = $1 FOR UPDATE", teamID).Scan(&oldName); err != nil {
+                return err
+        }
+        if _, err := tx.Exec("UPDATE teams SET name = $1 WHERE id = $2", name, teamID); err != nil {
+                return err
+        }
+        if err := logAudit(tx, adminChatID, "rename_team", "team", int64(teamID), oldName, name); err != nil {
+                return err
+        }
+        return tx.Commit()
+}
+
+func setTeamActive(db *sql.DB, teamID int, isActive bool) error {
+        _, err := db.Exec("UPDATE teams SET is_active = $1 WHERE id = $2", isActive, teamID)
+        return err
+}
+
+// Деактивирует команду и отменяет открытые сборы на ее участников.
+// Возвращает ID отмененных задач.
+func deactivateTeam(db *sql.DB, teamID int) ([]int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return nil, err
+        }
+
+        _, err = tx.Exec("UPDATE teams SET is_active = false WHERE id = $1", teamID)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        taskIDs, err := cancelOpenTasks(tx, "(bm.team_id = $1 OR yt.scope_team_id = $1)", teamID)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        if err := tx.Commit(); err != nil {
+                return nil, err
+        }
+        return taskIDs, nil
+}
+
+// Отменяет открытые сборы на именинников, подходящих под условие по team_members bm.
+// Флаги уведомлений выставляются, чтобы отмененные задачи не попали в рассылки.
+func cancelOpenTasks(tx *sql.Tx, condition string, arg interface{}) ([]int, error) {
+        rows, err := tx.Query(`
+                UPDATE year_tasks yt
+                SET cancelled_at = CURRENT_TIMESTAMP,
+                    is_members_notified = true,
+                    is_teamlead_notified = true
+                FROM team_members bm
+                WHERE yt.team_member_id = bm.id
+                AND `+condition+`
+                AND yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                RETURNING yt.id`,
+                arg)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var taskIDs []int
+        for rows.Next() {
+                var taskID int
+                if err := rows.Scan(&taskID); err != nil {
+                        return nil, err
+                }
+                taskIDs = append(taskIDs, taskID)
+        }
+        return taskIDs, rows.Err()
+}
+
+// Переносит участников в другую команду; возвращает число перенесенных
+func moveTeamMembers(db *sql.DB, sourceTeamID, targetTeamID int, memberIDs []int, adminChatID int64) (int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return 0, err
+        }
+
+        moved := 0
+        for _, memberID := range memberIDs {
+                result, err := tx.Exec(`
+                        UPDATE team_members
+                        SET team_id = $1
+                        WHERE id = $2
+                        AND team_id = $3`,
+                        targetTeamID, memberID, sourceTeamID)
+                if err != nil {
+                        tx.Rollback()
+                        return 0, err
+                }
+                rowsAffected, err := result.RowsAffected()
+                if err != nil {
+                        tx.Rollback()
+                        return 0, err
+                }
+                if rowsAffected == 0 {
+                        continue
+                }
+                moved++
+
+                err = logAudit(tx, adminChatID, "move_member", "member", int64(memberID),
+                        strconv.Itoa(sourceTeamID), strconv.Itoa(targetTeamID))
+                if err != nil {
+                        tx.Rollback()
+                        return 0, err
+                }
+        }
+
+        if err := tx.Commit(); err != nil {
+                return 0, err
+        }
+        return moved, nil
+}
+
+// Имена участников, которые остаются тимлидами или казначеем прежней команды
+func getTeamRoleHolders(db *sql.DB, teamID int, memberIDs []int) ([]string, error) {
+        var names []string
+        for _, memberID := range memberIDs {
+                var name string
+                err := db.QueryRow(`
+                        SELECT tm.name
+                        FROM team_members tm
+                        WHERE tm.id = $1
+                        AND (
+                                EXISTS (SELECT 1 FROM teamleads tl WHERE tl.team_member_id = tm.id AND tl.team_id = $2)
+                                OR EXISTS (SELECT 1 FROM treasurers tr WHERE tr.team_member_id = tm.id AND tr.team_id = $2)
+                        )`,
+                        memberID, teamID).Scan(&name)
+                if err == sql.ErrNoRows {
+                        continue
+                }
+                if err != nil {
+                        return nil, err
+                }
+                names = append(names, name)
+        }
+        return names, nil
+}
+
+func formatBirthdayMessage(birthdays []TeamMember, anniversaries []Anniversary) string {
+        if len(birthdays) == 0 && len(anniversaries) == 0 {
+                return "Нет предстоящих дней рождения и годовщин."
+        }
+
+        msg := ""
+        if len(birthdays) > 0 {
+                msg += "Дни рождения:\n\n"
+                for _, member := range birthdays {
+                        msg += fmt.Sprintf("🎂 %s (Команда: %s) - %s\n",
+                                member.Name,
+                                member.TeamName,
+                                member.Birthday.Format("02.01.2006"))
+                }
+        }
+        if len(anniversaries) > 0 {
+                if msg != "" {
+                        msg += "\n"
+                }
+                msg += "Годовщины работы:\n\n"
+                for _, anniversary := range anniversaries {
+                        msg += fmt.Sprintf("🏢 %s (Команда: %s) - %s в компании, %s\n",
+                                anniversary.Member.Name,
+                                anniversary.Member.TeamName,
+                                formatYears(anniversary.Years),
+                                anniversary.Date.Format("02.01.2006"))
+                }
+        }
+        return msg
+}
+
+// Число лет с согласованием: 1 год, 3 года, 5 лет
+func formatYears(years int) string {
+        switch n := years % 100; {
+        case n >= 11 && n <= 14:
+                return fmt.Sprintf("%d лет", years)
+        case n%10 == 1:
+                return fmt.Sprintf("%d год", years)
+        case n%10 >= 2 && n%10 <= 4:
+                return fmt.Sprintf("%d года", years)
+        default:
+                return fmt.Sprintf("%d лет", years)
+        }
+}
+
+func addBirthday(db *sql.DB, name string, birthday time.Time, phoneNumber string, teamID int, telegramChatID int64) error {
+        // Проверяем существование команды
+        var exists bool
+        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND is_active = true)", teamID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if !exists {
+                return fmt.Errorf("команда с ID %d не существует или не активна", teamID)
+        }
+
+        // Добавляем день рождения
+        _, err = db.Exec(`
+                INSERT INTO team_members (name, birthday, phone_number, team_id, telegram_chat_id)
+                VALUES ($1, $2, $3, $4, $5)`,
+                name, birthday, phoneNumber, teamID, telegramChatID)
+        return err
+}
+
+func getTeamLeads(db *sql.DB) ([]TeamLead, error) {
+        query := `
+                SELECT 
+                        tl.id,
+                        tl.team_member_id,
+                        tl.team_id,
+                        get_collector_phone(tm.id),
+                        tm.name as member_name,
+                        t.name as team_name
+                FROM teamleads tl
+                JOIN team_members tm ON tl.team_member_id = tm.id
+                JOIN teams t ON tl.team_id = t.id
+                WHERE t.is_active = true
+                ORDER BY t.name, tm.name`
+
+        rows, err := db.Query(query)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var teamLeads []TeamLead
+        for rows.Next() {
+                var lead TeamLead
+                err := rows.Scan(
+                        &lead.ID,
+                        &lead.TeamMemberID,
+                        &lead.TeamID,
+                        &lead.PhoneNumber,
+                        &lead.MemberName,
+                        &lead.TeamName,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                teamLeads = append(teamLeads, lead)
+        }
+
+        return teamLeads, nil
+}
+
+func getTeamLeadByTeamID(db *sql.DB, teamID int) (*TeamLead, error) {
+        query := `
+                SELECT 
+                        tl.id,
+                        tl.team_member_id,
+                        tl.team_id,
+                        get_collector_phone(tm.id),
+                        tm.name as member_name,
+                        t.name as team_name
+                FROM teamleads tl
+                JOIN team_members tm ON tl.team_member_id = tm.id
+                JOIN teams t ON tl.team_id = t.id
+                WHERE t.is_active = true AND tl.team_id = $1
+                ORDER BY tl.id
+                LIMIT 1`
+
+        var lead TeamLead
+        err := db.QueryRow(query, teamID).Scan(
+                &lead.ID,
+                &lead.TeamMemberID,
+                &lead.TeamID,
+                &lead.PhoneNumber,
+                &lead.MemberName,
+                &lead.TeamName,
+        )
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+
+        return &lead, nil
+}
+
+// Телефон тимлида берется из его подтвержденного контакта (см. get_collector_phone)
+func addTeamLead(db *sql.DB, teamMemberID, teamID int) error {
+        // Проверяем существование team_member
+        var exists bool
+        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM team_members WHERE id = $1)", teamMemberID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if !exists {
+                return fmt.Errorf("team member с ID %d не существует", teamMemberID)
+        }
+
+        // Проверяем существование team
+        err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND is_active = true)", teamID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if !exists {
+                return fmt.Errorf("team с ID %d не существует или не активна", teamID)
+        }
+
+        // Проверяем, не назначен ли участник уже тимлидом этой команды
+        err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM teamleads WHERE team_id = $1 AND team_member_id = $2)", teamID, teamMemberID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if exists {
+                return fmt.Errorf("участник с ID %d уже назначен тимлидом команды с ID %d", teamMemberID, teamID)
+        }
+
+        // Добавляем тимлида
+        _, err = db.Exec(`
+                INSERT INTO teamleads (team_member_id, team_id)
+                VALUES ($1, $2)`,
+                teamMemberID, teamID)
+        return err
+}
+
+func removeTeamLead(db *sql.DB, teamLeadID int) error {
+        result, err := db.Exec("DELETE FROM teamleads WHERE id = $1", teamLeadID)
+        if err != nil {
+                return err
+        }
+
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+                return err
+        }
+        if rowsAffected == 0 {
+                return fmt.Errorf("тимлид с ID %d не найден", teamLeadID)
+        }
+
+        return nil
+}
+
+func getTreasurers(db *sql.DB) ([]Treasurer, error) {
+        query := `
+                SELECT 
+                        tr.id,
+                        tr.team_member_id,
+                        tr.team_id,
+                        get_collector_phone(tm.id),
+                        tm.name as member_name,
+                        t.name as team_name
+                FROM treasurers tr
+                JOIN team_members tm ON tr.team_member_id = tm.id
+                JOIN teams t ON tr.team_id = t.id
+                WHERE t.is_active = true
+                ORDER BY t.name`
+
+        rows, err := db.Query(query)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var treasurers []Treasurer
+        for rows.Next() {
+                var treasurer Treasurer
+                err := rows.Scan(
+                        &treasurer.ID,
+                        &treasurer.TeamMemberID,
+                        &treasurer.TeamID,
+                        &treasurer.PhoneNumber,
+                        &treasurer.MemberName,
+                        &treasurer.TeamName,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                treasurers = append(treasurers, treasurer)
+        }
+
+        return treasurers, nil
+}
+
+func getTreasurerByTeamID(db *sql.DB, teamID int) (*Treasurer, error) {
+        query := `
+                SELECT 
+                        tr.id,
+                        tr.team_member_id,
+                        tr.team_id,
+                        get_collector_phone(tm.id),
+                        tm.name as member_name,
+                        t.name as team_name
+                FROM treasurers tr
+                JOIN team_members tm ON tr.team_member_id = tm.id
+                JOIN teams t ON tr.team_id = t.id
+                WHERE tr.team_id = $1`
+
+        var treasurer Treasurer
+        err := db.QueryRow(query, teamID).Scan(
+                &treasurer.ID,
+                &treasurer.TeamMemberID,
+                &treasurer.TeamID,
+                &treasurer.PhoneNumber,
+                &treasurer.MemberName,
+                &treasurer.TeamName,
+        )
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+
+        return &treasurer, nil
+}
+
+// Активные участники команды, из которых выбирается казначей
+func getTreasurerCandidates(db *sql.DB, teamID int) ([]TeamMember, error) {
+        rows, err := db.Query(`
+                SELECT id, name
+                FROM team_members
+                WHERE team_id = $1
+                AND is_active = true
+                ORDER BY name`,
+                teamID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var members []TeamMember
+        for rows.Next() {
+                var member TeamMember
+                if err := rows.Scan(&member.ID, &member.Name); err != nil {
+                        return nil, err
+                }
+                members = append(members, member)
+        }
+        return members, rows.Err()
+}
+
+// Назначает казначея команды; предыдущий казначей заменяется
+func setTreasurer(db *sql.DB, teamMemberID, teamID int, adminChatID int64) error {
+        // Проверяем существование team_member
+        var exists bool
+        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM team_members WHERE id = $1 AND is_active = true)", teamMemberID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if !exists {
+                return fmt.Errorf("team member с ID %d не существует или деактивирован", teamMemberID)
+        }
+
+        // Проверяем существование team
+        err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND is_active = true)", teamID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if !exists {
+                return fmt.Errorf("team с ID %d не существует или не активна", teamID)
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+
+        var oldMemberID sql.NullInt64
+        err = tx.QueryRow("SELECT team_member_id FROM treasurers WHERE team_id = $1 FOR UPDATE", teamID).Scan(&oldMemberID)
+        if err != nil && err != sql.ErrNoRows {
+                tx.Rollback()
+                return err
+        }
+
+        _, err = tx.Exec(`
+                INSERT INTO treasurers (team_member_id, team_id)
+                VALUES ($1, $2)
+                ON CONFLICT (team_id) DO UPDATE SET team_member_id = EXCLUDED.team_member_id`,
+                teamMemberID, teamID)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        oldValue := ""
+        if oldMemberID.Valid {
+                oldValue = strconv.FormatInt(oldMemberID.Int64, 10)
+        }
+        if err := logAudit(tx, adminChatID, "set_treasurer", "team", int64(teamID), oldValue, strconv.Itoa(teamMemberID)); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+// Снимает казначея команды; переводы снова получает тимлид
+func removeTreasurer(db *sql.DB, teamID int, adminChatID int64) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+
+        var oldMemberID int
+        err = tx.QueryRow("DELETE FROM treasurers WHERE team_id = $1 RETURNING team_member_id", teamID).Scan(&oldMemberID)
+        if err == sql.ErrNoRows {
+                tx.Rollback()
+                return fmt.Errorf("казначей для команды с ID %d не назначен", teamID)
+        }
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        if err := logAudit(tx, adminChatID, "remove_treasurer", "team", int64(teamID), strconv.Itoa(oldMemberID), ""); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+func getTeamLeadBackups(db *sql.DB) ([]TeamLeadBackup, error) {
+        query := `
+                SELECT 
+                        b.id,
+                        b.team_id,
+                        b.team_member_id,
+                        b.priority,
+                        tm.name as member_name,
+                        t.name as team_name
+                FROM teamlead_backups b
+                JOIN team_members tm ON b.team_member_id = tm.id
+                JOIN teams t ON b.team_id = t.id
+                WHERE t.is_active = true
+                ORDER BY t.name, b.priority, b.id`
+
+        rows, err := db.Query(query)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var backups []TeamLeadBackup
+        for rows.Next() {
+                var backup TeamLeadBackup
+                err := rows.Scan(
+                        &backup.ID,
+                        &backup.TeamID,
+                        &backup.TeamMemberID,
+                        &backup.Priority,
+                        &backup.MemberName,
+                        &backup.TeamName,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                backups = append(backups, backup)
+        }
+
+        return backups, nil
+}
+
+// Задает порядок резервных тимлидов команды; пустой список очищает порядок
+func setTeamLeadBackups(db *sql.DB, teamID int, memberIDs []int, adminChatID int64) error {
+        var exists bool
+        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND is_active = true)", teamID).Scan(&exists)
+        if err != nil {
+                return err
+        }
+        if !exists {
+                return fmt.Errorf("team с ID %d не существует или не активна", teamID)
+        }
+
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+
+        var oldOrder string
+        err = tx.QueryRow(`
+                SELECT COALESCE(string_agg(team_member_id::text, ',' ORDER BY priority), '')
+                FROM teamlead_backups
+                WHERE team_id = $1`,
+                teamID).Scan(&oldOrder)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        _, err = tx.Exec("DELETE FROM teamlead_backups WHERE team_id = $1", teamID)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        for i, memberID := range memberIDs {
+                err = tx.QueryRow("SELECT EXISTS(SELECT 1 FROM team_members WHERE id = $1 AND is_active = true)", memberID).Scan(&exists)
+                if err != nil {
+                        tx.Rollback()
+                        return err
+                }
+                if !exists {
+                        tx.Rollback()
+                        return fmt.Errorf("team member с ID %d не существует или деактивирован", memberID)
+                }
+
+                _, err = tx.Exec(`
+                        INSERT INTO teamlead_backups (team_id, team_member_id, priority)
+                        VALUES ($1, $2, $3)`,
+                        teamID, memberID, i+1)
+                if err != nil {
+                        tx.Rollback()
+                        return err
+                }
+        }
+
+        newOrder := make([]string, 0, len(memberIDs))
+        for _, memberID := range memberIDs {
+                newOrder = append(newOrder, strconv.Itoa(memberID))
+        }
+        if err := logAudit(tx, adminChatID, "set_teamlead_backups", "team", int64(teamID), oldOrder, strings.Join(newOrder, ",")); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+func formatTeamLeadBackupsMessage(backups []TeamLeadBackup) string {
+        if len(backups) == 0 {
+                return "Резервные тимлиды не назначены."
+        }
+
+        msg := "Резервные тимлиды:\n\n"
+        currentTeamID := 0
+        for _, backup := range backups {
+                if backup.TeamID != currentTeamID {
+                        if currentTeamID != 0 {
+                                msg += "\n"
+                        }
+                        msg += fmt.Sprintf("Команда: %s (ID %d)\n", backup.TeamName, backup.TeamID)
+                        currentTeamID = backup.TeamID
+                }
+                msg += fmt.Sprintf("%d. %s (ID %d)\n", backup.Priority, backup.MemberName, backup.TeamMemberID)
+        }
+        return msg
+}
+
+// Возвращает участника по chat ID, если он является тимлидом хотя бы одной команды
+func getTeamLeadMemberByChatID(db *sql.DB, chatID int64) (*TeamMember, error) {
+        query := `
+                SELECT tm.id, tm.name, tm.birthday, tm.team_id, t.name, tm.phone_number, tm.telegram_chat_id
+                FROM team_members tm
+                JOIN teams t ON tm.team_id = t.id
+                WHERE tm.telegram_chat_id = $1::bigint
+                AND EXISTS (SELECT 1 FROM teamleads tl WHERE tl.team_member_id = tm.id)
+                ORDER BY tm.id
+                LIMIT 1`
+
+        var member TeamMember
+        err := db.QueryRow(query, chatID).Scan(
+                &member.ID,
+                &member.Name,
+                &member.Birthday,
+                &member.TeamID,
+                &member.TeamName,
+                &member.PhoneNumber,
+                &member.TelegramChatID,
+        )
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+
+        return &member, nil
+}
+
+// Кандидаты в заместители: участники команд тимлида и другие тимлиды с привязанным Telegram
+func getDelegateCandidates(db *sql.DB, teamLeadMemberID int) ([]TeamMember, error) {
+        rows, err := db.Query(`
+                SELECT tm.id, tm.name
+                FROM team_members tm
+                WHERE tm.id != $1
+                AND tm.telegram_chat_id IS NOT NULL
+                AND tm.is_active = true
+                AND (
+                        tm.team_id IN (SELECT tl.team_id FROM teamleads tl WHERE tl.team_member_id = $1)
+                        OR tm.id IN (SELECT tl.team_member_id FROM teamleads tl)
+                )
+                ORDER BY tm.name`,
+                teamLeadMemberID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var members []TeamMember
+        for rows.Next() {
+                var member TeamMember
+                if err := rows.Scan(&member.ID, &member.Name); err != nil {
+                        return nil, err
+                }
+                members = append(members, member)
+        }
+        return members, nil
+}
+
+// Разбирает период вида "ДД.ММ-ДД.ММ" (год можно указать явно: "ДД.ММ.ГГГГ").
+// Без года используется ближайший период, который еще не закончился.
+func parseAwayPeriod(text string, now time.Time) (time.Time, time.Time, error) {
+        parts := strings.Split(text, "-")
+        if len(parts) != 2 {
+                return time.Time{}, time.Time{}, fmt.Errorf("неверный формат периода: %s", text)
+        }
+
+        parseDate := func(value string) (time.Time, bool, error) {
+                value = strings.TrimSpace(value)
+                if date, err := time.ParseInLocation("02.01.2006", value, time.Local); err == nil {
+                        return date, true, nil
+                }
+                date, err := time.ParseInLocation("02.01", value, time.Local)
+                if err != nil {
+                        return time.Time{}, false, err
+                }
+                return date.AddDate(now.Year()-date.Year(), 0, 0), false, nil
+        }
+
+        dateFrom, fromHasYear, err := parseDate(parts[0])
+        if err != nil {
+                return time.Time{}, time.Time{}, err
+        }
+        dateTo, toHasYear, err := parseDate(parts[1])
+        if err != nil {
+                return time.Time{}, time.Time{}, err
+        }
+
+        if !toHasYear && dateTo.Before(dateFrom) {
+                dateTo = dateTo.AddDate(1, 0, 0)
+        }
+        today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+        if !fromHasYear && !toHasYear && dateTo.Before(today) {
+                dateFrom = dateFrom.AddDate(1, 0, 0)
+                dateTo = dateTo.AddDate(1, 0, 0)
+        }
+        if dateTo.Before(dateFrom) {
+                return time.Time{}, time.Time{}, fmt.Errorf("дата окончания раньше даты начала: %s", text)
+        }
+
+        return dateFrom, dateTo, nil
+}
+
+func getTeamLeadAbsences(db *sql.DB, teamLeadMemberID int) ([]TeamLeadAbsence, error) {
+        rows, err := db.Query(`
+                SELECT ab.id, ab.team_member_id, ab.date_from, ab.date_to, ab.delegate_member_id, d.name
+                FROM teamlead_absences ab
+                JOIN team_members d ON ab.delegate_member_id = d.id
+                WHERE ab.team_member_id = $1
+                AND ab.date_to >= CURRENT_DATE
+                ORDER BY ab.date_from`,
+                teamLeadMemberID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var absences []TeamLeadAbsence
+        for rows.Next() {
+                var absence TeamLeadAbsence
+                err := rows.Scan(
+                        &absence.ID,
+                        &absence.TeamMemberID,
+                        &absence.DateFrom,
+                        &absence.DateTo,
+                        &absence.DelegateMemberID,
+                        &absence.DelegateName)
+                if err != nil {
+                        return nil, err
+                }
+                absences = append(absences, absence)
+        }
+        return absences, nil
+}
+
+func formatAbsencesMessage(absences []TeamLeadAbsence) string {
+        if len(absences) == 0 {
+                return "Периоды отсутствия не указаны.\n"
+        }
+
+        msg := "Периоды отсутствия:\n\n"
+        for _, absence := range absences {
+                msg += fmt.Sprintf("%s - %s, заместитель: %s\n",
+                        absence.DateFrom.Format("02.01.2006"),
+                        absence.DateTo.Format("02.01.2006"),
+                        absence.DelegateName)
+        }
+        return msg
+}
+
+// Сохраняет период отсутствия и передает заместителю открытые сборы,
+// период которых пересекается с отсутствием. Возвращает ID переданных задач.
+func addTeamLeadAbsence(db *sql.DB, teamLeadMemberID, delegateMemberID int, dateFrom, dateTo time.Time, actorChatID int64) (int, []int, []int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return 0, nil, nil, err
+        }
+
+        var absenceID int
+        err = tx.QueryRow(`
+                INSERT INTO teamlead_absences (team_member_id, date_from, date_to, delegate_member_id)
+                VALUES ($1, $2, $3, $4)
+                RETURNING id`,
+                teamLeadMemberID, dateFrom, dateTo, delegateMemberID).Scan(&absenceID)
+        if err != nil {
+                tx.Rollback()
+                return 0, nil, nil, err
+        }
+
+        // Переназначаем заместителю открытые задачи, период сбора которых пересекается с отсутствием
+        rows, err := tx.Query(`
+                UPDATE year_tasks yt
+                SET collector_member_id = $1,
+                    collector_delegated_from = COALESCE(yt.collector_delegated_from, $2),
+                    collector_source = 'delegate',
+                    collector_assigned_at = CURRENT_TIMESTAMP
+                WHERE yt.collector_member_id = $2
+                AND yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                AND yt.team_member_id != $1
+                AND get_task_event_date(yt.id) - 3 <= $4::date
+                AND get_task_event_date(yt.id) >= $3::date
+                RETURNING yt.id`,
+                delegateMemberID, teamLeadMemberID, dateFrom, dateTo)
+        if err != nil {
+                tx.Rollback()
+                return 0, nil, nil, err
+        }
+
+        var taskIDs []int
+        for rows.Next() {
+                var taskID int
+                if err := rows.Scan(&taskID); err != nil {
+                        rows.Close()
+                        tx.Rollback()
+                        return 0, nil, nil, err
+                }
+                taskIDs = append(taskIDs, taskID)
+        }
+        rows.Close()
+
+        // Сборы на подарок самому заместителю не могут перейти к нему: получатель
+        // назначается заново по общим правилам, отсутствующий тимлид при этом пропускается
+        rows, err = tx.Query(`
+                UPDATE year_tasks yt
+                SET collector_member_id = NULL,
+                    collector_delegated_from = NULL,
+                    collector_source = NULL,
+                    collector_assigned_at = NULL
+                WHERE yt.collector_member_id = $2
+                AND yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                AND yt.team_member_id = $1
+                AND get_task_event_date(yt.id) - 3 <= $4::date
+                AND get_task_event_date(yt.id) >= $3::date
+                RETURNING yt.id`,
+                delegateMemberID, teamLeadMemberID, dateFrom, dateTo)
+        if err != nil {
+                tx.Rollback()
+                return 0, nil, nil, err
+        }
+
+        var reassignedIDs []int
+        for rows.Next() {
+                var taskID int
+                if err := rows.Scan(&taskID); err != nil {
+                        rows.Close()
+                        tx.Rollback()
+                        return 0, nil, nil, err
+                }
+                reassignedIDs = append(reassignedIDs, taskID)
+        }
+        rows.Close()
+
+        for _, taskID := range reassignedIDs {
+                if _, err := tx.Exec("SELECT assign_task_collector($1)", taskID); err != nil {
+                        tx.Rollback()
+                        return 0, nil, nil, err
+                }
+        }
+
+        // Открытые действия payout по этим задачам переходят новому получателю переводов
+        for _, taskID := range append(append([]int{}, taskIDs...), reassignedIDs...) {
+                _, err = tx.Exec(`
+                        UPDATE actions a
+                        SET team_member_id = yt.collector_member_id
+                        FROM year_tasks yt
+                        WHERE yt.id = a.task_id
+                        AND a.task_id = $1
+                        AND a.type = 'payout'
+                        AND a.is_done = false
+                        AND yt.collector_member_id IS NOT NULL`,
+                        taskID)
+                if err != nil {
+                        tx.Rollback()
+                        return 0, nil, nil, err
+                }
+        }
+
+        err = logAudit(tx, actorChatID, "delegate_teamlead", "member", int64(teamLeadMemberID),
+                fmt.Sprintf("%s-%s", dateFrom.Format("02.01.2006"), dateTo.Format("02.01.2006")),
+                fmt.Sprintf("delegate %d, tasks %v, reassigned %v", delegateMemberID, taskIDs, reassignedIDs))
+        if err != nil {
+                tx.Rollback()
+                return 0, nil, nil, err
+        }
+
+        if err := tx.Commit(); err != nil {
+                return 0, nil, nil, err
+        }
+        return absenceID, taskIDs, reassignedIDs, nil
+}
+
+func cancelTeamLeadAbsences(db *sql.DB, teamLeadMemberID int) (int, error) {
+        result, err := db.Exec(`
+                DELETE FROM teamlead_absences
+                WHERE team_member_id = $1
+                AND date_to >= CURRENT_DATE`,
+                teamLeadMemberID)
+        if err != nil {
+                return 0, err
+        }
+
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+                return 0, err
+        }
+        return int(rowsAffected), nil
+}
+
+// Возвращает ID команд, в которых пользователь с данным chat ID является тимлидом
+func getTeamIDsByTeamLeadChatID(db *sql.DB, chatID int64) ([]int, error) {
+        rows, err := db.Query(`
+                SELECT DISTINCT tl.team_id
+                FROM teamleads tl
+                JOIN team_members tm ON tl.team_member_id = tm.id
+                JOIN teams t ON tl.team_id = t.id
+                WHERE tm.telegram_chat_id = $1::bigint
+                AND t.is_active = true
+                ORDER BY tl.team_id`,
+                chatID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var teamIDs []int
+        for rows.Next() {
+                var teamID int
+                if err := rows.Scan(&teamID); err != nil {
+                        return nil, err
+                }
+                teamIDs = append(teamIDs, teamID)
+        }
+        return teamIDs, nil
+}
+
+func getTeamMembers(db *sql.DB, teamID int) ([]TeamMember, error) {
+        rows, err := db.Query(`
+                SELECT m.id, m.name, m.birthday, m.team_id, t.name, m.phone_number, m.telegram_chat_id
+                FROM team_members m
+                JOIN teams t ON m.team_id = t.id
+                WHERE m.team_id = $1
+                ORDER BY m.name`,
+                teamID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var members []TeamMember
+        for rows.Next() {
+                var member TeamMember
+                var telegramChatID sql.NullInt64
+                err := rows.Scan(
+                        &member.ID,
+                        &member.Name,
+                        &member.Birthday,
+                        &member.TeamID,
+                        &member.TeamName,
+                        &member.PhoneNumber,
+                        &telegramChatID,
+                )
+                if err != nil {
+                        return nil, err
+                }
+                member.TelegramChatID = telegramChatID.Int64
+                members = append(members, member)
+        }
+        return members, nil
+}
+
+// Открытые сборы на именинников команды с прогрессом переводов
+func getTeamOpenTasks(db *sql.DB, teamID int) ([]TeamTaskSummary, error) {
+        rows, err := db.Query(`
+                SELECT
+                        yt.id,
+                        bm.name || COALESCE(' (' || yt.title || ')', ''),
+                        get_task_event_date(yt.id) as event_date,
+                        COUNT(a.id) FILTER (WHERE a.type = 'request' AND a.is_done = true),
+                        COUNT(a.id) FILTER (WHERE a.type = 'request')
+                FROM year_tasks yt
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                LEFT JOIN actions a ON a.task_id = yt.id
+                WHERE bm.team_id = $1
+                AND yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                GROUP BY yt.id, bm.name, yt.title
+                ORDER BY event_date`,
+                teamID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var tasks []TeamTaskSummary
+        for rows.Next() {
+                var task TeamTaskSummary
+                err := rows.Scan(&task.TaskID, &task.BirthdayName, &task.EventDate, &task.RequestsDone, &task.RequestsAll)
+                if err != nil {
+                        return nil, err
+                }
+                tasks = append(tasks, task)
+        }
+        return tasks, nil
+}
+
+// Невыполненные переводы подарков, день рождения по которым уже прошел
+func getTeamOverduePayouts(db *sql.DB, teamID int) ([]TeamTaskSummary, error) {
+        rows, err := db.Query(`
+                SELECT
+                        yt.id,
+                        bm.name || COALESCE(' (' || yt.title || ')', ''),
+                        get_task_event_date(yt.id) as event_date,
+                        pm.name
+                FROM actions a
+                JOIN year_tasks yt ON a.task_id = yt.id
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                JOIN team_members pm ON a.team_member_id = pm.id
+                WHERE bm.team_id = $1
+                AND a.type = 'payout'
+                AND a.is_done = false
+                AND yt.cancelled_at IS NULL
+                AND get_task_event_date(yt.id) < CURRENT_DATE
+                ORDER BY event_date`,
+                teamID)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var tasks []TeamTaskSummary
+        for rows.Next() {
+                var task TeamTaskSummary
+                if err := rows.Scan(&task.TaskID, &task.BirthdayName, &task.EventDate, &task.PayoutMember); err != nil {
+                        return nil, err
+                }
+                tasks = append(tasks, task)
+        }
+        return tasks, nil
+}
+
+// Открытые произвольные сборы: все для администратора, иначе сборы команд тимлида chatID и созданные им
+func getCustomCollections(db *sql.DB, chatID int64, all bool) ([]CustomCollection, error) {
+        return queryCustomCollections(db, `
+                AND yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                AND ($1 OR yt.created_by_chat_id = $2 OR COALESCE(yt.scope_team_id, bm.team_id) IN (
+                        SELECT tl.team_id
+                        FROM teamleads tl
+                        JOIN team_members tm ON tl.team_member_id = tm.id
+                        WHERE tm.telegram_chat_id = $2::bigint
+                ))`,
+                all, chatID)
+}
+
+// Открытый произвольный сбор по ID задачи; nil, если сбор не найден, отменен или закрыт
+func getCustomCollection(db *sql.DB, taskID int) (*CustomCollection, error) {
+        collections, err := queryCustomCollections(db, `
+                AND yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                AND yt.id = $1`,
+                taskID)
+        if err != nil || len(collections) == 0 {
+                return nil, err
+        }
+        return &collections[0], nil
+}
+
+func queryCustomCollections(db *sql.DB, condition string, args ...interface{}) ([]CustomCollection, error) {
+        rows, err := db.Query(`
+                SELECT
+                        yt.id,
+                        yt.title,
+                        bm.id,
+                        bm.name,
+                        bm.team_id,
+                        yt.deadline,
+                        yt.scope_team_id,
+                        st.name,
+                        yt.amount,
+                        cm.name,
+                        yt.created_by_chat_id,
+                        COUNT(a.id) FILTER (WHERE a.type = 'request' AND a.is_done = true),
+                        COUNT(a.id) FILTER (WHERE a.type = 'request')
+                FROM year_tasks yt
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                LEFT JOIN teams st ON yt.scope_team_id = st.id
+                LEFT JOIN team_members cm ON yt.collector_member_id = cm.id
+                LEFT JOIN actions a ON a.task_id = yt.id
+                WHERE yt.kind = 'custom'
+                `+condition+`
+                GROUP BY yt.id, bm.id, st.name, cm.name
+                ORDER BY yt.deadline, yt.id`,
+                args...)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var collections []CustomCollection
+        for rows.Next() {
+                var c CustomCollection
+                err := rows.Scan(&c.TaskID, &c.Title, &c.BeneficiaryID, &c.BeneficiaryName, &c.BeneficiaryTeamID,
+                        &c.Deadline, &c.ScopeTeamID, &c.ScopeTeamName, &c.Amount, &c.CollectorName, &c.CreatedByChatID,
+                        &c.RequestsDone, &c.RequestsAll)
+                if err != nil {
+                        return nil, err
+                }
+                collections = append(collections, c)
+        }
+        return collections, rows.Err()
+}
+
+// Число участников, которые получат запрос на перевод: активные участники компании
+// или команды scopeTeamID, кроме получателя подарка
+func countCollectionParticipants(db *sql.DB, beneficiaryID int, scopeTeamID sql.NullInt64) (int, error) {
+        var count int
+        err := db.QueryRow(`
+                SELECT COUNT(*)
+                FROM team_members
+                WHERE id != $1
+                AND is_active = true
+                AND ($2::integer IS NULL OR team_id = $2)`,
+                beneficiaryID, scopeTeamID).Scan(&count)
+        return count, err
+}
+
+// Создает произвольный сбор с запросами участникам и назначает получателя переводов
+func createCustomCollection(db *sql.DB, c CustomCollection, creatorChatID int64) (int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return 0, err
+        }
+
+        var taskID int
+        err = tx.QueryRow(`
+                INSERT INTO year_tasks (year, team_member_id, kind, title, deadline, scope_team_id, amount, created_by_chat_id)
+                VALUES ($1, $2, 'custom', $3, $4, $5, $6, $7)
+                RETURNING id`,
+                c.Deadline.Year(), c.BeneficiaryID, c.Title, c.Deadline.Format("2006-01-02"),
+                c.ScopeTeamID, c.Amount, creatorChatID).Scan(&taskID)
+        if err != nil {
+                tx.Rollback()
+                return 0, err
+        }
+
+        _, err = tx.Exec(`
+                INSERT INTO actions (task_id, team_member_id, type)
+                SELECT $1, id, 'request'
+                FROM team_members
+                WHERE id != $2
+                AND is_active = true
+                AND ($3::integer IS NULL OR team_id = $3)`,
+                taskID, c.BeneficiaryID, c.ScopeTeamID)
+        if err != nil {
+                tx.Rollback()
+                return 0, err
+        }
+
+        if _, err := tx.Exec("SELECT assign_task_collector($1)", taskID); err != nil {
+                tx.Rollback()
+                return 0, err
+        }
+
+        if err := logAudit(tx, creatorChatID, "create_collection", "task", int64(taskID), "", c.Title); err != nil {
+                tx.Rollback()
+                return 0, err
+        }
+
+        return taskID, tx.Commit()
+}
+
+// Отменяет открытый произвольный сбор; возвращает ID отмененных задач
+func cancelCustomCollection(db *sql.DB, taskID int, actorChatID int64) ([]int, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return nil, err
+        }
+
+        taskIDs, err := cancelOpenTasks(tx, "yt.kind = 'custom' AND yt.id = $1", taskID)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+        for _, id := range taskIDs {
+                if err := logAudit(tx, actorChatID, "cancel_collection", "task", int64(id), "", ""); err != nil {
+                        tx.Rollback()
+                        return nil, err
+                }
+        }
+
+        return taskIDs, tx.Commit()
+}
+
+// Сколько дней после праздника по задаче еще создается действие payout. Более старые
+// неоплаченные задачи не подхватываются, чтобы не напоминать о праздниках прошлых лет
+const payoutWindowDays = 7
+
+// Сколько дней после окончания окна выплаты неоплаченная задача без действия payout
+// показывается в отчете как пропущенная, например если бот был остановлен
+const payoutSkipReportDays = 30
+
+// Создает действие payout по задаче для закрепленного за ней получателя переводов.
+// На задачу создается не более одного действия payout; повторный вызов возвращает существующее.
+func ensurePayoutAction(db *sql.DB, taskID int) (int, bool, error) {
+        var collectorID sql.NullInt64
+        if err := db.QueryRow("SELECT assign_task_collector($1)", taskID).Scan(&collectorID); err != nil {
+                return 0, false, fmt.Errorf("error assigning collector for task %d: %v", taskID, err)
+        }
+        if !collectorID.Valid {
+                return 0, false, fmt.Errorf("нет получателя переводов для задачи с ID %d", taskID)
+        }
+
+        var actionID int
+        err := db.QueryRow(`
+                INSERT INTO actions (task_id, team_member_id, type)
+                VALUES ($1, $2, 'payout')
+                ON CONFLICT (task_id) WHERE type = 'payout' DO NOTHING
+                RETURNING id`,
+                taskID, collectorID.Int64).Scan(&actionID)
+        if err == nil {
+                return actionID, true, nil
+        }
+        if err != sql.ErrNoRows {
+                return 0, false, fmt.Errorf("error creating payout action for task %d: %v", taskID, err)
+        }
+
+        err = db.QueryRow(`
+                SELECT id
+                FROM actions
+                WHERE task_id = $1
+                AND type = 'payout'`,
+                taskID).Scan(&actionID)
+        if err != nil {
+                return 0, false, fmt.Errorf("error getting payout action for task %d: %v", taskID, err)
+        }
+        return actionID, false, nil
+}
+
+// Создает действия payout по задачам, день рождения по которым наступил в пределах payoutWindowDays.
+// Используется и расписанием, и ручным запуском из панели администратора.
+func assignBirthdayPayouts(db *sql.DB) (int, error) {
+        rows, err := db.Query(`
+                SELECT yt.id
+                FROM year_tasks yt
+                WHERE yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                AND get_task_event_date(yt.id) BETWEEN CURRENT_DATE - $1::integer AND CURRENT_DATE
+                AND NOT EXISTS (
+                        SELECT 1 FROM actions a
+                        WHERE a.task_id = yt.id
+                        AND a.type = 'payout'
+                )
+                ORDER BY yt.id`,
+                payoutWindowDays)
+        if err != nil {
+                return 0, fmt.Errorf("error querying tasks without payout: %v", err)
+        }
+
+        var taskIDs []int
+        for rows.Next() {
+                var taskID int
+                if err := rows.Scan(&taskID); err != nil {
+                        rows.Close()
+                        return 0, fmt.Errorf("error scanning task: %v", err)
+                }
+                taskIDs = append(taskIDs, taskID)
+        }
+        rows.Close()
+
+        created := 0
+        for _, taskID := range taskIDs {
+                _, isNew, err := ensurePayoutAction(db, taskID)
+                if err != nil {
+                        log.Printf("Error ensuring payout action: %v", err)
+                        continue
+                }
+                if isNew {
+                        created++
+                }
+        }
+        return created, nil
+}
+
+// Неоплаченные задачи без действия payout, окно выплаты по которым истекло не более
+// payoutSkipReportDays дней назад. Выплата по ним не назначается, они попадают в отчет как пропущенные
+func getSkippedPayoutTasks(db *sql.DB) ([]JobItem, error) {
+        rows, err := db.Query(`
+                SELECT yt.id, bm.name, get_task_event_date(yt.id)
+                FROM year_tasks yt
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                WHERE yt.is_money_transfered = false
+                AND yt.cancelled_at IS NULL
+                AND get_task_event_date(yt.id) < CURRENT_DATE - $1::integer
+                AND get_task_event_date(yt.id) >= CURRENT_DATE - $1::integer - $2::integer
+                AND NOT EXISTS (
+                        SELECT 1 FROM actions a
+                        WHERE a.task_id = yt.id
+                        AND a.type = 'payout'
+                )
+                ORDER BY yt.id`,
+                payoutWindowDays, payoutSkipReportDays)
+        if err != nil {
+                return nil, fmt.Errorf("error querying skipped payout tasks: %v", err)
+        }
+        defer rows.Close()
+
+        var items []JobItem
+        for rows.Next() {
+                var (
+                        taskID    int
+                        name      string
+                        eventDate time.Time
+                )
+                if err := rows.Scan(&taskID, &name, &eventDate); err != nil {
+                        return nil, fmt.Errorf("error scanning skipped payout task: %v", err)
+                }
+                log.Printf("Payout for task %d (%s, %s) skipped: outside of %d-day payout window",
+                        taskID, name, eventDate.Format("2006-01-02"), payoutWindowDays)
+                items = append(items, JobItem{
+                        Kind:   "payout_reminder",
+                        Name:   name,
+                        Status: "skipped",
+                        Reason: fmt.Sprintf("выплата по задаче %d не назначена: праздник %s, окно выплаты %d дней истекло",
+                                taskID, eventDate.Format("02.01.2006"), payoutWindowDays),
+                })
+        }
+        return items, rows.Err()
+}
+
+func getMemberByID(db *sql.DB, memberID int) (*TeamMember, error) {
+        return queryMember(db, `
+                SELECT tm.id, tm.name, tm.birthday, tm.team_id, t.name, tm.phone_number, tm.telegram_chat_id
+                FROM team_members tm
+                JOIN teams t ON tm.team_id = t.id
+                WHERE tm.id = $1`, memberID)
+}
+
+// Возвращает участника по chat ID, если он тимлид или казначей
+func getCollectorMemberByChatID(db *sql.DB, chatID int64) (*TeamMember, error) {
+        return queryMember(db, `
+                SELECT tm.id, tm.name, tm.birthday, tm.team_id, t.name, tm.phone_number, tm.telegram_chat_id
+                FROM team_members tm
+                JOIN teams t ON tm.team_id = t.id
+                WHERE tm.telegram_chat_id = $1::bigint
+                AND tm.is_active = true
+                AND (
+                        EXISTS (SELECT 1 FROM teamleads tl WHERE tl.team_member_id = tm.id)
+                        OR EXISTS (SELECT 1 FROM treasurers tr WHERE tr.team_member_id = tm.id)
+                )
+                ORDER BY tm.id
+                LIMIT 1`, chatID)
+}
+
+func queryMember(db *sql.DB, query string, args ...interface{}) (*TeamMember, error) {
+        var member TeamMember
+        var telegramChatID sql.NullInt64
+        err := db.QueryRow(query, args...).Scan(
+                &member.ID,
+                &member.Name,
+                &member.Birthday,
+                &member.TeamID,
+                &member.TeamName,
+                &member.PhoneNumber,
+                &telegramChatID,
+        )
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        member.TelegramChatID = telegramChatID.Int64
+
+        return &member, nil
+}
+
+// Возвращает телефон для получения переводов и признак подтвержденной замены
+func getCollectionPhone(db *sql.DB, memberID int) (string, bool, error) {
+        var phone string
+        var isOverride bool
+        err := db.QueryRow(`
+                SELECT
+                        get_collector_phone(tm.id),
+                        EXISTS (
+                                SELECT 1 FROM collection_phone_overrides o
+                                WHERE o.team_member_id = tm.id AND o.status = 'approved'
+                        )
+                FROM team_members tm
+                WHERE tm.id = $1`,
+                memberID).Scan(&phone, &isOverride)
+        return phone, isOverride, err
+}
+
+func getPendingPhoneOverride(db *sql.DB, memberID int) (*PhoneOverride, error) {
+        var override PhoneOverride
+        err := db.QueryRow(`
+                SELECT id, team_member_id, phone_number, status
+                FROM collection_phone_overrides
+                WHERE team_member_id = $1
+                AND status = 'pending'`,
+                memberID).Scan(&override.ID, &override.TeamMemberID, &override.PhoneNumber, &override.Status)
+        if err == sql.ErrNoRows {
+                return nil, nil
+        }
+        if err != nil {
+                return nil, err
+        }
+        return &override, nil
+}
+
+// Создает (или обновляет) ожидающий подтверждения запрос на замену телефона
+func requestPhoneOverride(db *sql.DB, memberID int, phoneNumber string) (int, error) {
+        var overrideID int
+        err := db.QueryRow(`
+                INSERT INTO collection_phone_overrides (team_member_id, phone_number)
+                VALUES ($1, $2)
+                ON CONFLICT (team_member_id) WHERE status = 'pending'
+                DO UPDATE SET phone_number = EXCLUDED.phone_number, requested_at = CURRENT_TIMESTAMP
+                RETURNING id`,
+                memberID, phoneNumber).Scan(&overrideID)
+        return overrideID, err
+}
+
+func markPhoneOverrideNotified(db *sql.DB, overrideID int) error {
+        _, err := db.Exec(`
+                UPDATE collection_phone_overrides
+                SET notified_at = CURRENT_TIMESTAMP
+                WHERE id = $1`,
+                overrideID)
+        return err
+}
+
+// Ожидающие запросы на замену телефона, которые еще не отправлялись администраторам
+func getUnnotifiedPhoneOverrides(db *sql.DB) ([]PhoneOverride, error) {
+        rows, err := db.Query(`
+                SELECT o.id, o.team_member_id, o.phone_number, o.status, tm.name, t.name, COALESCE(tm.phone_number, '')
+                FROM collection_phone_overrides o
+                JOIN team_members tm ON tm.id = o.team_member_id
+                JOIN teams t ON t.id = tm.team_id
+                WHERE o.status = 'pending'
+                AND o.notified_at IS NULL
+                ORDER BY o.id`)
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var overrides []PhoneOverride
+        for rows.Next() {
+                var override PhoneOverride
+                err := rows.Scan(&override.ID, &override.TeamMemberID, &override.PhoneNumber, &override.Status,
+                        &override.MemberName, &override.TeamName, &override.CurrentPhone)
+                if err != nil {
+                        return nil, err
+                }
+                overrides = append(overrides, override)
+        }
+        return overrides, rows.Err()
+}
+
+// Подтверждает или отклоняет запрос на замену телефона.
+// Подтвержденная замена заменяет предыдущую действующую.
+func decidePhoneOverride(db *sql.DB, overrideID int, approve bool, adminChatID int64) (*PhoneOverride, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return nil, err
+        }
+
+        var override PhoneOverride
+        err = tx.QueryRow(`
+                SELECT id, team_member_id, phone_number, status
+                FROM collection_phone_overrides
+                WHERE id = $1
+                FOR UPDATE`,
+                overrideID).Scan(&override.ID, &override.TeamMemberID, &override.PhoneNumber, &override.Status)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+        if override.Status != "pending" {
+                tx.Rollback()
+                return nil, fmt.Errorf("запрос уже обработан")
+        }
+
+        status := "rejected"
+        if approve {
+                status = "approved"
+                _, err = tx.Exec(`
+                        UPDATE collection_phone_overrides
+                        SET status = 'revoked', decided_at = CURRENT_TIMESTAMP, decided_by_chat_id = $2
+                        WHERE team_member_id = $1
+                        AND status = 'approved'`,
+                        override.TeamMemberID, adminChatID)
+                if err != nil {
+                        tx.Rollback()
+                        return nil, err
+                }
+        }
+
+        _, err = tx.Exec(`
+                UPDATE collection_phone_overrides
+                SET status = $1, decided_at = CURRENT_TIMESTAMP, decided_by_chat_id = $2
+                WHERE id = $3`,
+                status, adminChatID, overrideID)
+        if err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        action := "reject_phone_override"
+        if approve {
+                action = "approve_phone_override"
+        }
+        if err := logAudit(tx, adminChatID, action, "member", int64(override.TeamMemberID), "", override.PhoneNumber); err != nil {
+                tx.Rollback()
+                return nil, err
+        }
+
+        if err := tx.Commit(); err != nil {
+                return nil, err
+        }
+        override.Status = status
+        return &override, nil
+}
+
+// Сохраняет номер, подтвержденный повторной отправкой контакта; действующие замены снимаются
+func confirmPhoneByContact(db *sql.DB, memberID int, phoneNumber string, actorChatID int64) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+
+        var oldPhone string
+        err = tx.QueryRow("SELECT COALESCE(phone_number, '') FROM team_members WHERE id = $1 FOR UPDATE", memberID).Scan(&oldPhone)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        _, err = tx.Exec("UPDATE team_members SET phone_number = $1 WHERE id = $2", phoneNumber, memberID)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        if err := logAudit(tx, actorChatID, "confirm_phone", "member", int64(memberID), oldPhone, phoneNumber); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        _, err = tx.Exec(`
+                UPDATE collection_phone_overrides
+                SET status = CASE WHEN status = 'approved' THEN 'revoked' ELSE 'rejected' END,
+                    decided_at = CURRENT_TIMESTAMP
+                WHERE team_member_id = $1
+                AND status IN ('pending', 'approved')`,
+                memberID)
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+// Снимает действующую замену телефона; возвращает false, если замены не было
+func resetPhoneOverride(db *sql.DB, memberID int, actorChatID int64) (bool, error) {
+        tx, err := db.Begin()
+        if err != nil {
+                return false, err
+        }
+        defer tx.Rollback()
+
+        var oldPhone string
+        err = tx.QueryRow(`
+                UPDATE collection_phone_overrides
+                SET status = 'revoked', decided_at = CURRENT_TIMESTAMP
+                WHERE team_member_id = $1
+                AND status = 'approved'
+                RETURNING phone_number`,
+                memberID).Scan(&oldPhone)
+        if err == sql.ErrNoRows {
+                return false, nil
+        }
+        if err != nil {
+                return false, err
+        }
+
+        if err := logAudit(tx, actorChatID, "reset_phone_override", "member", int64(memberID), oldPhone, ""); err != nil {
+                return false, err
+        }
+        return true, tx.Commit()
+}
+
+// Приводит номер к виду +79991234567; возвращает false для некорректного номера
+func normalizePhone(text string) (string, bool) {
+        var digits strings.Builder
+        for _, r := range text {
+                if r >= '0' && r <= '9' {
+                        digits.WriteRune(r)
+                } else if !strings.ContainsRune(" +-()", r) {
+                        return "", false
+                }
+        }
+        if digits.Len() < 10 || digits.Len() > 15 {
+                return "", false
+        }
+        return "+" + digits.String(), true
+}
+
+// Запоминает пользователя, написавшего боту, для рассылок незарегистрированным
+func recordBotUser(db *sql.DB, user *tgbotapi.User) error {
+        if user == nil {
+                return nil
+        }
+        _, err := db.Exec(`
+                INSERT INTO bot_users (telegram_chat_id, username, first_name)
+                VALUES ($1, $2, $3)
+                ON CONFLICT (telegram_chat_id) DO UPDATE
+                SET username = EXCLUDED.username,
+                    first_name = EXCLUDED.first_name,
+                    last_seen_at = CURRENT_TIMESTAMP`,
+                user.ID, user.UserName, user.FirstName)
+        return err
+}
+
+// Получатели рассылки: all — активные участники, team_<id> — участники команды,
+// teamleads — тимлиды, unregistered — писавшие боту, но не завершившие регистрацию
+func getBroadcastRecipients(db *sql.DB, audience string) ([]BroadcastRecipient, error) {
+        var rows *sql.Rows
+        var err error
+        switch {
+        case audience == "all":
+                rows, err = db.Query(`
+                        SELECT DISTINCT ON (m.telegram_chat_id) m.telegram_chat_id, m.name
+                        FROM team_members m
+                        JOIN teams t ON m.team_id = t.id
+                        WHERE m.telegram_chat_id IS NOT NULL
+                        AND m.is_active = true
+                        AND t.is_active = true
+                        ORDER BY m.telegram_chat_id, m.id`)
+        case strings.HasPrefix(audience, "team_"):
+                teamID, convErr := strconv.Atoi(strings.TrimPrefix(audience, "team_"))
+                if convErr != nil {
+                        return nil, fmt.Errorf("invalid audience %q", audience)
+                }
+                rows, err = db.Query(`
+                        SELECT DISTINCT ON (m.telegram_chat_id) m.telegram_chat_id, m.name
+                        FROM team_members m
+                        WHERE m.telegram_chat_id IS NOT NULL
+                        AND m.is_active = true
+                        AND m.team_id = $1
+                        ORDER BY m.telegram_chat_id, m.id`,
+                        teamID)
+        case audience == "teamleads":
+                rows, err = db.Query(`
+                        SELECT DISTINCT ON (tm.telegram_chat_id) tm.telegram_chat_id, tm.name
+                        FROM teamleads tl
+                        JOIN team_members tm ON tl.team_member_id = tm.id
+                        WHERE tm.telegram_chat_id IS NOT NULL
+                        ORDER BY tm.telegram_chat_id, tm.id`)
+        case audience == "unregistered":
+                rows, err = db.Query(`
+                        SELECT u.telegram_chat_id, COALESCE(NULLIF(u.first_name, ''), u.username, '')
+                        FROM bot_users u
+                        WHERE NOT EXISTS (
+                                SELECT 1 FROM team_members m
+                                WHERE m.telegram_chat_id = u.telegram_chat_id
+                        )
+                        ORDER BY u.telegram_chat_id`)
+        default:
+                return nil, fmt.Errorf("invalid audience %q", audience)
+        }
+        if err != nil {
+                return nil, err
+        }
+        defer rows.Close()
+
+        var recipients []BroadcastRecipient
+        for rows.Next() {
+                var recipient BroadcastRecipient
+                if err := rows.Scan(&recipient.ChatID, &recipient.Name); err != nil {
+                        return nil, err
+                }
+                recipients = append(recipients, recipient)
+        }
+        return recipients, rows.Err()
+}
+
+func describeBroadcastAudience(db *sql.DB, audience string) string {
+        switch {
+        case audience == "all":
+                return "все участники"
+        case audience == "teamleads":
+                return "тимлиды"
+        case audience == "unregistered":
+                return "не завершившие регистрацию"
+        case strings.HasPrefix(audience, "team_"):
+                teamID, _ := strconv.Atoi(strings.TrimPrefix(audience, "team_"))
+                team, err := getTeamInfo(db, teamID)
+                if err == nil && team != nil {
+                        return "команда " + team.Name
+                }
+        }
+        return audience
+}
+
+func createBroadcast(db *sql.DB, adminChatID int64, text, audience string, recipientsCount int) (int, error) {
+        var broadcastID int
+        err := db.QueryRow(`
+                INSERT INTO broadcasts (admin_chat_id, text, audience, recipients_count)
+                VALUES ($1, $2, $3, $4)
+                RETURNING id`,
+                adminChatID, text, audience, recipientsCount).Scan(&broadcastID)
+        return broadcastID, err
+}
+
+func finishBroadcast(db *sql.DB, broadcastID, sentCount, failedCount int) error {
+        _, err := db.Exec(`
+                UPDATE broadcasts
+                SET sent_count = $1, failed_count = $2, finished_at = CURRENT_TIMESTAMP
+                WHERE id = $3`,
+                sentCount, failedCount, broadcastID)
+        return err
+}
+
+// Данные сообщения запуска, по которым повторяется отправка
+type jobItemPayload struct {
+        Text     string                         `json:"text"`
+        Keyboard *tgbotapi.InlineKeyboardMarkup `json:"keyboard,omitempty"`
+        Journal  JournalRecord                  `json:"journal"`
+}
+
+// Сохраняет запуск и всех его получателей, report.RunID заполняется номером запуска
+func saveJobReport(db *sql.DB, report *JobReport, adminChatID int64) error {
+        tx, err := db.Begin()
+        if err != nil {
+                return err
+        }
+        defer tx.Rollback()
+
+        err = tx.QueryRow(`
+                INSERT INTO job_runs (job, admin_chat_id, sent_count, failed_count, skipped_count)
+                VALUES ($1, $2, $3, $4, $5)
+                RETURNING id`,
+                report.Job, adminChatID, report.count("sent"), report.count("failed"), report.count("skipped")).Scan(&report.RunID)
+        if err != nil {
+                return err
+        }
+
+        for i := range report.Items {
+                item := &report.Items[i]
+                payload, err := json.Marshal(jobItemPayload{Text: item.Text, Keyboard: item.Keyboard, Journal: item.Journal})
+                if err != nil {
+                        return fmt.Errorf("error marshaling job item: %v", err)
+                }
+                err = tx.QueryRow(`
+                        INSERT INTO job_run_items (run_id, kind, chat_id, recipient_name, status, reason, action_id, payload)
+                        VALUES ($1, $2, $3, $4, $5, $6, $7, $8::jsonb)
+                        RETURNING id`,
+                        report.RunID, item.Kind, sql.NullInt64{Int64: item.ChatID, Valid: item.ChatID != 0},
+                        item.Name, item.Status, item.Reason, item.ActionID, string(payload)).Scan(&item.ID)
+                if err != nil {
+                        return err
+                }
+        }
+
+        return tx.Commit()
+}
+
+// Забирает неудачные отправки запуска для повтора. Статус retrying не дает
+// повторить одно и то же сообщение дважды при повторном нажатии кнопки.
+func claimFailedJobItems(db *sql.DB, runID int) (string, []JobItem, error) {
+        rows, err := db.Query(`
+                UPDATE job_run_items i
+                SET status = 'retrying', updated_at = CURRENT_TIMESTAMP
+                FROM job_runs r
+                WHERE r.id = i.run_id
+                AND i.run_id = $1
+                AND i.status = 'failed'
+                RETURNING r.job, i.id, i.kind, i.chat_id, i.recipient_name, i.action_id, i.payload`,
+                runID)
+        if err != nil {
+                return "", nil, err
+        }
+        defer rows.Close()
+
+        var job string
+        var items []JobItem
+        for rows.Next() {
+                var item JobItem
+                var payload []byte
+                if err := rows.Scan(&job, &item.ID, &item.Kind, &item.ChatID, &item.Name, &item.ActionID, &payload); err != nil {
+                        return "", nil, err
+                }
+                var data jobItemPayload
+                if err := json.Unmarshal(payload, &data); err != nil {
+                        return "", nil, fmt.Errorf("error unmarshaling job item %d: %v", item.ID, err)
+                }
+                item.Text = data.Text
+                item.Keyboard = data.Keyboard
+                item.Journal = data.Journal
+                items = append(items, item)
+        }
+        return job, items, rows.Err()
+}
+
+// Возвращает в failed отправки, повтор которых прервался остановкой бота,
+// чтобы их снова можно было повторить кнопкой из отчета
+func resetRetryingJobItems(db *sql.DB) (int64, error) {
+        result, err := db.Exec(`
+                UPDATE job_run_items
+                SET status = 'failed', reason = 'повтор прерван перезапуском бота', updated_at = CURRENT_TIMESTAMP
+                WHERE status = 'retrying'`)
+        if err != nil {
+                return 0, err
+        }
+        return result.RowsAffected()
+}
+
+func updateJobItem(db *sql.DB, item *JobItem) error {
+        _, err := db.Exec(`
+                UPDATE job_run_items
+                SET status = $1, reason = $2, updated_at = CURRENT_TIMESTAMP
+                WHERE id = $3`,
+                item.Status, item.Reason, item.ID)
+        return err
+}
+
+func refreshJobRunCounts(db *sql.DB, runID int) error {
+        _, err := db.Exec(`
+                UPDATE job_runs r
+                SET sent_count = (SELECT COUNT(*) FROM job_run_items i WHERE i.run_id = r.id AND i.status = 'sent'),
+                    failed_count = (SELECT COUNT(*) FROM job_run_items i WHERE i.run_id = r.id AND i.status = 'failed'),
+                    skipped_count = (SELECT COUNT(*) FROM job_run_items i WHERE i.run_id = r.id AND i.status = 'skipped'),
+                    retried_at = CURRENT_TIMESTAMP
+                WHERE r.id = $1`,
+                runID)
+        return err
+}
+
+// Повтор не нужен, если действие уже выполнено, сбор отменен
+// или уведомление тимлида уже доставлено плановой отправкой
+func isJobItemClosed(db *sql.DB, item *JobItem) (bool, error) {
+        if notification, ok := item.Journal.Payload.(*TeamLeadNotificationRecord); ok {
+                memberID, err := teamLeadNotificationMemberID(db, item, notification)
+                if err != nil {
+                        return false, err
+                }
+                var closed bool
+                err = db.QueryRow(`
+                        SELECT yt.cancelled_at IS NOT NULL OR EXISTS (
+                                SELECT 1 FROM teamlead_notification_deliveries d
+                                WHERE d.task_id = yt.id AND d.team_member_id = $2
+                        )
+                        FROM year_tasks yt
+                        WHERE yt.id = $1`,
+                        notification.TaskID, memberID).Scan(&closed)
+                if err == sql.ErrNoRows {
+                        return true, nil
+                }
+                return closed, err
+        }
+        if !item.ActionID.Valid {
+                return false, nil
+        }
+        var closed bool
+        err := db.QueryRow(`
+                SELECT a.is_done OR yt.cancelled_at IS NOT NULL
+                FROM actions a
+                JOIN year_tasks yt ON a.task_id = yt.id
+                WHERE a.id = $1`,
+                item.ActionID.Int64).Scan(&closed)
+        if err == sql.ErrNoRows {
+                return true, nil
+        }
+        return closed, err
 }
 
-func checkUpcomingBirthdays(db *sql.DB) {
-    for {
-        // Ждем до 00:01 по московскому времени
-        now := time.Now()
-        next := time.Date(now.Year(), now.Month(), now.Day(), 0, 1, 0, 0, time.Local)
-        if now.After(next) {
-            next = next.Add(24 * time.Hour)
+// Собирает сообщение действия по текущим данным: запрос на перевод (request) или напоминание о выплате (payout).
+// Возвращает nil, если действие выполнено или сбор отменен. ChatID равен 0, если получатель не зарегистрирован в боте
+func renderActionMessage(db *sql.DB, actionID int) (*JobItem, error) {
+        var (
+                actionType     string
+                taskID         int
+                memberName     string
+                telegramChatID sql.NullInt64
+                birthdayName   string
+                birthdayPhone  string
+                teamName       string
+                collectorName  sql.NullString
+                collectorPhone sql.NullString
+                occasion       CollectionOccasion
+                title          sql.NullString
+                closed         bool
+        )
+        err := db.QueryRow(`
+                SELECT
+                        a.type,
+                        yt.id,
+                        m.name,
+                        m.telegram_chat_id,
+                        bm.name,
+                        bm.phone_number,
+                        t.name,
+                        cm.name,
+                        get_collector_phone(cm.id),
+                        yt.kind,
+                        yt.title,
+                        get_task_event_date(yt.id),
+                        yt.amount,
+                        a.is_done OR yt.is_money_transfered OR yt.cancelled_at IS NOT NULL
+                FROM actions a
+                JOIN year_tasks yt ON a.task_id = yt.id
+                JOIN team_members m ON a.team_member_id = m.id
+                JOIN team_members bm ON yt.team_member_id = bm.id
+                JOIN teams t ON bm.team_id = t.id
+                LEFT JOIN team_members cm ON yt.collector_member_id = cm.id
+                WHERE a.id = $1`,
+                actionID).Scan(&actionType, &taskID, &memberName, &telegramChatID, &birthdayName, &birthdayPhone, &teamName,
+                &collectorName, &collectorPhone, &occasion.Kind, &title, &occasion.EventDate, &occasion.Amount, &closed)
+        if err == sql.ErrNoRows || (err == nil && closed) {
+                return nil, nil
         }
-        time.Sleep(time.Until(next))
+        if err != nil {
+                return nil, err
+        }
+        occasion.Title = title.String
 
-        // Проверяем и создаем задачи
-        count, err := checkUpcomingBirthdaysOnce(db)
-        if err != nil && err.Error() != "no new tasks created" {
-            log.Printf("Error in scheduled birthday check: %v", err)
-        } else if count > 0 {
-            log.Printf("Created %d new birthday tasks", count)
+        item := &JobItem{
+                ChatID:   telegramChatID.Int64,
+                Name:     memberName,
+                ActionID: sql.NullInt64{Int64: int64(actionID), Valid: true},
         }
-    }
+        var keyboard tgbotapi.InlineKeyboardMarkup
+        switch actionType {
+        case "request":
+                if !collectorName.Valid {
+                        return nil, fmt.Errorf("task %d has no collector", taskID)
+                }
+                keyboard = memberNotificationKeyboard(actionID)
+                item.Kind = "member_notification"
+                item.Text = formatMemberNotificationText(occasion, birthdayName, teamName, collectorPhone.String, collectorName.String)
+                item.Journal = memberNotificationJournal(item.Text, keyboard, birthdayName, teamName, collectorName.String,
+                        collectorPhone.String, collectionJournal(taskID, occasion))
+        case "payout":
+                keyboard = payoutReminderKeyboard(actionID, taskID)
+                item.Kind = "payout_reminder"
+                item.Text = formatPayoutReminderText(birthdayName, birthdayPhone)
+                item.Journal = payoutReminderJournal(item.Text, keyboard, birthdayName, birthdayPhone)
+        default:
+                return nil, fmt.Errorf("action %d of type %s has no message", actionID, actionType)
+        }
+        item.Keyboard = &keyboard
+        return item, nil
 }
 
-func getTodaysBirthdays(db *sql.DB) ([]TeamMember, error) {
-        query := `
-                SELECT m.id, m.name, m.birthday, m.team_id, t.name as team_name
-                FROM team_members m
-                JOIN teams t ON m.team_id = t.id
-                WHERE t.is_active = true
-                AND EXTRACT(MONTH FROM birthday) = EXTRACT(MONTH FROM CURRENT_DATE)
-                AND EXTRACT(DAY FROM birthday) = EXTRACT(DAY FROM CURRENT_DATE)`
-
-        return queryBirthdays(db, query)
+// После успешного повтора уведомления тимлида получатель больше не попадает в плановую отправку,
+// а задача — когда уведомление получили все ее получатели
+func markJobItemNotified(db *sql.DB, item *JobItem) error {
+        notification, ok := item.Journal.Payload.(*TeamLeadNotificationRecord)
+        if !ok {
+                return nil
+        }
+        memberID, err := teamLeadNotificationMemberID(db, item, notification)
+        if err != nil {
+                return err
+        }
+        if err := recordTeamLeadDelivery(db, notification.TaskID, memberID); err != nil {
+                return err
+        }
+        return markTeamLeadTaskNotified(db, notification.TaskID)
 }
 
-func getUpcomingBirthdays(db *sql.DB) ([]TeamMember, error) {
-        query := `
-                WITH birthday_dates AS (
-                        SELECT 
-                                id,
-                                birthday,
-                                (CASE 
-                                        WHEN (birthday + ((EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM birthday))::integer * INTERVAL '1 year')) < CURRENT_DATE
-                                        THEN (birthday + ((EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM birthday) + 1)::integer * INTERVAL '1 year'))
-                                        ELSE (birthday + ((EXTRACT(YEAR FROM CURRENT_DATE) - EXTRACT(YEAR FROM birthday))::integer * INTERVAL '1 year'))
-                                END) as next_birthday
-                        FROM team_members
-                )
-                SELECT 
-                        m.id, 
-                        m.name, 
-                        m.birthday, 
-                        m.team_id,
-                        t.name as team_name,
-                        m.phone_number
-                FROM team_members m
-                JOIN teams t ON m.team_id = t.id
-                JOIN birthday_dates bd ON m.id = bd.id
-                WHERE t.is_active = true
-                AND bd.next_birthday <= CURRENT_DATE + INTERVAL '30 days'
-                AND bd.next_birthday >= CURRENT_DATE
-                ORDER BY bd.next_birthday`
+// Получатель уведомления тимлида. В записях до notified_member_id он определяется по chat ID
+func teamLeadNotificationMemberID(db *sql.DB, item *JobItem, notification *TeamLeadNotificationRecord) (int, error) {
+        if notification.NotifiedMemberID != 0 {
+                return notification.NotifiedMemberID, nil
+        }
+        var memberID int
+        err := db.QueryRow(`
+                SELECT id FROM team_members
+                WHERE telegram_chat_id = $1
+                ORDER BY is_active DESC, id
+                LIMIT 1`,
+                item.ChatID).Scan(&memberID)
+        return memberID, err
+}
 
-        return queryBirthdays(db, query)
+// Разбирает список chat ID суперадминистраторов через запятую
+func parseSuperAdminIDs(value string) ([]int64, error) {
+        var ids []int64
+        for _, field := range strings.Split(value, ",") {
+                field = strings.TrimSpace(field)
+                if field == "" {
+                        continue
+                }
+                id, err := strconv.ParseInt(field, 10, 64)
+                if err != nil {
+                        return nil, fmt.Errorf("invalid chat ID %q", field)
+                }
+                ids = append(ids, id)
+        }
+        return ids, nil
 }
 
-func queryBirthdays(db *sql.DB, query string) ([]TeamMember, error) {
-        rows, err := db.Query(query)
+// Приводит суперадминистраторов в базе к списку из конфигурации.
+// Пустой список ничего не меняет, чтобы не остаться без суперадминистраторов.
+func syncSuperAdmins(db *sql.DB, chatIDs []int64) error {
+        if len(chatIDs) == 0 {
+                return nil
+        }
+
+        tx, err := db.Begin()
         if err != nil {
-                return nil, err
+                return err
         }
-        defer rows.Close()
 
-        var birthdays []TeamMember
+        // Запоминаем прежних суперадминистраторов, чтобы записать в аудит только изменения
+        previous := make(map[int64]bool)
+        rows, err := tx.Query("SELECT telegram_chat_id FROM admins WHERE is_super = true")
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
         for rows.Next() {
-                var member TeamMember
-                err := rows.Scan(
-                        &member.ID,
-                        &member.Name,
-                        &member.Birthday,
-                        &member.TeamID,
-                        &member.TeamName,
-                        &member.PhoneNumber,
-                )
+                var chatID int64
+                if err := rows.Scan(&chatID); err != nil {
+                        rows.Close()
+                        tx.Rollback()
+                        return err
+                }
+                previous[chatID] = true
+        }
+        rows.Close()
+
+        // Исключенные из конфигурации остаются обычными администраторами
+        _, err = tx.Exec("UPDATE admins SET is_super = false WHERE is_super = true")
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        configured := make(map[int64]bool)
+        for _, chatID := range chatIDs {
+                configured[chatID] = true
+                _, err = tx.Exec(`
+                        INSERT INTO admins (telegram_chat_id, is_super)
+                        VALUES ($1, true)
+                        ON CONFLICT (telegram_chat_id) DO UPDATE SET is_super = true`,
+                        chatID)
                 if err != nil {
-                        return nil, err
+                        tx.Rollback()
+                        return err
+                }
+                if !previous[chatID] {
+                        if err := logAudit(tx, 0, "grant_super_admin", "admin", chatID, "false", "true"); err != nil {
+                                tx.Rollback()
+                                return err
+                        }
+                }
+        }
+        for chatID := range previous {
+                if !configured[chatID] {
+                        if err := logAudit(tx, 0, "revoke_super_admin", "admin", chatID, "true", "false"); err != nil {
+                                tx.Rollback()
+                                return err
+                        }
                 }
-                birthdays = append(birthdays, member)
         }
 
-        return birthdays, nil
+        return tx.Commit()
 }
 
-func getActiveTeams(db *sql.DB) ([]Team, error) {
-        query := `
-                SELECT id, name, is_active
-                FROM teams
-                WHERE is_active = true
-                ORDER BY name`
+func isSuperAdmin(db *sql.DB, chatID int64) (bool, error) {
+        var exists bool
+        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM admins WHERE telegram_chat_id = $1 AND is_super = true)", chatID).Scan(&exists)
+        return exists, err
+}
 
-        rows, err := db.Query(query)
+const adminQuery = `
+        SELECT
+                a.telegram_chat_id,
+                a.is_super,
+                COALESCE((SELECT tm.name FROM team_members tm WHERE tm.telegram_chat_id = a.telegram_chat_id ORDER BY tm.id LIMIT 1), '')
+        FROM admins a`
+
+func getAdmins(db *sql.DB) ([]Admin, error) {
+        rows, err := db.Query(adminQuery + `
+                ORDER BY a.is_super DESC, a.id`)
         if err != nil {
                 return nil, err
         }
         defer rows.Close()
 
-        var teams []Team
+        var admins []Admin
         for rows.Next() {
-                var team Team
-                err := rows.Scan(&team.ID, &team.Name, &team.IsActive)
-                if err != nil {
+                var admin Admin
+                if err := rows.Scan(&admin.ChatID, &admin.IsSuper, &admin.Name); err != nil {
                         return nil, err
                 }
-                teams = append(teams, team)
+                admins = append(admins, admin)
         }
-
-        return teams, nil
+        return admins, rows.Err()
 }
 
-func formatBirthdayMessage(birthdays []TeamMember) string {
-        if len(birthdays) == 0 {
-                return "Нет предстоящих дней рождения."
+func getAdmin(db *sql.DB, chatID int64) (*Admin, error) {
+        var admin Admin
+        err := db.QueryRow(adminQuery+`
+                WHERE a.telegram_chat_id = $1`, chatID).Scan(&admin.ChatID, &admin.IsSuper, &admin.Name)
+        if err == sql.ErrNoRows {
+                return nil, nil
         }
-
-        msg := "Дни рождения:\n\n"
-        for _, member := range birthdays {
-                msg += fmt.Sprintf("%s (Команда: %s) - %s\n",
-                        member.Name,
-                        member.TeamName,
-                        member.Birthday.Format("02.01.2006"))
+        if err != nil {
+                return nil, err
         }
-        return msg
+        return &admin, nil
 }
 
-func addBirthday(db *sql.DB, name string, birthday time.Time, phoneNumber string, teamID int, telegramChatID int64) error {
-        // Проверяем существование команды
-        var exists bool
-        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND is_active = true)", teamID).Scan(&exists)
+// Выдает права администратора; возвращает false, если они уже были
+func grantAdmin(db *sql.DB, chatID int64, grantedByChatID int64) (bool, error) {
+        tx, err := db.Begin()
         if err != nil {
-                return err
+                return false, err
         }
-        if !exists {
-                return fmt.Errorf("команда с ID %d не существует или не активна", teamID)
+        defer tx.Rollback()
+
+        result, err := tx.Exec(`
+                INSERT INTO admins (telegram_chat_id, granted_by_chat_id)
+                VALUES ($1, $2)
+                ON CONFLICT (telegram_chat_id) DO NOTHING`,
+                chatID, grantedByChatID)
+        if err != nil {
+                return false, err
+        }
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+                return false, err
+        }
+        if rowsAffected == 0 {
+                return false, nil
         }
 
-        // Добавляем день рождения
-        _, err = db.Exec(`
-                INSERT INTO team_members (name, birthday, phone_number, team_id, telegram_chat_id)
-                VALUES ($1, $2, $3, $4, $5)`,
-                name, birthday, phoneNumber, teamID, telegramChatID)
-        return err
+        if err := logAudit(tx, grantedByChatID, "grant_admin", "admin", chatID, "", "admin"); err != nil {
+                return false, err
+        }
+        return true, tx.Commit()
 }
 
-func getTeamLeads(db *sql.DB) ([]TeamLead, error) {
-        query := `
-                SELECT 
-                        tl.id,
-                        tl.team_member_id,
-                        tl.team_id,
-                        tl.phone_number,
-                        tm.name as member_name,
-                        t.name as team_name
-                FROM teamleads tl
-                JOIN team_members tm ON tl.team_member_id = tm.id
-                JOIN teams t ON tl.team_id = t.id
-                WHERE t.is_active = true
-                ORDER BY t.name, tm.name`
-
-        rows, err := db.Query(query)
+// Проверяет, что после снятия статуса у chatID останется хотя бы один суперадминистратор.
+// Строки суперадминистраторов блокируются до конца транзакции.
+func ensureNotLastSuperAdmin(tx *sql.Tx, chatID int64) error {
+        rows, err := tx.Query("SELECT telegram_chat_id FROM admins WHERE is_super = true FOR UPDATE")
         if err != nil {
-                return nil, err
+                return err
         }
         defer rows.Close()
 
-        var teamLeads []TeamLead
+        remaining := 0
         for rows.Next() {
-                var lead TeamLead
-                err := rows.Scan(
-                        &lead.ID,
-                        &lead.TeamMemberID,
-                        &lead.TeamID,
-                        &lead.PhoneNumber,
-                        &lead.MemberName,
-                        &lead.TeamName,
-                )
-                if err != nil {
-                        return nil, err
+                var superChatID int64
+                if err := rows.Scan(&superChatID); err != nil {
+                        return err
+                }
+                if superChatID != chatID {
+                        remaining++
                 }
-                teamLeads = append(teamLeads, lead)
         }
-
-        return teamLeads, nil
+        if err := rows.Err(); err != nil {
+                return err
+        }
+        if remaining == 0 {
+                return fmt.Errorf("нельзя убрать последнего суперадминистратора")
+        }
+        return nil
 }
 
-func getTeamLeadByTeamID(db *sql.DB, teamID int) (*TeamLead, error) {
-        query := `
-                SELECT 
-                        tl.id,
-                        tl.team_member_id,
-                        tl.team_id,
-                        tl.phone_number,
-                        tm.name as member_name,
-                        t.name as team_name
-                FROM teamleads tl
-                JOIN team_members tm ON tl.team_member_id = tm.id
-                JOIN teams t ON tl.team_id = t.id
-                WHERE t.is_active = true AND tl.team_id = $1
-                LIMIT 1`
-
-        var lead TeamLead
-        err := db.QueryRow(query, teamID).Scan(
-                &lead.ID,
-                &lead.TeamMemberID,
-                &lead.TeamID,
-                &lead.PhoneNumber,
-                &lead.MemberName,
-                &lead.TeamName,
-        )
-        if err == sql.ErrNoRows {
-                return nil, nil
-        }
+func revokeAdmin(db *sql.DB, chatID int64, actorChatID int64) error {
+        tx, err := db.Begin()
         if err != nil {
-                return nil, err
+                return err
         }
 
-        return &lead, nil
-}
+        if err := ensureNotLastSuperAdmin(tx, chatID); err != nil {
+                tx.Rollback()
+                return err
+        }
 
-func addTeamLead(db *sql.DB, teamMemberID, teamID int, phoneNumber string) error {
-        // Проверяем существование team_member
-        var exists bool
-        err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM team_members WHERE id = $1)", teamMemberID).Scan(&exists)
+        result, err := tx.Exec("DELETE FROM admins WHERE telegram_chat_id = $1", chatID)
         if err != nil {
+                tx.Rollback()
                 return err
         }
-        if !exists {
-                return fmt.Errorf("team member с ID %d не существует", teamMemberID)
+        rowsAffected, err := result.RowsAffected()
+        if err != nil {
+                tx.Rollback()
+                return err
+        }
+        if rowsAffected == 0 {
+                tx.Rollback()
+                return fmt.Errorf("пользователь не является администратором")
         }
 
-        // Проверяем существование team
-        err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM teams WHERE id = $1 AND is_active = true)", teamID).Scan(&exists)
+        if err := logAudit(tx, actorChatID, "revoke_admin", "admin", chatID, "admin", ""); err != nil {
+                tx.Rollback()
+                return err
+        }
+
+        return tx.Commit()
+}
+
+func setSuperAdmin(db *sql.DB, chatID int64, isSuper bool, actorChatID int64) error {
+        tx, err := db.Begin()
         if err != nil {
                 return err
         }
-        if !exists {
-                return fmt.Errorf("team с ID %d не существует или не активна", teamID)
+
+        if !isSuper {
+                if err := ensureNotLastSuperAdmin(tx, chatID); err != nil {
+                        tx.Rollback()
+                        return err
+                }
         }
 
-        // Проверяем, нет ли уже тимлида для этой команды
-        err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM teamleads WHERE team_id = $1)", teamID).Scan(&exists)
-        if err != nil {
+        if _, err := tx.Exec("UPDATE admins SET is_super = $1 WHERE telegram_chat_id = $2", isSuper, chatID); err != nil {
+                tx.Rollback()
                 return err
         }
-        if exists {
-                return fmt.Errorf("для команды с ID %d уже назначен тимлид", teamID)
+
+        action := "revoke_super_admin"
+        if isSuper {
+                action = "grant_super_admin"
+        }
+        if err := logAudit(tx, actorChatID, action, "admin", chatID, strconv.FormatBool(!isSuper), strconv.FormatBool(isSuper)); err != nil {
+                tx.Rollback()
+                return err
         }
 
-        // Добавляем тимлида
-        _, err = db.Exec(`
-                INSERT INTO teamleads (team_member_id, team_id, phone_number)
-                VALUES ($1, $2, $3)`,
-                teamMemberID, teamID, phoneNumber)
-        return err
+        return tx.Commit()
 }
 
-func updateTeamLeadPhone(db *sql.DB, teamLeadID int, newPhoneNumber string) error {
-        result, err := db.Exec(`
-                UPDATE teamleads
-                SET phone_number = $1
-                WHERE id = $2`,
-                newPhoneNumber, teamLeadID)
+func getAdminChatIDs(db *sql.DB) ([]int64, error) {
+        rows, err := db.Query("SELECT telegram_chat_id FROM admins ORDER BY id")
         if err != nil {
-                return err
+                return nil, err
         }
+        defer rows.Close()
 
-        rowsAffected, err := result.RowsAffected()
-        if err != nil {
-                return err
-        }
-        if rowsAffected == 0 {
-                return fmt.Errorf("тимлид с ID %d не найден", teamLeadID)
+        var chatIDs []int64
+        for rows.Next() {
+                var chatID int64
+                if err := rows.Scan(&chatID); err != nil {
+                        return nil, err
+                }
+                chatIDs = append(chatIDs, chatID)
         }
-
-        return nil
+        return chatIDs, nil
 }
 
-func removeTeamLead(db *sql.DB, teamLeadID int) error {
-        result, err := db.Exec("DELETE FROM teamleads WHERE id = $1", teamLeadID)
+// Закрепляет получателя переводов за открытыми задачами, у которых он еще не выбран.
+// Задачи обрабатываются по одной, чтобы ротация учитывала предыдущие назначения.
+func assignTaskCollectors(db *sql.DB) error {
+        rows, err := db.Query(`
+                SELECT id
+                FROM year_tasks
+                WHERE collector_member_id IS NULL
+                AND is_money_transfered = false
+                AND cancelled_at IS NULL
+                ORDER BY id`)
         if err != nil {
-                return err
+                return fmt.Errorf("error querying tasks without collector: %v", err)
         }
 
-        rowsAffected, err := result.RowsAffected()
-        if err != nil {
-                return err
+        var taskIDs []int
+        for rows.Next() {
+                var taskID int
+                if err := rows.Scan(&taskID); err != nil {
+                        rows.Close()
+                        return fmt.Errorf("error scanning task: %v", err)
+                }
+                taskIDs = append(taskIDs, taskID)
         }
-        if rowsAffected == 0 {
-                return fmt.Errorf("тимлид с ID %d не найден", teamLeadID)
+        rows.Close()
+
+        for _, taskID := range taskIDs {
+                var collectorID sql.NullInt64
+                if err := db.QueryRow("SELECT assign_task_collector($1)", taskID).Scan(&collectorID); err != nil {
+                        log.Printf("Error assigning collector for task %d: %v", taskID, err)
+                        continue
+                }
+                if !collectorID.Valid {
+                        log.Printf("No collector available for task %d", taskID)
+                }
         }
 
         return nil
@@ -1283,7 +9834,7 @@ func removeTeamLead(db *sql.DB, teamLeadID int) error {
 func createRequestActionsOnce(db *sql.DB) error {
     // Находим задачи без actions типа request
     query := `
-        SELECT yt.id, yt.team_member_id
+        SELECT yt.id, yt.team_member_id, yt.scope_team_id
         FROM year_tasks yt
         LEFT JOIN actions a ON a.task_id = yt.id AND a.type = 'request'
         WHERE a.id IS NULL`
@@ -1297,17 +9848,20 @@ func createRequestActionsOnce(db *sql.DB) error {
     actionsCreated := 0
     for rows.Next() {
         var taskID, birthdayMemberID int
-        if err := rows.Scan(&taskID, &birthdayMemberID); err != nil {
+        var scopeTeamID sql.NullInt64
+        if err := rows.Scan(&taskID, &birthdayMemberID, &scopeTeamID); err != nil {
             log.Printf("Error scanning task: %v", err)
             continue
         }
 
-        // Получаем всех членов, кроме именинника
+        // Получаем всех членов (или членов команды сбора), кроме именинника
         memberRows, err := db.Query(`
             SELECT id
             FROM team_members
-            WHERE id != $1`,
-            birthdayMemberID)
+            WHERE id != $1
+            AND is_active = true
+            AND ($2::integer IS NULL OR team_id = $2)`,
+            birthdayMemberID, scopeTeamID)
         if err != nil {
             log.Printf("Error getting team members: %v", err)
             continue
@@ -1360,7 +9914,7 @@ func createRequestActions(db *sql.DB) {
 
                 // Находим задачи без actions типа request
                 query := `
-                        SELECT yt.id, yt.team_member_id
+                        SELECT yt.id, yt.team_member_id, yt.scope_team_id
                         FROM year_tasks yt
                         LEFT JOIN actions a ON a.task_id = yt.id AND a.type = 'request'
                         WHERE a.id IS NULL`
@@ -1373,17 +9927,20 @@ func createRequestActions(db *sql.DB) {
 
                 for rows.Next() {
                         var taskID, birthdayMemberID int
-                        if err := rows.Scan(&taskID, &birthdayMemberID); err != nil {
+                        var scopeTeamID sql.NullInt64
+                        if err := rows.Scan(&taskID, &birthdayMemberID, &scopeTeamID); err != nil {
                                 log.Printf("Error scanning task: %v", err)
                                 continue
                         }
 
-                        // Получаем всех членов команды, кроме именинника
+                        // Получаем всех членов (или членов команды сбора), кроме именинника
                         memberRows, err := db.Query(`
                                 SELECT id 
                                 FROM team_members 
-                                WHERE id != $1`,
-                                birthdayMemberID)
+                                WHERE id != $1
+                                AND is_active = true
+                                AND ($2::integer IS NULL OR team_id = $2)`,
+                                birthdayMemberID, scopeTeamID)
                         if err != nil {
                                 log.Printf("Error getting team members: %v", err)
                                 continue
@@ -1411,59 +9968,86 @@ func createRequestActions(db *sql.DB) {
         }
 }
 
-func handleTransferConfirmation(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
+func handleTransferConfirmation(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) error {
         // Извлекаем ID действия из callback data
         parts := strings.Split(callback.Data, "_")
         if len(parts) != 3 {
-                return
+                return fmt.Errorf("invalid callback data %s", callback.Data)
         }
 
         actionID, err := strconv.Atoi(parts[2])
         if err != nil {
-                return
+                return fmt.Errorf("invalid callback data %s", callback.Data)
+        }
+
+        // Отмечать можно только свой запрос на перевод
+        if _, err := getOwnedAction(bot, db, callback, actionID, "request"); err != nil {
+                return err
         }
 
         // Обновляем статус действия
         err = updateActionStatus(db, actionID, true)
         if err != nil {
                 log.Printf("Error updating action status: %v", err)
-                return
+                return err
         }
 
         // Отправляем подтверждение
         msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Спасибо! Статус обновлен.")
-        bot.Send(msg)
+        sendReply(bot, db, msg)
 
         // Удаляем кнопку
         edit := tgbotapi.NewEditMessageReplyMarkup(
                 callback.Message.Chat.ID,
                 callback.Message.MessageID,
                 tgbotapi.InlineKeyboardMarkup{})
-        bot.Send(edit)
+        sendReply(bot, db, edit)
+        return nil
+}
+
+// Загружает действие actionID типа actionType, если оно назначено нажавшему кнопку.
+// Иначе сообщает пользователю об отказе и возвращает ошибку
+func getOwnedAction(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery, actionID int, actionType string) (Action, error) {
+        action, err := getMemberAction(db, actionID, callback.From.ID)
+        if err == nil && action.Type != actionType {
+                err = sql.ErrNoRows
+        }
+        if err == sql.ErrNoRows {
+                log.Printf("User %d pressed %q for action %d not assigned to them", callback.From.ID, callback.Data, actionID)
+                sendReply(bot, db, tgbotapi.NewMessage(callback.Message.Chat.ID, "Эта кнопка относится к действию другого участника."))
+                return action, fmt.Errorf("action %d of type %s is not assigned to user %d", actionID, actionType, callback.From.ID)
+        }
+        if err != nil {
+                log.Printf("Error getting action %d: %v", actionID, err)
+        }
+        return action, err
 }
 
-func handlePayoutConfirmation(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) {
-        // Извлекаем ID действия и задачи из callback data
+func handlePayoutConfirmation(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbotapi.CallbackQuery) error {
+        // Извлекаем ID действия из callback data. ID задачи берется из самого действия,
+        // а не из callback data
         parts := strings.Split(callback.Data, "_")
         if len(parts) != 4 {
-                return
+                return fmt.Errorf("invalid callback data %s", callback.Data)
         }
 
         actionID, err := strconv.Atoi(parts[2])
         if err != nil {
-                return
+                return fmt.Errorf("invalid callback data %s", callback.Data)
         }
 
-        taskID, err := strconv.Atoi(parts[3])
+        // Подтвердить выплату может только назначенный на нее сборщик
+        action, err := getOwnedAction(bot, db, callback, actionID, "payout")
         if err != nil {
-                return
+                return err
         }
+        taskID := action.TaskID
 
         // Начинаем транзакцию
         tx, err := db.Begin()
         if err != nil {
                 log.Printf("Error starting transaction: %v", err)
-                return
+                return err
         }
 
         // Обновляем статус действия
@@ -1475,7 +10059,7 @@ func handlePayoutConfirmation(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbota
         if err != nil {
                 tx.Rollback()
                 log.Printf("Error updating action status: %v", err)
-                return
+                return err
         }
 
         // Обновляем статус задачи
@@ -1487,26 +10071,34 @@ func handlePayoutConfirmation(bot *tgbotapi.BotAPI, db *sql.DB, callback *tgbota
         if err != nil {
                 tx.Rollback()
                 log.Printf("Error updating task status: %v", err)
-                return
+                return err
+        }
+
+        err = logAudit(tx, callback.From.ID, "payout_done", "task", int64(taskID), "false", "true")
+        if err != nil {
+                tx.Rollback()
+                log.Printf("Error logging payout confirmation: %v", err)
+                return err
         }
 
         // Подтверждаем транзакцию
         err = tx.Commit()
         if err != nil {
                 log.Printf("Error committing transaction: %v", err)
-                return
+                return err
         }
 
         // Отправляем подтверждение
         msg := tgbotapi.NewMessage(callback.Message.Chat.ID, "Спасибо! Подарок отправлен имениннику.")
-        bot.Send(msg)
+        sendReply(bot, db, msg)
 
         // Удаляем кнопку
         edit := tgbotapi.NewEditMessageReplyMarkup(
                 callback.Message.Chat.ID,
                 callback.Message.MessageID,
                 tgbotapi.InlineKeyboardMarkup{})
-        bot.Send(edit)
+        sendReply(bot, db, edit)
+        return nil
 }
 
 func sendNotifications(db *sql.DB, bot *tgbotapi.BotAPI) {
@@ -1521,191 +10113,427 @@ func sendNotifications(db *sql.DB, bot *tgbotapi.BotAPI) {
                 time.Sleep(time.Until(next))
 
                 // Отправляем уведомления участникам
-                sendMemberNotifications(db, bot)
+                if report, err := sendMemberNotifications(db, bot, 0); err != nil {
+                        log.Printf("Error sending member notifications: %v", err)
+                } else {
+                        logJobReport(report)
+                }
 
                 // Ждем 5 минут
                 time.Sleep(5 * time.Minute)
 
                 // Отправляем уведомления тимлидам
-                sendTeamLeadNotifications(db, bot)
+                if report, err := sendTeamLeadNotifications(db, bot, 0); err != nil {
+                        log.Printf("Error sending teamlead notifications: %v", err)
+                } else {
+                        logJobReport(report)
+                }
         }
 }
 
-func sendMemberNotifications(db *sql.DB, bot *tgbotapi.BotAPI) {
-        query := `SELECT action_id, task_id, birthday_person_name, team_name, teamlead_phone, teamlead_name, telegram_chat_id FROM member_notifications`
+// Отправляет ожидающие уведомления участникам: по всем задачам или только по filterTaskID, если он не 0
+func sendMemberNotifications(db *sql.DB, bot *tgbotapi.BotAPI, filterTaskID int) (*JobReport, error) {
+        if err := assignTaskCollectors(db); err != nil {
+                log.Printf("Error assigning task collectors: %v", err)
+        }
 
-        rows, err := db.Query(query)
+        query := `
+                SELECT n.action_id, n.task_id, n.birthday_person_name, n.team_name, n.collector_phone,
+                        n.collector_name, n.telegram_chat_id, m.name, n.kind, n.title, n.event_date, n.amount
+                FROM member_notifications n
+                JOIN actions a ON a.id = n.action_id
+                JOIN team_members m ON a.team_member_id = m.id
+                WHERE $1 = 0 OR n.task_id = $1`
+
+        rows, err := db.Query(query, filterTaskID)
         if err != nil {
-                log.Printf("Error querying for member notifications: %v", err)
-                return
+                return nil, fmt.Errorf("error querying for member notifications: %v", err)
         }
         defer rows.Close()
 
+        report := &JobReport{Job: "member_notifications"}
         for rows.Next() {
                 var (
                         actionID        int
                         taskID         int
                         birthdayName   string
                         teamName       string
-                        teamleadPhone  string
-                        teamleadName   string
-                        telegramChatID int64
+                        collectorPhone string
+                        collectorName  string
+                        telegramChatID sql.NullInt64
+                        memberName     string
+                        occasion       CollectionOccasion
+                        title          sql.NullString
                 )
 
-                err := rows.Scan(&actionID, &taskID, &birthdayName, &teamName, &teamleadPhone, &teamleadName, &telegramChatID)
+                err := rows.Scan(&actionID, &taskID, &birthdayName, &teamName, &collectorPhone, &collectorName, &telegramChatID, &memberName,
+                        &occasion.Kind, &title, &occasion.EventDate, &occasion.Amount)
                 if err != nil {
                         log.Printf("Error scanning member notification data: %v", err)
                         continue
                 }
+                occasion.Title = title.String
 
                 // Создаем сообщение с кнопкой
-                keyboard := tgbotapi.NewInlineKeyboardMarkup(
-                        tgbotapi.NewInlineKeyboardRow(
-                                tgbotapi.NewInlineKeyboardButtonData("Готово, перевел", fmt.Sprintf("transfer_done_%d", actionID)),
-                        ),
-                )
-
-                messageText := fmt.Sprintf("Привет! Через 3 дня %s из команды %s празднует день рождения! "+
-                        "Переведи, пожалуйста, свой вклад в подарок нашему коллеге по номеру телефона %s, получатель %s.",
-                        birthdayName, teamName, teamleadPhone, teamleadName)
-                msg := tgbotapi.NewMessage(telegramChatID, messageText)
-                msg.ReplyMarkup = keyboard
-
-                // Отправляем сообщение
-                sentMessage, err := bot.Send(msg)
-                if err != nil {
-                        log.Printf("Error sending member notification: %v", err)
-                        continue
+                keyboard := memberNotificationKeyboard(actionID)
+                messageText := formatMemberNotificationText(occasion, birthdayName, teamName, collectorPhone, collectorName)
+                item := JobItem{
+                        Kind:     "member_notification",
+                        ChatID:   telegramChatID.Int64,
+                        Name:     memberName,
+                        Text:     messageText,
+                        Keyboard: &keyboard,
+                        Journal:  memberNotificationJournal(messageText, keyboard, birthdayName, teamName, collectorName, collectorPhone,
+                                collectionJournal(taskID, occasion)),
+                        ActionID: sql.NullInt64{Int64: int64(actionID), Valid: true},
                 }
-
-                if err := createMemberNotificationJournal(db, sentMessage, messageText, keyboard, birthdayName, teamName, teamleadName, teamleadPhone, actionID); err != nil {
-                    log.Printf("Error logging message to journal: %v", err)
+                if !telegramChatID.Valid {
+                        item.Status = "skipped"
+                        item.Reason = "не зарегистрирован в боте"
+                } else {
+                        deliverJobItem(bot, db, &item)
                 }
+                report.Items = append(report.Items, item)
+        }
+        if err = rows.Err(); err != nil {
+                return report, fmt.Errorf("error iterating over member notifications: %v", err)
         }
 
-        // Обновляем статус уведомлений
+        // Обновляем статус уведомлений (задачи без получателя переводов остаются в очереди).
+        // Неудачные отправки повторяются из отчета запуска.
         _, err = db.Exec(`
                 UPDATE year_tasks 
                 SET is_members_notified = true 
-                WHERE is_members_notified = false`)
+                WHERE is_members_notified = false
+                AND collector_member_id IS NOT NULL
+                AND ($1 = 0 OR id = $1)`,
+                filterTaskID)
         if err != nil {
                 log.Printf("Error updating members notification status: %v", err)
         }
+
+        return report, nil
+}
+
+func formatMemberNotificationText(occasion CollectionOccasion, birthdayName, teamName, collectorPhone, collectorName string) string {
+        if occasion.Kind == "anniversary" {
+                return fmt.Sprintf("Привет! Через 3 дня у %s из команды %s годовщина работы: %s! "+
+                        "Переведи, пожалуйста, свой вклад в подарок нашему коллеге по номеру телефона %s, получатель %s.",
+                        birthdayName, teamName, occasion.Title, collectorPhone, collectorName)
+        }
+        if occasion.Kind != "custom" {
+                return fmt.Sprintf("Привет! Через 3 дня %s из команды %s празднует день рождения! "+
+                        "Переведи, пожалуйста, свой вклад в подарок нашему коллеге по номеру телефона %s, получатель %s.",
+                        birthdayName, teamName, collectorPhone, collectorName)
+        }
+
+        text := fmt.Sprintf("Привет! Собираем «%s» для %s из команды %s до %s. "+
+                "Переведи, пожалуйста, свой вклад по номеру телефона %s, получатель %s.",
+                occasion.Title, birthdayName, teamName, occasion.EventDate.Format("02.01.2006"), collectorPhone, collectorName)
+        if occasion.Amount.Valid {
+                text += fmt.Sprintf(" Рекомендуемая сумма: %s ₽.", formatAmount(occasion.Amount.Float64))
+        }
+        return text
 }
 
-func sendTeamLeadNotifications(db *sql.DB, bot *tgbotapi.BotAPI) {
-        query := `SELECT task_id, birthday_person_name, telegram_chat_id, notified_teamlead_name FROM teamlead_notifications`
+// Первая фраза уведомления тимлида: повод и срок сбора
+func formatOccasionHeadline(occasion CollectionOccasion, birthdayName string) string {
+        if occasion.Kind == "anniversary" {
+                return fmt.Sprintf("У %s через 3 дня годовщина работы: %s!", birthdayName, occasion.Title)
+        }
+        if occasion.Kind != "custom" {
+                return fmt.Sprintf("%s празднует день рождения через 3 дня!", birthdayName)
+        }
+        return fmt.Sprintf("Открыт сбор «%s» для %s до %s!", occasion.Title, birthdayName, occasion.EventDate.Format("02.01.2006"))
+}
 
-        rows, err := db.Query(query)
+func formatAmount(amount float64) string {
+        return strconv.FormatFloat(amount, 'f', -1, 64)
+}
+
+func memberNotificationKeyboard(actionID int) tgbotapi.InlineKeyboardMarkup {
+        return tgbotapi.NewInlineKeyboardMarkup(
+                tgbotapi.NewInlineKeyboardRow(
+                        tgbotapi.NewInlineKeyboardButtonData("Готово, перевел", fmt.Sprintf("transfer_done_%d", actionID)),
+                ),
+        )
+}
+
+// Отправляет ожидающие уведомления тимлидам: по всем задачам или только по filterTaskID, если он не 0
+func sendTeamLeadNotifications(db *sql.DB, bot *tgbotapi.BotAPI, filterTaskID int) (*JobReport, error) {
+        if err := assignTaskCollectors(db); err != nil {
+                log.Printf("Error assigning task collectors: %v", err)
+        }
+
+        query := `
+                SELECT task_id, birthday_person_name, telegram_chat_id, notified_teamlead_name, notified_member_id,
+                        collector_name, is_collector, is_collector_teamlead, delegated_from_name,
+                        kind, title, event_date, amount, covering_for_name
+                FROM teamlead_notifications
+                WHERE $1 = 0 OR task_id = $1`
+
+        rows, err := db.Query(query, filterTaskID)
         if err != nil {
-                log.Printf("Error querying for teamlead notifications: %v", err)
-                return
+                return nil, fmt.Errorf("error querying for teamlead notifications: %v", err)
         }
         defer rows.Close()
 
+        report := &JobReport{Job: "teamlead_notifications"}
+        var taskIDs []int
+        taskSeen := make(map[int]bool)
         for rows.Next() {
                 var (
                         taskID              int
                         birthdayName        string
                         telegramChatID      int64
                         notifiedTeamleadName string
+                        notifiedMemberID    int
+                        collectorName       string
+                        isCollector         bool
+                        isCollectorTeamlead bool
+                        delegatedFromName   sql.NullString
+                        occasion            CollectionOccasion
+                        title               sql.NullString
+                        coveringForName     sql.NullString
                 )
 
-                err := rows.Scan(&taskID, &birthdayName, &telegramChatID, &notifiedTeamleadName)
+                err := rows.Scan(&taskID, &birthdayName, &telegramChatID, &notifiedTeamleadName, &notifiedMemberID,
+                        &collectorName, &isCollector, &isCollectorTeamlead, &delegatedFromName,
+                        &occasion.Kind, &title, &occasion.EventDate, &occasion.Amount, &coveringForName)
                 if err != nil {
                         log.Printf("Error scanning teamlead notification data: %v", err)
                         continue
                 }
-
-                messageText := fmt.Sprintf("Привет, %s! %s празднует день рождения через 3 дня! "+
-                        "Сейчас тебе начнут поступать переводы ему на подарок! "+
-                        "Не забудь запланировать поздравление!", notifiedTeamleadName, birthdayName)
-                msg := tgbotapi.NewMessage(telegramChatID, messageText)
-
-                // Отправляем сообщение
-                sentMessage, err := bot.Send(msg)
-                if err != nil {
-                        log.Printf("Error sending teamlead notification: %v", err)
+                occasion.Title = title.String
+                headline := formatOccasionHeadline(occasion, birthdayName)
+
+                var messageText string
+                switch {
+                case isCollector && delegatedFromName.Valid:
+                        // Заместитель отсутствующего тимлида берет на себя и переводы, и планирование
+                        messageText = fmt.Sprintf("Привет, %s! %s "+
+                                "Ты замещаешь %s, поэтому сейчас тебе начнут поступать переводы ему на подарок! "+
+                                "Не забудь запланировать поздравление!", notifiedTeamleadName, headline, delegatedFromName.String)
+                case isCollector && isCollectorTeamlead:
+                        messageText = fmt.Sprintf("Привет, %s! %s "+
+                                "Сейчас тебе начнут поступать переводы ему на подарок! "+
+                                "Не забудь запланировать поздравление!", notifiedTeamleadName, headline)
+                case isCollector:
+                        // Казначей получает только предупреждение о переводах
+                        messageText = fmt.Sprintf("Привет, %s! %s "+
+                                "Сейчас тебе начнут поступать переводы ему на подарок!", notifiedTeamleadName, headline)
+                case coveringForName.Valid:
+                        // Заместитель отсутствующего тимлида планирует поздравление вместо него
+                        messageText = fmt.Sprintf("Привет, %s! %s "+
+                                "Ты замещаешь %s, поэтому не забудь запланировать поздравление! "+
+                                "Переводы на подарок собирает %s.", notifiedTeamleadName, headline, coveringForName.String, collectorName)
+                case isCollectorTeamlead:
+                        // Переводы собирает другой тимлид, сообщение только для информации
+                        messageText = fmt.Sprintf("Привет, %s! %s "+
+                                "Для информации: переводы на подарок собирает %s.", notifiedTeamleadName, headline, collectorName)
+                default:
+                        messageText = fmt.Sprintf("Привет, %s! %s "+
+                                "Переводы на подарок собирает %s. "+
+                                "Не забудь запланировать поздравление!", notifiedTeamleadName, headline, collectorName)
+                }
+                kind := "teamlead_notification"
+                if isCollector && !isCollectorTeamlead && !delegatedFromName.Valid {
+                        kind = "collector_notification"
+                }
+                item := JobItem{
+                        Kind:    kind,
+                        ChatID:  telegramChatID,
+                        Name:    notifiedTeamleadName,
+                        Text:    messageText,
+                        Journal: teamLeadNotificationJournal(messageText, kind, birthdayName, taskID, notifiedMemberID,
+                                collectionJournal(taskID, occasion)),
+                }
+                deliverJobItem(bot, db, &item)
+                report.Items = append(report.Items, item)
+                if !taskSeen[taskID] {
+                        taskSeen[taskID] = true
+                        taskIDs = append(taskIDs, taskID)
+                }
+                if item.Status != "sent" {
                         continue
                 }
 
-                if err := createTeamLeadNotificationJournal(db, sentMessage, messageText, birthdayName, taskID); err != nil {
-                    log.Printf("Error logging message to journal: %v", err)
+                // Получатель больше не попадает в отправку по этой задаче
+                if err := recordTeamLeadDelivery(db, taskID, notifiedMemberID); err != nil {
+                        log.Printf("Error recording teamlead notification delivery: %v", err)
                 }
+        }
+        if err = rows.Err(); err != nil {
+                return report, fmt.Errorf("error iterating over teamlead notifications: %v", err)
+        }
 
-                // Обновляем статус уведомления для этой задачи
-                _, err = db.Exec(`
-                        UPDATE year_tasks 
-                        SET is_teamlead_notified = true 
-                        WHERE id = $1`,
-                        taskID)
-                if err != nil {
+        for _, taskID := range taskIDs {
+                if err := markTeamLeadTaskNotified(db, taskID); err != nil {
                         log.Printf("Error updating teamlead notification status: %v", err)
                 }
         }
+
+        return report, nil
+}
+
+// Отмечает, что получатель memberID получил уведомление тимлида по задаче
+func recordTeamLeadDelivery(db *sql.DB, taskID, memberID int) error {
+        _, err := db.Exec(`
+                INSERT INTO teamlead_notification_deliveries (task_id, team_member_id)
+                VALUES ($1, $2)
+                ON CONFLICT DO NOTHING`,
+                taskID, memberID)
+        return err
+}
+
+// Задача отмечается отправленной, когда уведомление получили все ее получатели.
+// Неудачные отправки остаются в teamlead_notifications до следующего запуска или повтора
+func markTeamLeadTaskNotified(db *sql.DB, taskID int) error {
+        _, err := db.Exec(`
+                UPDATE year_tasks
+                SET is_teamlead_notified = true
+                WHERE id = $1
+                AND NOT EXISTS (SELECT 1 FROM teamlead_notifications WHERE task_id = $1)`,
+                taskID)
+        return err
 }
 
-func sendBirthdayWishesOnce(db *sql.DB, bot *tgbotapi.BotAPI) error {
+func sendBirthdayWishesOnce(db *sql.DB, bot *tgbotapi.BotAPI) (*JobReport, error) {
     // Находим именинников
     query := `
         SELECT
             m.id,
             m.name,
             m.telegram_chat_id,
-            t.id as team_id,
-            yt.id as task_id,
-            tl.team_member_id as teamlead_id
+            t.id as team_id
         FROM team_members m
         JOIN teams t ON m.team_id = t.id
-        JOIN teamleads tl ON t.id = tl.team_id
-        LEFT JOIN year_tasks yt ON
-            yt.team_member_id = m.id AND
-            yt.year = EXTRACT(YEAR FROM CURRENT_DATE)::integer
         WHERE EXTRACT(MONTH FROM m.birthday) = EXTRACT(MONTH FROM CURRENT_DATE)
-        AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM CURRENT_DATE)`
+        AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM CURRENT_DATE)
+        AND m.is_active = true`
 
     rows, err := db.Query(query)
     if err != nil {
-        return fmt.Errorf("error querying birthday people: %v", err)
+        return nil, fmt.Errorf("error querying birthday people: %v", err)
     }
     defer rows.Close()
 
+    report := &JobReport{Job: "birthday_wishes"}
     for rows.Next() {
         var (
             memberID       int
             name          string
-            telegramChatID int64
+            telegramChatID sql.NullInt64
             teamID        int
-            taskID        sql.NullInt64
-            teamleadID    int
         )
 
-        err := rows.Scan(&memberID, &name, &telegramChatID, &teamID, &taskID, &teamleadID)
+        err := rows.Scan(&memberID, &name, &telegramChatID, &teamID)
         if err != nil {
             log.Printf("Error scanning birthday person data: %v", err)
             continue
         }
 
         messageText := fmt.Sprintf("С днем рождения, %s! 🎉\nЖелаем успехов, счастья и всего самого наилучшего! 🎂", name)
-        msg := tgbotapi.NewMessage(telegramChatID, messageText)
+        item := JobItem{
+            Kind:    "birthday_wish",
+            ChatID:  telegramChatID.Int64,
+            Name:    name,
+            Text:    messageText,
+            Journal: birthdayWishJournal(messageText, memberID, name, teamID),
+        }
+        if !telegramChatID.Valid {
+            item.Status = "skipped"
+            item.Reason = "не зарегистрирован в боте"
+        } else {
+            deliverJobItem(bot, db, &item)
+        }
+        report.Items = append(report.Items, item)
+    }
+
+    if err = rows.Err(); err != nil {
+        return report, fmt.Errorf("error iterating over birthday people: %v", err)
+    }
+
+    if _, err := assignBirthdayPayouts(db); err != nil {
+        return report, err
+    }
+
+    // Задачи, выплата по которым не назначена из-за окна выплаты, попадают в отчет
+    skipped, err := getSkippedPayoutTasks(db)
+    if err != nil {
+        return report, err
+    }
+    report.Items = append(report.Items, skipped...)
 
-        // Отправляем сообщение
-        sentMessage, err := bot.Send(msg)
+    return report, nil
+}
+
+// Поздравляет участников с годовщиной работы в компании
+func sendAnniversaryWishesOnce(db *sql.DB, bot *tgbotapi.BotAPI) (*JobReport, error) {
+    query := `
+        SELECT
+            m.id,
+            m.name,
+            m.telegram_chat_id,
+            t.id as team_id,
+            EXTRACT(YEAR FROM CURRENT_DATE)::integer - EXTRACT(YEAR FROM m.hire_date)::integer as years
+        FROM team_members m
+        JOIN teams t ON m.team_id = t.id
+        WHERE EXTRACT(MONTH FROM m.hire_date) = EXTRACT(MONTH FROM CURRENT_DATE)
+        AND EXTRACT(DAY FROM m.hire_date) = EXTRACT(DAY FROM CURRENT_DATE)
+        AND m.hire_date < CURRENT_DATE
+        AND m.is_active = true`
+
+    rows, err := db.Query(query)
+    if err != nil {
+        return nil, fmt.Errorf("error querying anniversaries: %v", err)
+    }
+    defer rows.Close()
+
+    report := &JobReport{Job: "anniversary_wishes"}
+    for rows.Next() {
+        var (
+            memberID       int
+            name           string
+            telegramChatID sql.NullInt64
+            teamID         int
+            years          int
+        )
+
+        err := rows.Scan(&memberID, &name, &telegramChatID, &teamID, &years)
         if err != nil {
-            log.Printf("Error sending birthday wish to %s: %v", name, err)
+            log.Printf("Error scanning anniversary data: %v", err)
             continue
         }
 
-        if err := createBirthdayWishJournal(db, sentMessage, messageText, memberID, name, teamID); err != nil {
-            log.Printf("Error logging message to journal: %v", err)
+        messageText := fmt.Sprintf("Поздравляем с годовщиной, %s! 🎉\nСегодня ровно %s, как ты с нами в компании. "+
+            "Спасибо за твой вклад и за то, что ты с нами! 🏢", name, formatYears(years))
+        item := JobItem{
+            Kind:    "anniversary_wish",
+            ChatID:  telegramChatID.Int64,
+            Name:    name,
+            Text:    messageText,
+            Journal: anniversaryWishJournal(messageText, memberID, name, teamID, years),
         }
+        if !telegramChatID.Valid {
+            item.Status = "skipped"
+            item.Reason = "не зарегистрирован в боте"
+        } else {
+            deliverJobItem(bot, db, &item)
+        }
+        report.Items = append(report.Items, item)
     }
 
     if err = rows.Err(); err != nil {
-        return fmt.Errorf("error iterating over birthday people: %v", err)
+        return report, fmt.Errorf("error iterating over anniversaries: %v", err)
     }
 
-    return nil
+    // Выплаты по сборам на годовщины создаются так же, как по дням рождения
+    if _, err := assignBirthdayPayouts(db); err != nil {
+        return report, err
+    }
+
+    return report, nil
 }
 
 func sendBirthdayWishes(db *sql.DB, bot *tgbotapi.BotAPI) {
@@ -1718,69 +10546,19 @@ func sendBirthdayWishes(db *sql.DB, bot *tgbotapi.BotAPI) {
                 }
                 time.Sleep(time.Until(next))
 
-                // Находим именинников
-                query := `
-                        SELECT 
-                                m.id,
-                                m.name,
-                                m.telegram_chat_id,
-                                t.id as team_id,
-                                yt.id as task_id,
-                                tl.team_member_id as teamlead_id
-                        FROM team_members m
-                        JOIN teams t ON m.team_id = t.id
-                        JOIN teamleads tl ON t.id = tl.team_id
-                        LEFT JOIN year_tasks yt ON 
-                                yt.team_member_id = m.id AND 
-                                yt.year = EXTRACT(YEAR FROM CURRENT_DATE)::integer
-                        WHERE EXTRACT(MONTH FROM m.birthday) = EXTRACT(MONTH FROM CURRENT_DATE)
-                        AND EXTRACT(DAY FROM m.birthday) = EXTRACT(DAY FROM CURRENT_DATE)`
-
-                rows, err := db.Query(query)
-                if err != nil {
-                        log.Printf("Error querying birthday people: %v", err)
-                        continue
+                // Поздравляем именинников и создаем действия payout для получателей переводов
+                if report, err := sendBirthdayWishesOnce(db, bot); err != nil {
+                        log.Printf("Error sending birthday wishes: %v", err)
+                } else {
+                        logJobReport(report)
                 }
 
-                for rows.Next() {
-                        var (
-                                memberID       int
-                                name          string
-                                telegramChatID int64
-                                teamID        int
-                                taskID        sql.NullInt64
-                                teamleadID    int
-                        )
-
-                        err := rows.Scan(&memberID, &name, &telegramChatID, &teamID, &taskID, &teamleadID)
-                        if err != nil {
-                                log.Printf("Error scanning birthday person data: %v", err)
-                                continue
-                        }
-
-                        // Отправляем поздравление
-                        msg := tgbotapi.NewMessage(telegramChatID,
-                                "Привет! Сегодня твой день рождения и, от имени всей команды, "+
-                                        "я поздравляю тебя с этим замечательным праздником! "+
-                                        "Пусть тебе сопутствуют успех, удача и здоровье!")
-                        
-                        _, err = bot.Send(msg)
-                        if err != nil {
-                                log.Printf("Error sending birthday wish: %v", err)
-                        }
-
-                        // Создаем action для тимлида, если есть task
-                        if taskID.Valid {
-                                _, err = db.Exec(`
-                                        INSERT INTO actions (task_id, team_member_id, type)
-                                        VALUES ($1, $2, 'payout')`,
-                                        taskID.Int64, teamleadID)
-                                if err != nil {
-                                        log.Printf("Error creating payout action: %v", err)
-                                }
-                        }
+                // Поздравляем с годовщиной работы
+                if report, err := sendAnniversaryWishesOnce(db, bot); err != nil {
+                        log.Printf("Error sending anniversary wishes: %v", err)
+                } else {
+                        logJobReport(report)
                 }
-                rows.Close()
         }
 }
 
@@ -1794,75 +10572,45 @@ func sendPayoutReminders(db *sql.DB, bot *tgbotapi.BotAPI) {
                 }
                 time.Sleep(time.Until(next))
 
-                query := `
-                        SELECT 
-                                a.id as action_id,
-                                tl.telegram_chat_id as teamlead_chat_id,
-                                bm.name as birthday_person_name,
-                                bm.phone_number as birthday_person_phone,
-                                yt.id as task_id
-                        FROM actions a
-                        JOIN year_tasks yt ON a.task_id = yt.id
-                        JOIN team_members bm ON yt.team_member_id = bm.id
-                        JOIN team_members tl ON a.team_member_id = tl.id
-                        WHERE a.type = 'payout' 
-                        AND a.is_done = false
-                        AND yt.is_money_transfered = false`
-
-                rows, err := db.Query(query)
-                if err != nil {
-                        log.Printf("Error querying payout reminders: %v", err)
-                        continue
+                if report, err := sendPayoutRemindersOnce(db, bot); err != nil {
+                        log.Printf("Error sending payout reminders: %v", err)
+                } else {
+                        logJobReport(report)
                 }
+        }
+}
 
-                for rows.Next() {
-                        var (
-                                actionID           int
-                                teamleadChatID     int64
-                                birthdayPersonName string
-                                birthdayPersonPhone string
-                                taskID             int
-                        )
-
-                        err := rows.Scan(&actionID, &teamleadChatID, &birthdayPersonName, &birthdayPersonPhone, &taskID)
-                        if err != nil {
-                                log.Printf("Error scanning payout reminder data: %v", err)
-                                continue
-                        }
-
-                        // Создаем сообщение с кнопкой
-                        keyboard := tgbotapi.NewInlineKeyboardMarkup(
-                                tgbotapi.NewInlineKeyboardRow(
-                                        tgbotapi.NewInlineKeyboardButtonData("Готово, перевел", fmt.Sprintf("payout_done_%d_%d", actionID, taskID)),
-                                ),
-                        )
-
-                        msg := tgbotapi.NewMessage(teamleadChatID,
-                                fmt.Sprintf("Привет! Нужно перевести подарок имениннику! "+
-                                        "Получатель %s, номер телефона %s",
-                                        birthdayPersonName, birthdayPersonPhone))
-                        msg.ReplyMarkup = keyboard
-
-                        _, err = bot.Send(msg)
-                        if err != nil {
-                                log.Printf("Error sending payout reminder: %v", err)
-                        }
-                }
-                rows.Close()
+// Обрезает текст до лимита длины сообщения Telegram, не разрывая символы
+func truncateMessage(text string, limit int) string {
+        runes := []rune(text)
+        if len(runes) <= limit {
+                return text
         }
+        return string(runes[:limit]) + "…"
 }
 
-func formatTeamLeadsMessage(teamLeads []TeamLead) string {
+func formatTeamLeadsMessage(teamLeads []TeamLead, treasurers []Treasurer) string {
         if len(teamLeads) == 0 {
                 return "Нет назначенных тимлидов."
         }
 
+        treasurerByTeam := make(map[int]Treasurer)
+        for _, treasurer := range treasurers {
+                treasurerByTeam[treasurer.TeamID] = treasurer
+        }
+
         msg := "Список тимлидов:\n\n"
         for _, lead := range teamLeads {
-                msg += fmt.Sprintf("Команда: %s\nТимлид: %s\nТелефон: %s\n\n",
+                msg += fmt.Sprintf("Команда: %s\nТимлид: %s\nТелефон: %s\n",
                         lead.TeamName,
                         lead.MemberName,
                         lead.PhoneNumber)
+                if treasurer, ok := treasurerByTeam[lead.TeamID]; ok {
+                        msg += fmt.Sprintf("Казначей: %s\nТелефон казначея: %s\n",
+                                treasurer.MemberName,
+                                treasurer.PhoneNumber)
+                }
+                msg += "\n"
         }
         return msg
 }
@@ -1975,6 +10723,25 @@ func updateActionStatus(db *sql.DB, actionID int, isDone bool) error {
         return nil
 }
 
+// Возвращает действие actionID, назначенное участнику с telegram_chat_id = chatID.
+// Чужие и несуществующие действия возвращают sql.ErrNoRows
+func getMemberAction(db *sql.DB, actionID int, chatID int64) (Action, error) {
+        var action Action
+        err := db.QueryRow(`
+                SELECT a.id, a.task_id, a.team_member_id, a.type, a.is_done, m.name
+                FROM actions a
+                JOIN team_members m ON a.team_member_id = m.id
+                WHERE a.id = $1 AND m.telegram_chat_id = $2::bigint`,
+                actionID, chatID).Scan(
+                &action.ID,
+                &action.TaskID,
+                &action.TeamMemberID,
+                &action.Type,
+                &action.IsDone,
+                &action.MemberName)
+        return action, err
+}
+
 func getActionsByMember(db *sql.DB, teamMemberID int) ([]Action, error) {
         rows, err := db.Query(`
                 SELECT a.id, a.task_id, a.team_member_id, a.type, a.is_done, m.name
@@ -2006,11 +10773,47 @@ func getActionsByMember(db *sql.DB, teamMemberID int) ([]Action, error) {
         return actions, nil
 }
 
-func isAdmin(db *sql.DB, chatID int64) (bool, error) {
-    var exists bool
-    err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM admins WHERE telegram_chat_id = $1)", chatID).Scan(&exists)
+// Определяет роли пользователя по его Telegram ID
+func getUserRoles(db *sql.DB, userID int64) (RoleSet, error) {
+    var isMember, isTeamLead, isTreasurer, isHR, isAdmin bool
+    err := db.QueryRow(`
+        SELECT
+            EXISTS (SELECT 1 FROM team_members WHERE telegram_chat_id = $1 AND is_active = true),
+            EXISTS (
+                SELECT 1 FROM teamleads tl
+                JOIN team_members tm ON tl.team_member_id = tm.id
+                WHERE tm.telegram_chat_id = $1
+                AND tm.is_active = true
+            ),
+            EXISTS (
+                SELECT 1 FROM treasurers tr
+                JOIN team_members tm ON tr.team_member_id = tm.id
+                WHERE tm.telegram_chat_id = $1
+                AND tm.is_active = true
+            ),
+            EXISTS (
+                SELECT 1 FROM hr_staff h
+                JOIN team_members tm ON h.team_member_id = tm.id
+                WHERE tm.telegram_chat_id = $1
+            ),
+            EXISTS (SELECT 1 FROM admins WHERE telegram_chat_id = $1)`,
+        userID).Scan(&isMember, &isTeamLead, &isTreasurer, &isHR, &isAdmin)
     if err != nil {
-        return false, err
+        return nil, err
     }
-    return exists, nil
+
+    roles := RoleSet{}
+    for role, has := range map[Role]bool{
+        RoleMember:    isMember,
+        RoleTeamLead:  isTeamLead,
+        RoleTreasurer: isTreasurer,
+        RoleHR:        isHR,
+        RoleAdmin:     isAdmin,
+    } {
+        if has {
+            roles[role] = true
+        }
+    }
+    return roles, nil
 }
+
@@ -0,0 +1,116 @@
+-- Отмена сборов: задача закрывается без перевода подарка (например, при деактивации команды)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS cancelled_at TIMESTAMP WITH TIME ZONE;
+
+-- Функция для назначения получателя переводов по задаче
+-- Отмененные сборы не учитываются в нагрузке тимлида
+CREATE OR REPLACE FUNCTION assign_task_collector(task_id INTEGER)
+RETURNS INTEGER AS $$
+DECLARE
+    v_collector_id INTEGER;
+    v_source VARCHAR(20);
+    v_team_id INTEGER;
+    v_birthday_member_id INTEGER;
+    v_year INTEGER;
+    v_event_date DATE;
+    v_delegate_id INTEGER;
+    v_delegated_from INTEGER;
+BEGIN
+    SELECT yt.collector_member_id, bm.team_id, bm.id, yt.year
+    INTO v_collector_id, v_team_id, v_birthday_member_id, v_year
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1
+    FOR UPDATE OF yt;
+
+    -- Получатель уже назначен: все шаги используют его
+    IF NOT FOUND OR v_collector_id IS NOT NULL THEN
+        RETURN v_collector_id;
+    END IF;
+
+    -- Казначей команды, если он не является именинником
+    SELECT tr.team_member_id INTO v_collector_id
+    FROM treasurers tr
+    WHERE tr.team_id = v_team_id
+    AND tr.team_member_id != v_birthday_member_id;
+    IF v_collector_id IS NOT NULL THEN
+        v_source := 'treasurer';
+    END IF;
+
+    -- Тимлид команды: меньше открытых сборов, затем дольше всех без назначения
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM teamleads tl
+        WHERE tl.team_id = v_team_id
+        AND tl.team_member_id != v_birthday_member_id
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.is_money_transfered = false
+             AND x.cancelled_at IS NULL),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'teamlead';
+        END IF;
+    END IF;
+
+    -- Резервные тимлиды команды в заданном порядке
+    IF v_collector_id IS NULL THEN
+        SELECT b.team_member_id INTO v_collector_id
+        FROM teamlead_backups b
+        WHERE b.team_id = v_team_id
+        AND b.team_member_id != v_birthday_member_id
+        ORDER BY b.priority, b.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'backup';
+        END IF;
+    END IF;
+
+    -- Справедливая ротация: тимлид с наименьшим числом сборов за год
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM (
+            SELECT DISTINCT team_member_id
+            FROM teamleads
+            WHERE team_member_id != v_birthday_member_id
+        ) tl
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.year = v_year),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.team_member_id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'rotation';
+        END IF;
+    END IF;
+
+    -- Замещение на время отсутствия (ограничиваем глубину цепочки заместителей)
+    IF v_collector_id IS NOT NULL THEN
+        v_event_date := get_task_event_date($1);
+        FOR i IN 1..5 LOOP
+            v_delegate_id := get_absence_delegate(v_collector_id, v_event_date - 3, v_event_date);
+            EXIT WHEN v_delegate_id IS NULL OR v_delegate_id = v_birthday_member_id;
+            v_delegated_from := COALESCE(v_delegated_from, v_collector_id);
+            v_collector_id := v_delegate_id;
+            v_source := 'delegate';
+        END LOOP;
+    END IF;
+
+    IF v_collector_id IS NOT NULL THEN
+        UPDATE year_tasks
+        SET collector_member_id = v_collector_id,
+            collector_assigned_at = CURRENT_TIMESTAMP,
+            collector_source = v_source,
+            collector_delegated_from = v_delegated_from
+        WHERE id = $1;
+    END IF;
+
+    RETURN v_collector_id;
+END;
+$$ LANGUAGE plpgsql;
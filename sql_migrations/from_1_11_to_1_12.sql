@@ -0,0 +1,20 @@
+-- Деактивированные участники не участвуют в сборах и не получают поздравлений
+ALTER TABLE team_members ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT true;
+
+-- Создание таблицы истории изменений участников администраторами
+-- Ссылки на team_members нет, чтобы история сохранялась после удаления участника
+CREATE TABLE IF NOT EXISTS member_audit (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL,
+    admin_chat_id BIGINT NOT NULL,
+    action VARCHAR(30) NOT NULL,
+    old_value TEXT,
+    new_value TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS member_audit_member_idx ON member_audit (team_member_id, created_at);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE member_audit TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE member_audit_id_seq TO birthdaybot;
@@ -0,0 +1,5 @@
+-- Суперадминистраторы управляют списком администраторов
+-- Список суперадминистраторов задается переменной окружения SUPER_ADMIN_IDS и применяется при запуске
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS is_super BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS granted_by_chat_id BIGINT;
+ALTER TABLE admins ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP;
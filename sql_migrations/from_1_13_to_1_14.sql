@@ -0,0 +1,12 @@
+-- Создание таблицы сотрудников HR
+-- Роль HR дает доступ к дням рождения и статистике без прав администратора
+CREATE TABLE IF NOT EXISTS hr_staff (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL UNIQUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE hr_staff TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE hr_staff_id_seq TO birthdaybot;
@@ -0,0 +1,27 @@
+-- Создание таблицы пользователей, писавших боту
+-- Нужна для рассылок пользователям, которые не завершили регистрацию
+CREATE TABLE IF NOT EXISTS bot_users (
+    telegram_chat_id BIGINT PRIMARY KEY,
+    username VARCHAR(100),
+    first_name VARCHAR(100),
+    first_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Создание таблицы рассылок администраторов
+CREATE TABLE IF NOT EXISTS broadcasts (
+    id SERIAL PRIMARY KEY,
+    admin_chat_id BIGINT NOT NULL,
+    text TEXT NOT NULL,
+    audience VARCHAR(50) NOT NULL,
+    recipients_count INTEGER NOT NULL DEFAULT 0,
+    sent_count INTEGER NOT NULL DEFAULT 0,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Предоставление прав на новые таблицы
+GRANT ALL PRIVILEGES ON TABLE bot_users TO birthdaybot;
+GRANT ALL PRIVILEGES ON TABLE broadcasts TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE broadcasts_id_seq TO birthdaybot;
@@ -0,0 +1,36 @@
+-- Создание таблицы запусков рассылок из панели администратора
+CREATE TABLE IF NOT EXISTS job_runs (
+    id SERIAL PRIMARY KEY,
+    job VARCHAR(50) NOT NULL,
+    admin_chat_id BIGINT,
+    sent_count INTEGER NOT NULL DEFAULT 0,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    skipped_count INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    retried_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Получатели запуска: статус sent, failed, skipped или retrying,
+-- ошибка Telegram или причина пропуска и данные сообщения для повтора
+CREATE TABLE IF NOT EXISTS job_run_items (
+    id SERIAL PRIMARY KEY,
+    run_id INTEGER NOT NULL,
+    kind VARCHAR(50) NOT NULL,
+    chat_id BIGINT,
+    recipient_name VARCHAR(100),
+    status VARCHAR(20) NOT NULL,
+    reason TEXT,
+    action_id INTEGER,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (run_id) REFERENCES job_runs(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS job_run_items_run_status_idx ON job_run_items (run_id, status);
+
+-- Предоставление прав на новые таблицы
+GRANT ALL PRIVILEGES ON TABLE job_runs TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE job_runs_id_seq TO birthdaybot;
+GRANT ALL PRIVILEGES ON TABLE job_run_items TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE job_run_items_id_seq TO birthdaybot;
@@ -0,0 +1,44 @@
+-- Создание журнала аудита привилегированных действий
+-- actor_chat_id = NULL: изменение из конфигурации (SUPER_ADMIN_IDS)
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_chat_id BIGINT,
+    action VARCHAR(100) NOT NULL,
+    target_type VARCHAR(50),
+    target_id BIGINT,
+    old_value TEXT,
+    new_value TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_actor_idx ON audit_log (actor_chat_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_target_idx ON audit_log (target_type, target_id);
+
+-- Журнал только пополняется: изменение и удаление записей запрещены
+CREATE OR REPLACE FUNCTION audit_log_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_no_update ON audit_log;
+CREATE TRIGGER audit_log_no_update
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
+
+-- Боту нужны только чтение и добавление записей
+GRANT SELECT, INSERT ON TABLE audit_log TO birthdaybot;
+GRANT USAGE, SELECT ON SEQUENCE audit_log_id_seq TO birthdaybot;
+
+-- Перенос истории изменений участников в общий журнал
+INSERT INTO audit_log (actor_chat_id, action, target_type, target_id, old_value, new_value, created_at)
+SELECT admin_chat_id, action, 'member', team_member_id, NULLIF(old_value, ''), NULLIF(new_value, ''), created_at
+FROM member_audit
+ORDER BY created_at, id;
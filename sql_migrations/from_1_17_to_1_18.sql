@@ -0,0 +1,2 @@
+-- Индекс для поиска записей журнала по действию (статистика /stats)
+CREATE INDEX IF NOT EXISTS api_messages_journal_action_idx ON api_messages_journal (action_id);
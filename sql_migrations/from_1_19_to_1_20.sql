@@ -0,0 +1,18 @@
+-- Дата приема на работу для годовщин (NULL — не указана)
+ALTER TABLE team_members ADD COLUMN IF NOT EXISTS hire_date DATE;
+
+-- Дата события: годовщина работы, срок произвольного сбора или день рождения в году задачи
+CREATE OR REPLACE FUNCTION get_task_event_date(task_id INTEGER)
+RETURNS DATE AS $$
+    SELECT CASE
+        WHEN yt.kind = 'anniversary' THEN
+            (bm.hire_date + make_interval(years => yt.year - EXTRACT(YEAR FROM bm.hire_date)::integer))::date
+        ELSE COALESCE(
+            yt.deadline,
+            (bm.birthday + make_interval(years => yt.year - EXTRACT(YEAR FROM bm.birthday)::integer))::date
+        )
+    END
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1;
+$$ LANGUAGE sql STABLE;
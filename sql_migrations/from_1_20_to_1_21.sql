@@ -0,0 +1,3 @@
+-- Индексы для поиска по журналу сообщений (/journal): по типу сообщения и по дате
+CREATE INDEX IF NOT EXISTS api_messages_journal_type_idx ON api_messages_journal ((message->>'type'));
+CREATE INDEX IF NOT EXISTS api_messages_journal_created_idx ON api_messages_journal (created_at);
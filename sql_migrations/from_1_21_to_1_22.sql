@@ -0,0 +1,91 @@
+-- Журнал сообщений разбивается на помесячные секции по created_at.
+-- chat_id и message_id вынесены в вычисляемые столбцы с индексами вместо сравнения текста из JSON
+
+-- Создает секцию журнала за месяц, если ее еще нет.
+-- Выполняется с правами владельца таблицы, чтобы бот мог создавать секции заранее
+CREATE OR REPLACE FUNCTION ensure_journal_partition(month DATE)
+RETURNS VOID AS $$
+DECLARE
+    month_start DATE := date_trunc('month', month)::date;
+BEGIN
+    EXECUTE format(
+        'CREATE TABLE IF NOT EXISTS %I PARTITION OF api_messages_journal FOR VALUES FROM (%L) TO (%L)',
+        'api_messages_journal_p' || to_char(month_start, 'YYYY_MM'),
+        month_start,
+        (month_start + interval '1 month')::date
+    );
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+-- Удаляет секцию журнала за месяц после архивации
+CREATE OR REPLACE FUNCTION drop_journal_partition(month DATE)
+RETURNS VOID AS $$
+BEGIN
+    EXECUTE format(
+        'DROP TABLE IF EXISTS %I',
+        'api_messages_journal_p' || to_char(date_trunc('month', month), 'YYYY_MM')
+    );
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+BEGIN;
+
+ALTER TABLE api_messages_journal RENAME TO api_messages_journal_old;
+ALTER TABLE api_messages_journal_old RENAME CONSTRAINT api_messages_journal_pkey TO api_messages_journal_old_pkey;
+ALTER INDEX IF EXISTS api_messages_journal_action_idx RENAME TO api_messages_journal_old_action_idx;
+ALTER INDEX IF EXISTS api_messages_journal_type_idx RENAME TO api_messages_journal_old_type_idx;
+ALTER INDEX IF EXISTS api_messages_journal_created_idx RENAME TO api_messages_journal_old_created_idx;
+
+CREATE TABLE api_messages_journal (
+    id INTEGER NOT NULL DEFAULT nextval('api_messages_journal_id_seq'),
+    message JSONB NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    action_id INTEGER REFERENCES actions(id),
+    chat_id BIGINT GENERATED ALWAYS AS ((message->>'chat_id')::bigint) STORED,
+    message_id INTEGER GENERATED ALWAYS AS ((message->>'message_id')::integer) STORED,
+    PRIMARY KEY (id, created_at)
+) PARTITION BY RANGE (created_at);
+
+ALTER SEQUENCE api_messages_journal_id_seq OWNED BY api_messages_journal.id;
+
+-- Секции для всех месяцев существующих записей, текущего и следующего месяца
+SELECT ensure_journal_partition(month)
+FROM (
+    SELECT DISTINCT date_trunc('month', COALESCE(created_at, updated_at, CURRENT_TIMESTAMP))::date as month
+    FROM api_messages_journal_old
+    UNION
+    SELECT date_trunc('month', CURRENT_DATE)::date
+    UNION
+    SELECT (date_trunc('month', CURRENT_DATE) + interval '1 month')::date
+) months;
+
+INSERT INTO api_messages_journal (id, message, created_at, updated_at, action_id)
+SELECT id, message, COALESCE(created_at, updated_at, CURRENT_TIMESTAMP), updated_at, action_id
+FROM api_messages_journal_old;
+
+DROP TABLE api_messages_journal_old;
+
+CREATE INDEX IF NOT EXISTS api_messages_journal_action_idx ON api_messages_journal (action_id);
+CREATE INDEX IF NOT EXISTS api_messages_journal_type_idx ON api_messages_journal ((message->>'type'));
+CREATE INDEX IF NOT EXISTS api_messages_journal_created_idx ON api_messages_journal (created_at);
+CREATE INDEX IF NOT EXISTS api_messages_journal_chat_idx ON api_messages_journal (chat_id);
+CREATE INDEX IF NOT EXISTS api_messages_journal_message_idx ON api_messages_journal (message_id, chat_id);
+
+GRANT ALL PRIVILEGES ON TABLE api_messages_journal TO birthdaybot;
+
+COMMIT;
+
+-- Архивы секций журнала, выгруженных в сжатые JSONL-файлы по сроку хранения
+CREATE TABLE IF NOT EXISTS journal_archives (
+    id SERIAL PRIMARY KEY,
+    partition_name VARCHAR(63) NOT NULL,
+    month DATE NOT NULL UNIQUE,
+    file_path TEXT NOT NULL,
+    row_count INTEGER NOT NULL,
+    file_size BIGINT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+GRANT ALL PRIVILEGES ON TABLE journal_archives TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE journal_archives_id_seq TO birthdaybot;
@@ -0,0 +1,58 @@
+-- История нажатий кнопок: кто, что и когда нажал и чем закончилась обработка.
+-- Заменяет поля callback_data и callback_time записи журнала, которые перезаписывались при каждом нажатии.
+-- journal_id без внешнего ключа: секции журнала архивируются и удаляются по сроку хранения
+CREATE TABLE IF NOT EXISTS callback_interactions (
+    id BIGSERIAL PRIMARY KEY,
+    journal_id INTEGER,
+    chat_id BIGINT,
+    message_id INTEGER,
+    from_chat_id BIGINT NOT NULL,
+    username VARCHAR(100),
+    data TEXT NOT NULL,
+    outcome VARCHAR(20) NOT NULL,
+    error TEXT,
+    pressed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS callback_interactions_journal_idx ON callback_interactions (journal_id);
+CREATE INDEX IF NOT EXISTS callback_interactions_message_idx ON callback_interactions (chat_id, message_id);
+CREATE INDEX IF NOT EXISTS callback_interactions_data_idx ON callback_interactions (data);
+
+-- Последние нажатия из журнала переносятся в историю с неизвестным итогом
+BEGIN;
+
+INSERT INTO callback_interactions (journal_id, chat_id, message_id, from_chat_id, data, outcome, pressed_at)
+SELECT j.id, j.chat_id, j.message_id, j.chat_id, j.message->>'callback_data', 'unknown',
+    COALESCE((j.message->>'callback_time')::timestamptz, j.updated_at, j.created_at)
+FROM api_messages_journal j
+WHERE j.message ? 'callback_data'
+AND j.chat_id IS NOT NULL;
+
+UPDATE api_messages_journal
+SET message = message - 'callback_data' - 'callback_time'
+WHERE message ? 'callback_data';
+
+COMMIT;
+
+-- История только пополняется: изменение и удаление записей запрещены
+CREATE OR REPLACE FUNCTION callback_interactions_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'callback_interactions is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS callback_interactions_no_update ON callback_interactions;
+CREATE TRIGGER callback_interactions_no_update
+    BEFORE UPDATE OR DELETE ON callback_interactions
+    FOR EACH ROW EXECUTE FUNCTION callback_interactions_append_only();
+
+DROP TRIGGER IF EXISTS callback_interactions_no_truncate ON callback_interactions;
+CREATE TRIGGER callback_interactions_no_truncate
+    BEFORE TRUNCATE ON callback_interactions
+    FOR EACH STATEMENT EXECUTE FUNCTION callback_interactions_append_only();
+
+-- Боту нужны только чтение и добавление записей
+GRANT SELECT, INSERT ON TABLE callback_interactions TO birthdaybot;
+GRANT USAGE, SELECT ON SEQUENCE callback_interactions_id_seq TO birthdaybot;
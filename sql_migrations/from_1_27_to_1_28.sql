@@ -0,0 +1,39 @@
+-- Правки отправленных сообщений при изменении данных: причина, текст до и после, итог правки.
+-- journal_id без внешнего ключа: секции журнала архивируются и удаляются по сроку хранения
+CREATE TABLE IF NOT EXISTS message_edits (
+    id BIGSERIAL PRIMARY KEY,
+    journal_id INTEGER NOT NULL,
+    chat_id BIGINT NOT NULL,
+    message_id INTEGER NOT NULL,
+    reason VARCHAR(50) NOT NULL,
+    old_text TEXT NOT NULL,
+    new_text TEXT NOT NULL,
+    closed BOOLEAN NOT NULL DEFAULT false,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    edited_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS message_edits_journal_idx ON message_edits (journal_id);
+
+-- История только пополняется: изменение и удаление записей запрещены
+CREATE OR REPLACE FUNCTION message_edits_append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'message_edits is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS message_edits_no_update ON message_edits;
+CREATE TRIGGER message_edits_no_update
+    BEFORE UPDATE OR DELETE ON message_edits
+    FOR EACH ROW EXECUTE FUNCTION message_edits_append_only();
+
+DROP TRIGGER IF EXISTS message_edits_no_truncate ON message_edits;
+CREATE TRIGGER message_edits_no_truncate
+    BEFORE TRUNCATE ON message_edits
+    FOR EACH STATEMENT EXECUTE FUNCTION message_edits_append_only();
+
+-- Боту нужны только чтение и добавление записей
+GRANT SELECT, INSERT ON TABLE message_edits TO birthdaybot;
+GRANT USAGE, SELECT ON SEQUENCE message_edits_id_seq TO birthdaybot;
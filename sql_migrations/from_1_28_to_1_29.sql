@@ -0,0 +1,340 @@
+DROP FUNCTION IF EXISTS drop_journal_partition(DATE);
+
+-- Удаляет секцию журнала за месяц после архивации. Секция удаляется, только если в ней
+-- ровно expected_rows записей, то есть все они попали в архив
+CREATE OR REPLACE FUNCTION drop_journal_partition(month DATE, expected_rows BIGINT)
+RETURNS VOID AS $$
+DECLARE
+    partition_name TEXT := 'api_messages_journal_p' || to_char(date_trunc('month', month), 'YYYY_MM');
+    actual_rows BIGINT;
+BEGIN
+    IF to_regclass(partition_name) IS NULL THEN
+        RETURN;
+    END IF;
+    EXECUTE format('SELECT count(*) FROM %I', partition_name) INTO actual_rows;
+    IF actual_rows != expected_rows THEN
+        RAISE EXCEPTION 'partition % has % rows, % archived', partition_name, actual_rows, expected_rows;
+    END IF;
+    EXECUTE format('DROP TABLE %I', partition_name);
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path = public;
+
+-- Деактивированные участники не выбираются получателями переводов и заместителями.
+-- Кандидат, которого на время сбора замещает сам именинник, пропускается
+CREATE OR REPLACE FUNCTION assign_task_collector(task_id INTEGER)
+RETURNS INTEGER AS $$
+DECLARE
+    v_collector_id INTEGER;
+    v_source VARCHAR(20);
+    v_team_id INTEGER;
+    v_birthday_member_id INTEGER;
+    v_year INTEGER;
+    v_event_date DATE;
+    v_delegate_id INTEGER;
+    v_delegated_from INTEGER;
+BEGIN
+    SELECT yt.collector_member_id, COALESCE(yt.scope_team_id, bm.team_id), bm.id, yt.year
+    INTO v_collector_id, v_team_id, v_birthday_member_id, v_year
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1
+    FOR UPDATE OF yt;
+
+    -- Получатель уже назначен: все шаги используют его
+    IF NOT FOUND OR v_collector_id IS NOT NULL THEN
+        RETURN v_collector_id;
+    END IF;
+
+    -- Кандидат, отсутствующий в период сбора, которого замещает сам именинник, пропускается
+    v_event_date := get_task_event_date($1);
+
+    -- Казначей команды, если он не является именинником
+    SELECT tr.team_member_id INTO v_collector_id
+    FROM treasurers tr
+    JOIN team_members tm ON tm.id = tr.team_member_id
+    WHERE tr.team_id = v_team_id
+    AND tr.team_member_id != v_birthday_member_id
+    AND tm.is_active
+    AND get_absence_delegate(tr.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id;
+    IF v_collector_id IS NOT NULL THEN
+        v_source := 'treasurer';
+    END IF;
+
+    -- Тимлид команды: меньше открытых сборов, затем дольше всех без назначения
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM teamleads tl
+        JOIN team_members tm ON tm.id = tl.team_member_id
+        WHERE tl.team_id = v_team_id
+        AND tl.team_member_id != v_birthday_member_id
+        AND tm.is_active
+        AND get_absence_delegate(tl.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.is_money_transfered = false
+             AND x.cancelled_at IS NULL),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'teamlead';
+        END IF;
+    END IF;
+
+    -- Резервные тимлиды команды в заданном порядке
+    IF v_collector_id IS NULL THEN
+        SELECT b.team_member_id INTO v_collector_id
+        FROM teamlead_backups b
+        JOIN team_members tm ON tm.id = b.team_member_id
+        WHERE b.team_id = v_team_id
+        AND b.team_member_id != v_birthday_member_id
+        AND tm.is_active
+        AND get_absence_delegate(b.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id
+        ORDER BY b.priority, b.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'backup';
+        END IF;
+    END IF;
+
+    -- Справедливая ротация: тимлид с наименьшим числом сборов за год
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM (
+            SELECT DISTINCT t.team_member_id
+            FROM teamleads t
+            JOIN team_members tm ON tm.id = t.team_member_id
+            WHERE t.team_member_id != v_birthday_member_id
+            AND tm.is_active
+            AND get_absence_delegate(t.team_member_id, v_event_date - 3, v_event_date) IS DISTINCT FROM v_birthday_member_id
+        ) tl
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.year = v_year),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.team_member_id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'rotation';
+        END IF;
+    END IF;
+
+    -- Замещение на время отсутствия (ограничиваем глубину цепочки заместителей)
+    IF v_collector_id IS NOT NULL THEN
+        FOR i IN 1..5 LOOP
+            v_delegate_id := get_absence_delegate(v_collector_id, v_event_date - 3, v_event_date);
+            EXIT WHEN v_delegate_id IS NULL OR v_delegate_id = v_birthday_member_id
+                OR NOT EXISTS (SELECT 1 FROM team_members WHERE id = v_delegate_id AND is_active);
+            v_delegated_from := COALESCE(v_delegated_from, v_collector_id);
+            v_collector_id := v_delegate_id;
+            v_source := 'delegate';
+        END LOOP;
+    END IF;
+
+    IF v_collector_id IS NOT NULL THEN
+        UPDATE year_tasks
+        SET collector_member_id = v_collector_id,
+            collector_assigned_at = CURRENT_TIMESTAMP,
+            collector_source = v_source,
+            collector_delegated_from = v_delegated_from
+        WHERE id = $1;
+    END IF;
+
+    RETURN v_collector_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Доставленные уведомления тимлидов по задачам.
+-- Получатель, которому уведомление уже доставлено, не получает его повторно
+CREATE TABLE IF NOT EXISTS teamlead_notification_deliveries (
+    task_id INTEGER NOT NULL REFERENCES year_tasks(id),
+    team_member_id INTEGER NOT NULL REFERENCES team_members(id),
+    sent_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (task_id, team_member_id)
+);
+
+GRANT SELECT, INSERT ON TABLE teamlead_notification_deliveries TO birthdaybot;
+
+-- Уже доставленные уведомления по задачам, ожидающим остальных получателей, берутся из журнала
+INSERT INTO teamlead_notification_deliveries (task_id, team_member_id, sent_at)
+SELECT DISTINCT ON (yt.id, tm.id) yt.id, tm.id, j.created_at
+FROM api_messages_journal j
+JOIN year_tasks yt ON yt.id = (j.message->>'task_id')::integer
+JOIN team_members tm ON tm.telegram_chat_id = j.chat_id
+WHERE j.message->>'type' IN ('teamlead_notification', 'collector_notification')
+AND COALESCE(j.message->>'status', 'sent') = 'sent'
+AND yt.is_teamlead_notified = false
+ORDER BY yt.id, tm.id, j.created_at
+ON CONFLICT DO NOTHING;
+
+-- Деактивированные тимлиды и получатели переводов не получают уведомлений тимлидов,
+-- заместители отсутствующих тимлидов получают уведомление вместо них.
+-- Получатели, которым уведомление уже доставлено, исключаются
+CREATE OR REPLACE VIEW teamlead_notifications AS
+WITH birthday_info AS (
+    SELECT
+        yt.id as task_id,
+        bm.name as birthday_person_name,
+        COALESCE(yt.scope_team_id, bm.team_id) as team_id,
+        bm.id as birthday_member_id,
+        get_task_event_date(yt.id) as event_date,
+        cm.id as collector_member_id,
+        cm.name as collector_name,
+        EXISTS (
+            SELECT 1
+            FROM teamleads tl
+            WHERE tl.team_member_id = cm.id
+        ) as is_collector_teamlead,
+        df.name as delegated_from_name,
+        yt.kind,
+        yt.title,
+        yt.amount
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    JOIN team_members cm ON yt.collector_member_id = cm.id
+    LEFT JOIN team_members df ON yt.collector_delegated_from = df.id
+    WHERE yt.is_teamlead_notified = false
+),
+team_leads AS (
+    -- Активные тимлиды команды именинника, кроме него самого, и их заместители на время сбора
+    SELECT
+        bi.task_id,
+        tl.team_member_id as lead_member_id,
+        get_absence_delegate(tl.team_member_id, bi.event_date - 3, bi.event_date) as delegate_member_id
+    FROM birthday_info bi
+    JOIN teamleads tl ON tl.team_id = bi.team_id
+    JOIN team_members tm ON tm.id = tl.team_member_id
+    WHERE tl.team_member_id != bi.birthday_member_id
+    AND tm.is_active
+),
+recipients AS (
+    -- Присутствующие тимлиды
+    SELECT task_id, lead_member_id as notified_member_id, NULL::integer as covering_for_member_id
+    FROM team_leads
+    WHERE delegate_member_id IS NULL
+    UNION
+    -- Получатель переводов (казначей, альтернативный тимлид или заместитель)
+    SELECT bi.task_id, bi.collector_member_id, NULL::integer
+    FROM birthday_info bi
+    UNION
+    -- Заместители отсутствующих тимлидов, если они не получают уведомление сами
+    SELECT tl.task_id, tl.delegate_member_id, MIN(tl.lead_member_id)
+    FROM team_leads tl
+    JOIN birthday_info bi ON bi.task_id = tl.task_id
+    WHERE tl.delegate_member_id IS NOT NULL
+    AND tl.delegate_member_id != bi.collector_member_id
+    AND tl.delegate_member_id != bi.birthday_member_id
+    AND NOT EXISTS (
+        SELECT 1 FROM team_leads o
+        WHERE o.task_id = tl.task_id
+        AND o.lead_member_id = tl.delegate_member_id
+        AND o.delegate_member_id IS NULL
+    )
+    GROUP BY tl.task_id, tl.delegate_member_id
+)
+SELECT
+    bi.task_id,
+    bi.birthday_person_name,
+    rm.telegram_chat_id,
+    rm.name as notified_teamlead_name,
+    rm.id as notified_member_id,
+    bi.collector_member_id,
+    bi.collector_name,
+    rm.id = bi.collector_member_id as is_collector,
+    bi.is_collector_teamlead,
+    bi.delegated_from_name,
+    bi.kind,
+    bi.title,
+    bi.event_date,
+    bi.amount,
+    cf.name as covering_for_name
+FROM recipients r
+JOIN birthday_info bi ON bi.task_id = r.task_id
+JOIN team_members rm ON r.notified_member_id = rm.id
+LEFT JOIN team_members cf ON r.covering_for_member_id = cf.id
+WHERE rm.telegram_chat_id IS NOT NULL
+AND rm.is_active
+AND NOT EXISTS (
+    SELECT 1 FROM teamlead_notification_deliveries d
+    WHERE d.task_id = r.task_id AND d.team_member_id = r.notified_member_id
+);
+
+-- Запрос на замену телефона отправляется администраторам один раз, после отправки заполняется notified_at
+ALTER TABLE collection_phone_overrides ADD COLUMN IF NOT EXISTS notified_at TIMESTAMP WITH TIME ZONE;
+UPDATE collection_phone_overrides SET notified_at = requested_at WHERE notified_at IS NULL;
+
+-- Телефоны тимлидов, которые отличаются от подтвержденного контакта, становятся запросами на замену.
+-- Бот отправит их администраторам на подтверждение при запуске
+INSERT INTO collection_phone_overrides (team_member_id, phone_number)
+SELECT DISTINCT ON (tl.team_member_id) tl.team_member_id, tl.phone_number
+FROM teamleads tl
+JOIN team_members tm ON tm.id = tl.team_member_id
+WHERE NULLIF(tl.phone_number, '') IS NOT NULL
+AND tl.phone_number IS DISTINCT FROM tm.phone_number
+AND tm.is_active
+AND NOT EXISTS (
+    SELECT 1 FROM collection_phone_overrides o
+    WHERE o.team_member_id = tl.team_member_id AND o.status IN ('pending', 'approved')
+)
+ORDER BY tl.team_member_id, tl.id;
+
+-- Таблицы истории переводятся на общую функцию append_only вместо отдельной функции на таблицу
+CREATE OR REPLACE FUNCTION append_only()
+RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION '% is append-only', TG_TABLE_NAME;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_no_update ON audit_log;
+CREATE TRIGGER audit_log_no_update
+    BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS audit_log_no_truncate ON audit_log;
+CREATE TRIGGER audit_log_no_truncate
+    BEFORE TRUNCATE ON audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS callback_interactions_no_update ON callback_interactions;
+CREATE TRIGGER callback_interactions_no_update
+    BEFORE UPDATE OR DELETE ON callback_interactions
+    FOR EACH ROW EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS callback_interactions_no_truncate ON callback_interactions;
+CREATE TRIGGER callback_interactions_no_truncate
+    BEFORE TRUNCATE ON callback_interactions
+    FOR EACH STATEMENT EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS message_edits_no_update ON message_edits;
+CREATE TRIGGER message_edits_no_update
+    BEFORE UPDATE OR DELETE ON message_edits
+    FOR EACH ROW EXECUTE FUNCTION append_only();
+
+DROP TRIGGER IF EXISTS message_edits_no_truncate ON message_edits;
+CREATE TRIGGER message_edits_no_truncate
+    BEFORE TRUNCATE ON message_edits
+    FOR EACH STATEMENT EXECUTE FUNCTION append_only();
+
+DROP FUNCTION IF EXISTS audit_log_append_only();
+DROP FUNCTION IF EXISTS callback_interactions_append_only();
+DROP FUNCTION IF EXISTS message_edits_append_only();
+
+-- Нажавший кнопку до версии 1.25 неизвестен: при переносе в историю вместо него был записан получатель сообщения
+ALTER TABLE callback_interactions ALTER COLUMN from_chat_id DROP NOT NULL;
+
+BEGIN;
+
+ALTER TABLE callback_interactions DISABLE TRIGGER callback_interactions_no_update;
+
+UPDATE callback_interactions
+SET from_chat_id = NULL
+WHERE outcome = 'unknown';
+
+ALTER TABLE callback_interactions ENABLE TRIGGER callback_interactions_no_update;
+
+COMMIT;
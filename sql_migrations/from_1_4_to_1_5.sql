@@ -0,0 +1,160 @@
+-- Создание таблицы казначеев команд
+-- Казначей получает переводы и действия payout вместо тимлида
+CREATE TABLE IF NOT EXISTS treasurers (
+    id SERIAL PRIMARY KEY,
+    team_id INTEGER NOT NULL UNIQUE,
+    team_member_id INTEGER NOT NULL,
+    FOREIGN KEY (team_id) REFERENCES teams(id),
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE treasurers TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE treasurers_id_seq TO birthdaybot;
+
+-- Функция для получения получателя переводов (казначея или тимлида)
+CREATE OR REPLACE FUNCTION get_team_collector(team_id INTEGER, birthday_member_id INTEGER)
+RETURNS TABLE (
+    collector_member_id INTEGER,
+    phone_number VARCHAR(50),
+    member_name VARCHAR(100),
+    telegram_chat_id BIGINT
+) AS $$
+BEGIN
+    -- Сначала казначей команды, если он назначен и не является именинником
+    RETURN QUERY
+    SELECT
+        tm.id,
+        tm.phone_number,
+        tm.name,
+        tm.telegram_chat_id
+    FROM treasurers tr
+    JOIN team_members tm ON tr.team_member_id = tm.id
+    WHERE tr.team_id = $1
+    AND tr.team_member_id != $2;
+
+    IF FOUND THEN
+        RETURN;
+    END IF;
+
+    -- Затем тимлид команды, если он не является именинником
+    RETURN QUERY
+    SELECT
+        tm.id,
+        tl.phone_number,
+        tm.name,
+        tm.telegram_chat_id
+    FROM teamleads tl
+    JOIN team_members tm ON tl.team_member_id = tm.id
+    WHERE tl.team_id = $1
+    AND tl.team_member_id != $2
+    LIMIT 1;
+
+    IF FOUND THEN
+        RETURN;
+    END IF;
+
+    -- Иначе альтернативный тимлид
+    RETURN QUERY
+    SELECT
+        tm.id,
+        alt.phone_number,
+        alt.member_name,
+        tm.telegram_chat_id
+    FROM get_alternative_teamlead($1, $2) alt
+    JOIN teamleads tl ON alt.teamlead_id = tl.id
+    JOIN team_members tm ON tl.team_member_id = tm.id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Уведомления тимлида теперь содержат получателя переводов
+DROP VIEW IF EXISTS teamlead_notifications;
+CREATE VIEW teamlead_notifications AS
+WITH birthday_info AS (
+    SELECT
+        yt.id as task_id,
+        bm.name as birthday_person_name,
+        t.id as team_id,
+        bm.id as birthday_member_id,
+        -- Проверяем, является ли именинник тимлидом
+        EXISTS (
+            SELECT 1
+            FROM teamleads tl
+            WHERE tl.team_member_id = bm.id
+        ) as is_birthday_person_teamlead
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    JOIN teams t ON bm.team_id = t.id
+    WHERE yt.is_teamlead_notified = false
+),
+teamlead_info AS (
+    SELECT
+        bi.*,
+        CASE
+            WHEN bi.is_birthday_person_teamlead THEN
+                (SELECT tl.team_member_id
+                 FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id) alt
+                 JOIN teamleads tl ON alt.teamlead_id = tl.id)
+            ELSE
+                tlm.id
+        END as notified_member_id,
+        CASE
+            WHEN bi.is_birthday_person_teamlead THEN
+                (SELECT member_name FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
+            ELSE
+                tlm.name
+        END as notified_teamlead_name,
+        CASE
+            WHEN bi.is_birthday_person_teamlead THEN
+                (SELECT tm.telegram_chat_id
+                 FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id) alt
+                 JOIN teamleads tl ON alt.teamlead_id = tl.id
+                 JOIN team_members tm ON tl.team_member_id = tm.id)
+            ELSE
+                tlm.telegram_chat_id
+        END as telegram_chat_id
+    FROM birthday_info bi
+    LEFT JOIN teamleads tl ON bi.team_id = tl.team_id
+    LEFT JOIN team_members tlm ON tl.team_member_id = tlm.id
+    WHERE NOT bi.is_birthday_person_teamlead
+    OR EXISTS (SELECT 1 FROM get_alternative_teamlead(bi.team_id, bi.birthday_member_id))
+)
+SELECT
+    ti.task_id,
+    ti.birthday_person_name,
+    ti.telegram_chat_id,
+    ti.notified_teamlead_name,
+    ti.notified_member_id,
+    c.collector_member_id,
+    c.member_name as collector_name,
+    c.telegram_chat_id as collector_chat_id
+FROM teamlead_info ti
+LEFT JOIN LATERAL get_team_collector(ti.team_id, ti.birthday_member_id) c ON true;
+
+-- Уведомления участников содержат реквизиты казначея (или тимлида)
+DROP VIEW IF EXISTS member_notifications;
+CREATE VIEW member_notifications AS
+WITH birthday_info AS (
+    SELECT
+        yt.id as task_id,
+        bm.name as birthday_person_name,
+        t.id as team_id,
+        t.name as team_name,
+        bm.id as birthday_member_id
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    JOIN teams t ON bm.team_id = t.id
+    WHERE yt.is_members_notified = false
+)
+SELECT
+    a.id as action_id,
+    bi.*,
+    c.collector_member_id,
+    c.phone_number as collector_phone,
+    c.member_name as collector_name,
+    m.telegram_chat_id
+FROM birthday_info bi
+JOIN LATERAL get_team_collector(bi.team_id, bi.birthday_member_id) c ON true
+JOIN actions a ON a.task_id = bi.task_id
+JOIN team_members m ON a.team_member_id = m.id
+WHERE a.type = 'request' AND a.is_done = false;
@@ -0,0 +1,160 @@
+-- Удаляем дубли тимлидов (один участник — одна запись на команду)
+DELETE FROM teamleads a
+USING teamleads b
+WHERE a.team_id = b.team_id
+AND a.team_member_id = b.team_member_id
+AND a.id > b.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS teamleads_team_member_idx ON teamleads (team_id, team_member_id);
+
+-- Получатель переводов закрепляется за задачей
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_member_id INTEGER REFERENCES team_members(id);
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_assigned_at TIMESTAMP WITH TIME ZONE;
+
+-- Функция для получения телефона получателя переводов
+CREATE OR REPLACE FUNCTION get_collector_phone(member_id INTEGER)
+RETURNS VARCHAR(50) AS $$
+    SELECT COALESCE(
+        (SELECT tl.phone_number FROM teamleads tl WHERE tl.team_member_id = $1 ORDER BY tl.id LIMIT 1),
+        (SELECT tm.phone_number FROM team_members tm WHERE tm.id = $1)
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Функция для назначения получателя переводов по задаче
+-- Порядок: казначей команды, тимлид команды с наименьшей нагрузкой, альтернативный тимлид
+CREATE OR REPLACE FUNCTION assign_task_collector(task_id INTEGER)
+RETURNS INTEGER AS $$
+DECLARE
+    v_collector_id INTEGER;
+    v_team_id INTEGER;
+    v_birthday_member_id INTEGER;
+BEGIN
+    SELECT yt.collector_member_id, bm.team_id, bm.id
+    INTO v_collector_id, v_team_id, v_birthday_member_id
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1
+    FOR UPDATE OF yt;
+
+    -- Получатель уже назначен: все шаги используют его
+    IF NOT FOUND OR v_collector_id IS NOT NULL THEN
+        RETURN v_collector_id;
+    END IF;
+
+    -- Казначей команды, если он не является именинником
+    SELECT tr.team_member_id INTO v_collector_id
+    FROM treasurers tr
+    WHERE tr.team_id = v_team_id
+    AND tr.team_member_id != v_birthday_member_id;
+
+    -- Тимлид команды: меньше открытых сборов, затем дольше всех без назначения
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM teamleads tl
+        WHERE tl.team_id = v_team_id
+        AND tl.team_member_id != v_birthday_member_id
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.is_money_transfered = false),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.id
+        LIMIT 1;
+    END IF;
+
+    -- Альтернативный тимлид
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM get_alternative_teamlead(v_team_id, v_birthday_member_id) alt
+        JOIN teamleads tl ON alt.teamlead_id = tl.id;
+    END IF;
+
+    IF v_collector_id IS NOT NULL THEN
+        UPDATE year_tasks
+        SET collector_member_id = v_collector_id,
+            collector_assigned_at = CURRENT_TIMESTAMP
+        WHERE id = $1;
+    END IF;
+
+    RETURN v_collector_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Уведомления тимлидов: каждый тимлид команды получает ровно одно сообщение
+DROP VIEW IF EXISTS teamlead_notifications;
+CREATE VIEW teamlead_notifications AS
+WITH birthday_info AS (
+    SELECT
+        yt.id as task_id,
+        bm.name as birthday_person_name,
+        bm.team_id,
+        bm.id as birthday_member_id,
+        cm.id as collector_member_id,
+        cm.name as collector_name,
+        EXISTS (
+            SELECT 1
+            FROM teamleads tl
+            WHERE tl.team_member_id = cm.id
+        ) as is_collector_teamlead
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    JOIN team_members cm ON yt.collector_member_id = cm.id
+    WHERE yt.is_teamlead_notified = false
+),
+recipients AS (
+    -- Тимлиды команды именинника, кроме него самого
+    SELECT bi.task_id, tl.team_member_id as notified_member_id
+    FROM birthday_info bi
+    JOIN teamleads tl ON tl.team_id = bi.team_id
+    WHERE tl.team_member_id != bi.birthday_member_id
+    UNION
+    -- Получатель переводов (казначей или альтернативный тимлид)
+    SELECT bi.task_id, bi.collector_member_id
+    FROM birthday_info bi
+)
+SELECT
+    bi.task_id,
+    bi.birthday_person_name,
+    rm.telegram_chat_id,
+    rm.name as notified_teamlead_name,
+    rm.id as notified_member_id,
+    bi.collector_member_id,
+    bi.collector_name,
+    rm.id = bi.collector_member_id as is_collector,
+    bi.is_collector_teamlead
+FROM recipients r
+JOIN birthday_info bi ON bi.task_id = r.task_id
+JOIN team_members rm ON r.notified_member_id = rm.id
+WHERE rm.telegram_chat_id IS NOT NULL;
+
+-- Уведомления участников: реквизиты закрепленного за задачей получателя
+DROP VIEW IF EXISTS member_notifications;
+CREATE VIEW member_notifications AS
+WITH birthday_info AS (
+    SELECT
+        yt.id as task_id,
+        bm.name as birthday_person_name,
+        t.id as team_id,
+        t.name as team_name,
+        bm.id as birthday_member_id,
+        cm.id as collector_member_id,
+        get_collector_phone(cm.id) as collector_phone,
+        cm.name as collector_name
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    JOIN teams t ON bm.team_id = t.id
+    JOIN team_members cm ON yt.collector_member_id = cm.id
+    WHERE yt.is_members_notified = false
+)
+SELECT
+    a.id as action_id,
+    bi.*,
+    m.telegram_chat_id
+FROM birthday_info bi
+JOIN actions a ON a.task_id = bi.task_id
+JOIN team_members m ON a.team_member_id = m.id
+WHERE a.type = 'request' AND a.is_done = false;
+
+-- Выбор получателя перенесен в assign_task_collector
+DROP FUNCTION IF EXISTS get_team_collector(INTEGER, INTEGER);
@@ -0,0 +1,153 @@
+-- Создание таблицы резервных тимлидов команды
+-- Резервные тимлиды используются по порядку priority, если в команде нет другого тимлида
+CREATE TABLE IF NOT EXISTS teamlead_backups (
+    id SERIAL PRIMARY KEY,
+    team_id INTEGER NOT NULL,
+    team_member_id INTEGER NOT NULL,
+    priority INTEGER NOT NULL,
+    FOREIGN KEY (team_id) REFERENCES teams(id),
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id),
+    UNIQUE (team_id, team_member_id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE teamlead_backups TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE teamlead_backups_id_seq TO birthdaybot;
+
+-- Источник выбора получателя переводов: treasurer, teamlead, backup, rotation
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_source VARCHAR(20);
+
+-- Функция для получения альтернативного тимлида (детерминированный порядок)
+CREATE OR REPLACE FUNCTION get_alternative_teamlead(team_id INTEGER, birthday_member_id INTEGER)
+RETURNS TABLE (
+    teamlead_id INTEGER,
+    phone_number VARCHAR(50),
+    member_name VARCHAR(100)
+) AS $$
+BEGIN
+    -- Сначала пытаемся найти другого тимлида из той же команды
+    RETURN QUERY
+    SELECT
+        tl.id,
+        tl.phone_number,
+        tm.name
+    FROM teamleads tl
+    JOIN team_members tm ON tl.team_member_id = tm.id
+    WHERE tl.team_id = $1
+    AND tl.team_member_id != $2
+    ORDER BY tl.id
+    LIMIT 1;
+
+    -- Если не нашли, возвращаем любого другого тимлида
+    IF NOT FOUND THEN
+        RETURN QUERY
+        SELECT
+            tl.id,
+            tl.phone_number,
+            tm.name
+        FROM teamleads tl
+        JOIN team_members tm ON tl.team_member_id = tm.id
+        WHERE tl.team_member_id != $2
+        ORDER BY tl.id
+        LIMIT 1;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Функция для назначения получателя переводов по задаче
+-- Порядок: казначей команды, тимлид команды с наименьшей нагрузкой,
+-- резервные тимлиды команды по порядку, справедливая ротация тимлидов по компании
+CREATE OR REPLACE FUNCTION assign_task_collector(task_id INTEGER)
+RETURNS INTEGER AS $$
+DECLARE
+    v_collector_id INTEGER;
+    v_source VARCHAR(20);
+    v_team_id INTEGER;
+    v_birthday_member_id INTEGER;
+    v_year INTEGER;
+BEGIN
+    SELECT yt.collector_member_id, bm.team_id, bm.id, yt.year
+    INTO v_collector_id, v_team_id, v_birthday_member_id, v_year
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1
+    FOR UPDATE OF yt;
+
+    -- Получатель уже назначен: все шаги используют его
+    IF NOT FOUND OR v_collector_id IS NOT NULL THEN
+        RETURN v_collector_id;
+    END IF;
+
+    -- Казначей команды, если он не является именинником
+    SELECT tr.team_member_id INTO v_collector_id
+    FROM treasurers tr
+    WHERE tr.team_id = v_team_id
+    AND tr.team_member_id != v_birthday_member_id;
+    IF v_collector_id IS NOT NULL THEN
+        v_source := 'treasurer';
+    END IF;
+
+    -- Тимлид команды: меньше открытых сборов, затем дольше всех без назначения
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM teamleads tl
+        WHERE tl.team_id = v_team_id
+        AND tl.team_member_id != v_birthday_member_id
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.is_money_transfered = false),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'teamlead';
+        END IF;
+    END IF;
+
+    -- Резервные тимлиды команды в заданном порядке
+    IF v_collector_id IS NULL THEN
+        SELECT b.team_member_id INTO v_collector_id
+        FROM teamlead_backups b
+        WHERE b.team_id = v_team_id
+        AND b.team_member_id != v_birthday_member_id
+        ORDER BY b.priority, b.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'backup';
+        END IF;
+    END IF;
+
+    -- Справедливая ротация: тимлид с наименьшим числом сборов за год
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM (
+            SELECT DISTINCT team_member_id
+            FROM teamleads
+            WHERE team_member_id != v_birthday_member_id
+        ) tl
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.year = v_year),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.team_member_id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'rotation';
+        END IF;
+    END IF;
+
+    IF v_collector_id IS NOT NULL THEN
+        UPDATE year_tasks
+        SET collector_member_id = v_collector_id,
+            collector_assigned_at = CURRENT_TIMESTAMP,
+            collector_source = v_source
+        WHERE id = $1;
+    END IF;
+
+    RETURN v_collector_id;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,209 @@
+-- Создание таблицы периодов отсутствия тимлидов
+-- На период отсутствия сборы передаются заместителю (delegate_member_id)
+CREATE TABLE IF NOT EXISTS teamlead_absences (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL,
+    date_from DATE NOT NULL,
+    date_to DATE NOT NULL,
+    delegate_member_id INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id),
+    FOREIGN KEY (delegate_member_id) REFERENCES team_members(id),
+    CHECK (date_from <= date_to),
+    CHECK (team_member_id != delegate_member_id)
+);
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE teamlead_absences TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE teamlead_absences_id_seq TO birthdaybot;
+
+-- Кого замещает получатель переводов (NULL, если замещения нет)
+ALTER TABLE year_tasks ADD COLUMN IF NOT EXISTS collector_delegated_from INTEGER REFERENCES team_members(id);
+
+-- Функция для получения даты события задачи (день рождения в году задачи)
+CREATE OR REPLACE FUNCTION get_task_event_date(task_id INTEGER)
+RETURNS DATE AS $$
+    SELECT (bm.birthday + make_interval(years => yt.year - EXTRACT(YEAR FROM bm.birthday)::integer))::date
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1;
+$$ LANGUAGE sql STABLE;
+
+-- Функция для получения заместителя, если период отсутствия пересекается с периодом сбора
+CREATE OR REPLACE FUNCTION get_absence_delegate(member_id INTEGER, window_from DATE, window_to DATE)
+RETURNS INTEGER AS $$
+    SELECT ab.delegate_member_id
+    FROM teamlead_absences ab
+    WHERE ab.team_member_id = $1
+    AND ab.date_from <= $3
+    AND ab.date_to >= $2
+    ORDER BY ab.created_at DESC, ab.id DESC
+    LIMIT 1;
+$$ LANGUAGE sql STABLE;
+
+-- Функция для назначения получателя переводов по задаче
+-- Порядок: казначей команды, тимлид команды с наименьшей нагрузкой,
+-- резервные тимлиды команды по порядку, справедливая ротация тимлидов по компании.
+-- Если выбранный получатель отсутствует в период сбора, назначается его заместитель
+CREATE OR REPLACE FUNCTION assign_task_collector(task_id INTEGER)
+RETURNS INTEGER AS $$
+DECLARE
+    v_collector_id INTEGER;
+    v_source VARCHAR(20);
+    v_team_id INTEGER;
+    v_birthday_member_id INTEGER;
+    v_year INTEGER;
+    v_event_date DATE;
+    v_delegate_id INTEGER;
+    v_delegated_from INTEGER;
+BEGIN
+    SELECT yt.collector_member_id, bm.team_id, bm.id, yt.year
+    INTO v_collector_id, v_team_id, v_birthday_member_id, v_year
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    WHERE yt.id = $1
+    FOR UPDATE OF yt;
+
+    -- Получатель уже назначен: все шаги используют его
+    IF NOT FOUND OR v_collector_id IS NOT NULL THEN
+        RETURN v_collector_id;
+    END IF;
+
+    -- Казначей команды, если он не является именинником
+    SELECT tr.team_member_id INTO v_collector_id
+    FROM treasurers tr
+    WHERE tr.team_id = v_team_id
+    AND tr.team_member_id != v_birthday_member_id;
+    IF v_collector_id IS NOT NULL THEN
+        v_source := 'treasurer';
+    END IF;
+
+    -- Тимлид команды: меньше открытых сборов, затем дольше всех без назначения
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM teamleads tl
+        WHERE tl.team_id = v_team_id
+        AND tl.team_member_id != v_birthday_member_id
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.is_money_transfered = false),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'teamlead';
+        END IF;
+    END IF;
+
+    -- Резервные тимлиды команды в заданном порядке
+    IF v_collector_id IS NULL THEN
+        SELECT b.team_member_id INTO v_collector_id
+        FROM teamlead_backups b
+        WHERE b.team_id = v_team_id
+        AND b.team_member_id != v_birthday_member_id
+        ORDER BY b.priority, b.id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'backup';
+        END IF;
+    END IF;
+
+    -- Справедливая ротация: тимлид с наименьшим числом сборов за год
+    IF v_collector_id IS NULL THEN
+        SELECT tl.team_member_id INTO v_collector_id
+        FROM (
+            SELECT DISTINCT team_member_id
+            FROM teamleads
+            WHERE team_member_id != v_birthday_member_id
+        ) tl
+        ORDER BY
+            (SELECT COUNT(*) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id
+             AND x.year = v_year),
+            (SELECT MAX(x.collector_assigned_at) FROM year_tasks x
+             WHERE x.collector_member_id = tl.team_member_id) NULLS FIRST,
+            tl.team_member_id
+        LIMIT 1;
+        IF v_collector_id IS NOT NULL THEN
+            v_source := 'rotation';
+        END IF;
+    END IF;
+
+    -- Замещение на время отсутствия (ограничиваем глубину цепочки заместителей)
+    IF v_collector_id IS NOT NULL THEN
+        v_event_date := get_task_event_date($1);
+        FOR i IN 1..5 LOOP
+            v_delegate_id := get_absence_delegate(v_collector_id, v_event_date - 3, v_event_date);
+            EXIT WHEN v_delegate_id IS NULL OR v_delegate_id = v_birthday_member_id;
+            v_delegated_from := COALESCE(v_delegated_from, v_collector_id);
+            v_collector_id := v_delegate_id;
+            v_source := 'delegate';
+        END LOOP;
+    END IF;
+
+    IF v_collector_id IS NOT NULL THEN
+        UPDATE year_tasks
+        SET collector_member_id = v_collector_id,
+            collector_assigned_at = CURRENT_TIMESTAMP,
+            collector_source = v_source,
+            collector_delegated_from = v_delegated_from
+        WHERE id = $1;
+    END IF;
+
+    RETURN v_collector_id;
+END;
+$$ LANGUAGE plpgsql;
+
+-- Уведомления тимлидов: отсутствующие тимлиды не уведомляются, заместитель получает уведомление получателя
+DROP VIEW IF EXISTS teamlead_notifications;
+CREATE VIEW teamlead_notifications AS
+WITH birthday_info AS (
+    SELECT
+        yt.id as task_id,
+        bm.name as birthday_person_name,
+        bm.team_id,
+        bm.id as birthday_member_id,
+        get_task_event_date(yt.id) as event_date,
+        cm.id as collector_member_id,
+        cm.name as collector_name,
+        EXISTS (
+            SELECT 1
+            FROM teamleads tl
+            WHERE tl.team_member_id = cm.id
+        ) as is_collector_teamlead,
+        df.name as delegated_from_name
+    FROM year_tasks yt
+    JOIN team_members bm ON yt.team_member_id = bm.id
+    JOIN team_members cm ON yt.collector_member_id = cm.id
+    LEFT JOIN team_members df ON yt.collector_delegated_from = df.id
+    WHERE yt.is_teamlead_notified = false
+),
+recipients AS (
+    -- Тимлиды команды именинника, кроме него самого и отсутствующих
+    SELECT bi.task_id, tl.team_member_id as notified_member_id
+    FROM birthday_info bi
+    JOIN teamleads tl ON tl.team_id = bi.team_id
+    WHERE tl.team_member_id != bi.birthday_member_id
+    AND get_absence_delegate(tl.team_member_id, bi.event_date - 3, bi.event_date) IS NULL
+    UNION
+    -- Получатель переводов (казначей, альтернативный тимлид или заместитель)
+    SELECT bi.task_id, bi.collector_member_id
+    FROM birthday_info bi
+)
+SELECT
+    bi.task_id,
+    bi.birthday_person_name,
+    rm.telegram_chat_id,
+    rm.name as notified_teamlead_name,
+    rm.id as notified_member_id,
+    bi.collector_member_id,
+    bi.collector_name,
+    rm.id = bi.collector_member_id as is_collector,
+    bi.is_collector_teamlead,
+    bi.delegated_from_name
+FROM recipients r
+JOIN birthday_info bi ON bi.task_id = r.task_id
+JOIN team_members rm ON r.notified_member_id = rm.id
+WHERE rm.telegram_chat_id IS NOT NULL;
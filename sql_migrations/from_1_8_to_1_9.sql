@@ -0,0 +1,28 @@
+-- Удаляем дубли действий payout: остается одно действие на задачу
+-- (выполненное, если такое есть, иначе самое раннее)
+WITH ranked AS (
+    SELECT
+        id,
+        task_id,
+        FIRST_VALUE(id) OVER (
+            PARTITION BY task_id
+            ORDER BY is_done DESC, id
+        ) as keep_id
+    FROM actions
+    WHERE type = 'payout'
+)
+UPDATE api_messages_journal j
+SET action_id = r.keep_id
+FROM ranked r
+WHERE j.action_id = r.id
+AND r.id != r.keep_id;
+
+DELETE FROM actions a
+USING actions b
+WHERE a.type = 'payout'
+AND b.type = 'payout'
+AND a.task_id = b.task_id
+AND (b.is_done, -b.id) > (a.is_done, -a.id);
+
+-- Не более одного действия payout на задачу
+CREATE UNIQUE INDEX IF NOT EXISTS actions_task_payout_idx ON actions (task_id) WHERE type = 'payout';
@@ -0,0 +1,78 @@
+-- Телефон тимлида берется из подтвержденного контакта (team_members.phone_number).
+-- Колонка teamleads.phone_number больше не используется
+ALTER TABLE teamleads ALTER COLUMN phone_number DROP NOT NULL;
+
+-- Создание таблицы замен телефона для получения переводов
+-- Замена действует только после подтверждения администратором (status = 'approved')
+CREATE TABLE IF NOT EXISTS collection_phone_overrides (
+    id SERIAL PRIMARY KEY,
+    team_member_id INTEGER NOT NULL,
+    phone_number VARCHAR(50) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    requested_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    decided_at TIMESTAMP WITH TIME ZONE,
+    decided_by_chat_id BIGINT,
+    FOREIGN KEY (team_member_id) REFERENCES team_members(id),
+    CHECK (status IN ('pending', 'approved', 'rejected', 'revoked'))
+);
+
+-- Не более одной действующей и одной ожидающей замены на участника
+CREATE UNIQUE INDEX IF NOT EXISTS collection_phone_overrides_approved_idx
+    ON collection_phone_overrides (team_member_id)
+    WHERE status = 'approved';
+CREATE UNIQUE INDEX IF NOT EXISTS collection_phone_overrides_pending_idx
+    ON collection_phone_overrides (team_member_id)
+    WHERE status = 'pending';
+
+-- Предоставление прав на новую таблицу
+GRANT ALL PRIVILEGES ON TABLE collection_phone_overrides TO birthdaybot;
+GRANT ALL PRIVILEGES ON SEQUENCE collection_phone_overrides_id_seq TO birthdaybot;
+
+-- Функция для получения телефона получателя переводов:
+-- подтвержденная замена, иначе подтвержденный контакт участника
+CREATE OR REPLACE FUNCTION get_collector_phone(member_id INTEGER)
+RETURNS VARCHAR(50) AS $$
+    SELECT COALESCE(
+        (SELECT o.phone_number FROM collection_phone_overrides o
+         WHERE o.team_member_id = $1 AND o.status = 'approved'
+         ORDER BY o.decided_at DESC LIMIT 1),
+        (SELECT tm.phone_number FROM team_members tm WHERE tm.id = $1)
+    );
+$$ LANGUAGE sql STABLE;
+
+-- Функция для получения альтернативного тимлида (телефон из подтвержденного источника)
+CREATE OR REPLACE FUNCTION get_alternative_teamlead(team_id INTEGER, birthday_member_id INTEGER)
+RETURNS TABLE (
+    teamlead_id INTEGER,
+    phone_number VARCHAR(50),
+    member_name VARCHAR(100)
+) AS $$
+BEGIN
+    -- Сначала пытаемся найти другого тимлида из той же команды
+    RETURN QUERY
+    SELECT
+        tl.id,
+        get_collector_phone(tm.id),
+        tm.name
+    FROM teamleads tl
+    JOIN team_members tm ON tl.team_member_id = tm.id
+    WHERE tl.team_id = $1
+    AND tl.team_member_id != $2
+    ORDER BY tl.id
+    LIMIT 1;
+
+    -- Если не нашли, возвращаем любого другого тимлида
+    IF NOT FOUND THEN
+        RETURN QUERY
+        SELECT
+            tl.id,
+            get_collector_phone(tm.id),
+            tm.name
+        FROM teamleads tl
+        JOIN team_members tm ON tl.team_member_id = tm.id
+        WHERE tl.team_member_id != $2
+        ORDER BY tl.id
+        LIMIT 1;
+    END IF;
+END;
+$$ LANGUAGE plpgsql;